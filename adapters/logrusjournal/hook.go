@@ -0,0 +1,70 @@
+// Package logrusjournal provides a logrus.Hook that writes logrus' entries to
+// a journal.Logger, so that logrus can be used on top of journald's transport
+// and logfile rotation.
+package logrusjournal
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/vaitekunas/journal"
+)
+
+// Hook implements the logrus.Hook interface
+type Hook struct {
+	logger journal.Logger
+	caller string
+	levels []logrus.Level
+}
+
+// NewHook creates a logrus.Hook that logs entries of the given levels (all
+// levels if none are given) via journal.Logger.LogAt
+func NewHook(logger journal.Logger, caller string, levels ...logrus.Level) *Hook {
+	if len(levels) == 0 {
+		levels = logrus.AllLevels
+	}
+
+	return &Hook{
+		logger: logger,
+		caller: caller,
+		levels: levels,
+	}
+}
+
+// Code returns the journal message code of a logrus level
+func Code(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 10
+	case logrus.ErrorLevel:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Levels returns the levels the hook fires for
+func (h *Hook) Levels() []logrus.Level {
+	return h.levels
+}
+
+// Fire logs the entry together with its fields and the logrus level (field "level")
+func (h *Hook) Fire(entry *logrus.Entry) error {
+
+	fields := make(map[string]interface{}, len(entry.Data)+1)
+	for key, value := range entry.Data {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fields[key] = value
+	}
+	fields["level"] = entry.Level.String()
+
+	file, line := "N/A", 0
+	if entry.Caller != nil {
+		file, line = entry.Caller.File, entry.Caller.Line
+	}
+
+	// The returned error only reflects the message code
+	h.logger.LogAt(h.caller, Code(entry.Level), file, line, entry.Message, fields)
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package logrusjournal
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vaitekunas/journal"
+)
+
+func TestHook(t *testing.T) {
+
+	stdout := &bytes.Buffer{}
+	logger, err := journal.New(&journal.Config{
+		Out:          journal.OUT_STDOUT,
+		StdoutWriter: stdout,
+		Columns:      []int64{journal.COL_CALLER, journal.COL_FILE, journal.COL_LINE, journal.COL_MSG_TYPE_INT, journal.COL_MSG, journal.COL_FIELDS},
+	})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	hook := NewHook(logger, "logrus")
+	if len(hook.Levels()) != len(logrus.AllLevels) {
+		t.Errorf("Hook does not fire for all levels by default")
+	}
+
+	hook.Fire(&logrus.Entry{Level: logrus.WarnLevel, Message: "slow {user}", Data: logrus.Fields{"user": "alice"}, Caller: &runtime.Frame{File: "app/main.go", Line: 42}})
+	hook.Fire(&logrus.Entry{Level: logrus.FatalLevel, Message: "down", Data: logrus.Fields{"error": fmt.Errorf("boom")}})
+	hook.Fire(&logrus.Entry{Level: logrus.InfoLevel, Message: "odd", Data: logrus.Fields{"done": make(chan bool)}})
+	logger.Quit()
+
+	expected := []string{
+		`logrus	app/main.go	42	0	slow {user}	{"level":"warning","user":"alice"}	`,
+		`logrus	N/A	0	10	down	{"error":"boom","level":"fatal"}	`,
+		`logrus	N/A	0	0	odd	{"done":"0x`,
+	}
+	if !strings.HasPrefix(stdout.String(), strings.Join(expected, "\n")) {
+		t.Errorf("Unexpected entries:\n%s", stdout.String())
+	}
+}
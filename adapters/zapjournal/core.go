@@ -0,0 +1,89 @@
+// Package zapjournal provides a zapcore.Core that writes zap's entries to a
+// journal.Logger, so that zap can be used on top of journald's transport and
+// logfile rotation.
+package zapjournal
+
+import (
+	"github.com/vaitekunas/journal"
+	"go.uber.org/zap/zapcore"
+)
+
+// core implements the zapcore.Core interface
+type core struct {
+	zapcore.LevelEnabler
+	logger journal.Logger
+	caller string
+	fields []zapcore.Field
+}
+
+// NewCore creates a zapcore.Core that logs entries of enabled levels via
+// journal.Logger.LogAt. The caller is used for entries of unnamed zap loggers.
+func NewCore(logger journal.Logger, caller string, enabler zapcore.LevelEnabler) zapcore.Core {
+	return &core{
+		LevelEnabler: enabler,
+		logger:       logger,
+		caller:       caller,
+	}
+}
+
+// Code returns the journal message code of a zap level
+func Code(level zapcore.Level) int {
+	switch {
+	case level >= zapcore.DPanicLevel:
+		return 10
+	case level == zapcore.ErrorLevel:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// With adds structured context to the core
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.fields = make([]zapcore.Field, 0, len(c.fields)+len(fields))
+	clone.fields = append(clone.fields, c.fields...)
+	clone.fields = append(clone.fields, fields...)
+	return &clone
+}
+
+// Check adds the core to the checked entry if the entry's level is enabled
+func (c *core) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+// Write logs the entry together with its fields and the zap level (field "level")
+func (c *core) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+
+	enc := zapcore.NewMapObjectEncoder()
+	for _, field := range c.fields {
+		field.AddTo(enc)
+	}
+	for _, field := range fields {
+		field.AddTo(enc)
+	}
+	enc.Fields["level"] = entry.Level.String()
+
+	caller := c.caller
+	if entry.LoggerName != "" {
+		caller = entry.LoggerName
+	}
+
+	file, line := "N/A", 0
+	if entry.Caller.Defined {
+		file, line = entry.Caller.File, entry.Caller.Line
+	}
+
+	// The returned error only reflects the message code
+	c.logger.LogAt(caller, Code(entry.Level), file, line, entry.Message, enc.Fields)
+
+	return nil
+}
+
+// Sync is a no-op: entries are flushed by journal.Logger.Quit
+func (c *core) Sync() error {
+	return nil
+}
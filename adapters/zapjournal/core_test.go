@@ -0,0 +1,48 @@
+package zapjournal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vaitekunas/journal"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestCore(t *testing.T) {
+
+	stdout := &bytes.Buffer{}
+	logger, err := journal.New(&journal.Config{
+		Out:          journal.OUT_STDOUT,
+		StdoutWriter: stdout,
+		Columns:      []int64{journal.COL_CALLER, journal.COL_FILE, journal.COL_LINE, journal.COL_MSG_TYPE_INT, journal.COL_MSG, journal.COL_FIELDS},
+	})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	core := NewCore(logger, "zap", zapcore.InfoLevel).With([]zapcore.Field{
+		{Key: "user", Type: zapcore.StringType, String: "alice"},
+	})
+
+	entries := []zapcore.Entry{
+		{Level: zapcore.DebugLevel, Message: "disabled"},
+		{Level: zapcore.InfoLevel, Message: "hello {user}", Caller: zapcore.EntryCaller{Defined: true, File: "app/main.go", Line: 42}},
+		{Level: zapcore.ErrorLevel, Message: "failed", LoggerName: "db"},
+	}
+	for _, entry := range entries {
+		if checked := core.Check(entry, nil); checked != nil {
+			checked.Write(zapcore.Field{Key: "err", Type: zapcore.ErrorType, Interface: fmt.Errorf("boom")})
+		}
+	}
+	logger.Quit()
+
+	expected := []string{
+		`zap	app/main.go	42	0	hello {user}	{"err":"boom","level":"info","user":"alice"}	`,
+		`db	N/A	0	1	failed	{"err":"boom","level":"error","user":"alice"}	`,
+	}
+	if stdout.String() != strings.Join(expected, "\n")+"\n" {
+		t.Errorf("Unexpected entries:\n%s", stdout.String())
+	}
+}
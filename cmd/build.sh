@@ -11,11 +11,13 @@ if [ $? -ne 0 ]; then
 	exit 1;
 fi
 
-go install github.com/vaitekunas/log/cmd/log
+VERSION=`git describe --tags --always 2>/dev/null || echo dev`
+COMMIT=`git rev-parse --short HEAD 2>/dev/null`
+go install -ldflags "-X main.VERSION=$VERSION -X main.COMMIT=$COMMIT" github.com/vaitekunas/journal/cmd/journald
 
 if [ $? -ne 0 ]; then
 	echo "Installation failed. Aborting"
 	exit 1;
 fi
 
-echo "Log binary installed"
+echo "journald $VERSION installed"
@@ -1,13 +1,15 @@
 #!/bin/sh
 
-git describe  | awk '{print "package main\nconst VERSION = \"" $1 "\""}' > version.go
+VERSION=`git describe --tags --always 2>/dev/null || echo dev`
+COMMIT=`git rev-parse --short HEAD 2>/dev/null`
+LDFLAGS="-X main.VERSION=$VERSION -X main.COMMIT=$COMMIT"
 
-if [ "$#" -eq 0 ] || [ "$1" -eq "build" ]; then
-  go build github.com/vaitekunas/journal/cmd/journald
+if [ "$#" -eq 0 ] || [ "$1" = "build" ]; then
+  go build -ldflags "$LDFLAGS" github.com/vaitekunas/journal/cmd/journald
   exit 0
 fi
 
-if [ "$1" -eq "install" ]; then
-  go install github.com/vaitekunas/journal/cmd/journald
+if [ "$1" = "install" ]; then
+  go install -ldflags "$LDFLAGS" github.com/vaitekunas/journal/cmd/journald
   exit 0
 fi
@@ -7,15 +7,23 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	uclient "github.com/vaitekunas/unixsock/client"
 )
 
+// clientFlags defines the flags of the connect subcommand
+func clientFlags(clt *flag.FlagSet) (sockfile, secret *string) {
+	sockfile = clt.String("sockfile", "/opt/journald/journald.sock", "path to the journald's unix domain socket file")
+	secret = clt.String("secret", "", "management console secret (admin or viewer)")
+	return sockfile, secret
+}
+
 // StartClient starts the journald unix domain socket client
 func StartClient(clt *flag.FlagSet) {
 
 	// Subcommand arguments
-	unixSockPathPtr := clt.String("sockfile", "/opt/journald/journald.sock", "path to the journald's unix domain socket file")
+	unixSockPathPtr, secretPtr := clientFlags(clt)
 	clt.Parse(os.Args[2:])
 
 	// Validate UNIX domain socket file
@@ -34,6 +42,7 @@ func StartClient(clt *flag.FlagSet) {
 	c := &client{
 		unixClient:   unixClient,
 		unixSockPath: *unixSockPathPtr,
+		secret:       *secretPtr,
 	}
 
 	// Say hi
@@ -57,14 +66,55 @@ Loop:
 		case lowerText == "help":
 			cmdHelp()
 
+		case lowerText == "status":
+			c.Run("status", map[string]interface{}{})
+
+		case lowerText == "version":
+			c.Run("version", map[string]interface{}{})
+
 		case lowerText == "statistics" || lowerText == "stats":
 			c.Run("statistics", map[string]interface{}{})
 
+		case argCmd(args, 2) == "export stats":
+			format := "json"
+			if len(args) > 2 {
+				format = strings.ToLower(args[2])
+			}
+			filename := fmt.Sprintf("journald_stats_%s.%s", time.Now().Format("2006-01-02_150405"), format)
+			if len(args) > 3 {
+				filename = args[3]
+			}
+			c.Export("statistics.export", map[string]interface{}{
+				"format": format,
+			}, filename)
+
 		case argCmd(args, 3) == "create token for":
-			c.Run("tokens.add", map[string]interface{}{
+			cmdArgs := map[string]interface{}{
 				"service":  args[3],
 				"instance": args[4],
-			})
+			}
+			if len(args) > 6 && strings.ToLower(args[5]) == "value" {
+				cmdArgs["token"] = args[6]
+			}
+			c.Run("tokens.add", cmdArgs)
+
+		case argCmd(args, 2) == "import tokens" && len(args) > 2:
+			passphrase := ""
+			if len(args) > 3 {
+				passphrase = args[3]
+			}
+			c.Import(args[2], passphrase)
+
+		case argCmd(args, 2) == "export tokens":
+			filename := fmt.Sprintf("journald_tokens_%s.json", time.Now().Format("2006-01-02_150405"))
+			if len(args) > 2 {
+				filename = args[2]
+			}
+			cmdArgs := map[string]interface{}{}
+			if len(args) > 3 {
+				cmdArgs["passphrase"] = args[3]
+			}
+			c.Export("tokens.export", cmdArgs, filename)
 
 		case argCmd(args, 3) == "revoke token for":
 			c.Run("tokens.revoke.instance", map[string]interface{}{
@@ -77,13 +127,51 @@ Loop:
 				"service": args[3],
 			})
 
+		case argCmd(args, 2) == "revoke matching" && len(args) == 3:
+			c.Run("tokens.revoke.matching", map[string]interface{}{
+				"pattern": args[2],
+			})
+
 		case argCmd(args, 3) == "list instances of":
-			c.Run("tokens.list.instances", map[string]interface{}{
+			cmdArgs := map[string]interface{}{
 				"service": args[3],
-			})
+			}
+			if len(args) > 5 && strings.ToLower(args[4]) == "page" {
+				if !paginate(cmdArgs, args[5]) {
+					continue
+				}
+			}
+			if strings.ToLower(args[len(args)-1]) == "reveal" {
+				cmdArgs["reveal"] = true
+			}
+			c.Run("tokens.list.instances", cmdArgs)
+
+		case argCmd(args, 3) == "list all tokens":
+			cmdArgs := map[string]interface{}{}
+			for i := 3; i < len(args); i++ {
+				switch strings.ToLower(args[i]) {
+				case "reveal":
+					cmdArgs["reveal"] = true
+				case "sort":
+					if i++; i < len(args) {
+						cmdArgs["sort"] = strings.ToLower(args[i])
+					}
+				case "page":
+					if i++; i < len(args) && !paginate(cmdArgs, args[i]) {
+						continue Loop
+					}
+				}
+			}
+			c.Run("tokens.list.all", cmdArgs)
 
 		case argCmd(args, 2) == "list services":
-			c.Run("tokens.list.services", map[string]interface{}{})
+			cmdArgs := map[string]interface{}{}
+			if len(args) > 3 && strings.ToLower(args[2]) == "page" {
+				if !paginate(cmdArgs, args[3]) {
+					continue
+				}
+			}
+			c.Run("tokens.list.services", cmdArgs)
 
 		case argCmd(args, 3) == "list remote backends":
 			c.Run("remote.list", map[string]interface{}{})
@@ -102,6 +190,9 @@ Loop:
 				c.Run("logs.list", map[string]interface{}{})
 			}
 
+		case lowerText == "rotate logs":
+			c.Run("logs.rotate", map[string]interface{}{})
+
 		case argCmd(args, 4) == "add remote backend journald":
 			port, err := strconv.Atoi(args[5])
 			if err != nil {
@@ -1,23 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"strconv"
 	"strings"
 
 	"github.com/fatih/color"
+	"github.com/vaitekunas/journal/server"
 	"github.com/vaitekunas/unixsock"
 	uclient "github.com/vaitekunas/unixsock/client"
 )
 
 var CMDS = []string{
+	"status - shows journald's version, uptime, etc.",
+	"version - shows journald's version",
 	"stats - shows journald statistics",
-	"create token for <service> <instance> - creates a new journald authentication token",
+	"export stats [csv|json] [file] - writes raw journald statistics to a local file",
+	"create token for <service> <instance> [value <token>] - creates a new journald authentication token (random unless a value is given)",
+	"import tokens <file> [passphrase] - creates tokens for all the <service> <instance> lines of a file or restores exported tokens",
+	"export tokens [file] [passphrase] - writes all the tokens to a local file (encrypted if a passphrase is given)",
 	"revoke token for <service> <instance> - removes an instance's authentication token",
 	"revoke tokens for <service> - removes all service's authentication tokens",
-	"list services - lists services using this instance of journald",
-	"list instances of <service> - lists all instances of a service using this instance of journald",
+	"revoke matching <pattern> - removes all tokens whose <service>/<instance> matches a glob or re:<regex>",
+	"list services [page <n>] - lists services using this instance of journald",
+	"list instances of <service> [page <n>] [reveal] - lists all instances of a service using this instance of journald (tokens are masked unless revealed)",
+	"list all tokens [sort <name|active|logs|volume>] [page <n>] [reveal] - lists all service instances with their token status and activity",
 	"list remote backends",
 	"list logs [number] - lists log files",
+	"rotate logs - archives the current logfile and opens a fresh one",
 	"add remote backend journald <host> <port> <service> <instance> <token> - add a journald backend",
 	"remove remote backend journald <host> <port>",
 	"",
@@ -25,14 +38,42 @@ var CMDS = []string{
 	"quit - exits journalist",
 }
 
+// chunkSize is the size of the chunks large payloads are fetched in
+const chunkSize = 1 << 20
+
 type client struct {
 	unixClient   uclient.UnixSockClient
 	unixSockPath string
+	secret       string // Management console secret
 }
 
-// Run runs a journald client command
+// Run runs a journald client command. Results are requested as JSON and
+// rendered locally (servers that do not support it send rendered text).
 func (c *client) Run(cmd string, args map[string]interface{}) {
-	resp, err := c.unixClient.Send(cmd, args, true, false)
+	args["format"] = "json"
+	resp, err := c.send(cmd, args)
+	if err != nil {
+		consoleErr("%s\n", err.Error())
+		return
+	}
+
+	if resp.Status == unixsock.STATUS_FAIL {
+		consoleErr("%s\n", resp.Error)
+		return
+	}
+
+	result, err := server.DecodeResult(fmt.Sprint(resp.Payload))
+	if err != nil {
+		fmt.Println(resp.Payload)
+		return
+	}
+
+	fmt.Println(server.RenderResult(result))
+}
+
+// Export runs a journald export command and writes its payload to a local file
+func (c *client) Export(cmd string, args map[string]interface{}, filename string) {
+	resp, err := c.send(cmd, args)
 	if err != nil {
 		consoleErr("%s\n", err.Error())
 		return
@@ -43,7 +84,80 @@ func (c *client) Run(cmd string, args map[string]interface{}) {
 		return
 	}
 
-	fmt.Println(resp.Payload)
+	if err := ioutil.WriteFile(filename, []byte(fmt.Sprint(resp.Payload)), 0600); err != nil {
+		consoleErr("Could not write to '%s': %s\n", filename, err.Error())
+		return
+	}
+
+	message(fmt.Sprintf("exported to %s", filename))
+}
+
+// Import uploads a local token list (see server.ParseTokenList) or an exported
+// token database to journald (tokens.import)
+func (c *client) Import(filename, passphrase string) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		consoleErr("Could not read '%s': %s\n", filename, err.Error())
+		return
+	}
+
+	// Exported token databases are JSON-encoded
+	args := map[string]interface{}{}
+	if trimmed := strings.TrimSpace(string(contents)); strings.HasPrefix(trimmed, "{") {
+		args["tokens"] = trimmed
+		args["passphrase"] = passphrase
+	} else {
+		pairs, malformed := server.ParseTokenList(string(contents))
+		if len(malformed) > 0 {
+			lines := make([]string, len(malformed))
+			for i, line := range malformed {
+				lines[i] = strconv.Itoa(line)
+			}
+			consoleErr("Skipped malformed line(s) %s of '%s'\n", strings.Join(lines, ", "), filename)
+		}
+		tokens := make([]interface{}, len(pairs))
+		for i, pair := range pairs {
+			tokens[i] = map[string]interface{}{"service": pair[0], "instance": pair[1]}
+		}
+		args["tokens"] = tokens
+	}
+
+	c.Run("tokens.import", args)
+}
+
+// send sends a journald command. Large payloads are fetched in chunks and
+// reassembled before they are returned (the payload is rendered as a whole).
+func (c *client) send(cmd string, args map[string]interface{}) (*unixsock.Response, error) {
+	args["chunk_size"] = chunkSize
+	if c.secret != "" {
+		args["secret"] = c.secret
+	}
+	resp, err := c.unixClient.Send(cmd, args, true, false)
+	if err != nil || resp.Status != server.STATUS_CHUNKED {
+		return resp, err
+	}
+
+	chunked := server.ChunkedPayload{}
+	if err := json.Unmarshal([]byte(fmt.Sprint(resp.Payload)), &chunked); err != nil {
+		return nil, fmt.Errorf("could not decode chunked payload: %s", err.Error())
+	}
+
+	payload := bytes.NewBuffer(make([]byte, 0, chunked.Size))
+	for i := 0; i < chunked.Chunks; i++ {
+		chunk, err := c.unixClient.Send("chunk", map[string]interface{}{"id": chunked.ID, "index": i, "secret": c.secret}, true, false)
+		if err != nil {
+			return nil, err
+		}
+		if chunk.Status != unixsock.STATUS_OK {
+			return chunk, nil
+		}
+		payload.WriteString(fmt.Sprint(chunk.Payload))
+	}
+
+	resp.Status = unixsock.STATUS_OK
+	resp.Payload = payload.String()
+
+	return resp, nil
 }
 
 func cmdHelp() {
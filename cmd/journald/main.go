@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/fatih/color"
+	"io"
 	"os"
 	"strings"
 )
@@ -39,15 +40,61 @@ func init() {
 		c10(`  d88P`),
 		c11(`888P`),
 		c12(``),
-		c13(VERSION),
+		c13(versionString()),
 	}
 
 	banner = strings.Join(bannerSlice, "\n")
 }
 
+// VERSION is journald's version, set at build time:
+//
+//	go build -ldflags "-X main.VERSION=v1.2.3" github.com/vaitekunas/journal/cmd/journald
+var VERSION = "dev"
+
+// COMMIT is the commit journald has been built from (set at build time like VERSION)
+var COMMIT = ""
+
+// versionString describes the build, e.g. "v1.2.3 (commit 1a2b3c4)"
+func versionString() string {
+	if COMMIT == "" {
+		return VERSION
+	}
+	return fmt.Sprintf("%s (commit %s)", VERSION, COMMIT)
+}
+
+// subcommands are journald's subcommands and their descriptions
+var subcommands = [][2]string{
+	{"start-server", "starts the journald log server"},
+	{"connect", "connects to the management console of a running journald"},
+	{"version", "prints journald's version"},
+}
+
 func init() {
-	// TODO: implement flag.Usage
-	flag.Usage = func() {}
+	flag.Usage = func() {
+		usage(os.Stderr)
+	}
+}
+
+// usage prints the subcommands and their flags
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "journald %s\n\nUsage:\n\n\tjournald <command> [flags]\n\nCommands:\n\n", versionString())
+	for _, cmd := range subcommands {
+		fmt.Fprintf(w, "\t%-14s %s\n", cmd[0], cmd[1])
+	}
+
+	flagSets := []*flag.FlagSet{
+		flag.NewFlagSet("start-server", flag.ContinueOnError),
+		flag.NewFlagSet("connect", flag.ContinueOnError),
+	}
+	serverFlags(flagSets[0])
+	clientFlags(flagSets[1])
+
+	for _, fs := range flagSets {
+		fmt.Fprintf(w, "\nFlags of %s:\n\n", fs.Name())
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+	}
+	fmt.Fprintln(w)
 }
 
 func main() {
@@ -70,6 +117,9 @@ func main() {
 	case "connect":
 		StartClient(clt)
 
+	case "version":
+		fmt.Printf("journald %s\n", versionString())
+
 	default:
 		fmt.Printf("Unknown command '%s'\n", os.Args[1])
 		flag.Usage()
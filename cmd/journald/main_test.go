@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUsage(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	usage(buf)
+
+	for _, expected := range []string{VERSION, "start-server", "connect", "-sockfile", "-filestem", "-check"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Usage does not mention '%s':\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	if versionString() == "" {
+		t.Errorf("Empty version")
+	}
+
+	defer func(commit string) { COMMIT = commit }(COMMIT)
+	COMMIT = "1a2b3c4"
+	if version := versionString(); !strings.HasPrefix(version, VERSION) || !strings.Contains(version, "1a2b3c4") {
+		t.Errorf("Unexpected version: %s", version)
+	}
+}
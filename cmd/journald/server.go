@@ -5,80 +5,197 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/vaitekunas/journal"
 	"github.com/vaitekunas/journal/server"
 )
 
-// StartServer starts the journald server
-func StartServer(srv *flag.FlagSet) {
+// serverFlags defines the flags of the start-server subcommand. The returned
+// function builds the server configuration (and reports whether it should only
+// be validated) once the flags have been parsed.
+func serverFlags(srv *flag.FlagSet) func() (*server.Config, bool) {
 
 	// Remote config
 	hostPtr := srv.String("host", "127.0.0.1", "Remote logger's host")
 	portPtr := srv.Int("port", 4332, "Remote logger's port")
 	unixSockPtr := srv.String("unix-socket", "/var/run/journald.sock", "Remote logger's unix socket file")
 	tokenPtr := srv.String("tokens", "/opt/journald/tokens.db", "Remote logger's access tokens")
+	jsonTokensPtr := srv.Bool("json-tokens", false, "Store access tokens in JSON format (migrates legacy token databases)")
 	statsPtr := srv.String("stats", "/opt/journald/stats.db", "Remote logger's statistics")
+	disableStatsPtr := srv.Bool("disable-stats", false, "Neither gather nor store statistics")
+	statsFormatPtr := srv.String("stats-format", "json", "Statistics file format: {json|gob}")
+	maxStatsPtr := srv.Int("max-stats", 0, "Maximum number of retained service/instance statistics (0 - unlimited)")
+	evictionPtr := srv.String("stats-eviction", "inactive", "Statistics to evict above -max-stats: {inactive|smallest}")
+	granularityPtr := srv.Duration("stats-granularity", time.Hour, "Duration of a statistics bucket")
+	windowPtr := srv.Duration("stats-window", 24*time.Hour, "Duration of all the statistics buckets (a multiple of -stats-granularity)")
+	statsRetriesPtr := srv.Int("stats-load-retries", 2, "Additional attempts to read the statistics at startup (e.g. on slow network mounts)")
+	statsRetryDelayPtr := srv.Duration("stats-load-retry-delay", 500*time.Millisecond, "Delay between the attempts to read the statistics")
+	codesPtr := srv.String("codes", "", "JSON file with custom message codes, e.g. {\"42\": {\"Type\": \"PaymentDeclined\", \"Error\": true}}")
+	maxDiskPtr := srv.Int64("max-disk", 0, "Maximum total size of the log folder in bytes (0 - unlimited)")
+	shutdownPtr := srv.Duration("shutdown-timeout", 10*time.Second, "Maximum time to wait for in-flight logs on shutdown")
+	lifecyclePtr := srv.Bool("log-lifecycle", true, "Log server start and stop")
+	adminSecretPtr := srv.String("admin-secret", "", "Management console secret permitting all commands (empty - open console)")
+	viewerSecretPtr := srv.String("viewer-secret", "", "Management console secret permitting read-only commands")
+	selfReportPtr := srv.Duration("self-report", 0, "Interval of the logged throughput summaries (0 - never)")
+	trustClientIPPtr := srv.Bool("trust-client-ip", false, "Record the IP claimed by the clients instead of the connection's address")
+	proxiesPtr := srv.String("trusted-proxies", "", "Comma-separated IPs of proxies whose x-forwarded-for metadata is honored")
+	serverIDPtr := srv.String("server-id", "", "Unique ID of this server in the routes of forwarded logs (default random)")
+	maxHopsPtr := srv.Int("max-hops", 8, "Maximum number of servers a forwarded log may pass")
+	reflectionPtr := srv.Bool("reflection", false, "Register the gRPC reflection service (debugging only, exposes the schema)")
 
 	// Local config
 	filePtr := srv.String("filestem", "aggregate", "Log filename stem (without date and extension)")
+	templatePtr := srv.String("filename-template", "", "Log filename template with {stem}, {date}, {service}, {instance} and {host} (default \"{stem}_{date}\")")
 	folderPtr := srv.String("folder", "/var/logs/journald", "Logserver's folder to store logs in")
 	rotPtr := srv.String("rotation", "daily", "Log rotation mode: {none|daily|weekly|monthly|annually}")
 	outPtr := srv.String("output", "file", "Log output mode: {file|stdout|both}")
 	headPtr := srv.Bool("headers", true, "Always print headers")
 	jsonPtr := srv.Bool("json", true, "Print logs encoded in json")
 	compressPtr := srv.Bool("compress", true, "Compress rotated logs")
+	breakerPtr := srv.Int("breaker-threshold", 0, "Consecutive failed writes after which a remote backend is skipped for -breaker-cooldown (0 - never)")
+	cooldownPtr := srv.Duration("breaker-cooldown", 30*time.Second, "Time a failing remote backend is skipped for")
+	maxMessagePtr := srv.Int("max-message-bytes", 0, "Maximum length of a logged message in bytes, longer ones are truncated (0 - unlimited)")
+	columnsPtr := srv.String("columns", "", "Comma-separated log columns, e.g. service,caller,message (default columns if empty)")
 
-	srv.Parse(os.Args[2:])
+	// Validation only
+	checkPtr := srv.Bool("check", false, "Validate the configuration and exit")
 
-	// Decide on rotation
-	var rot int
-	switch *rotPtr {
-	case "daily":
-		rot = journal.ROT_DAILY
-	case "weekly":
-		rot = journal.ROT_WEEKLY
-	case "monthly":
-		rot = journal.ROT_MONTHLY
-	case "annually":
-		rot = journal.ROT_ANNUALLY
-	default:
-		rot = journal.ROT_NONE
-	}
+	return func() (*server.Config, bool) {
+
+		// Decide on rotation
+		var rot int
+		switch *rotPtr {
+		case "daily":
+			rot = journal.ROT_DAILY
+		case "weekly":
+			rot = journal.ROT_WEEKLY
+		case "monthly":
+			rot = journal.ROT_MONTHLY
+		case "annually":
+			rot = journal.ROT_ANNUALLY
+		default:
+			rot = journal.ROT_NONE
+		}
+
+		// Decide on statistics storage
+		statsFormat := server.STATS_JSON
+		if *statsFormatPtr == "gob" {
+			statsFormat = server.STATS_GOB
+		}
+		eviction := server.EVICT_LEAST_RECENTLY_ACTIVE
+		if *evictionPtr == "smallest" {
+			eviction = server.EVICT_SMALLEST_VOLUME
+		}
+
+		// Decide on output
+		var out int
+		switch *outPtr {
+		case "stdout":
+			out = journal.OUT_STDOUT
+		case "both":
+			out = journal.OUT_FILE_AND_STDOUT
+		default:
+			out = journal.OUT_FILE
+		}
+
+		// Decide on columns
+		var columnNames []string
+		if *columnsPtr != "" {
+			columnNames = strings.Split(*columnsPtr, ",")
+		}
+
+		// Decide on trusted proxies
+		var proxies []string
+		if *proxiesPtr != "" {
+			proxies = strings.Split(*proxiesPtr, ",")
+		}
+
+		// Complete config
+		config := &server.Config{
+			Host:         *hostPtr,
+			Port:         *portPtr,
+			UnixSockPath: *unixSockPtr,
+			TokenPath:    *tokenPtr,
+			JSONTokens:   *jsonTokensPtr,
+			StatsPath:    *statsPtr,
+			CodesPath:    *codesPtr,
+			MaxDiskBytes: *maxDiskPtr,
+
+			DisableStatistics: *disableStatsPtr,
+			StatsFormat:       statsFormat,
+			MaxStatistics:     *maxStatsPtr,
+			StatsEviction:     eviction,
+			StatsGranularity:  *granularityPtr,
+			StatsWindow:       *windowPtr,
+
+			StatsLoadRetries:    *statsRetriesPtr,
+			StatsLoadRetryDelay: *statsRetryDelayPtr,
+
+			ShutdownTimeout:  *shutdownPtr,
+			QuietLifecycle:   !*lifecyclePtr,
+			Version:          versionString(),
+			EnableReflection: *reflectionPtr,
+
+			SelfReportInterval: *selfReportPtr,
 
-	// Decide on output
-	var out int
-	switch *outPtr {
-	case "stdout":
-		out = journal.OUT_STDOUT
-	case "both":
-		out = journal.OUT_FILE_AND_STDOUT
-	default:
-		out = journal.OUT_FILE
+			TrustClientIP:  *trustClientIPPtr,
+			TrustedProxies: proxies,
+
+			ServerID: *serverIDPtr,
+			MaxHops:  *maxHopsPtr,
+
+			AdminSecret:  *adminSecretPtr,
+			ViewerSecret: *viewerSecretPtr,
+
+			LoggerConfig: &journal.Config{
+				Service:  "",
+				Instance: "",
+				Folder:   *folderPtr,
+				Filename: *filePtr,
+				Rotation: rot,
+				Out:      out,
+				Headers:  *headPtr,
+				JSON:     *jsonPtr,
+				Compress: *compressPtr,
+				Columns:  []int64{}, // List of relevant columns (can be empty if default columns should be used)
+
+				ColumnNames:      columnNames,
+				FilenameTemplate: *templatePtr,
+
+				BreakerThreshold: *breakerPtr,
+				BreakerCooldown:  *cooldownPtr,
+
+				MaxMessageBytes: *maxMessagePtr,
+			},
+		}
+
+		return config, *checkPtr
 	}
+}
+
+// StartServer starts the journald server
+func StartServer(srv *flag.FlagSet) {
 
-	// Complete config
-	config := &server.Config{
-		Host:         *hostPtr,
-		Port:         *portPtr,
-		UnixSockPath: *unixSockPtr,
-		TokenPath:    *tokenPtr,
-		StatsPath:    *statsPtr,
-
-		LoggerConfig: &journal.Config{
-			Service:  "",
-			Instance: "",
-			Folder:   *folderPtr,
-			Filename: *filePtr,
-			Rotation: rot,
-			Out:      out,
-			Headers:  *headPtr,
-			JSON:     *jsonPtr,
-			Compress: *compressPtr,
-			Columns:  []int64{}, // List of relevant columns (can be empty if default columns should be used)
-		},
+	buildConfig := serverFlags(srv)
+	srv.Parse(os.Args[2:])
+	config, check := buildConfig()
+
+	// Validate configuration only
+	if check {
+		if err := server.ValidateConfig(config); err != nil {
+			fmt.Printf("Invalid configuration: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
 	}
 
+	// Survive a closed stdout pipe (the logger stops writing to it instead)
+	signal.Ignore(syscall.SIGPIPE)
+
 	// Management console
 	manager := server.NewConsole()
 
@@ -99,9 +216,13 @@ func StartServer(srv *flag.FlagSet) {
 	case <-sig: // Standard os interrupt (ctrl+c)
 		fmt.Println("\nReceived interrupt signal. Quitting.")
 		journald.Quit()
-	case <-journald.KillSwitch(): // Can be triggered via the management console
+	case <-journald.KillSwitch(): // Can be triggered via the management console or a server failure
 		fmt.Println("Received killswitch signal. Quitting.")
 		journald.Quit()
+		if err := journald.Err(); err != nil {
+			fmt.Printf("journald has failed: %s\n", err.Error())
+			os.Exit(1)
+		}
 	}
 	fmt.Println("journald has been shut down...")
 }
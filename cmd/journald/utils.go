@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -45,3 +46,20 @@ func argCmd(args []string, length int) string {
 
 	return strings.ToLower(strings.Join(args[:length], " "))
 }
+
+// Number of rows per page of paginated listings
+const pageSize = 50
+
+// paginate adds the offset and limit of a (1-based) page to command arguments
+func paginate(cmdArgs map[string]interface{}, page string) bool {
+	n, err := strconv.Atoi(page)
+	if err != nil || n < 1 {
+		consoleErr("Invalid page '%s'", page)
+		return false
+	}
+
+	cmdArgs["offset"] = (n - 1) * pageSize
+	cmdArgs["limit"] = pageSize
+
+	return true
+}
@@ -1,47 +1,184 @@
 package connect
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/vaitekunas/journal"
 	"github.com/vaitekunas/journal/logrpc"
 
 	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
+// RemoteClient is a connection to a remote log server. Write accepts a single
+// JSON-encoded log entry (map of column codes to values), as produced by the
+// Logger for its destinations. Mock implementations can be used in tests instead
+// of a real gRPC server.
+type RemoteClient interface {
+	io.WriteCloser
+
+	// Reconnect points the client at another address of the log server
+	Reconnect(host string, port int) error
+}
+
 // remoteClient implements the io.Writer and logrpc.RemoteLoggerClient interfaces
 // and is used to write log entries to a remote log server
 type remoteClient struct {
-	timeout time.Duration
-	close   func() error
-	client  logrpc.RemoteLoggerClient
+	sync.RWMutex // Protects the connection (writes hold a read lock)
+
+	timeout     time.Duration
+	dialTimeout time.Duration             // Dial timeout used when reconnecting
+	target      poolKey                   // Key of the pooled connection (zero if not pooled)
+	closed      bool                      // Has the client been closed?
+	client      logrpc.RemoteLoggerClient // Client of the current connection
+	callOpts    []grpc.CallOption         // Per-call options (e.g. credentials of a shared connection)
+	compact     bool                      // Does the server accept the compact form? (see negotiate)
 }
 
 // Write sends the log via gRPC to the remote log server
 func (r *remoteClient) Write(p []byte) (n int, err error) {
 
-	// Call context with timeout
-	ctx, _ := context.WithTimeout(context.Background(), r.timeout)
+	// A reconnection waits for the write to finish
+	r.RLock()
+	defer r.RUnlock()
 
-	// Unmarshal log entry
-	newEntry := map[int64]string{}
-	if err := json.Unmarshal(p, &newEntry); err != nil {
-		return 0, fmt.Errorf("Write: could not unmarshal logEntry: %s", err.Error())
+	// Unmarshal the log entry into the negotiated form and catch misconfigured
+	// writers before sending
+	var compact *logrpc.CompactLogEntry
+	var newEntry map[int64]string
+	if r.compact {
+		if compact, err = decodeCompact(p); err != nil {
+			return 0, fmt.Errorf("Write: could not unmarshal logEntry (expected a JSON-encoded map of column codes to values): %s", err.Error())
+		}
+		err = journal.ValidateRawColumns(compact.GetColumns())
+	} else {
+		if err = json.Unmarshal(p, &newEntry); err != nil {
+			return 0, fmt.Errorf("Write: could not unmarshal logEntry (expected a JSON-encoded map of column codes to values): %s", err.Error())
+		}
+		err = journal.ValidateRawEntry(newEntry)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Write: incomplete logEntry: %s", err.Error())
 	}
 
 	// Send log entry
-	if _, err := r.client.RemoteLog(ctx, &logrpc.LogEntry{Entry: newEntry}); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	if compact != nil {
+		_, err = r.client.RemoteLogCompact(ctx, compact, r.callOpts...)
+	} else {
+		_, err = r.client.RemoteLog(ctx, &logrpc.LogEntry{Entry: newEntry}, r.callOpts...)
+	}
+	if err != nil {
 		return 0, fmt.Errorf("Write: failed to write log to remote backend: %s", err.Error())
 	}
 
 	return len(p), nil
 }
 
+// negotiate asks the server once per connection (when connecting) whether it
+// accepts the compact form, i.e. servers accepting it say so in their version.
+// Older servers and failed negotiations get the map form.
+func negotiate(client logrpc.RemoteLoggerClient, callOpts []grpc.CallOption, timeout time.Duration) bool {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	version, err := client.Version(ctx, &logrpc.Nothing{}, callOpts...)
+	return err == nil && version.GetCompact()
+}
+
+// decodeCompact decodes a JSON-encoded log entry (object of column codes to
+// values) straight into the compact form
+func decodeCompact(p []byte) (*logrpc.CompactLogEntry, error) {
+
+	dec := json.NewDecoder(bytes.NewReader(p))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+
+	compact := &logrpc.CompactLogEntry{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		col, err := strconv.ParseInt(tok.(string), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid column '%s'", tok)
+		}
+
+		if tok, err = dec.Token(); err != nil {
+			return nil, err
+		}
+		value, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("value of column '%d' is not a string", col)
+		}
+
+		compact.Columns = append(compact.Columns, col)
+		compact.Values = append(compact.Values, value)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	return compact, nil
+}
+
+// Reconnect points the client at another address of the log server (e.g. after
+// the server has moved). Reconnect waits for in-flight writes to finish on the
+// old connection (each write is limited by the timeout), all the subsequent
+// writes go to the new address. The old connection is released.
+func (r *remoteClient) Reconnect(host string, port int) error {
+
+	target, conn, err := dialJournald(host, port, r.dialTimeout)
+	if err != nil {
+		return fmt.Errorf("Reconnect: %s", err.Error())
+	}
+	client := logrpc.NewRemoteLoggerClient(conn)
+	compact := negotiate(client, r.callOpts, r.timeout)
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		journaldPool.release(target)
+		return fmt.Errorf("Reconnect: client has been closed")
+	}
+
+	old := r.target
+	r.target = target
+	r.client = client
+	r.compact = compact
+
+	if old != (poolKey{}) {
+		if err := journaldPool.release(old); err != nil {
+			return fmt.Errorf("Reconnect: could not release the old connection: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
 // Close closes the remote client connection
 func (r *remoteClient) Close() error {
-	if r.close != nil {
-		return r.close()
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed || r.target == (poolKey{}) {
+		r.closed = true
+		return nil
 	}
-	return nil
+	r.closed = true
+
+	return journaldPool.release(r.target)
 }
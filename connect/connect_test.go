@@ -0,0 +1,82 @@
+package connect
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vaitekunas/journal"
+	"github.com/vaitekunas/journal/logrpc"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// countingClient counts the entries sent to a log server
+type countingClient struct {
+	sent int
+}
+
+func (c *countingClient) RemoteLog(ctx context.Context, in *logrpc.LogEntry, opts ...grpc.CallOption) (*logrpc.Nothing, error) {
+	c.sent++
+	return &logrpc.Nothing{}, nil
+}
+
+func (c *countingClient) RemoteLogCompact(ctx context.Context, in *logrpc.CompactLogEntry, opts ...grpc.CallOption) (*logrpc.Nothing, error) {
+	c.sent++
+	return &logrpc.Nothing{}, nil
+}
+
+func (c *countingClient) VerifyToken(ctx context.Context, in *logrpc.Nothing, opts ...grpc.CallOption) (*logrpc.Nothing, error) {
+	return &logrpc.Nothing{}, nil
+}
+
+func (c *countingClient) Version(ctx context.Context, in *logrpc.Nothing, opts ...grpc.CallOption) (*logrpc.ServerVersion, error) {
+	return &logrpc.ServerVersion{}, nil
+}
+
+func TestWriteValidatesEntries(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		testWriteValidatesEntries(t, compact)
+	}
+}
+
+// testWriteValidatesEntries writes malformed, incomplete and complete entries in the map or compact form
+func testWriteValidatesEntries(t *testing.T, compact bool) {
+	client := &countingClient{}
+	remote := &remoteClient{timeout: time.Second, client: client, compact: compact}
+
+	complete := map[int64]string{}
+	for col := int64(journal.COL_DATE_YYMMDD); col <= journal.COL_LINE; col++ {
+		complete[col] = "N/A"
+	}
+	incomplete := map[int64]string{journal.COL_MSG: "no service"}
+
+	for _, test := range []struct {
+		name  string
+		entry interface{}
+		error string
+	}{
+		{"malformed", "2017-03-05 12:00:00 web 1 message", "could not unmarshal"},
+		{"non-string", map[int64]int{journal.COL_MSG: 1}, "could not unmarshal"},
+		{"incomplete", incomplete, "incomplete logEntry"},
+		{"complete", complete, ""},
+	} {
+		p, _ := json.Marshal(test.entry)
+		if test.name == "malformed" {
+			p = []byte(test.entry.(string))
+		}
+
+		_, err := remote.Write(p)
+		switch {
+		case test.error == "" && err != nil:
+			t.Errorf("%s entry has been rejected (compact: %t): %s", test.name, compact, err.Error())
+		case test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)):
+			t.Errorf("%s entry: expected error '%s' (compact: %t), got %v", test.name, test.error, compact, err)
+		}
+	}
+
+	if client.sent != 1 {
+		t.Errorf("Expected only the complete entry to be sent (compact: %t), got %d", compact, client.sent)
+	}
+}
@@ -0,0 +1,71 @@
+package connect_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/vaitekunas/journal"
+	"github.com/vaitekunas/journal/connect"
+)
+
+// mockRemote is a RemoteClient that keeps the received entries in memory
+type mockRemote struct {
+	sync.Mutex
+	entries []map[int64]string
+	closed  bool
+}
+
+// Write decodes and stores a log entry
+func (m *mockRemote) Write(p []byte) (int, error) {
+	entry := map[int64]string{}
+	if err := json.Unmarshal(p, &entry); err != nil {
+		return 0, err
+	}
+
+	m.Lock()
+	m.entries = append(m.entries, entry)
+	m.Unlock()
+
+	return len(p), nil
+}
+
+// Reconnect does nothing, the mock has no address
+func (m *mockRemote) Reconnect(host string, port int) error {
+	return nil
+}
+
+// Close marks the mock as closed
+func (m *mockRemote) Close() error {
+	m.closed = true
+	return nil
+}
+
+// Example of replacing a journald connection with a mock
+func ExampleRemoteClient() {
+
+	var remote connect.RemoteClient = &mockRemote{}
+
+	logger, err := journal.New(&journal.Config{
+		Service:      "MyService",
+		Instance:     "MyInstance",
+		Out:          journal.OUT_STDOUT,
+		StdoutWriter: ioutil.Discard,
+		Columns:      []int64{},
+	})
+	if err != nil {
+		fmt.Printf("Could not start logger: %s", err.Error())
+		return
+	}
+
+	// Forward logs to the mock instead of a remote log server
+	logger.AddDestination("journald", remote)
+	logger.Log("example", 0, "Hello, %s!", "journald")
+	logger.Quit()
+	remote.Close()
+
+	mock := remote.(*mockRemote)
+	fmt.Println(mock.entries[0][journal.COL_SERVICE], mock.entries[0][journal.COL_MSG], mock.closed)
+	// Output: MyService Hello, journald! true
+}
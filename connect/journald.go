@@ -2,30 +2,145 @@ package connect
 
 import (
 	"fmt"
-	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/vaitekunas/journal/logrpc"
+	context "golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
 
-// ToJournald connects to a log server backend
-func ToJournald(host string, port int, service, instance, token string, timeout time.Duration) (io.WriteCloser, error) {
+// Option configures the connection to a log server (see ToJournald)
+type Option func(*settings)
 
-	conn, err := grpc.Dial(fmt.Sprintf("%s:%d", host, port), grpc.WithPerRPCCredentials(&logrpc.TokenCred{
+// settings of a connection to a log server
+type settings struct {
+	creds       *logrpc.TokenCred
+	dialTimeout time.Duration
+}
+
+// Valid keys of custom metadata (gRPC metadata keys are lowercase)
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// WithMetadata attaches a custom key/value pair (e.g. "tenant") to all the logs
+// sent. The server stores the metadata in the column journal.COL_METADATA and
+// passes it to its interceptors (see server.MetadataFromContext). Keys are
+// lowercased and may contain a-z, 0-9 and ._- only, values must be printable ASCII.
+func WithMetadata(key, value string) Option {
+	return func(s *settings) {
+		if s.creds.Metadata == nil {
+			s.creds.Metadata = map[string]string{}
+		}
+		s.creds.Metadata[strings.ToLower(key)] = value
+	}
+}
+
+// WithDialTimeout makes ToJournald wait for the connection to be established
+// and fail if the log server cannot be reached in time. Without it connections
+// are dialed lazily, i.e. connection failures surface only when writing.
+func WithDialTimeout(dialTimeout time.Duration) Option {
+	return func(s *settings) {
+		s.dialTimeout = dialTimeout
+	}
+}
+
+// ToJournald connects to a log server backend. The host can be a hostname or
+// an IPv4/IPv6 address (IPv6 addresses may be enclosed in brackets). Each write
+// is limited by timeout. An already established connection to the endpoint is
+// reused (see WithDialTimeout).
+func ToJournald(host string, port int, service, instance, token string, timeout time.Duration, opts ...Option) (RemoteClient, error) {
+
+	creds := &logrpc.TokenCred{
 		IP:       getIP(),
 		Service:  service,
 		Instance: instance,
 		Token:    token,
-	}), grpc.WithInsecure()) // TODO: replace or make it an option
+		Schema:   logrpc.SCHEMA_VERSION,
+	}
+	s := &settings{creds: creds}
+	for _, opt := range opts {
+		opt(s)
+	}
+	for key, value := range creds.Metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("ConnectToLogServer: invalid metadata key '%s'", key)
+		}
+		for _, r := range value {
+			if r < ' ' || r > '~' {
+				return nil, fmt.Errorf("ConnectToLogServer: invalid metadata value of '%s' (must be printable ASCII)", key)
+			}
+		}
+	}
 
+	target, conn, err := dialJournald(host, port, s.dialTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("ConnectToLogServer: could not establish a gRPC connection :%s", err.Error())
+		return nil, fmt.Errorf("ConnectToLogServer: %s", err.Error())
 	}
 
+	client := logrpc.NewRemoteLoggerClient(conn)
+	callOpts := []grpc.CallOption{grpc.PerRPCCredentials(creds)}
+
 	return &remoteClient{
-		timeout: timeout,
-		close:   conn.Close,
-		client:  logrpc.NewRemoteLoggerClient(conn),
+		timeout:     timeout,
+		dialTimeout: s.dialTimeout,
+		target:      target,
+		client:      client,
+		callOpts:    callOpts,
+		compact:     negotiate(client, callOpts, timeout),
 	}, nil
 }
+
+// dialJournald validates the address of a log server and acquires a (shared)
+// connection to it
+func dialJournald(host string, port int, dialTimeout time.Duration) (poolKey, *grpc.ClientConn, error) {
+
+	// Validate the address
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(host), "["), "]")
+	if host == "" {
+		return poolKey{}, nil, fmt.Errorf("missing host")
+	}
+	if port < 1 || port > 65535 {
+		return poolKey{}, nil, fmt.Errorf("invalid port '%d'", port)
+	}
+
+	// Connections to the same endpoint are shared (credentials are sent per call)
+	key := newPoolKey(net.JoinHostPort(host, strconv.Itoa(port)))
+	conn, err := journaldPool.acquire(key, dialTimeout)
+	if err != nil {
+		return poolKey{}, nil, fmt.Errorf("could not establish a gRPC connection :%s", err.Error())
+	}
+
+	return key, conn, nil
+}
+
+// newPoolKey returns the key of a connection to a log server
+func newPoolKey(target string) poolKey {
+	return poolKey{target: target, insecure: true} // TODO: replace or make it an option
+}
+
+// verifyTimeout limits connecting to and verifying credentials with a log server
+const verifyTimeout = 10 * time.Second
+
+// Verify checks the credentials of a service/instance with a log server without
+// logging anything, e.g. as a preflight check at startup
+func Verify(host string, port int, service, instance, token string) error {
+
+	remote, err := ToJournald(host, port, service, instance, token, verifyTimeout, WithDialTimeout(verifyTimeout))
+	if err != nil {
+		return fmt.Errorf("Verify: could not connect to log server: %s", err.Error())
+	}
+	defer remote.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+
+	client := remote.(*remoteClient)
+	if _, err := client.client.VerifyToken(ctx, &logrpc.Nothing{}, client.callOpts...); err != nil {
+		return fmt.Errorf("Verify: credentials rejected: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package connect
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vaitekunas/journal"
+	"github.com/vaitekunas/journal/logrpc"
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func TestToJournaldDialTimeout(t *testing.T) {
+
+	// Find a closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not find a free port: %s", err.Error())
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	start := time.Now()
+	if remote, err := ToJournald("127.0.0.1", port, "service", "instance", "token", time.Second, WithDialTimeout(200*time.Millisecond)); err == nil {
+		remote.Close()
+		t.Fatalf("Connected to a closed port")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Dialing took %s", elapsed)
+	}
+	if refs := journaldPool.refs(newPoolKey(listener.Addr().String())); refs != 0 {
+		t.Errorf("Failed connection has been pooled")
+	}
+
+	// Lazy dialing succeeds regardless
+	remote, err := ToJournald("127.0.0.1", port, "service", "instance", "token", time.Second)
+	if err != nil {
+		t.Fatalf("Lazy dialing failed: %s", err.Error())
+	}
+	defer remote.Close()
+
+	// Reusing the lazily dialed connection still checks that it is ready
+	if reused, err := ToJournald("127.0.0.1", port, "service", "instance", "token", time.Second, WithDialTimeout(200*time.Millisecond)); err == nil {
+		reused.Close()
+		t.Fatalf("Reused a connection to a closed port")
+	}
+	if refs := journaldPool.refs(newPoolKey(listener.Addr().String())); refs != 1 {
+		t.Errorf("Expected the lazy connection to remain pooled, got %d users", refs)
+	}
+}
+
+// listeningServer is a log server that passes on the received entries
+type listeningServer struct {
+	compact  bool                  // Accept the compact form?
+	received chan map[int64]string // Entries received in the map form
+	compacts chan map[int64]string // Entries received in the compact form
+}
+
+func (s *listeningServer) RemoteLog(ctx context.Context, in *logrpc.LogEntry) (*logrpc.Nothing, error) {
+	s.received <- in.GetEntry()
+	return &logrpc.Nothing{}, nil
+}
+
+func (s *listeningServer) RemoteLogCompact(ctx context.Context, in *logrpc.CompactLogEntry) (*logrpc.Nothing, error) {
+	entry := map[int64]string{}
+	for i, col := range in.GetColumns() {
+		entry[col] = in.GetValues()[i]
+	}
+	s.compacts <- entry
+	return &logrpc.Nothing{}, nil
+}
+
+func (s *listeningServer) VerifyToken(ctx context.Context, in *logrpc.Nothing) (*logrpc.Nothing, error) {
+	return &logrpc.Nothing{}, nil
+}
+
+func (s *listeningServer) Version(ctx context.Context, in *logrpc.Nothing) (*logrpc.ServerVersion, error) {
+	return &logrpc.ServerVersion{Compact: s.compact}, nil
+}
+
+// listen starts a log server on a free port
+func listen(t testing.TB, compact bool) (*listeningServer, *grpc.Server, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err.Error())
+	}
+
+	srv := &listeningServer{
+		compact:  compact,
+		received: make(chan map[int64]string, 1),
+		compacts: make(chan map[int64]string, 1),
+	}
+	grpcServer := grpc.NewServer()
+	logrpc.RegisterRemoteLoggerServer(grpcServer, srv)
+	go grpcServer.Serve(listener)
+
+	return srv, grpcServer, listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestReconnect(t *testing.T) {
+
+	first, firstServer, firstPort := listen(t, false)
+	defer firstServer.Stop()
+	second, secondServer, secondPort := listen(t, false)
+	defer secondServer.Stop()
+
+	remote, err := ToJournald("127.0.0.1", firstPort, "service", "instance", "token", time.Second, WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err.Error())
+	}
+	defer remote.Close()
+
+	entry := map[int64]string{}
+	for col := int64(journal.COL_DATE_YYMMDD); col <= journal.COL_LINE; col++ {
+		entry[col] = "N/A"
+	}
+	p, _ := json.Marshal(entry)
+
+	write := func(srv *listeningServer, name string) {
+		if _, err := remote.Write(p); err != nil {
+			t.Fatalf("Could not write to the %s listener: %s", name, err.Error())
+		}
+		select {
+		case <-srv.received:
+		case <-time.After(time.Second):
+			t.Fatalf("The %s listener has not received the entry", name)
+		}
+	}
+
+	write(first, "first")
+
+	if err := remote.Reconnect("127.0.0.1", secondPort); err != nil {
+		t.Fatalf("Could not reconnect: %s", err.Error())
+	}
+	write(second, "second")
+
+	if refs := journaldPool.refs(newPoolKey(net.JoinHostPort("127.0.0.1", strconv.Itoa(firstPort)))); refs != 0 {
+		t.Errorf("The old connection has not been released")
+	}
+
+	// A closed client cannot be reconnected
+	remote.Close()
+	if err := remote.Reconnect("127.0.0.1", firstPort); err == nil {
+		t.Errorf("Reconnected a closed client")
+	}
+	if refs := journaldPool.refs(newPoolKey(net.JoinHostPort("127.0.0.1", strconv.Itoa(firstPort)))); refs != 0 {
+		t.Errorf("A failed reconnection has not released its connection")
+	}
+}
+
+func TestCompactNegotiation(t *testing.T) {
+
+	entry := map[int64]string{}
+	for col := int64(journal.COL_DATE_YYMMDD); col <= journal.COL_LINE; col++ {
+		entry[col] = strconv.FormatInt(col, 10)
+	}
+	p, _ := json.Marshal(entry)
+
+	for _, compact := range []bool{false, true} {
+		srv, grpcServer, port := listen(t, compact)
+		remote, err := ToJournald("127.0.0.1", port, "service", "instance", "token", time.Second, WithDialTimeout(time.Second))
+		if err != nil {
+			t.Fatalf("Could not connect: %s", err.Error())
+		}
+
+		if _, err := remote.Write(p); err != nil {
+			t.Fatalf("Could not write (compact: %t): %s", compact, err.Error())
+		}
+
+		expected, other := srv.received, srv.compacts
+		if compact {
+			expected, other = srv.compacts, srv.received
+		}
+		select {
+		case received := <-expected:
+			if received[journal.COL_MSG] != entry[journal.COL_MSG] || len(received) != len(entry) {
+				t.Errorf("Unexpected entry (compact: %t): %v", compact, received)
+			}
+		case <-other:
+			t.Errorf("Entry has been sent in the wrong form (compact: %t)", compact)
+		case <-time.After(time.Second):
+			t.Errorf("Entry has not been received (compact: %t)", compact)
+		}
+
+		remote.Close()
+		grpcServer.Stop()
+	}
+}
+
+// benchmarkWrite measures the entries per second sent in the map or compact form
+func benchmarkWrite(b *testing.B, compact bool) {
+
+	srv, grpcServer, port := listen(b, compact)
+	defer grpcServer.Stop()
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-srv.received:
+			case <-srv.compacts:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	remote, err := ToJournald("127.0.0.1", port, "service", "instance", "token", time.Second, WithDialTimeout(time.Second))
+	if err != nil {
+		b.Fatalf("Could not connect: %s", err.Error())
+	}
+	defer remote.Close()
+
+	entry := map[int64]string{}
+	for col := int64(journal.COL_DATE_YYMMDD); col <= journal.COL_METADATA; col++ {
+		entry[col] = "N/A"
+	}
+	entry[journal.COL_MSG] = "a fairly typical log message of a service"
+	p, _ := json.Marshal(entry)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := remote.Write(p); err != nil {
+			b.Fatalf("Could not write: %s", err.Error())
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "entries/s")
+}
+
+func BenchmarkWriteMap(b *testing.B) {
+	benchmarkWrite(b, false)
+}
+
+func BenchmarkWriteCompact(b *testing.B) {
+	benchmarkWrite(b, true)
+}
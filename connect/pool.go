@@ -0,0 +1,132 @@
+package connect
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// Pool of gRPC connections shared by all the remote clients of an endpoint
+var journaldPool = &connPool{conns: map[poolKey]*pooledConn{}}
+
+// connPool reference-counts gRPC connections by endpoint and dial options
+type connPool struct {
+	sync.Mutex
+	conns map[poolKey]*pooledConn
+}
+
+// poolKey identifies a shared connection: the endpoint (host:port) and the
+// options it is dialed with. Only users with the same options share a connection.
+type poolKey struct {
+	target   string
+	insecure bool // Plaintext connection (no transport security)
+}
+
+// dialOptions returns the gRPC options the connection is dialed with
+func (k poolKey) dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{}
+	if k.insecure {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	return opts
+}
+
+// pooledConn is a shared gRPC connection
+type pooledConn struct {
+	conn   *grpc.ClientConn
+	err    error         // Dial error (set before dialed is closed)
+	dialed chan struct{} // Closed once the connection has been dialed
+	refs   int
+}
+
+// acquire returns the endpoint's connection, dialing it if necessary. Each
+// endpoint is dialed once, other users wait for the dial without holding the
+// pool's lock. With a positive dialTimeout acquire waits for the connection
+// (new or reused) to be ready and fails if it is not ready in time.
+func (p *connPool) acquire(key poolKey, dialTimeout time.Duration) (*grpc.ClientConn, error) {
+
+	p.Lock()
+	pooled, ok := p.conns[key]
+	if !ok {
+		pooled = &pooledConn{dialed: make(chan struct{})}
+		p.conns[key] = pooled
+	}
+	pooled.refs++
+	p.Unlock()
+
+	if !ok {
+		pooled.conn, pooled.err = grpc.Dial(key.target, key.dialOptions()...)
+		close(pooled.dialed)
+	}
+	<-pooled.dialed
+
+	if pooled.err != nil {
+		p.release(key)
+		return nil, pooled.err
+	}
+
+	if dialTimeout > 0 {
+		if err := waitForReady(pooled.conn, dialTimeout); err != nil {
+			p.release(key)
+			return nil, err
+		}
+	}
+
+	return pooled.conn, nil
+}
+
+// waitForReady waits for a connection to become ready
+func waitForReady(conn *grpc.ClientConn, timeout time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.Shutdown:
+			return fmt.Errorf("connection has been closed")
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("connection is not ready after %s (%s)", timeout, state)
+		}
+	}
+}
+
+// release closes the endpoint's connection once its last user has released it
+func (p *connPool) release(key poolKey) error {
+	p.Lock()
+	defer p.Unlock()
+
+	pooled, ok := p.conns[key]
+	if !ok {
+		return fmt.Errorf("release: no connection to '%s'", key.target)
+	}
+
+	if pooled.refs--; pooled.refs > 0 {
+		return nil
+	}
+	delete(p.conns, key)
+
+	if pooled.conn == nil {
+		return nil
+	}
+	return pooled.conn.Close()
+}
+
+// refs returns the number of users of the connection
+func (p *connPool) refs(key poolKey) int {
+	p.Lock()
+	defer p.Unlock()
+
+	if pooled, ok := p.conns[key]; ok {
+		return pooled.refs
+	}
+	return 0
+}
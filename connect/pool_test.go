@@ -0,0 +1,62 @@
+package connect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToJournaldSharesConnections(t *testing.T) {
+
+	target := "127.0.0.1:4332"
+
+	first, err := ToJournald("127.0.0.1", 4332, "service", "instance1", "token1", time.Second)
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err.Error())
+	}
+	second, err := ToJournald("127.0.0.1", 4332, "service", "instance2", "token2", time.Second)
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err.Error())
+	}
+
+	if refs := journaldPool.refs(newPoolKey(target)); refs != 2 {
+		t.Fatalf("Expected a single connection with 2 users, got %d users", refs)
+	}
+	if len(first.(*remoteClient).callOpts) != 1 || len(second.(*remoteClient).callOpts) != 1 {
+		t.Errorf("Remote clients do not send their own credentials")
+	}
+
+	// Closing twice releases the connection only once
+	first.Close()
+	first.Close()
+	if refs := journaldPool.refs(newPoolKey(target)); refs != 1 {
+		t.Fatalf("Expected 1 remaining user, got %d", refs)
+	}
+
+	second.Close()
+	if refs := journaldPool.refs(newPoolKey(target)); refs != 0 {
+		t.Errorf("Connection has not been closed by the last user")
+	}
+}
+
+func TestPoolKeysIncludeOptions(t *testing.T) {
+
+	plain := poolKey{target: "127.0.0.1:4333", insecure: true}
+	secure := poolKey{target: "127.0.0.1:4333"}
+
+	conn, err := journaldPool.acquire(plain, 0)
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err.Error())
+	}
+	defer journaldPool.release(plain)
+
+	// A connection dialed with other options is not shared
+	if other, err := journaldPool.acquire(secure, 0); err == nil {
+		defer journaldPool.release(secure)
+		if other == conn {
+			t.Errorf("Connection has been shared between different options")
+		}
+	}
+	if refs := journaldPool.refs(plain); refs != 1 {
+		t.Errorf("Expected 1 user of the plaintext connection, got %d", refs)
+	}
+}
@@ -0,0 +1,24 @@
+package journal
+
+import "golang.org/x/net/context"
+
+// contextKey is the type of the keys of values stored in contexts by the logger
+type contextKey int
+
+// Context keys
+const (
+	callerKey contextKey = iota
+)
+
+// ContextWithCaller returns a copy of ctx carrying the caller. LogCtx and
+// LogFieldsCtx use it for entries logged with an empty caller. Precedence:
+// explicit caller > context caller > derived caller (Config.AutoCaller).
+func ContextWithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey, caller)
+}
+
+// CallerFromContext returns the caller stored in ctx by ContextWithCaller
+func CallerFromContext(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(callerKey).(string)
+	return caller, ok && caller != ""
+}
@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"runtime/debug"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vaitekunas/journal/logrpc"
@@ -22,52 +26,215 @@ type Config struct {
 	Rotation int     // Logfile rotation frequency
 	Out      int     // Logger output type
 	Headers  bool    // Should the logfile contain column headers?
-	JSON     bool    // Should each entry be written as a JSON-formatted string?
+	JSON     bool    // Should each entry be written as a JSON-formatted string? (same as Format = FORMAT_JSON)
+	Format   int     // Logfile format
 	Compress bool    // Should old logfiles be compressed?
 	Columns  []int64 // List of relevant columns (can be empty if default columns should be used)
+
+	// ColumnNames is an alternative to Columns: relevant columns by name (see
+	// ColumnsFromNames). Only one of them can be set.
+	ColumnNames []string
+
+	QuietErrors    bool // Should Log, LogFields and callers always return nil? (LogErr still returns errors)
+	ErrorsToStderr bool // Should error entries be written to stderr instead of stdout?
+	AutoCaller     bool // Should an empty caller be replaced with the calling function (package.Func)?
+	SyncOnError    bool // Should the logfiles be synced to disk after each error entry? (notifications are not synced)
+
+	// StdoutWriter replaces os.Stdout (e.g. a buffer or ioutil.Discard). The logger
+	// stops writing to stdout/stderr after several consecutive failed writes. Note
+	// that writing to a closed os.Stdout pipe kills the process with SIGPIPE, unless
+	// the signal is ignored (signal.Ignore(syscall.SIGPIPE)).
+	StdoutWriter io.Writer
+	StderrWriter io.Writer // Replaces os.Stderr (only used with ErrorsToStderr)
+
+	MaxDiskBytes int64 // Maximum total size of all the logfiles in Folder (0 - unlimited)
+
+	// BreakerThreshold is the number of consecutive failed writes after which a
+	// remote destination is skipped for BreakerCooldown (0 - never skipped).
+	// Once the cooldown has passed, a single write probes the destination: a
+	// success closes the circuit, a failure opens it again. See DestStats.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration // Default: 30 seconds
+
+	// RingBufferSize is the number of the most recent entries retained in memory
+	// regardless of the output, e.g. to be dumped after a crash (0 - disabled).
+	// See Logger.RecentEntries.
+	RingBufferSize int
+
+	// MaxMessageBytes truncates longer messages (column COL_MSG) to this many
+	// bytes, ending with the marker "...(truncated)", i.e. it must be at least
+	// the marker's length. UTF-8 characters are not split. See Logger.Truncated
+	// (0 - unlimited).
+	MaxMessageBytes int
+
+	// FilenameTemplate is the name of the logfiles (without file extension) with the
+	// placeholders {stem} (Filename or ErrorFile), {date} (rotation date), {service},
+	// {instance} and {host}. Defaults to "{stem}_{date}". Separators left dangling
+	// at the ends of the name by the empty {date} of ROT_NONE are trimmed.
+	FilenameTemplate string
+
+	// ErrorFile is the filename (without date suffix and file extension) of
+	// additional logfiles in Folder that only contain error entries (empty -
+	// disabled). The error logfiles are rotated and compressed like the main ones.
+	ErrorFile string
+
+	// File is a pre-opened logfile (e.g. passed by a supervisor) used instead of
+	// Folder/Filename. The logger neither rotates nor compresses it, i.e. rotation
+	// is the caller's responsibility. The logger closes File on Quit.
+	File *os.File
 }
 
-// New creates a new logging facility
-func New(config *Config) (Logger, error) {
+// ValidateConfig performs all the configuration checks done by New without
+// starting the logger
+func ValidateConfig(config *Config) error {
+
+	if config == nil {
+		return fmt.Errorf("ValidateConfig: missing configuration")
+	}
 
 	// Validate options
-	if config.Rotation < ROT_NONE || config.Rotation > ROT_ANNUALLY {
-		return nil, fmt.Errorf("New: invalid roll option '%d'", config.Rotation)
+	if config.Rotation < 0 || config.Rotation > ROT_NONE {
+		return fmt.Errorf("ValidateConfig: invalid roll option '%d'", config.Rotation)
 	}
 	if config.Out < OUT_FILE || config.Out > OUT_FILE_AND_STDOUT {
-		return nil, fmt.Errorf("New: invalid output option '%d'", config.Out)
+		return fmt.Errorf("ValidateConfig: invalid output option '%d'", config.Out)
+	}
+	if config.Format < FORMAT_TSV || config.Format > FORMAT_CEF {
+		return fmt.Errorf("ValidateConfig: invalid format option '%d'", config.Format)
+	}
+	if config.MaxDiskBytes < 0 {
+		return fmt.Errorf("ValidateConfig: invalid maximum disk usage '%d'", config.MaxDiskBytes)
+	}
+	if config.BreakerThreshold < 0 {
+		return fmt.Errorf("ValidateConfig: invalid breaker threshold '%d'", config.BreakerThreshold)
+	}
+	if config.BreakerCooldown < 0 {
+		return fmt.Errorf("ValidateConfig: invalid breaker cooldown '%s'", config.BreakerCooldown)
+	}
+	if config.RingBufferSize < 0 {
+		return fmt.Errorf("ValidateConfig: invalid ring buffer size '%d'", config.RingBufferSize)
+	}
+	if config.MaxMessageBytes < 0 {
+		return fmt.Errorf("ValidateConfig: invalid maximum message length '%d'", config.MaxMessageBytes)
+	}
+	if config.MaxMessageBytes > 0 && config.MaxMessageBytes < len(truncationMarker) {
+		return fmt.Errorf("ValidateConfig: maximum message length '%d' is shorter than the truncation marker (%d bytes)", config.MaxMessageBytes, len(truncationMarker))
+	}
+	if config.File != nil && config.Out == OUT_STDOUT {
+		return fmt.Errorf("ValidateConfig: a logfile has been provided, but the output is stdout only")
+	}
+	if config.ErrorFile != "" && config.File != nil {
+		return fmt.Errorf("ValidateConfig: an error logfile cannot be used along with a pre-opened logfile")
+	}
+	if config.ErrorFile != "" && config.ErrorFile == config.Filename {
+		return fmt.Errorf("ValidateConfig: the error logfile must differ from the main logfile")
+	}
+	if config.ErrorFile != "" && (!safeFilenamePattern.MatchString(config.ErrorFile) || strings.Trim(config.ErrorFile, ".") == "") {
+		return fmt.Errorf("ValidateConfig: '%s' is not a safe error logfile name", config.ErrorFile)
+	}
+	if err := validFilenameTemplate(config); err != nil {
+		return fmt.Errorf("ValidateConfig: invalid filename template: %s", err.Error())
 	}
 
-	if len(config.Columns) == 0 {
-		config.Columns = defaultCols
-	} else {
-		for _, col := range config.Columns {
-			if col < COL_DATE_YYMMDD || col > COL_LINE {
-				return nil, fmt.Errorf("New: invalid column '%d'", col)
-			}
+	if len(config.ColumnNames) > 0 {
+		if len(config.Columns) > 0 {
+			return fmt.Errorf("ValidateConfig: columns can be set either by code or by name")
+		}
+		if _, err := ColumnsFromNames(config.ColumnNames); err != nil {
+			return fmt.Errorf("ValidateConfig: invalid column names: %s", err.Error())
+		}
+	}
+
+	for _, col := range config.Columns {
+		if col < COL_DATE_YYMMDD || col > COL_METADATA {
+			return fmt.Errorf("ValidateConfig: invalid column '%d'", col)
 		}
 	}
 
 	// Check permissions
-	if config.Out == OUT_FILE || config.Out == OUT_FILE_AND_STDOUT {
+	if (config.Out == OUT_FILE || config.Out == OUT_FILE_AND_STDOUT) && config.File == nil {
 		if !canWrite(config.Folder) {
-			return nil, fmt.Errorf("New: cannot write to '%s'", config.Folder)
+			return fmt.Errorf("ValidateConfig: cannot write to '%s'", config.Folder)
 		}
 	}
 
+	return nil
+}
+
+// copyConfig returns a copy of the configuration
+func copyConfig(config *Config) *Config {
+	configCopy := *config
+	configCopy.Columns = append([]int64{}, config.Columns...)
+	configCopy.ColumnNames = append([]string{}, config.ColumnNames...)
+	return &configCopy
+}
+
+// New creates a new logging facility
+func New(config *Config) (Logger, error) {
+
+	// Validate options
+	if err := ValidateConfig(config); err != nil {
+		return nil, fmt.Errorf("New: invalid configuration: %s", err.Error())
+	}
+
+	// Keep a private copy (the configuration can change at runtime)
+	config = copyConfig(config)
+
+	// Apply defaults
+	if config.JSON && config.Format == FORMAT_TSV {
+		config.Format = FORMAT_JSON
+	}
+	if len(config.ColumnNames) > 0 {
+		config.Columns, _ = ColumnsFromNames(config.ColumnNames)
+	}
+	if len(config.Columns) == 0 {
+		config.Columns = defaultCols
+	}
+	if config.Rotation == 0 {
+		config.Rotation = ROT_DAILY
+	}
+	if config.BreakerCooldown == 0 {
+		config.BreakerCooldown = defaultBreakerCooldown
+	}
+	sizeColumn := false
+	for _, col := range config.Columns {
+		sizeColumn = sizeColumn || col == COL_SIZE
+	}
+
+	// Custom codes must not leak into other loggers
+	codes := make(map[int]Code, len(defaultCodes))
+	for code, lCode := range defaultCodes {
+		codes[code] = lCode
+	}
+
 	// Internal context
 	internalCTX, cancel := context.WithCancel(context.Background())
 
 	// Initiate log instance
 	Log := &logger{
 		mu:            &sync.Mutex{},
+		reconfigure:   &sync.Mutex{},
+		compressions:  &sync.WaitGroup{},
+		compressSlots: make(chan bool, maxCompressions),
+		clock:         time.Now,
 		wg:            &sync.WaitGroup{},
+		state:         &sync.RWMutex{},
 		active:        true,
+		hostname:      hostname(),
 		config:        config,
-		codes:         defaultCodes,
-		ledger:        make(chan logEntry, 1000),
+		sizeColumn:    sizeColumn,
+		codes:         codes,
+		ledger:        make(chan *logEntry, 1000),
 		remoteWriters: map[string]io.Writer{},
+		remoteStats:   map[string]*destCounters{},
+		ctx:           internalCTX,
 		cancel:        cancel,
+		writerDone:    make(chan struct{}),
+		done:          make(chan struct{}),
+		doneOnce:      &sync.Once{},
+	}
+	if config.RingBufferSize > 0 {
+		Log.ring = newRingBuffer(config.RingBufferSize)
 	}
 
 	// Start file rotation (async)
@@ -79,28 +246,133 @@ func New(config *Config) (Logger, error) {
 	return Log, nil
 }
 
+// namedWriter is a remote log writer along with its name and write metrics
+type namedWriter struct {
+	name   string
+	writer io.Writer
+	stats  *destCounters
+}
+
+// DestStats are the write metrics of a (remote) destination
+type DestStats struct {
+	Entries     int64     // Entries sent
+	Bytes       int64     // Bytes sent
+	Failures    int64     // Failed writes
+	LastSuccess time.Time // Time of the last successful write (zero if none)
+	LastError   string    // Error of the last failed write (empty if none)
+
+	Open      bool      // Is the destination skipped after too many failures? (see Config.BreakerThreshold)
+	OpenUntil time.Time // End of the cooldown (the destination is probed afterwards)
+	Skipped   int64     // Entries not sent while the circuit was open
+}
+
+// destCounters are the write metrics and circuit breaker of a destination
+// updated by the write loop
+type destCounters struct {
+	sync.Mutex
+	DestStats
+
+	threshold   int           // Consecutive failures opening the circuit (0 - never)
+	cooldown    time.Duration // Time the destination is skipped for
+	consecutive int           // Consecutive failed writes
+}
+
+// allow checks whether an entry should be sent to the destination, i.e. the
+// circuit is closed or its cooldown has passed (the entry probes the destination)
+func (c *destCounters) allow(now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Open && now.Before(c.OpenUntil) {
+		c.Skipped++
+		return false
+	}
+	return true
+}
+
+// record counts a write of n bytes. Returns true if the failure has opened the
+// circuit (a failed probe reopens it silently).
+func (c *destCounters) record(n int, err error) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if err != nil {
+		c.Failures++
+		c.LastError = err.Error()
+		c.consecutive++
+		if c.threshold == 0 || c.consecutive < c.threshold {
+			return false
+		}
+		opened := !c.Open
+		c.Open = true
+		c.OpenUntil = time.Now().Add(c.cooldown)
+		return opened
+	}
+
+	c.Entries++
+	c.Bytes += int64(n)
+	c.LastSuccess = time.Now()
+	c.consecutive = 0
+	c.Open = false
+	c.OpenUntil = time.Time{}
+	return false
+}
+
 // logger is the main loggger struct
 type logger struct {
+	dropped   int64 // Number of entries dropped because the ledger was full (atomic, kept first for alignment)
+	truncated int64 // Number of messages truncated to Config.MaxMessageBytes (atomic)
+
 	mu *sync.Mutex     // Protect logfile changes
 	wg *sync.WaitGroup // Protect ledger processing
 
-	active bool         // logger Activity switch
-	config *Config      // Main config
-	codes  map[int]Code // Mapping of integer message codes to their string values
-
-	ledger chan logEntry // Ledger of unprocessed log entries
-	cancel func()        // Function to cancel internal  context
+	state      *sync.RWMutex // Protects the activity switch (see admit)
+	active     bool          // logger Activity switch
+	config     *Config       // Main config
+	codes      map[int]Code  // Mapping of integer message codes to their string values
+	sizeColumn bool          // Is COL_SIZE one of the columns? (entries are measured only if so)
+	hostname   string        // Host reported in FORMAT_GELF entries
+
+	ledger     chan *logEntry  // Ledger of unprocessed log entries
+	ctx        context.Context // Internal context
+	cancel     func()          // Function to cancel internal  context
+	writerDone chan struct{}   // Closed once the write coroutine has exited
+	done       chan struct{}   // Closed once the logger has stopped (see Done)
+	doneOnce   *sync.Once      // Closes done only once (Quit may be called repeatedly)
+
+	reconfigure   *sync.Mutex      // Serializes runtime reconfigurations
+	stopRotation  func()           // Stops the logfile rotation coroutine (nil if not rotating)
+	clock         func() time.Time // Current time used for the logfile rotation
+	compressions  *sync.WaitGroup  // Pending compressions of rotated logfiles (see compressAsync)
+	compressSlots chan bool        // Limits the number of concurrent compressions
 
 	// log Writers
-	logfile       *os.File             // local logfile's file descriptor
-	stdout        *os.File             // local stdout
-	remoteWriters map[string]io.Writer // remote log writers (grpc, kafka, etc)
+	logfile         *os.File                 // local logfile's file descriptor
+	firstEntry      bool                     // Is the next entry the first one in the logfile? (FORMAT_JSON_ARRAY)
+	errfile         *os.File                 // local logfile of error entries (Config.ErrorFile)
+	errFirstEntry   bool                     // Is the next error the first one in the error logfile? (FORMAT_JSON_ARRAY)
+	stdout          io.Writer                // local stdout
+	stderr          io.Writer                // local stderr (only used for errors if Config.ErrorsToStderr is set)
+	consoleFailures int                      // Consecutive failed writes to stdout/stderr
+	remoteWriters   map[string]io.Writer     // remote log writers (grpc, kafka, etc)
+	remoteStats     map[string]*destCounters // write metrics of the remote log writers
+	remoteSnapshot  []namedWriter            // remote log writers sorted by name (see snapshotRemoteWriters)
+	ring            *ringBuffer              // most recent entries (nil if Config.RingBufferSize is 0)
 
 	// gRPC-related
 	gRPC        *logrpc.RemoteLoggerClient // gRPC client
 	gRPCTimeout time.Duration              // gRPC timeout duration
 }
 
+// RecentEntries returns the most recent entries (oldest first) retained in
+// memory (see Config.RingBufferSize)
+func (l *logger) RecentEntries() []LogRecord {
+	if l.ring == nil {
+		return []LogRecord{}
+	}
+	return l.ring.recent()
+}
+
 // UseCustomCodes Replaces loggers default message codes with custom ones
 func (l *logger) UseCustomCodes(codes map[int]Code) {
 	for code, lCode := range codes {
@@ -110,30 +382,164 @@ func (l *logger) UseCustomCodes(codes map[int]Code) {
 	}
 }
 
-// Log logs a simple message and returns nil or error, depending on the code
+// Log logs a simple message and returns nil or error, depending on the code.
+// With Config.QuietErrors Log always returns nil.
 func (l *logger) Log(caller string, code int, msg string, format ...interface{}) error {
-	return l.pushToLedger(2, caller, code, msg, format...)
+	return l.quiet(l.pushToLedger(context.Background(), 2, caller, code, msg, format...))
+}
+
+// LogCtx logs a simple message like Log and adds the trace and span IDs
+// of the context's OpenTelemetry span (columns COL_TRACE_ID and COL_SPAN_ID).
+// An empty caller is taken from the context (see ContextWithCaller).
+// If the ledger is full, the entry is dropped once the context is done.
+func (l *logger) LogCtx(ctx context.Context, caller string, code int, msg string, format ...interface{}) error {
+	return l.quiet(l.pushToLedger(ctx, 2, caller, code, msg, format...))
+}
+
+// LogContext is an alias of LogCtx (the entry is pushed directly, so that the
+// file and line are those of the caller)
+func (l *logger) LogContext(ctx context.Context, caller string, code int, msg string, format ...interface{}) error {
+	return l.quiet(l.pushToLedger(ctx, 2, caller, code, msg, format...))
+}
+
+// TryLog logs a simple message like Log, but never blocks: if the ledger is
+// full (or the logger has quit) the entry is dropped and TryLog returns false
+func (l *logger) TryLog(caller string, code int, msg string, format ...interface{}) bool {
+
+	// Format message
+	fmsg := msg
+	if len(format) > 0 {
+		fmsg = fmt.Sprintf(msg, format...)
+	}
+
+	return l.tryPush(3, caller, code, fmsg)
+}
+
+// tryPush pushes a log entry into the ledger without blocking
+func (l *logger) tryPush(depth int, caller string, code int, fmsg string) bool {
+
+	if !l.admit() {
+		atomic.AddInt64(&l.dropped, 1)
+		return false
+	}
+
+	entry, _ := l.buildEntry(context.Background(), depth, caller, code, fmsg, "N/A")
+
+	select {
+	case l.ledger <- entry:
+		return true
+	default:
+		releaseEntry(entry)
+		atomic.AddInt64(&l.dropped, 1)
+		l.wg.Done()
+		return false
+	}
+}
+
+// Dropped returns the number of entries dropped because the ledger was full
+func (l *logger) Dropped() int64 {
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// Truncated returns the number of messages truncated to Config.MaxMessageBytes
+func (l *logger) Truncated() int64 {
+	return atomic.LoadInt64(&l.truncated)
+}
+
+// LogErr logs a simple message and returns the formatted message as an error
+// if the code is an error code, regardless of Config.QuietErrors
+func (l *logger) LogErr(caller string, code int, msg string, format ...interface{}) error {
+	return l.pushToLedger(context.Background(), 2, caller, code, msg, format...)
 }
 
 // LogFields encodes the message (not the whole log) in JSON and writes to log
 func (l *logger) LogFields(caller string, code int, msg map[string]interface{}) error {
+	return l.quiet(l.logFields(context.Background(), 3, caller, code, msg))
+}
+
+// LogFieldsCtx is the context-aware variant of LogFields (see LogCtx)
+func (l *logger) LogFieldsCtx(ctx context.Context, caller string, code int, msg map[string]interface{}) error {
+	return l.quiet(l.logFields(ctx, 3, caller, code, msg))
+}
+
+// logFields encodes the message in JSON and pushes it to the ledger
+func (l *logger) logFields(ctx context.Context, depth int, caller string, code int, msg map[string]interface{}) error {
 	jsoned, err := json.Marshal(msg)
 	if err != nil {
-		return l.pushToLedger(2, "system", 1, "LogFields: could not marshal log entry to JSON: %s", err.Error())
+		return l.pushToLedger(ctx, depth, "system", 1, "LogFields: could not marshal log entry to JSON: %s", err.Error())
+	}
+
+	return l.pushToLedger(ctx, depth, caller, code, string(jsoned))
+}
+
+// Logf logs a message built from a template with {name} placeholders that are
+// substituted from fields. The fields are also kept as structured data: JSON
+// logfiles get them as separate keys and column COL_FIELDS contains them encoded.
+// If the fields cannot be encoded, COL_FIELDS contains the error instead.
+func (l *logger) Logf(caller string, code int, template string, fields map[string]interface{}) error {
+	return l.quiet(l.push(context.Background(), 2, caller, code, fillTemplate(template, fields), marshalFields(fields)))
+}
+
+// LogAt logs a message as it is (no placeholders or format verbs) together with
+// structured fields (see Logf). The file and line are given explicitly, which
+// lets adapters of other logging libraries keep the location of the original
+// call. Fields that cannot be encoded in JSON are kept as strings (fmt.Sprint).
+func (l *logger) LogAt(caller string, code int, file string, line int, msg string, fields map[string]interface{}) error {
+	return l.quiet(l.pushAt(caller, code, file, line, msg, encodeFields(fields)))
+}
+
+// Recover is meant to be deferred: it recovers from a panic and logs the panic
+// value and the stack trace as an error (code 1). The stack trace is a separate
+// key in JSON logfiles and is appended to the message otherwise.
+func (l *logger) Recover(caller string) {
+	if r := recover(); r != nil {
+		l.logPanic(caller, r)
+	}
+}
+
+// RecoverAndRepanic is like Recover, but panics again once the panic has been
+// logged (and written)
+func (l *logger) RecoverAndRepanic(caller string) {
+	if r := recover(); r != nil {
+		l.logPanic(caller, r)
+		l.wg.Wait()
+		panic(r)
+	}
+}
+
+// logPanic logs a recovered panic along with the stack trace
+func (l *logger) logPanic(caller string, r interface{}) {
+	stack := string(debug.Stack())
+	jsoned, err := json.Marshal(map[string]interface{}{"panic": fmt.Sprint(r), "stack": stack})
+	if err != nil {
+		jsoned = []byte("N/A")
 	}
 
-	return l.pushToLedger(2, caller, code, string(jsoned))
+	fmsg := fmt.Sprintf("recovered from panic: %v", r)
+	if l.config.Format == FORMAT_TSV {
+		fmsg = fmt.Sprintf("%s %s", fmsg, stack)
+	}
+
+	l.push(context.Background(), 4, caller, 1, fmsg, string(jsoned))
 }
 
 // NewCaller is a wrapper for the Logger.Log function
 func (l *logger) NewCaller(caller string) func(int, string, ...interface{}) error {
 
 	return func(code int, msg string, format ...interface{}) error {
-		return l.pushToLedger(2, caller, code, msg, format...)
+		return l.quiet(l.pushToLedger(context.Background(), 2, caller, code, msg, format...))
 	}
 
 }
 
+// quiet suppresses the error if the logger is configured with QuietErrors
+func (l *logger) quiet(err error) error {
+	if l.config.QuietErrors {
+		return nil
+	}
+	return err
+}
+
 // NewCallerWithFields is a wrapper for the Logger.LogFields function
 func (l *logger) NewCallerWithFields(caller string) func(int, map[string]interface{}) error {
 
@@ -143,23 +549,72 @@ func (l *logger) NewCallerWithFields(caller string) func(int, map[string]interfa
 
 }
 
+// ValidateRawEntry verifies that a raw log entry contains all the columns
+// required by Logger.RawEntry (the default columns)
+func ValidateRawEntry(entry map[int64]string) error {
+	for _, code := range defaultCols {
+		if _, ok := entry[code]; !ok {
+			return fmt.Errorf("missing column '%d' (%s)", code, colname(code))
+		}
+	}
+	return nil
+}
+
+// ValidateRawColumns is ValidateRawEntry for the columns of a raw log entry
+// given as parallel arrays (see Logger.RawColumns)
+func ValidateRawColumns(columns []int64) error {
+	for _, code := range defaultCols {
+		found := false
+		for _, col := range columns {
+			if col == code {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("missing column '%d' (%s)", code, colname(code))
+		}
+	}
+	return nil
+}
+
+// RawColumns writes a raw log entry given as parallel arrays of columns and
+// values (e.g. logrpc.CompactLogEntry) into the ledger without building a map.
+// The columns must be the same as for RawEntry.
+func (l *logger) RawColumns(columns []int64, values []string) error {
+
+	// Validate the raw Entry
+	if len(columns) != len(values) {
+		return fmt.Errorf("RawColumns: got %d columns, but %d values", len(columns), len(values))
+	}
+	if err := ValidateRawColumns(columns); err != nil {
+		return fmt.Errorf("RawColumns: %s", err.Error())
+	}
+
+	// Write the entry into the ledger (oversized messages are truncated)
+	if l.admit() {
+		raw := entryFromColumns(columns, values)
+		l.limitMessage(raw)
+		l.enqueue(context.Background(), raw)
+	}
+
+	return nil
+}
+
 // RawEntry writes a raw log entry (map of strings) into the ledger.
 // The raw entry must contain columns COL_DATE_YYMMDD_HHMMSS_NANO to COL_LINE
 func (l *logger) RawEntry(entry map[int64]string) error {
 
 	// Validate the raw Entry
-	for _, code := range defaultCols {
-		if _, ok := entry[code]; !ok {
-			return fmt.Errorf("RawEntry: missing column '%d'", code)
-		}
+	if err := ValidateRawEntry(entry); err != nil {
+		return fmt.Errorf("RawEntry: %s", err.Error())
 	}
 
-	// Write the entry into the ledger
-	if l.active {
-		l.wg.Add(1)
-		go func() {
-			l.ledger <- entry
-		}()
+	// Write the entry into the ledger (oversized messages are truncated)
+	if l.admit() {
+		raw := entryFromMap(entry)
+		l.limitMessage(raw)
+		l.enqueue(context.Background(), raw)
 	}
 
 	return nil
@@ -175,6 +630,8 @@ func (l *logger) AddDestination(name string, writer io.Writer) error {
 	}
 
 	l.remoteWriters[name] = writer
+	l.remoteStats[name] = &destCounters{threshold: l.config.BreakerThreshold, cooldown: l.config.BreakerCooldown}
+	l.snapshotRemoteWriters()
 
 	return nil
 }
@@ -189,10 +646,25 @@ func (l *logger) RemoveDestination(name string) error {
 	}
 
 	delete(l.remoteWriters, name)
+	delete(l.remoteStats, name)
+	l.snapshotRemoteWriters()
 
 	return nil
 }
 
+// snapshotRemoteWriters replaces the snapshot of the remote writers (sorted by
+// name) used by the write loop. Snapshots are never modified, i.e. the write
+// loop can use one without holding the lock.
+func (l *logger) snapshotRemoteWriters() {
+	snapshot := make([]namedWriter, 0, len(l.remoteWriters))
+	for name, writer := range l.remoteWriters {
+		snapshot = append(snapshot, namedWriter{name, writer, l.remoteStats[name]})
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].name < snapshot[j].name })
+
+	l.remoteSnapshot = snapshot
+}
+
 // ListDestinations lists all (remote) destinations
 func (l *logger) ListDestinations() []string {
 	l.mu.Lock()
@@ -200,13 +672,14 @@ func (l *logger) ListDestinations() []string {
 
 	var localDst []string
 
-	switch l.config.Out {
-	case OUT_STDOUT:
-		localDst = []string{"stdout"}
-	case OUT_FILE:
-		localDst = []string{l.logfile.Name()}
-	case OUT_FILE_AND_STDOUT:
-		localDst = []string{"stdout", l.logfile.Name()}
+	if l.stdout != nil {
+		localDst = append(localDst, "stdout")
+	}
+	if l.logfile != nil {
+		localDst = append(localDst, l.logfile.Name())
+	}
+	if l.errfile != nil {
+		localDst = append(localDst, l.errfile.Name())
 	}
 
 	remoteDst := make([]string, len(l.remoteWriters))
@@ -220,25 +693,240 @@ func (l *logger) ListDestinations() []string {
 	return append(localDst, remoteDst...)
 }
 
+// DestinationStats returns the write metrics of the (remote) destinations
+func (l *logger) DestinationStats() map[string]DestStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := make(map[string]DestStats, len(l.remoteStats))
+	for name, counters := range l.remoteStats {
+		counters.Lock()
+		stats[name] = counters.DestStats
+		counters.Unlock()
+	}
+
+	return stats
+}
+
+// CurrentLogfile returns the path of the active logfile, or false if the
+// logger does not write to a file
+func (l *logger) CurrentLogfile() (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.logfile == nil {
+		return "", false
+	}
+
+	return l.logfile.Name(), true
+}
+
+// Reconfigure changes the logger's local outputs at runtime without losing
+// buffered entries (entries still waiting in the ledger are written to the new
+// outputs). The following fields of config are hot-reloadable: Out, Rotation,
+// Compress, Folder and Filename (the latter two reopen the logfile).
+// All the other fields are ignored. A pre-opened Config.File is kept as it is,
+// i.e. only the output mode can be changed.
+func (l *logger) Reconfigure(config Config) error {
+	l.reconfigure.Lock()
+	defer l.reconfigure.Unlock()
+
+	l.state.RLock()
+	active := l.active
+	l.state.RUnlock()
+
+	if !active {
+		return fmt.Errorf("Reconfigure: logger has been stopped")
+	}
+
+	// Validate the resulting configuration
+	l.mu.Lock()
+	merged := *l.config
+	l.mu.Unlock()
+
+	merged.Out = config.Out
+	if merged.File == nil {
+		merged.Rotation = config.Rotation
+		if merged.Rotation == 0 {
+			merged.Rotation = ROT_DAILY
+		}
+		merged.Compress = config.Compress
+		merged.Folder = config.Folder
+		merged.Filename = config.Filename
+	}
+
+	if err := ValidateConfig(&merged); err != nil {
+		return fmt.Errorf("Reconfigure: invalid configuration: %s", err.Error())
+	}
+
+	// Stop the rotation of the current logfile (and wait for its compressions,
+	// which use the current folder)
+	if l.stopRotation != nil {
+		l.stopRotation()
+		l.stopRotation = nil
+	}
+	l.compressions.Wait()
+
+	// Replace the local writers (entries wait in the ledger meanwhile). The new
+	// logfile is opened before the active one is closed, so that a failure
+	// leaves the logger as it was.
+	l.mu.Lock()
+	previous := *l.config
+	rotating := l.config.File == nil && l.logfile != nil
+
+	l.config.Out = merged.Out
+	if l.config.File == nil {
+		l.config.Rotation = merged.Rotation
+		l.config.Compress = merged.Compress
+		l.config.Folder = merged.Folder
+		l.config.Filename = merged.Filename
+	}
+
+	var err error
+	current := l.logfileDate()
+	switch {
+	case l.config.File != nil:
+	case l.config.Out == OUT_STDOUT:
+		l.closeLogfile()
+	default:
+		err = l.openLogfileLocked(current)
+	}
+
+	if err != nil {
+		l.config.Out = previous.Out
+		l.config.Rotation = previous.Rotation
+		l.config.Compress = previous.Compress
+		l.config.Folder = previous.Folder
+		l.config.Filename = previous.Filename
+		current = l.logfileDate()
+	} else {
+		l.openConsole()
+		rotating = l.config.File == nil && l.logfile != nil
+	}
+	l.mu.Unlock()
+
+	// Resume the rotation (of the previous logfile if the new one could not be opened)
+	if rotating {
+		l.startRotation(l.ctx, current)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Reconfigure: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Rotate archives the current logfile (and error logfile) and opens a fresh one
+// regardless of the rotation schedule. The archive keeps the logfile's name with
+// a sequence number (e.g. filename_2017-10-22.1.log) and is compressed in the
+// background if Config.Compress is set. The scheduled rotation is paused meanwhile.
+func (l *logger) Rotate() error {
+	l.reconfigure.Lock()
+	defer l.reconfigure.Unlock()
+
+	l.state.RLock()
+	active := l.active
+	l.state.RUnlock()
+
+	if !active {
+		return fmt.Errorf("Rotate: logger has been stopped")
+	}
+
+	// Stop the scheduled rotation (prevents rotating twice)
+	if l.stopRotation != nil {
+		l.stopRotation()
+		l.stopRotation = nil
+	}
+
+	// Replace the logfiles (entries wait in the ledger meanwhile)
+	l.mu.Lock()
+	if l.config.File != nil || l.logfile == nil {
+		l.mu.Unlock()
+		return fmt.Errorf("Rotate: there is no logfile to rotate")
+	}
+
+	current := l.logfileDate()
+	rotated := []string{l.logfile.Name()}
+	if l.errfile != nil {
+		rotated = append(rotated, l.errfile.Name())
+	}
+	l.closeLogfile()
+
+	var archives []string
+	var errArchive error
+	for _, filename := range rotated {
+		archive, err := archiveLogfile(filename, filename == l.logfilePath(current) || filename == l.errfilePath(current))
+		if err != nil {
+			errArchive = err
+			continue
+		}
+		archives = append(archives, archive)
+	}
+
+	err := l.openLogfileLocked(current)
+	l.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("Rotate: %s", err.Error())
+	}
+	l.startRotation(l.ctx, current)
+
+	// Compress the archives, then prune old archives if the logfiles take up
+	// too much space (in the background, like the scheduled rotation)
+	var old []string
+	if l.config.Compress {
+		for _, archive := range archives {
+			old = append(old, strings.TrimSuffix(path.Base(archive), ".log"))
+		}
+	}
+	l.compressAsync(current, old...)
+
+	if errArchive != nil {
+		return fmt.Errorf("Rotate: could not archive logfile: %s", errArchive.Error())
+	}
+
+	return nil
+}
+
 // Quit stops all Logger coroutines and closes files
 func (l *logger) Quit() {
 
-	// Deactivate ledger
+	// Deactivate ledger (entries admitted before are waited for below)
+	l.state.Lock()
 	l.active = false
+	l.state.Unlock()
+
+	// Wait for the rotation coroutine to exit and the rotated logfiles to be compressed
+	l.reconfigure.Lock()
+	if l.stopRotation != nil {
+		l.stopRotation()
+		l.stopRotation = nil
+	}
+	l.compressions.Wait()
+	l.reconfigure.Unlock()
 
 	// Wait for the ledger processing to finish
 	l.wg.Wait()
 
 	// Lock any writing or file rotation activity
 	l.mu.Lock()
-	defer l.mu.Unlock()
 
 	// Stop all registered goroutines
 	l.cancel()
+	<-l.writerDone
 
-	// Close active log
-	if l.logfile != nil {
-		l.logfile.Close()
-	}
+	// Close active logs
+	l.closeLogfile()
+	l.mu.Unlock()
+
+	// Signal the shutdown (see Done)
+	l.doneOnce.Do(func() { close(l.done) })
+
+}
 
+// Done returns a channel that is closed once Quit has stopped all the logger's
+// goroutines (ledger drained, files closed)
+func (l *logger) Done() <-chan struct{} {
+	return l.done
 }
@@ -0,0 +1,1624 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// brokenWriter is a writer that starts failing once it is closed
+type brokenWriter struct {
+	mu       sync.Mutex
+	closed   bool
+	writes   int
+	attempts int
+}
+
+func (b *brokenWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		b.attempts++
+		return 0, fmt.Errorf("broken pipe")
+	}
+	b.writes++
+	return len(p), nil
+}
+
+func (b *brokenWriter) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+}
+
+func (b *brokenWriter) counts() (writes, attempts int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writes, b.attempts
+}
+
+// syncBuffer is a buffer that can be read while the logger writes to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+// waitFor waits up to a second for the condition to become true
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for the logger")
+}
+
+// logfileName returns the name of today's logfile
+func logfileName(folder, filename string) string {
+	return path.Join(folder, fmt.Sprintf("%s_%s.log", filename, time.Now().Format("2006-01-02")))
+}
+
+func TestJSONArrayLifecycle(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	config := &Config{
+		Service:  "MyService",
+		Instance: "MyInstance",
+		Folder:   tempdir,
+		Filename: "myservice",
+		Rotation: ROT_DAILY,
+		Out:      OUT_FILE,
+		Format:   FORMAT_JSON_ARRAY,
+	}
+
+	// Open, append and close
+	logger, err := New(config)
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	logger.Log("test", 0, "first")
+	logger.Log("test", 0, "second")
+	logger.Quit()
+
+	var entries []map[string]string
+	contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		t.Fatalf("Logfile is not a valid JSON array: %s\n%s", err.Error(), contents)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+
+	// Reopen the same logfile and append
+	logger, err = New(config)
+	if err != nil {
+		t.Fatalf("Could not restart logger: %s", err.Error())
+	}
+	logger.Log("test", 0, "third")
+	logger.Quit()
+
+	entries = nil
+	contents, _ = ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		t.Fatalf("Reopened logfile is not a valid JSON array: %s\n%s", err.Error(), contents)
+	}
+	if len(entries) != 3 || entries[2]["Message"] != "third" {
+		t.Errorf("Unexpected entries after reopening: %v", entries)
+	}
+}
+
+func TestJSONArrayEmpty(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	logger, err := New(&Config{
+		Folder:   tempdir,
+		Filename: "myservice",
+		Rotation: ROT_DAILY,
+		Out:      OUT_FILE,
+		Format:   FORMAT_JSON_ARRAY,
+	})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	logger.Quit()
+
+	var entries []map[string]string
+	contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	if err := json.Unmarshal(contents, &entries); err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty JSON array, got: %s", contents)
+	}
+}
+
+func TestQuietErrors(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	for _, quiet := range []bool{false, true} {
+		logger, err := New(&Config{Folder: tempdir, Filename: "myservice", Out: OUT_FILE, QuietErrors: quiet})
+		if err != nil {
+			t.Fatalf("Could not start logger: %s", err.Error())
+		}
+
+		if err := logger.Log("test", 0, "notification"); err != nil {
+			t.Errorf("Log returned an error for a notification (quiet: %t)", quiet)
+		}
+		if err := logger.Log("test", 404, "not found"); (err != nil) == quiet {
+			t.Errorf("Log returned unexpected error value '%v' (quiet: %t)", err, quiet)
+		}
+		if err := logger.LogErr("test", 404, "not %s", "found"); err == nil || err.Error() != "not found" {
+			t.Errorf("LogErr returned unexpected error value '%v' (quiet: %t)", err, quiet)
+		}
+
+		logger.Quit()
+	}
+}
+
+func TestCurrentLogfile(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", Rotation: ROT_DAILY, Out: OUT_FILE})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	defer l.Quit()
+
+	if current, ok := l.CurrentLogfile(); !ok || current != logfileName(tempdir, "myservice") {
+		t.Errorf("Unexpected logfile '%s' (ok: %t)", current, ok)
+	}
+
+	// Rotate
+	if err := l.(*logger).openLogfile("2000-01-01"); err != nil {
+		t.Fatalf("Could not rotate logfile: %s", err.Error())
+	}
+
+	if current, ok := l.CurrentLogfile(); !ok || current != path.Join(tempdir, "myservice_2000-01-01.log") {
+		t.Errorf("Logfile did not change after rotation: '%s' (ok: %t)", current, ok)
+	}
+}
+
+func TestErrorsToStderr(t *testing.T) {
+
+	stdout := bytes.NewBuffer([]byte{})
+	stderr := bytes.NewBuffer([]byte{})
+
+	logger, err := New(&Config{Out: OUT_STDOUT, ErrorsToStderr: true, StdoutWriter: stdout, StderrWriter: stderr})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	logger.Log("test", 0, "notification")
+	logger.Log("test", 1, "error")
+	logger.Quit()
+
+	if out := stdout.String(); !strings.Contains(out, "notification") || strings.Contains(out, "error") {
+		t.Errorf("Unexpected stdout contents: %s", out)
+	}
+	if errOut := stderr.String(); !strings.Contains(errOut, "error") || strings.Contains(errOut, "notification") {
+		t.Errorf("Unexpected stderr contents: %s", errOut)
+	}
+}
+
+func TestStdoutWriter(t *testing.T) {
+
+	stdout := bytes.NewBuffer([]byte{})
+
+	logger, err := New(&Config{
+		Service:      "MyService",
+		Instance:     "MyInstance",
+		Out:          OUT_STDOUT,
+		Columns:      []int64{COL_SERVICE, COL_INSTANCE, COL_CALLER, COL_MSG_TYPE_SHORT, COL_MSG},
+		StdoutWriter: stdout,
+	})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	logger.Log("test", 0, "Hello, %s!", "World")
+	logger.Quit()
+
+	if out := stdout.String(); out != "MyService\tMyInstance\ttest\tMSG\tHello, World!\t\n" {
+		t.Errorf("Unexpected stdout contents: %q", out)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	invalid := []*Config{
+		nil,
+		{Out: OUT_STDOUT, Rotation: ROT_NONE + 1},
+		{Out: OUT_FILE_AND_STDOUT + 1},
+		{Out: OUT_STDOUT, Format: FORMAT_CEF + 1},
+		{Out: OUT_STDOUT, Columns: []int64{COL_METADATA + 1}},
+		{Out: OUT_FILE, Folder: path.Join(tempdir, "missing")},
+		{Out: OUT_STDOUT, MaxMessageBytes: len(truncationMarker) - 1},
+		{Out: OUT_FILE, Folder: tempdir, ErrorFile: "../errors"},
+	}
+	for i, config := range invalid {
+		if err := ValidateConfig(config); err == nil {
+			t.Errorf("Invalid config #%d passed validation", i)
+		}
+	}
+
+	config := &Config{Out: OUT_FILE, Folder: tempdir}
+	if err := ValidateConfig(config); err != nil {
+		t.Errorf("Valid config failed validation: %s", err.Error())
+	}
+	if config.Columns != nil {
+		t.Errorf("ValidateConfig modified the config")
+	}
+}
+
+func TestPreopenedFile(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	f, err := os.OpenFile(path.Join(tempdir, "supervised.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Could not open logfile: %s", err.Error())
+	}
+
+	logger, err := New(&Config{Out: OUT_FILE, Rotation: ROT_DAILY, Format: FORMAT_JSON, File: f})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	if current, _ := logger.CurrentLogfile(); current != f.Name() {
+		t.Errorf("Logger is not using the provided file: %s", current)
+	}
+
+	logger.Log("test", 0, "supervised")
+	logger.Quit()
+
+	contents, _ := ioutil.ReadFile(f.Name())
+	if !strings.Contains(string(contents), "supervised") {
+		t.Errorf("Entry has not been written to the provided file: %s", contents)
+	}
+
+	files, _ := ioutil.ReadDir(tempdir)
+	if len(files) != 1 {
+		t.Errorf("Logger created additional files")
+	}
+}
+
+func TestBrokenStdout(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	stdout := &brokenWriter{}
+	logger, err := New(&Config{Folder: tempdir, Filename: "myservice", Out: OUT_FILE_AND_STDOUT, Format: FORMAT_JSON, StdoutWriter: stdout})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	// Wait for the first entry to reach stdout and break it
+	logger.Log("test", 0, "before")
+	for i := 0; i < 100; i++ {
+		if writes, _ := stdout.counts(); writes > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stdout.Close()
+
+	for i := 0; i < 10; i++ {
+		logger.Log("test", 0, "after %d", i)
+	}
+	logger.Quit()
+
+	if _, attempts := stdout.counts(); attempts != maxConsoleFailures {
+		t.Errorf("Expected %d attempts to write to a broken stdout, got %d", maxConsoleFailures, attempts)
+	}
+
+	contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	if !strings.Contains(string(contents), "after 9") || !strings.Contains(string(contents), "stopped writing to stdout") {
+		t.Errorf("Logfile is missing entries: %s", contents)
+	}
+	for _, dst := range logger.ListDestinations() {
+		if dst == "stdout" {
+			t.Errorf("Broken stdout is still listed as a destination")
+		}
+	}
+}
+
+func TestRawEntryOwnership(t *testing.T) {
+
+	stdout := bytes.NewBuffer([]byte{})
+	logger, err := New(&Config{Out: OUT_STDOUT, Columns: []int64{COL_MSG}, StdoutWriter: stdout})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	entry := map[int64]string{}
+	for col := int64(COL_DATE_YYMMDD); col <= COL_LINE; col++ {
+		entry[col] = "N/A"
+	}
+	entry[COL_MSG] = "raw"
+	if err := logger.RawEntry(entry); err != nil {
+		t.Fatalf("Could not write raw entry: %s", err.Error())
+	}
+	logger.Log("test", 0, "pooled")
+	logger.Quit()
+
+	if len(entry) != COL_LINE+1 || entry[COL_MSG] != "raw" {
+		t.Errorf("RawEntry modified the caller's entry: %v", entry)
+	}
+	if out := stdout.String(); out != "raw\t\npooled\t\n" {
+		t.Errorf("Unexpected stdout contents: %q", out)
+	}
+}
+
+// Measures allocations of the Log hot path (without and with formatting)
+func BenchmarkLog(b *testing.B) {
+
+	logger, err := New(&Config{Out: OUT_STDOUT, StdoutWriter: ioutil.Discard})
+	if err != nil {
+		b.Fatalf("Could not start logger: %s", err.Error())
+	}
+	defer logger.Quit()
+
+	b.Run("plain", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			logger.Log("bench", 0, "plain message")
+		}
+	})
+
+	b.Run("formatted", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			logger.Log("bench", 0, "formatted message #%d", i)
+		}
+	})
+}
+
+// Measures building and formatting a single log entry
+func BenchmarkRawEntry(b *testing.B) {
+
+	l := &logger{config: &Config{Service: "bench", Instance: "bench", Columns: defaultCols}, codes: defaultCodes}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		entry := l.newRawEntry("bench", "MSG", "message", "file.go", 1, 0, false)
+		entry.toStr(l.config.Columns)
+		releaseEntry(entry)
+	}
+}
+
+func TestLogCtx(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{
+		Folder:   tempdir,
+		Filename: "myservice",
+		Out:      OUT_FILE,
+		Format:   FORMAT_JSON,
+		Columns:  []int64{COL_MSG, COL_TRACE_ID, COL_SPAN_ID, COL_FILE},
+	})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	span := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		SpanID:  trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+	})
+	l.LogCtx(trace.ContextWithSpanContext(context.Background(), span), "test", 0, "traced")
+	l.LogCtx(context.Background(), "test", 0, "untraced")
+	l.LogContext(trace.ContextWithSpanContext(context.Background(), span), "test", 0, "alias")
+	l.Quit()
+
+	contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 entries, got: %s", contents)
+	}
+
+	expected := []map[string]string{
+		{"Message": "traced", "TraceID": "0102030405060708090a0b0c0d0e0f10", "SpanID": "0102030405060708", "File": "journal_test.go"},
+		{"Message": "untraced", "TraceID": "N/A", "SpanID": "N/A", "File": "journal_test.go"},
+		{"Message": "alias", "TraceID": "0102030405060708090a0b0c0d0e0f10", "SpanID": "0102030405060708", "File": "journal_test.go"},
+	}
+	for i, line := range lines {
+		entry := map[string]string{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Could not unmarshal entry: %s", err.Error())
+		}
+		entry["File"] = path.Base(entry["File"])
+		for key, value := range expected[i] {
+			if entry[key] != value {
+				t.Errorf("Unexpected %s in entry #%d: '%s'", key, i, entry[key])
+			}
+		}
+	}
+}
+
+func TestLogCtxCancelledUnderBackpressure(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", Out: OUT_FILE, Columns: []int64{COL_MSG}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	lg := l.(*logger)
+
+	// Stall the writer and fill up the ledger
+	lg.mu.Lock()
+	for i := 0; i <= cap(lg.ledger); i++ {
+		l.LogFieldsCtx(context.Background(), "test", 0, map[string]interface{}{"i": i})
+	}
+	waitFor(t, func() bool { return len(lg.ledger) == cap(lg.ledger) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.LogCtx(ctx, "test", 0, "cancelled")
+	l.LogCtx(context.Background(), "test", 0, "kept")
+	time.Sleep(50 * time.Millisecond)
+	lg.mu.Unlock()
+	l.Quit()
+
+	contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	if strings.Contains(string(contents), "cancelled") {
+		t.Errorf("Entry of a cancelled context has been written")
+	}
+	if !strings.Contains(string(contents), "kept") {
+		t.Errorf("Entry of a background context has been dropped")
+	}
+	if lines := strings.Count(string(contents), "\n") - 1; lines != cap(lg.ledger)+2 {
+		t.Errorf("Expected %d entries (and headers), got %d", cap(lg.ledger)+2, lines)
+	}
+}
+
+func TestLogf(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{
+		Folder:   tempdir,
+		Filename: "myservice",
+		Out:      OUT_FILE,
+		Format:   FORMAT_JSON,
+		Columns:  []int64{COL_CALLER, COL_MSG},
+	})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	l.Logf("test", 0, "User {user} logged in {count} times ({missing})", map[string]interface{}{
+		"user":    "alice",
+		"count":   3,
+		"Message": "clash",
+	})
+	l.Quit()
+
+	contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		t.Fatalf("Could not unmarshal entry: %s", err.Error())
+	}
+
+	// Columns take precedence over fields of the same name
+	if entry["Message"] != "User alice logged in 3 times ({missing})" {
+		t.Errorf("Unexpected message: %v", entry["Message"])
+	}
+	if entry["user"] != "alice" || entry["count"] != float64(3) || entry["Caller"] != "test" {
+		t.Errorf("Fields have not been emitted: %s", contents)
+	}
+}
+
+func TestLogfUnencodableFields(t *testing.T) {
+	stdout := &syncBuffer{}
+	l, err := New(&Config{Out: OUT_STDOUT, StdoutWriter: stdout, Columns: []int64{COL_CALLER, COL_MSG, COL_FIELDS}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	l.Logf("test", 0, "done {user}", map[string]interface{}{"user": "alice", "done": make(chan bool)})
+	l.WithPrefix("[db] ").Logf("test", 0, "done", map[string]interface{}{"done": make(chan bool)})
+	l.Quit()
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "test\tdone alice\t{\"FieldsError\":") || !strings.HasPrefix(lines[1], "test\t[db] done\t{\"FieldsError\":") {
+		t.Errorf("Unexpected entries:\n%s", stdout.String())
+	}
+}
+
+func TestAutoCaller(t *testing.T) {
+	stdout := &syncBuffer{}
+	l, err := New(&Config{Out: OUT_STDOUT, StdoutWriter: stdout, AutoCaller: true, Columns: []int64{COL_CALLER, COL_MSG}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	l.Log("", 0, "derived")
+	l.NewCaller("")(0, "derived via wrapper")
+	l.Log("explicit", 0, "kept")
+	l.Quit()
+
+	expected := "journal.TestAutoCaller\tderived\t\n" +
+		"journal.TestAutoCaller\tderived via wrapper\t\n" +
+		"explicit\tkept\t\n"
+	if stdout.String() != expected {
+		t.Errorf("Unexpected callers:\n%s", stdout.String())
+	}
+}
+
+func TestRotNoneStableFile(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	if next := rotationDate(ROT_NONE, 1, time.Now()); next != "" {
+		t.Errorf("ROT_NONE has a rotation date: %s", next)
+	}
+
+	// The same logfile is reused across restarts
+	for _, msg := range []string{"first", "second"} {
+		l, err := New(&Config{Folder: tempdir, Filename: "myservice", Rotation: ROT_NONE, Out: OUT_FILE, Compress: true, Columns: []int64{COL_MSG}})
+		if err != nil {
+			t.Fatalf("Could not start logger: %s", err.Error())
+		}
+		if current, _ := l.CurrentLogfile(); current != path.Join(tempdir, "myservice.log") {
+			t.Errorf("Unexpected logfile: %s", current)
+		}
+		l.Log("test", 0, msg)
+		l.Quit()
+	}
+
+	files, _ := ioutil.ReadDir(tempdir)
+	if len(files) != 1 {
+		t.Fatalf("Expected a single logfile, got %d files", len(files))
+	}
+	contents, _ := ioutil.ReadFile(path.Join(tempdir, "myservice.log"))
+	if string(contents) != "Message\nfirst\t\nsecond\t\n" {
+		t.Errorf("Unexpected logfile contents: %q", contents)
+	}
+}
+
+func TestRotationCoroutine(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	// No coroutine is started for ROT_NONE
+	l, err := New(&Config{Folder: tempdir, Filename: "none", Rotation: ROT_NONE, Out: OUT_FILE})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	if l.(*logger).stopRotation != nil {
+		t.Errorf("Rotation coroutine started for ROT_NONE")
+	}
+	l.Quit()
+
+	// Quit waits for the coroutine to exit
+	l, err = New(&Config{Folder: tempdir, Filename: "daily", Rotation: ROT_DAILY, Out: OUT_FILE})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	if l.(*logger).stopRotation == nil {
+		t.Fatalf("Rotation coroutine has not been started for ROT_DAILY")
+	}
+	l.Quit()
+	if l.(*logger).stopRotation != nil {
+		t.Errorf("Rotation coroutine has not been stopped on Quit")
+	}
+}
+
+// fakeClock is a manually advanced clock
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+// Now returns the current fake time
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// Set sets the current fake time
+func (c *fakeClock) Set(now time.Time) {
+	c.Lock()
+	c.now = now
+	c.Unlock()
+}
+
+func TestRotationAtBoundary(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", ErrorFile: "errors", Rotation: ROT_DAILY, Out: OUT_FILE})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	defer l.Quit()
+
+	// Restart the rotation shortly before midnight
+	lg := l.(*logger)
+	clock := &fakeClock{now: time.Date(2017, 3, 4, 23, 59, 59, 950000000, time.Local)}
+	lg.stopRotation()
+	lg.clock = clock.Now
+	lg.startRotation(lg.ctx, "2017-03-04")
+
+	// No rotation before the boundary
+	time.Sleep(120 * time.Millisecond)
+	if current, _ := l.CurrentLogfile(); current == path.Join(tempdir, "myservice_2017-03-05.log") {
+		t.Fatalf("Logfile has been rotated before the boundary")
+	}
+
+	clock.Set(time.Date(2017, 3, 5, 0, 0, 0, 0, time.Local))
+	waitFor(t, func() bool {
+		current, _ := l.CurrentLogfile()
+		return current == path.Join(tempdir, "myservice_2017-03-05.log")
+	})
+
+	// The error logfile rotates along
+	if _, err := os.Stat(path.Join(tempdir, "errors_2017-03-05.log")); err != nil {
+		t.Errorf("Error logfile has not been rotated")
+	}
+}
+
+func TestRotationIntoSamePeriod(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", Rotation: ROT_DAILY, Out: OUT_FILE, Columns: []int64{COL_MSG}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	lg := l.(*logger)
+	clock := &fakeClock{}
+	lg.stopRotation()
+	lg.clock = clock.Now
+
+	// Rotate into the same day twice (the clock is set back in between)
+	logfile := path.Join(tempdir, "myservice_2017-03-05.log")
+	archive := path.Join(tempdir, "myservice_2017-03-05.1.log")
+	for i, msg := range []string{"first", "second"} {
+		clock.Set(time.Date(2017, 3, 4, 23, 59, 59, 950000000, time.Local))
+		lg.startRotation(lg.ctx, "2017-03-04")
+		time.Sleep(120 * time.Millisecond)
+		clock.Set(time.Date(2017, 3, 5, 0, 0, 0, 0, time.Local))
+		waitFor(t, func() bool {
+			current, _ := l.CurrentLogfile()
+			_, err := os.Stat(archive)
+			return current == logfile && (i == 0 || err == nil)
+		})
+
+		l.Log("test", 0, msg)
+		waitFor(t, func() bool {
+			contents, _ := ioutil.ReadFile(logfile)
+			return strings.Contains(string(contents), msg)
+		})
+		lg.stopRotation()
+	}
+	lg.stopRotation = nil
+	l.Quit()
+
+	first, _ := ioutil.ReadFile(archive)
+	second, _ := ioutil.ReadFile(logfile)
+	if !strings.Contains(string(first), "first") || strings.Contains(string(first), "second") {
+		t.Errorf("Unexpected logfile of the first rotation: %s", first)
+	}
+	if !strings.Contains(string(second), "second") || strings.Contains(string(second), "first") {
+		t.Errorf("Unexpected logfile of the second rotation: %s", second)
+	}
+}
+
+func TestCompressionDoesNotDelayRotation(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", Rotation: ROT_DAILY, Out: OUT_FILE, Compress: true})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	// A large logfile of the day before the rotation
+	large := bytes.Repeat([]byte("2017-03-04 12:00:00\tmyservice\tsome rather long log message\n"), 1<<18)
+	if err := ioutil.WriteFile(path.Join(tempdir, "myservice_2017-03-04.log"), large, 0600); err != nil {
+		t.Fatalf("Could not write large logfile: %s", err.Error())
+	}
+
+	// Restart the rotation shortly before midnight with all compression slots taken
+	lg := l.(*logger)
+	clock := &fakeClock{now: time.Date(2017, 3, 4, 23, 59, 59, 950000000, time.Local)}
+	lg.stopRotation()
+	lg.clock = clock.Now
+	for i := 0; i < maxCompressions; i++ {
+		lg.compressSlots <- true
+	}
+	lg.startRotation(lg.ctx, "2017-03-04")
+
+	time.Sleep(120 * time.Millisecond)
+	clock.Set(time.Date(2017, 3, 5, 0, 0, 0, 0, time.Local))
+	waitFor(t, func() bool {
+		current, _ := l.CurrentLogfile()
+		return current == path.Join(tempdir, "myservice_2017-03-05.log")
+	})
+
+	// The rotation coroutine is waiting for the next boundary, not for the compression
+	stopped := make(chan bool)
+	go func() {
+		lg.stopRotation()
+		lg.stopRotation = nil
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Rotation coroutine is blocked by the pending compression")
+	}
+	if _, err := os.Stat(path.Join(tempdir, "myservice_2017-03-04.log")); err != nil {
+		t.Errorf("Logfile has been compressed without a free slot")
+	}
+
+	// Quit waits for the pending compression
+	for i := 0; i < maxCompressions; i++ {
+		<-lg.compressSlots
+	}
+	l.Quit()
+
+	if _, err := os.Stat(path.Join(tempdir, "myservice_2017-03-04.log.gz")); err != nil {
+		t.Errorf("Rotated logfile has not been compressed: %s", err.Error())
+	}
+	if _, err := os.Stat(path.Join(tempdir, "myservice_2017-03-04.log")); !os.IsNotExist(err) {
+		t.Errorf("Rotated logfile has not been removed")
+	}
+}
+
+func TestSizeColumn(t *testing.T) {
+	stdout := &syncBuffer{}
+	l, err := New(&Config{Out: OUT_STDOUT, StdoutWriter: stdout, Columns: []int64{COL_MSG, COL_SIZE}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	raw := map[int64]string{}
+	for _, col := range defaultCols {
+		raw[col] = "value"
+	}
+	raw[COL_MSG] = "measured"
+	l.RawEntry(raw)
+	l.Quit()
+
+	// Measured while the size column is still "N/A"
+	jsoned, _ := json.Marshal(entryFromMap(raw).toMap())
+	if expected := fmt.Sprintf("measured\t%d\t\n", len(jsoned)); stdout.String() != expected {
+		t.Errorf("Unexpected size: %q (expected %q)", stdout.String(), expected)
+	}
+}
+
+func TestJSONKeyOrder(t *testing.T) {
+	entry := getEntry()
+	defer releaseEntry(entry)
+
+	entry[COL_MSG] = "hello"
+	entry[COL_CALLER] = "test"
+	entry[COL_DATE_YYMMDD] = "2017-01-01"
+	entry[COL_TIMESTAMP] = "1483228800"
+	entry[COL_FIELDS] = `{"b":2,"a":"x","Caller":"clash"}`
+
+	expected := `{"Message":"hello","Caller":"test","Date":"2017-01-01","Timestamp":"1483228800","a":"x","b":2}`
+	if jsoned, _ := entry.toJSON([]int64{COL_MSG, COL_CALLER, COL_DATE_YYMMDD, COL_TIMESTAMP}); jsoned != expected {
+		t.Errorf("Unexpected JSON: %s", jsoned)
+	}
+}
+
+func TestJSONInvalidFields(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", Out: OUT_FILE, Format: FORMAT_JSON, Columns: []int64{COL_CALLER, COL_MSG}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	raw := map[int64]string{}
+	for _, col := range defaultCols {
+		raw[col] = "value"
+	}
+	raw[COL_FIELDS] = `{"broken":`
+	l.RawEntry(raw)
+	l.Quit()
+
+	contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the entry and an error entry, got: %s", contents)
+	}
+
+	entry := map[string]string{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Fallback entry is not valid JSON: %s", lines[0])
+	}
+	if entry["Fields"] != `{"broken":` || !strings.Contains(entry["FieldsError"], "could not decode structured fields") {
+		t.Errorf("Unexpected fallback entry: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], "written partially") {
+		t.Errorf("The failure has not been logged: %s", lines[1])
+	}
+}
+
+func TestContextWithCaller(t *testing.T) {
+	stdout := &syncBuffer{}
+	l, err := New(&Config{Out: OUT_STDOUT, StdoutWriter: stdout, AutoCaller: true, Columns: []int64{COL_CALLER, COL_MSG}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	ctx := ContextWithCaller(context.Background(), "handler")
+	l.LogCtx(ctx, "explicit", 0, "explicit caller")
+	l.LogCtx(ctx, "", 0, "context caller")
+	l.LogFieldsCtx(ctx, "", 0, map[string]interface{}{"fields": true})
+	l.LogCtx(context.Background(), "", 0, "derived caller")
+	l.Quit()
+
+	expected := "explicit\texplicit caller\t\n" +
+		"handler\tcontext caller\t\n" +
+		"handler\t{\"fields\":true}\t\n" +
+		"journal.TestContextWithCaller\tderived caller\t\n"
+	if stdout.String() != expected {
+		t.Errorf("Unexpected callers:\n%s", stdout.String())
+	}
+}
+
+func TestJSONStdout(t *testing.T) {
+	for _, format := range []int{FORMAT_JSON, FORMAT_JSON_ARRAY} {
+		stdout := &syncBuffer{}
+		l, err := New(&Config{Out: OUT_STDOUT, StdoutWriter: stdout, Format: format, Columns: []int64{COL_CALLER, COL_MSG}})
+		if err != nil {
+			t.Fatalf("Could not start logger: %s", err.Error())
+		}
+
+		l.Log("test", 0, "first")
+		l.Log("test", 0, "second")
+		l.Quit()
+
+		expected := `{"Caller":"test","Message":"first"}` + "\n" + `{"Caller":"test","Message":"second"}` + "\n"
+		if stdout.String() != expected {
+			t.Errorf("Unexpected stdout (format %d):\n%s", format, stdout.String())
+		}
+	}
+}
+
+func TestErrorFile(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	for _, format := range []int{FORMAT_TSV, FORMAT_JSON_ARRAY} {
+		l, err := New(&Config{Folder: tempdir, Filename: "myservice", ErrorFile: "errors", Rotation: ROT_DAILY, Out: OUT_FILE, Format: format, Columns: []int64{COL_MSG}})
+		if err != nil {
+			t.Fatalf("Could not start logger: %s", err.Error())
+		}
+		l.Log("test", 0, "notification")
+		l.Log("test", 1, "error")
+		l.Quit()
+
+		main, _ := ReadLogfile(logfileName(tempdir, "myservice"))
+		errors, _ := ReadLogfile(logfileName(tempdir, "errors"))
+		if len(main) != 2 || main[0]["Message"] != "notification" || main[1]["Message"] != "error" {
+			t.Errorf("Unexpected main logfile (format %d): %v", format, main)
+		}
+		if len(errors) != 1 || errors[0]["Message"] != "error" {
+			t.Errorf("Unexpected error logfile (format %d): %v", format, errors)
+		}
+
+		os.Remove(logfileName(tempdir, "myservice"))
+		os.Remove(logfileName(tempdir, "errors"))
+	}
+
+	if _, err := New(&Config{Folder: tempdir, Filename: "myservice", ErrorFile: "myservice", Out: OUT_FILE}); err == nil {
+		t.Errorf("Error logfile must differ from the main logfile")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	stdout := &syncBuffer{}
+	config := &Config{Folder: tempdir, Filename: "myservice", Rotation: ROT_DAILY, Out: OUT_FILE, Columns: []int64{COL_MSG}, StdoutWriter: stdout}
+	l, err := New(config)
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	// File -> stdout -> file (in another folder)
+	for i := 0; i < 10; i++ {
+		l.Log("test", 0, "file %d", i)
+	}
+	waitFor(t, func() bool {
+		contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+		return strings.Contains(string(contents), "file 9")
+	})
+
+	toStdout := *config
+	toStdout.Out = OUT_STDOUT
+	if err := l.Reconfigure(toStdout); err != nil {
+		t.Fatalf("Could not switch to stdout: %s", err.Error())
+	}
+	if _, ok := l.CurrentLogfile(); ok {
+		t.Errorf("Logfile is still open after switching to stdout")
+	}
+	for i := 0; i < 10; i++ {
+		l.Log("test", 0, "stdout %d", i)
+	}
+	waitFor(t, func() bool {
+		return strings.Contains(stdout.String(), "stdout 9")
+	})
+
+	otherFolder := path.Join(tempdir, "other")
+	os.Mkdir(otherFolder, 0700)
+	toFile := *config
+	toFile.Folder = otherFolder
+	if err := l.Reconfigure(toFile); err != nil {
+		t.Fatalf("Could not switch back to file: %s", err.Error())
+	}
+	l.Log("test", 0, "other file")
+
+	// Invalid configurations are rejected
+	invalid := *config
+	invalid.Out = OUT_FILE_AND_STDOUT + 1
+	if err := l.Reconfigure(invalid); err == nil {
+		t.Errorf("Invalid configuration has been accepted")
+	}
+
+	// A logfile that cannot be opened leaves the current one active
+	brokenFolder := path.Join(tempdir, "broken")
+	os.MkdirAll(logfileName(brokenFolder, "myservice"), 0700)
+	broken := *config
+	broken.Folder = brokenFolder
+	if err := l.Reconfigure(broken); err == nil {
+		t.Errorf("Expected the logfile not to open")
+	}
+	if current, ok := l.CurrentLogfile(); !ok || current != logfileName(otherFolder, "myservice") {
+		t.Errorf("Unexpected logfile after a failed reconfiguration: '%s' (ok: %t)", current, ok)
+	}
+	l.Log("test", 0, "after failure")
+	l.Quit()
+
+	contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+	other, _ := ioutil.ReadFile(logfileName(otherFolder, "myservice"))
+	out := stdout.String()
+	for i := 0; i < 10; i++ {
+		if !strings.Contains(string(contents), fmt.Sprintf("file %d\t", i)) {
+			t.Errorf("Entry 'file %d' is missing from the logfile", i)
+		}
+		if !strings.Contains(out, fmt.Sprintf("stdout %d\t", i)) || strings.Contains(string(contents)+string(other), fmt.Sprintf("stdout %d\t", i)) {
+			t.Errorf("Entry 'stdout %d' has not been written to stdout only", i)
+		}
+	}
+	if !strings.Contains(string(other), "other file") || strings.Contains(out, "other file") {
+		t.Errorf("Entry has not been written to the new logfile: %s", other)
+	}
+	if !strings.Contains(string(other), "after failure") {
+		t.Errorf("Entry has not been written to the previous logfile: %s", other)
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Service: "web", Instance: "1", Folder: tempdir, Filename: "myservice", Rotation: ROT_NONE, Out: OUT_FILE, RingBufferSize: 10})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	for i := 0; i < 25; i++ {
+		l.Log("test", 0, "entry %d", i)
+	}
+	l.Quit()
+
+	recent := l.RecentEntries()
+	if len(recent) != 10 {
+		t.Fatalf("Expected 10 entries, got %d", len(recent))
+	}
+	for i, record := range recent {
+		if expected := fmt.Sprintf("entry %d", 15+i); record[COL_MSG] != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, record[COL_MSG])
+		}
+	}
+
+	if _, err := New(&Config{Out: OUT_STDOUT, RingBufferSize: -1}); err == nil {
+		t.Errorf("Negative ring buffer size has been accepted")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Service: "web", Instance: "1", Folder: tempdir, Filename: "myservice", Rotation: ROT_NONE, Out: OUT_FILE, Format: FORMAT_JSON, Columns: []int64{COL_MSG_TYPE_SHORT, COL_MSG}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	func() {
+		defer l.Recover("worker")
+		panic("boom")
+	}()
+
+	// The panic is passed on by RecoverAndRepanic
+	repanicked := func() (r interface{}) {
+		defer func() { r = recover() }()
+		defer l.RecoverAndRepanic("worker")
+		panic("boom again")
+	}()
+	if repanicked != "boom again" {
+		t.Errorf("Panic has not been passed on: %v", repanicked)
+	}
+	l.Quit()
+
+	entries, err := ReadLogfile(path.Join(tempdir, "myservice.log"))
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 entries: %v", err)
+	}
+	for i, expected := range []string{"boom", "boom again"} {
+		if entries[i]["Type"] != "ERR" || entries[i]["panic"] != expected || !strings.Contains(entries[i]["stack"], "TestRecover") {
+			t.Errorf("Unexpected entry: %v", entries[i])
+		}
+	}
+}
+
+func TestColumnsFromNames(t *testing.T) {
+	cols, err := ColumnsFromNames([]string{"service", " Caller", "MESSAGE", "line"})
+	if err != nil {
+		t.Fatalf("Could not map column names: %s", err.Error())
+	}
+	if !reflect.DeepEqual(cols, []int64{COL_SERVICE, COL_CALLER, COL_MSG, COL_LINE}) {
+		t.Errorf("Unexpected columns: %v", cols)
+	}
+
+	if _, err := ColumnsFromNames([]string{"service", "msg"}); err == nil || !strings.Contains(err.Error(), "'msg'") {
+		t.Errorf("Unknown column name has not been reported: %v", err)
+	}
+
+	if err := ValidateConfig(&Config{Out: OUT_STDOUT, ColumnNames: []string{"nope"}}); err == nil {
+		t.Errorf("Invalid column names have been accepted")
+	}
+	if err := ValidateConfig(&Config{Out: OUT_STDOUT, Columns: []int64{COL_MSG}, ColumnNames: []string{"message"}}); err == nil {
+		t.Errorf("Columns set by both code and name have been accepted")
+	}
+}
+
+// blockingWriter blocks each write until it is released (started signals
+// writes as long as there is room in the channel)
+type blockingWriter struct {
+	started chan bool
+	release chan bool
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case b.started <- true:
+	default:
+	}
+	<-b.release
+	return len(p), nil
+}
+
+func TestDestinationsDuringSlowWrite(t *testing.T) {
+	slow := &blockingWriter{started: make(chan bool, 1), release: make(chan bool)}
+
+	l, err := New(&Config{Service: "web", Instance: "1", Out: OUT_STDOUT, StdoutWriter: ioutil.Discard})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	l.AddDestination("slow", slow)
+	l.Log("test", 0, "slow entry")
+
+	select {
+	case <-slow.started:
+	case <-time.After(time.Second):
+		t.Fatalf("Remote write has not started")
+	}
+
+	// Destinations can be managed while the write is in progress
+	done := make(chan bool)
+	go func() {
+		l.AddDestination("other", ioutil.Discard)
+		l.RemoveDestination("other")
+		l.ListDestinations()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Destination management has been blocked by a slow write")
+	}
+
+	close(slow.release)
+	l.Quit()
+}
+
+func TestTryLog(t *testing.T) {
+	gated := &blockingWriter{started: make(chan bool, 1), release: make(chan bool)}
+
+	l, err := New(&Config{Service: "web", Instance: "1", Out: OUT_STDOUT, StdoutWriter: ioutil.Discard})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	l.AddDestination("gated", gated)
+
+	if !l.TryLog("test", 0, "first entry") {
+		t.Fatalf("TryLog dropped an entry of an empty ledger")
+	}
+	select {
+	case <-gated.started:
+	case <-time.After(time.Second):
+		t.Fatalf("Remote write has not started")
+	}
+
+	// The writer is stuck, so the ledger fills up
+	accepted := 0
+	for accepted <= 1000 && l.TryLog("test", 0, "entry %d", accepted) {
+		accepted++
+	}
+	if accepted > 1000 {
+		t.Fatalf("TryLog never reported a full ledger")
+	}
+	if dropped := l.Dropped(); dropped != 1 {
+		t.Errorf("Expected 1 dropped entry, got %d", dropped)
+	}
+
+	close(gated.release)
+	l.Quit()
+
+	if l.TryLog("test", 0, "after quit") {
+		t.Errorf("TryLog accepted an entry after Quit")
+	}
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	l, err := New(&Config{Service: "web", Instance: "1", Out: OUT_STDOUT, StdoutWriter: ioutil.Discard, RingBufferSize: 3, MaxMessageBytes: 64})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	// A three-byte character straddles the cut (50 bytes before the marker)
+	oversized := strings.Repeat("a", 49) + strings.Repeat("€", 1000)
+	l.Log("test", 0, oversized)
+	l.Log("test", 0, "short message")
+
+	// Raw (e.g. forwarded) entries are truncated as well
+	raw := map[int64]string{}
+	for col := int64(COL_DATE_YYMMDD); col <= COL_LINE; col++ {
+		raw[col] = "N/A"
+	}
+	raw[COL_MSG] = oversized
+	if err := l.RawEntry(raw); err != nil {
+		t.Fatalf("Could not write raw entry: %s", err.Error())
+	}
+	l.Quit()
+
+	records := l.RecentEntries()
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(records))
+	}
+	if msg := records[0][COL_MSG]; msg != strings.Repeat("a", 49)+"...(truncated)" {
+		t.Errorf("Unexpected truncated message '%s' (%d bytes)", msg, len(msg))
+	} else if !utf8.ValidString(msg) {
+		t.Errorf("Truncation split a character")
+	}
+	if msg := records[1][COL_MSG]; msg != "short message" {
+		t.Errorf("Short message has been changed: '%s'", msg)
+	}
+	if msg := records[2][COL_MSG]; msg != records[0][COL_MSG] {
+		t.Errorf("Raw entry has not been truncated (%d bytes)", len(msg))
+	}
+	if truncated := l.Truncated(); truncated != 2 {
+		t.Errorf("Expected 2 truncated messages, got %d", truncated)
+	}
+}
+
+// countingWriter counts the written entries whose message has a prefix
+type countingWriter struct {
+	mu     sync.Mutex
+	prefix string
+	count  int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	entry := map[int64]string{}
+	if err := json.Unmarshal(p, &entry); err == nil && strings.HasPrefix(entry[COL_MSG], c.prefix) {
+		c.mu.Lock()
+		c.count++
+		c.mu.Unlock()
+	}
+	return len(p), nil
+}
+
+func TestQuitDrainsLedger(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		counter := &countingWriter{prefix: "accepted"}
+
+		l, err := New(&Config{Service: "web", Instance: "1", Out: OUT_STDOUT, StdoutWriter: ioutil.Discard})
+		if err != nil {
+			t.Fatalf("Could not start logger: %s", err.Error())
+		}
+		l.AddDestination("counter", counter)
+
+		var wg sync.WaitGroup
+		accepted := make([]int, 8)
+		for i := range accepted {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 500; j++ {
+					if i%2 == 0 {
+						l.Log("test", 0, "logged %d", j)
+					} else if l.TryLog("test", 0, "accepted %d", j) {
+						accepted[i]++
+					}
+				}
+			}(i)
+		}
+
+		time.Sleep(time.Millisecond)
+		l.Quit()
+		wg.Wait()
+
+		total := 0
+		for _, n := range accepted {
+			total += n
+		}
+
+		counter.mu.Lock()
+		written := counter.count
+		counter.mu.Unlock()
+		if written != total {
+			t.Fatalf("Round %d: %d entries have been accepted, but %d written", round, total, written)
+		}
+	}
+}
+
+func TestDone(t *testing.T) {
+	l, err := New(&Config{Service: "web", Instance: "1", Out: OUT_STDOUT, StdoutWriter: ioutil.Discard})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	select {
+	case <-l.Done():
+		t.Fatal("Done is closed before Quit")
+	default:
+	}
+
+	l.Log("test", 0, "Hello")
+	l.Quit()
+
+	select {
+	case <-l.Done():
+	default:
+		t.Fatal("Done is not closed after Quit has returned")
+	}
+
+	// Quitting twice must not close Done twice
+	l.Quit()
+	<-l.Done()
+}
+
+func TestGELFFormat(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+
+	l, err := New(&Config{Service: "web", Instance: "1", Out: OUT_STDOUT, Format: FORMAT_GELF, StdoutWriter: buf})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	l.Log("test", 0, "notification")
+	l.Log("test", 1, "general error")
+	l.Log("test", 404, "not found")
+	l.Log("test", 10, "catastrophe")
+	l.Logf("test", 0, "user {user}", map[string]interface{}{"user": 42, "user id": "u42", "tags": []string{"a"}})
+	l.Quit()
+
+	levels := []float64{6, 3, 4, 2, 6}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(levels) {
+		t.Fatalf("Expected %d entries, got %d: %s", len(levels), len(lines), buf.String())
+	}
+
+	for i, line := range lines {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Entry is not valid JSON: %s", line)
+		}
+		for _, field := range []string{"version", "host", "short_message", "timestamp", "level", "_service", "_caller"} {
+			if _, ok := entry[field]; !ok {
+				t.Errorf("Entry %d is missing field '%s': %s", i, field, line)
+			}
+		}
+		if entry["version"] != "1.1" || entry["_service"] != "web" {
+			t.Errorf("Entry %d has wrong version or service: %s", i, line)
+		}
+		if _, ok := entry["timestamp"].(float64); !ok {
+			t.Errorf("Entry %d has a non-numeric timestamp: %s", i, line)
+		}
+		if entry["level"] != levels[i] {
+			t.Errorf("Entry %d: expected level %v, got %v", i, levels[i], entry["level"])
+		}
+	}
+
+	// Structured fields are additional fields
+	last := map[string]interface{}{}
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if last["_user"] != float64(42) || last["_user_id"] != "u42" || last["_tags"] != `["a"]` || last["short_message"] != "user 42" {
+		t.Errorf("Structured fields have not been written as additional fields: %s", lines[len(lines)-1])
+	}
+}
+
+func TestCEFFormat(t *testing.T) {
+	l := &logger{config: &Config{Service: "we|b", Instance: "1", Columns: defaultCols}, codes: defaultCodes}
+
+	entry := l.newRawEntry("test", "UserError", `a=b|c\d`+"\nnext", "file.go", 7, 404, true)
+	defer releaseEntry(entry)
+
+	cef := entry.toCEF([]int64{COL_DATE_YYMMDD_HHMMSS_NANO, COL_SERVICE, COL_CALLER, COL_MSG, COL_FILE, COL_LINE})
+
+	header := `CEF:0|journal|we\|b|N/A|404|UserError|5|`
+	if !strings.HasPrefix(cef, header) {
+		t.Fatalf("Expected header '%s', got '%s'", header, cef)
+	}
+
+	extensions := strings.TrimPrefix(cef, header)
+	for _, expected := range []string{`journalService=we|b`, `journalCaller=test`, `msg=a\=b|c\\d\nnext`, `fname=file.go`, `journalLine=7`} {
+		if !strings.Contains(extensions, expected) {
+			t.Errorf("Extension '%s' is missing: %s", expected, extensions)
+		}
+	}
+	if !regexp.MustCompile(`^rt=\d{13} `).MatchString(extensions) {
+		t.Errorf("Receipt time is not in milliseconds: %s", extensions)
+	}
+
+	// Severities
+	for _, test := range []struct {
+		code     int
+		isErr    bool
+		severity int
+	}{
+		{0, false, 3}, {1, true, 7}, {404, true, 5}, {10, true, 10},
+	} {
+		if severity := cefSeverity(test.code, test.isErr); severity != test.severity {
+			t.Errorf("Code %d: expected severity %d, got %d", test.code, test.severity, severity)
+		}
+	}
+}
+
+func TestSyncOnError(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", Out: OUT_FILE, Columns: []int64{COL_MSG}, SyncOnError: true})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	defer l.Quit()
+
+	l.Log("test", 0, "notification")
+	l.Log("test", 1, "critical failure")
+
+	// The error is on disk without quitting the logger
+	deadline := time.Now().Add(time.Second)
+	for {
+		contents, _ := ioutil.ReadFile(logfileName(tempdir, "myservice"))
+		if strings.Contains(string(contents), "critical failure") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Error entry has not been written to disk: %s", contents)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWithPrefix(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+
+	l, err := New(&Config{Service: "web", Instance: "1", Out: OUT_STDOUT, StdoutWriter: buf, Columns: []int64{COL_FILE, COL_MSG}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	goroutines := runtime.NumGoroutine()
+
+	db := l.WithPrefix("[db] ")
+	replica := db.WithPrefix("[replica] ")
+	db.Log("test", 0, "connected to %s (100%% healthy)", "primary")
+	replica.Logf("test", 0, "lag {lag}", map[string]interface{}{"lag": "2s"})
+	replica.TryLog("test", 0, "caught up")
+	l.Log("test", 0, "unprefixed")
+
+	if spawned := runtime.NumGoroutine() - goroutines; spawned > 0 {
+		t.Errorf("Prefixed loggers have spawned %d goroutines", spawned)
+	}
+	l.Quit()
+
+	for _, expected := range []string{
+		"[db] connected to primary (100% healthy)",
+		"[db] [replica] lag 2s",
+		"[db] [replica] caught up",
+		"\tunprefixed",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Missing entry '%s': %s", expected, buf.String())
+		}
+	}
+	if strings.Count(buf.String(), "journal_test.go") != 4 {
+		t.Errorf("Entries have not been attributed to the caller: %s", buf.String())
+	}
+}
+
+func TestRotate(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	config := &Config{Folder: tempdir, Filename: "myservice", Rotation: ROT_DAILY, Out: OUT_FILE, Columns: []int64{COL_MSG}}
+	l, err := New(config)
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	logfile := logfileName(tempdir, "myservice")
+	archive := strings.TrimSuffix(logfile, ".log") + ".1.log"
+
+	l.Log("test", 0, "before rotation")
+	waitFor(t, func() bool {
+		contents, _ := ioutil.ReadFile(logfile)
+		return strings.Contains(string(contents), "before rotation")
+	})
+
+	if err := l.Rotate(); err != nil {
+		t.Fatalf("Could not rotate logfile: %s", err.Error())
+	}
+	l.Log("test", 0, "after rotation")
+	l.Quit()
+
+	archived, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("Rotated logfile is missing: %s", err.Error())
+	}
+	contents, _ := ioutil.ReadFile(logfile)
+	if !strings.Contains(string(archived), "before rotation") || strings.Contains(string(archived), "after rotation") {
+		t.Errorf("Unexpected rotated logfile: %s", archived)
+	}
+	if !strings.Contains(string(contents), "after rotation") || strings.Contains(string(contents), "before rotation") {
+		t.Errorf("Unexpected fresh logfile: %s", contents)
+	}
+
+	if err := l.Rotate(); err == nil {
+		t.Errorf("Stopped logger has been rotated")
+	}
+}
+
+func TestRotateCompressesInBackground(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", Rotation: ROT_DAILY, Out: OUT_FILE, Compress: true})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+
+	logfile := logfileName(tempdir, "myservice")
+	l.Log("test", 0, "before rotation")
+	if err := l.Rotate(); err != nil {
+		t.Fatalf("Could not rotate logfile: %s", err.Error())
+	}
+	l.Quit()
+
+	// Quit waits for the compression
+	if _, err := os.Stat(strings.TrimSuffix(logfile, ".log") + ".1.log.gz"); err != nil {
+		t.Errorf("Rotated logfile has not been compressed: %s", err.Error())
+	}
+	if _, err := os.Stat(strings.TrimSuffix(logfile, ".log") + ".1.log"); !os.IsNotExist(err) {
+		t.Errorf("Rotated logfile has not been removed after compression")
+	}
+}
+
+func TestDestinationStats(t *testing.T) {
+	l, err := New(&Config{Out: OUT_STDOUT, StdoutWriter: ioutil.Discard})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	defer l.Quit()
+
+	remote := &brokenWriter{}
+	l.AddDestination("remote", remote)
+
+	before := time.Now()
+	l.Log("test", 0, "first")
+	l.Log("test", 0, "second")
+	waitFor(t, func() bool {
+		return l.DestinationStats()["remote"].Entries == 2
+	})
+
+	remote.Close()
+	l.Log("test", 0, "lost")
+	waitFor(t, func() bool {
+		return l.DestinationStats()["remote"].Failures == 1
+	})
+
+	stats := l.DestinationStats()["remote"]
+	if stats.Entries != 2 || stats.Bytes == 0 || stats.LastSuccess.Before(before) || stats.LastError != "broken pipe" {
+		t.Errorf("Unexpected destination statistics: %+v", stats)
+	}
+
+	l.RemoveDestination("remote")
+	if _, ok := l.DestinationStats()["remote"]; ok {
+		t.Errorf("Statistics of a removed destination are still reported")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	l, err := New(&Config{Out: OUT_STDOUT, StdoutWriter: ioutil.Discard, BreakerThreshold: 2, BreakerCooldown: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	defer l.Quit()
+
+	remote := &brokenWriter{}
+	l.AddDestination("remote", remote)
+	remote.Close()
+
+	// Two failures open the circuit, the other entries are skipped
+	for i := 0; i < 5; i++ {
+		l.Log("test", 0, "entry %d", i)
+	}
+	waitFor(t, func() bool {
+		return l.DestinationStats()["remote"].Skipped == 3
+	})
+	if _, attempts := remote.counts(); attempts != 2 {
+		t.Errorf("Expected 2 attempts before the circuit opened, got %d", attempts)
+	}
+	if stats := l.DestinationStats()["remote"]; !stats.Open || stats.Failures != 2 {
+		t.Errorf("Circuit has not been opened: %+v", stats)
+	}
+
+	// The destination recovers and the probe after the cooldown closes the circuit
+	remote.mu.Lock()
+	remote.closed = false
+	remote.mu.Unlock()
+	time.Sleep(150 * time.Millisecond)
+
+	l.Log("test", 0, "probe")
+	waitFor(t, func() bool {
+		writes, _ := remote.counts()
+		return writes == 1
+	})
+	if stats := l.DestinationStats()["remote"]; stats.Open || stats.Entries != 1 {
+		t.Errorf("Circuit has not been closed: %+v", stats)
+	}
+}
@@ -1,12 +1,22 @@
 package journal
 
-// File rotation frequency
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// File rotation frequency (rotates daily if not set)
+//
+// ROT_NONE never rotates: all entries are appended to a single logfile without
+// a date suffix (<Filename>.log), which is reused across restarts.
 const (
-	ROT_NONE     = 0
 	ROT_DAILY    = 1
 	ROT_WEEKLY   = 2
 	ROT_MONTHLY  = 3
 	ROT_ANNUALLY = 4
+	ROT_NONE     = 5
 )
 
 // Output selection
@@ -16,6 +26,38 @@ const (
 	OUT_FILE_AND_STDOUT = 2
 )
 
+// Logfile format
+//
+// FORMAT_JSON_ARRAY writes all entries into a single JSON array. The array is
+// closed only when the logfile is rotated or the logger quits, i.e. the active
+// logfile is not valid JSON until then.
+//
+// FORMAT_GELF writes one Graylog (GELF 1.1) JSON object per line. The columns
+// are written as additional fields (e.g. "_caller").
+//
+// FORMAT_CEF writes one Common Event Format line per entry (for SIEMs). The
+// device product is the service, the columns are written as extensions. CEF
+// logfiles cannot be read back with ReadLogfile.
+const (
+	FORMAT_TSV        = 0
+	FORMAT_JSON       = 1
+	FORMAT_JSON_ARRAY = 2
+	FORMAT_GELF       = 3
+	FORMAT_CEF        = 4
+)
+
+// Number of consecutive failed writes after which stdout/stderr are abandoned
+const maxConsoleFailures = 3
+
+// Maximum number of rotated logfiles compressed concurrently
+const maxCompressions = 2
+
+// Marker ending the messages truncated to Config.MaxMessageBytes
+const truncationMarker = "...(truncated)"
+
+// Default time a failing remote destination is skipped for (see Config.BreakerThreshold)
+const defaultBreakerCooldown = 30 * time.Second
+
 // Log columns
 const (
 	COL_DATE_YYMMDD             = 0
@@ -31,20 +73,27 @@ const (
 	COL_MSG                     = 10
 	COL_FILE                    = 11
 	COL_LINE                    = 12
+	COL_TRACE_ID                = 13 // OpenTelemetry trace ID (see LogCtx)
+	COL_SPAN_ID                 = 14 // OpenTelemetry span ID (see LogCtx)
+	COL_FIELDS                  = 15 // JSON-encoded structured fields (see Logf)
+	COL_SIZE                    = 16 // Size of the JSON-encoded entry in bytes as sent to remote destinations (this column is "N/A" then)
+	COL_ROUTE                   = 17 // IDs of the servers a forwarded entry has passed (see server.Config.ServerID)
+	COL_METADATA                = 18 // JSON-encoded custom metadata of the remote client (see connect.WithMetadata)
 )
 
-// colname returns a column's textual representation
+// colname returns a column's textual representation (unique per column, used as
+// the TSV header and the JSON key)
 func colname(col int64) string {
 
 	switch col {
 	case COL_DATE_YYMMDD:
 		return "Date"
 	case COL_DATE_YYMMDD_HHMMSS:
-		return "Date"
+		return "DateTime"
 	case COL_DATE_YYMMDD_HHMMSS_NANO:
-		return "Date"
+		return "DateTimeNano"
 	case COL_TIMESTAMP:
-		return "Date"
+		return "Timestamp"
 	case COL_SERVICE:
 		return "Service"
 	case COL_INSTANCE:
@@ -63,12 +112,66 @@ func colname(col int64) string {
 		return "File"
 	case COL_LINE:
 		return "Line"
+	case COL_TRACE_ID:
+		return "TraceID"
+	case COL_SPAN_ID:
+		return "SpanID"
+	case COL_FIELDS:
+		return "Fields"
+	case COL_SIZE:
+		return "Size"
+	case COL_ROUTE:
+		return "Route"
+	case COL_METADATA:
+		return "Metadata"
 	default:
 		return "Unknown"
 	}
 
 }
 
+// columnNames maps the (case-insensitive) names accepted by ColumnsFromNames to columns
+var columnNames = map[string]int64{
+	"date":          COL_DATE_YYMMDD,
+	"datetime":      COL_DATE_YYMMDD_HHMMSS,
+	"datetime_nano": COL_DATE_YYMMDD_HHMMSS_NANO,
+	"timestamp":     COL_TIMESTAMP,
+	"service":       COL_SERVICE,
+	"instance":      COL_INSTANCE,
+	"caller":        COL_CALLER,
+	"type":          COL_MSG_TYPE_SHORT,
+	"type_int":      COL_MSG_TYPE_INT,
+	"type_str":      COL_MSG_TYPE_STR,
+	"message":       COL_MSG,
+	"file":          COL_FILE,
+	"line":          COL_LINE,
+	"trace_id":      COL_TRACE_ID,
+	"span_id":       COL_SPAN_ID,
+	"fields":        COL_FIELDS,
+	"size":          COL_SIZE,
+	"route":         COL_ROUTE,
+	"metadata":      COL_METADATA,
+}
+
+// ColumnsFromNames converts column names (e.g. "service", "message", "line") to
+// columns (COL_*). Names are case-insensitive.
+func ColumnsFromNames(names []string) ([]int64, error) {
+	cols := make([]int64, 0, len(names))
+	for _, name := range names {
+		col, ok := columnNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			known := make([]string, 0, len(columnNames))
+			for key := range columnNames {
+				known = append(known, key)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("ColumnsFromNames: unknown column '%s' (known columns: %s)", name, strings.Join(known, ", "))
+		}
+		cols = append(cols, col)
+	}
+	return cols, nil
+}
+
 // Code contains a single message type with an indicator of whether this
 // message should be treated as an error.
 type Code struct {
@@ -83,6 +186,8 @@ var defaultCodes = map[int]Code{
 	2:   Code{true, "ConfigurationError"},
 	3:   Code{true, "FailedAction"},
 	4:   Code{true, "UserError"},
+	5:   Code{false, "Summary"},
+	6:   Code{false, "Warning"},
 	10:  Code{true, "CatastrophicFailure"},
 	100: Code{false, "HTTP-StatusContinue"},
 	101: Code{false, "HTTP-StatusSwitchingProtocols"},
@@ -1,19 +1,89 @@
 package journal
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Log entry correction pattern
 var correctionPattern = regexp.MustCompile("[\t\n\r\b\f\v]")
 
-// logEntry contains all the column values of a log entry
-type logEntry map[int64]string // Compatible with logrpc.LogEntry.Entry
+// logEntry contains all the column values of a log entry, indexed by column code
+type logEntry [COL_METADATA + 1]string
+
+// Pool of reusable log entries (keeps the Log hot path allocation-free)
+var entryPool = sync.Pool{
+	New: func() interface{} {
+		return &logEntry{}
+	},
+}
+
+// getEntry returns an empty log entry from the pool
+func getEntry() *logEntry {
+	return entryPool.Get().(*logEntry)
+}
+
+// releaseEntry resets a log entry and returns it to the pool.
+// The entry must not be used afterwards.
+func releaseEntry(entry *logEntry) {
+	*entry = logEntry{}
+	entryPool.Put(entry)
+}
+
+// entryFromMap copies a raw (gRPC) log entry into a pooled log entry.
+// Unknown columns are ignored and missing optional columns are set to "N/A".
+func entryFromMap(raw map[int64]string) *logEntry {
+	entry := getRawEntry()
+	for col, value := range raw {
+		if col >= 0 && col < int64(len(entry)) {
+			entry[col] = value
+		}
+	}
+	return entry
+}
+
+// entryFromColumns is entryFromMap for a raw log entry given as parallel
+// arrays of columns and values (of the same length)
+func entryFromColumns(columns []int64, values []string) *logEntry {
+	entry := getRawEntry()
+	for i, col := range columns {
+		if col >= 0 && col < int64(len(entry)) {
+			entry[col] = values[i]
+		}
+	}
+	return entry
+}
+
+// getRawEntry returns a pooled log entry with the optional columns set to "N/A"
+func getRawEntry() *logEntry {
+	entry := getEntry()
+	entry[COL_TRACE_ID] = "N/A"
+	entry[COL_SPAN_ID] = "N/A"
+	entry[COL_FIELDS] = "N/A"
+	entry[COL_SIZE] = "N/A"
+	entry[COL_ROUTE] = "N/A"
+	entry[COL_METADATA] = "N/A"
+	return entry
+}
+
+// toMap turns logEntry to a raw log entry (compatible with logrpc.LogEntry.Entry)
+func (l *logEntry) toMap() map[int64]string {
+	raw := make(map[int64]string, len(l))
+	for col, value := range l {
+		raw[int64(col)] = value
+	}
+	return raw
+}
 
 // correct corrects some possible mistakes in logEntry
-func (l logEntry) correct() {
+func (l *logEntry) correct() {
 
 	for i, v := range l {
 		if v == "" {
@@ -25,25 +95,290 @@ func (l logEntry) correct() {
 }
 
 // toStr turns logEntry to string
-func (l logEntry) toStr(cols []int64) string {
-	msg := ""
+func (l *logEntry) toStr(cols []int64) string {
+	size := 0
 	for _, code := range cols {
-		msg = fmt.Sprintf("%s%s\t", msg, l[code])
+		size += len(l[code]) + 1
 	}
-	return msg
-}
 
-// toJSON turns logEntry to json-encoded string
-func (l logEntry) toJSON(cols []int64) string {
-	nameLog := map[string]string{}
+	msg := make([]byte, 0, size)
 	for _, code := range cols {
-		nameLog[colname(code)] = l[code]
+		msg = append(msg, l[code]...)
+		msg = append(msg, '\t')
 	}
+	return string(msg)
+}
+
+// toJSON turns logEntry to json-encoded string with keys in the order of the
+// columns. Columns listed more than once are written once (the last one wins).
+// Structured fields (see Logger.Logf) are added afterwards as separate keys
+// (sorted), unless they clash with a column. Should the fields not be valid
+// JSON, they are written as a string (key "Fields") along with the error (key
+// "FieldsError") and the error is returned.
+func (l *logEntry) toJSON(cols []int64) (string, error) {
+	var err error
+	var buf bytes.Buffer
+	names := make(map[string]bool, len(cols))
+
+	buf.WriteByte('{')
+	for i, code := range cols {
+		name := colname(code)
+
+		// Skip the column if another one of the same name follows
+		shadowed := false
+		for _, next := range cols[i+1:] {
+			shadowed = shadowed || colname(next) == name
+		}
+		if shadowed {
+			continue
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		names[name] = true
+		writeJSONPair(&buf, name, l[code])
+	}
+
+	if fields := l[COL_FIELDS]; fields != "" && fields != "N/A" {
+		raw := map[string]json.RawMessage{}
+		if errFields := json.Unmarshal([]byte(fields), &raw); errFields != nil {
+			err = fmt.Errorf("toJSON: could not decode structured fields: %s", errFields.Error())
+			raw = map[string]json.RawMessage{}
+			raw["Fields"], _ = json.Marshal(fields)
+			raw["FieldsError"], _ = json.Marshal(err.Error())
+		}
+
+		keys := make([]string, 0, len(raw))
+		for key := range raw {
+			if !names[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+			jsoned, _ := json.Marshal(key)
+			buf.Write(jsoned)
+			buf.WriteByte(':')
+			buf.Write(raw[key])
+		}
+	}
+	buf.WriteByte('}')
+
+	return buf.String(), err
+}
+
+// writeJSONPair writes a JSON-encoded key/value pair of strings
+func writeJSONPair(buf *bytes.Buffer, key, value string) {
+	jsoned, _ := json.Marshal(key)
+	buf.Write(jsoned)
+	buf.WriteByte(':')
+	jsoned, _ = json.Marshal(value)
+	buf.Write(jsoned)
+}
+
+// gelfFields maps columns to their additional GELF fields ("_" and the column's
+// name accepted by ColumnsFromNames)
+var gelfFields = func() map[int64]string {
+	fields := make(map[int64]string, len(columnNames))
+	for name, col := range columnNames {
+		fields[col] = "_" + name
+	}
+	return fields
+}()
+
+// Characters not permitted in the names of additional GELF fields
+var gelfFieldPattern = regexp.MustCompile(`[^\w\.\-]`)
 
-	jsoned, err := json.Marshal(nameLog)
-	if err != nil {
-		return "{}"
+// gelfLevel maps a message code to a GELF (syslog) level: catastrophic failures
+// and exceptions are critical, HTTP client errors are warnings, the remaining
+// error codes are errors and all the other codes are informational
+func gelfLevel(code int, isErr bool) int {
+	switch {
+	case !isErr:
+		return 6
+	case code == 10 || code == 999:
+		return 2
+	case code >= 400 && code < 500:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// timestamp returns the entry's time (zero if the entry carries none)
+func (l *logEntry) timestamp() time.Time {
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05.000000000", l[COL_DATE_YYMMDD_HHMMSS_NANO], time.Local); err == nil {
+		return t
+	}
+	if secs, err := strconv.ParseInt(l[COL_TIMESTAMP], 10, 64); err == nil {
+		return time.Unix(secs, 0)
+	}
+	return time.Time{}
+}
+
+// toGELF turns logEntry to a GELF-encoded (version 1.1) string. The columns are
+// written as additional fields (the message is the short message) and so are
+// the structured fields (see Logger.Logf), unless they clash with a column.
+// Structured fields that are neither strings nor numbers are JSON-encoded as
+// strings. Should the fields not be valid JSON, they are written as a string
+// (field "_fields") along with the error (field "_fields_error") and the error
+// is returned.
+func (l *logEntry) toGELF(cols []int64, host string) (string, error) {
+	var err error
+	var buf bytes.Buffer
+	names := map[string]bool{"_id": true}
+
+	code, _ := strconv.Atoi(l[COL_MSG_TYPE_INT])
+	t := l.timestamp()
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	buf.WriteByte('{')
+	writeJSONPair(&buf, "version", "1.1")
+	buf.WriteByte(',')
+	writeJSONPair(&buf, "host", host)
+	buf.WriteByte(',')
+	writeJSONPair(&buf, "short_message", l[COL_MSG])
+	fmt.Fprintf(&buf, `,"timestamp":%d.%06d,"level":%d`, t.Unix(), t.Nanosecond()/1000, gelfLevel(code, l[COL_MSG_TYPE_SHORT] == "ERR"))
+
+	for _, col := range cols {
+		name := gelfFields[col]
+		if col == COL_MSG || col == COL_FIELDS || names[name] {
+			continue
+		}
+		names[name] = true
+		buf.WriteByte(',')
+		writeJSONPair(&buf, name, l[col])
+	}
+
+	if fields := l[COL_FIELDS]; fields != "" && fields != "N/A" {
+		raw := map[string]json.RawMessage{}
+		if errFields := json.Unmarshal([]byte(fields), &raw); errFields != nil {
+			err = fmt.Errorf("toGELF: could not decode structured fields: %s", errFields.Error())
+			buf.WriteByte(',')
+			writeJSONPair(&buf, "_fields", fields)
+			buf.WriteByte(',')
+			writeJSONPair(&buf, "_fields_error", err.Error())
+			raw = map[string]json.RawMessage{}
+		}
+
+		keys := make([]string, 0, len(raw))
+		for key := range raw {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			name := "_" + gelfFieldPattern.ReplaceAllString(key, "_")
+			if names[name] {
+				continue
+			}
+			names[name] = true
+
+			buf.WriteByte(',')
+			value := bytes.TrimSpace(raw[key])
+			if len(value) > 0 && (value[0] == '"' || value[0] == '-' || (value[0] >= '0' && value[0] <= '9')) {
+				jsoned, _ := json.Marshal(name)
+				buf.Write(jsoned)
+				buf.WriteByte(':')
+				buf.Write(value)
+			} else {
+				writeJSONPair(&buf, name, string(value))
+			}
+		}
+	}
+	buf.WriteByte('}')
+
+	return buf.String(), err
+}
+
+// cefExtensions maps columns to their CEF extension keys. The message, file and
+// time have standard keys, all the other columns are prefixed with "journal"
+// (e.g. "journalCaller").
+var cefExtensions = func() map[int64]string {
+	extensions := make(map[int64]string, len(columnNames))
+	for name, col := range columnNames {
+		key := "journal"
+		for _, part := range strings.Split(name, "_") {
+			key += strings.ToUpper(part[:1]) + part[1:]
+		}
+		extensions[col] = key
+	}
+	extensions[COL_MSG] = "msg"
+	extensions[COL_FILE] = "fname"
+	for _, col := range []int64{COL_DATE_YYMMDD, COL_DATE_YYMMDD_HHMMSS, COL_DATE_YYMMDD_HHMMSS_NANO, COL_TIMESTAMP} {
+		extensions[col] = "rt"
+	}
+	return extensions
+}()
+
+// Escaping of CEF header fields and extension values
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// cefSeverity maps a message code to a CEF severity (0-10): catastrophic
+// failures and exceptions are very high, HTTP client errors medium, the
+// remaining error codes high and all the other codes low
+func cefSeverity(code int, isErr bool) int {
+	switch {
+	case !isErr:
+		return 3
+	case code == 10 || code == 999:
+		return 10
+	case code >= 400 && code < 500:
+		return 5
+	default:
+		return 7
+	}
+}
+
+// toCEF turns logEntry to a CEF-encoded (version 0) string. The signature ID is
+// the message code and the name its type. The columns are written as
+// extensions, the date columns as the receipt time ("rt", milliseconds).
+func (l *logEntry) toCEF(cols []int64) string {
+	var buf bytes.Buffer
+
+	code, _ := strconv.Atoi(l[COL_MSG_TYPE_INT])
+	header := []string{"CEF:0", "journal", l[COL_SERVICE], "N/A", l[COL_MSG_TYPE_INT], l[COL_MSG_TYPE_STR]}
+	for i, field := range header {
+		if i > 1 {
+			field = cefHeaderEscaper.Replace(field)
+		}
+		buf.WriteString(field)
+		buf.WriteByte('|')
+	}
+	fmt.Fprintf(&buf, "%d|", cefSeverity(code, l[COL_MSG_TYPE_SHORT] == "ERR"))
+
+	written := map[string]bool{}
+	for _, col := range cols {
+		key := cefExtensions[col]
+		if written[key] {
+			continue
+		}
+		written[key] = true
+
+		value := l[col]
+		if key == "rt" {
+			if t := l.timestamp(); !t.IsZero() {
+				value = strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+			}
+		}
+
+		if len(written) > 1 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(cefExtensionEscaper.Replace(value))
 	}
 
-	return string(jsoned)
+	return buf.String()
 }
@@ -44,7 +44,7 @@ func ExampleLogger_Log() {
 
 	if err != nil {
 		fmt.Printf("Could not start logger: %s", err.Error())
-		os.Exit(1)
+		return
 	}
 
 	// Log messages
@@ -2,6 +2,8 @@ package journal
 
 import (
   "io"
+
+  "golang.org/x/net/context"
 )
 
 // Logger is the main interface implemented by journal
@@ -10,15 +12,50 @@ type Logger interface{
     // AddDestination adds a (remote) destination to send logs to
     AddDestination(name string, writer io.Writer) error
 
+    // CurrentLogfile returns the path of the active logfile, or false if the logger does not write to a file
+    CurrentLogfile() (string, bool)
+
+    // DestinationStats returns the write metrics (entries, bytes, failures, last success) of the (remote) destinations
+    DestinationStats() map[string]DestStats
+
+    // Done returns a channel that is closed once Quit has stopped all the logger's goroutines (ledger drained, files closed)
+    Done() <-chan struct{}
+
+    // Dropped returns the number of entries dropped because the ledger was full
+    Dropped() int64
+
     // ListDestinations lists all (remote) destinations
     ListDestinations() []string
 
-    // Log logs a simple message and returns nil or error, depending on the code
+    // Log logs a simple message and returns nil or error, depending on the code (always nil with Config.QuietErrors)
     Log(caller string, code int, msg string, format ...interface{}) error
 
+    // LogCtx logs a simple message like Log and adds the trace and span IDs of the context's OpenTelemetry span.
+    // If the ledger is full, the entry is dropped once the context is done
+    LogCtx(ctx context.Context, caller string, code int, msg string, format ...interface{}) error
+
+    // LogContext is an alias of LogCtx
+    LogContext(ctx context.Context, caller string, code int, msg string, format ...interface{}) error
+
+    // TryLog logs a simple message like Log without ever blocking. It returns false if the entry has been dropped (ledger full)
+    TryLog(caller string, code int, msg string, format ...interface{}) bool
+
+    // LogErr logs a simple message and returns an error if the code is an error code, regardless of Config.QuietErrors
+    LogErr(caller string, code int, msg string, format ...interface{}) error
+
     // LogFields encodes the message (not the whole log) in JSON and writes to lo
     LogFields(caller string, code int, msg map[string]interface{}) error
 
+    // Logf logs a message built from a template with {name} placeholders substituted from fields.
+    // The fields are also written as structured data (separate JSON keys, column COL_FIELDS)
+    Logf(caller string, code int, template string, fields map[string]interface{}) error
+
+    // LogAt logs a message verbatim with fields and the file/line it has been logged at (e.g. by another logging library)
+    LogAt(caller string, code int, file string, line int, msg string, fields map[string]interface{}) error
+
+    // LogFieldsCtx is the context-aware variant of LogFields (see LogCtx)
+    LogFieldsCtx(ctx context.Context, caller string, code int, msg map[string]interface{}) error
+
     // NewCaller is a wrapper for the Logger.Log function
     NewCaller(caller string) func(int, string, ...interface{}) error
 
@@ -28,12 +65,36 @@ type Logger interface{
     // Quit stops all Logger coroutines and closes files
     Quit()
 
+    // Reconfigure changes the output mode, rotation, compression, folder and filename at runtime
+    Reconfigure(config Config) error
+
+    // Recover recovers from a panic (if deferred) and logs the panic value and stack trace as an error
+    Recover(caller string)
+
+    // RecoverAndRepanic is like Recover, but panics again once the panic has been logged
+    RecoverAndRepanic(caller string)
+
+    // RecentEntries returns the most recent entries (oldest first) retained in memory (see Config.RingBufferSize)
+    RecentEntries() []LogRecord
+
     // RawEntry writes a raw log entry (map of strings) into the ledger. The raw entry must contain columns COL_DATE_YYMMDD_HHMMSS_NANO to COL_LINE
     RawEntry(entry map[int64]string) error
 
+    // RawColumns writes a raw log entry given as parallel arrays of columns and values into the ledger (see RawEntry)
+    RawColumns(columns []int64, values []string) error
+
     // RemoveDestination removes a (remote) destination to send logs to
     RemoveDestination(name string) error
 
+    // Rotate archives the current logfile (compressed if Config.Compress is set) and opens a fresh one regardless of the rotation schedule
+    Rotate() error
+
+    // WithPrefix returns a Logger sharing this one's ledger and writers that prepends prefix to the messages
+    WithPrefix(prefix string) Logger
+
+    // Truncated returns the number of messages truncated to Config.MaxMessageBytes
+    Truncated() int64
+
     // UseCustomCodes Replaces loggers default message codes with custom ones
     UseCustomCodes(codes map[int]Code)
 
@@ -2,6 +2,15 @@ package logrpc
 
 import "golang.org/x/net/context"
 
+// SCHEMA_VERSION is the version of the log entry schema (set of columns) sent by
+// clients. It changes whenever the columns change incompatibly, and servers
+// reject clients using another schema.
+const SCHEMA_VERSION = "1"
+
+// METADATA_PREFIX prefixes the keys of the custom metadata sent along with the
+// credentials, so that they cannot clash with the credentials or gRPC's own keys
+const METADATA_PREFIX = "x-journal-"
+
 // TokenCred implements grpc.PerRPCCredentials and can be used for authentication
 // via gRPC
 type TokenCred struct {
@@ -9,16 +18,23 @@ type TokenCred struct {
 	Service  string
 	Instance string
 	Token    string
+	Schema   string            // Log entry schema version (SCHEMA_VERSION)
+	Metadata map[string]string // Custom metadata, e.g. a tenant (sent with METADATA_PREFIX)
 }
 
 // GetRequestMetadata returns request metadata
 func (c *TokenCred) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
-	return map[string]string{
+	md := map[string]string{
 		"service":  c.Service,
 		"instance": c.Instance,
 		"token":    c.Token,
 		"ip":       c.IP,
-	}, nil
+		"schema":   c.Schema,
+	}
+	for key, value := range c.Metadata {
+		md[METADATA_PREFIX+key] = value
+	}
+	return md, nil
 }
 
 // RequireTransportSecurity returns transport security preferences
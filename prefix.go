@@ -0,0 +1,85 @@
+package journal
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// prefixedLogger prepends a prefix to the messages of a logger (see
+// Logger.WithPrefix). It shares the logger's ledger, writers and goroutines.
+type prefixedLogger struct {
+	*logger
+	prefix string
+}
+
+// WithPrefix returns a Logger that prepends prefix to the messages of Log,
+// LogCtx, LogErr, TryLog, Logf and NewCaller (e.g. "[component] "). The
+// JSON-encoded messages of LogFields are left as they are. The returned
+// Logger shares everything else (incl. Quit) with l.
+func (l *logger) WithPrefix(prefix string) Logger {
+	return &prefixedLogger{logger: l, prefix: prefix}
+}
+
+// WithPrefix returns a Logger that prepends prefix after this logger's prefix
+func (p *prefixedLogger) WithPrefix(prefix string) Logger {
+	return &prefixedLogger{logger: p.logger, prefix: p.prefix + prefix}
+}
+
+// prefixed prepends the prefix to a message (escaped if the message is a format)
+func (p *prefixedLogger) prefixed(msg string, format []interface{}) string {
+	if len(format) > 0 {
+		return strings.Replace(p.prefix, "%", "%%", -1) + msg
+	}
+	return p.prefix + msg
+}
+
+// Log logs a prefixed message (see logger.Log)
+func (p *prefixedLogger) Log(caller string, code int, msg string, format ...interface{}) error {
+	return p.quiet(p.pushToLedger(context.Background(), 2, caller, code, p.prefixed(msg, format), format...))
+}
+
+// LogCtx logs a prefixed message (see logger.LogCtx)
+func (p *prefixedLogger) LogCtx(ctx context.Context, caller string, code int, msg string, format ...interface{}) error {
+	return p.quiet(p.pushToLedger(ctx, 2, caller, code, p.prefixed(msg, format), format...))
+}
+
+// LogContext logs a prefixed message (see logger.LogContext)
+func (p *prefixedLogger) LogContext(ctx context.Context, caller string, code int, msg string, format ...interface{}) error {
+	return p.quiet(p.pushToLedger(ctx, 2, caller, code, p.prefixed(msg, format), format...))
+}
+
+// LogErr logs a prefixed message (see logger.LogErr)
+func (p *prefixedLogger) LogErr(caller string, code int, msg string, format ...interface{}) error {
+	return p.pushToLedger(context.Background(), 2, caller, code, p.prefixed(msg, format), format...)
+}
+
+// TryLog logs a prefixed message without blocking (see logger.TryLog)
+func (p *prefixedLogger) TryLog(caller string, code int, msg string, format ...interface{}) bool {
+	fmsg := p.prefixed(msg, format)
+	if len(format) > 0 {
+		fmsg = fmt.Sprintf(fmsg, format...)
+	}
+	return p.tryPush(3, caller, code, fmsg)
+}
+
+// Logf logs a prefixed message built from a template (see logger.Logf). The
+// prefix is prepended after the placeholders have been substituted.
+func (p *prefixedLogger) Logf(caller string, code int, template string, fields map[string]interface{}) error {
+	return p.quiet(p.push(context.Background(), 2, caller, code, p.prefix+fillTemplate(template, fields), marshalFields(fields)))
+}
+
+// LogAt logs a prefixed message verbatim (see logger.LogAt)
+func (p *prefixedLogger) LogAt(caller string, code int, file string, line int, msg string, fields map[string]interface{}) error {
+	return p.quiet(p.pushAt(caller, code, file, line, p.prefix+msg, encodeFields(fields)))
+}
+
+// NewCaller is a wrapper for the prefixed Log function
+func (p *prefixedLogger) NewCaller(caller string) func(int, string, ...interface{}) error {
+
+	return func(code int, msg string, format ...interface{}) error {
+		return p.quiet(p.pushToLedger(context.Background(), 2, caller, code, p.prefixed(msg, format), format...))
+	}
+
+}
@@ -0,0 +1,245 @@
+package journal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ReadLogfile reads all the entries of a logfile (plain or gzip-compressed).
+// The format is detected per file: files starting with '{' contain JSON lines,
+// files starting with '[' a JSON array and all the others tab-separated values
+// with a header line. Entries are returned as maps of column names to values.
+func ReadLogfile(filename string) ([]map[string]string, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("ReadLogfile: could not open logfile: %s", err.Error())
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	if strings.HasSuffix(filename, ".gz") {
+		zip, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("ReadLogfile: could not decompress logfile: %s", err.Error())
+		}
+		defer zip.Close()
+		reader = zip
+	}
+
+	// Sniff the format (the logfile is read line by line)
+	buffered := bufio.NewReader(reader)
+	first, err := firstNonSpace(buffered)
+	if err != nil {
+		return nil, fmt.Errorf("ReadLogfile: could not read logfile: %s", err.Error())
+	}
+
+	switch first {
+	case 0:
+		return []map[string]string{}, nil
+	case '[':
+		return readJSONArray(buffered)
+	case '{':
+		return readJSONLines(buffered)
+	default:
+		return readTSV(buffered)
+	}
+}
+
+// firstNonSpace peeks at the first byte that is not whitespace (0 if there is none)
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for n := 1; ; n++ {
+		peeked, err := r.Peek(n)
+		if len(peeked) < n {
+			if err == io.EOF {
+				return 0, nil
+			}
+			return 0, err
+		}
+		if c := peeked[n-1]; c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, nil
+		}
+	}
+}
+
+// Search returns the entries of all the logfiles (archives included) of the
+// config's Folder and Filename (named after its FilenameTemplate) that match all
+// the filter values (column name to value, e.g. {"Service": "web", "Type_INT": "1"}).
+// Logfiles are read in chronological order.
+func Search(config *Config, filter map[string]string) ([]map[string]string, error) {
+
+	files, err := ioutil.ReadDir(config.Folder)
+	if err != nil {
+		return nil, fmt.Errorf("Search: could not list logfiles: %s", err.Error())
+	}
+
+	// Collect the logfiles (dates sort chronologically, the undated logfile
+	// of ROT_NONE is always the newest one)
+	host := hostname()
+	pattern := expandFilename(config, host, config.Filename, "*")
+	undated := expandFilename(config, host, config.Filename, "")
+	names := []string{}
+	dates := map[string]string{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			continue
+		}
+		if matchLogfile(undated, name) {
+			names = append(names, name)
+		} else if matchLogfile(pattern, name) {
+			names = append(names, name)
+			dates[name] = archiveDate(pattern, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		_, datedI := dates[names[i]]
+		_, datedJ := dates[names[j]]
+		if datedI != datedJ {
+			return datedI
+		}
+		if dates[names[i]] != dates[names[j]] {
+			return dates[names[i]] < dates[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	// Filter the entries
+	matches := []map[string]string{}
+	for _, name := range names {
+		entries, err := ReadLogfile(path.Join(config.Folder, name))
+		if err != nil {
+			return matches, fmt.Errorf("Search: could not read '%s': %s", name, err.Error())
+		}
+
+		for _, entry := range entries {
+			matched := true
+			for key, value := range filter {
+				matched = matched && entry[key] == value
+			}
+			if matched {
+				matches = append(matches, entry)
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+// readTSV parses tab-separated entries. The first line contains the column names.
+func readTSV(r *bufio.Reader) ([]map[string]string, error) {
+	entries := []map[string]string{}
+
+	var header []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("readTSV: could not read entries: %s", err.Error())
+		}
+
+		// Each value is followed by a tab
+		if trimmed := strings.TrimRight(line, "\r\n"); trimmed != "" {
+			values := strings.Split(strings.TrimSuffix(trimmed, "\t"), "\t")
+			if header == nil {
+				header = values
+			} else {
+				entry := make(map[string]string, len(header))
+				for i, name := range header {
+					if i < len(values) {
+						entry[name] = values[i]
+					}
+				}
+				entries = append(entries, entry)
+			}
+		}
+
+		if err == io.EOF {
+			return entries, nil
+		}
+	}
+}
+
+// readJSONLines parses one JSON-encoded entry per line
+func readJSONLines(r io.Reader) ([]map[string]string, error) {
+	entries := []map[string]string{}
+
+	decoder := json.NewDecoder(r)
+	for {
+		raw := map[string]json.RawMessage{}
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("readJSONLines: could not decode entry: %s", err.Error())
+		}
+		entries = append(entries, flattenJSON(raw))
+	}
+
+	return entries, nil
+}
+
+// readJSONArray parses a JSON array of entries one entry at a time. The closing
+// bracket of the active logfile might be missing.
+func readJSONArray(r io.Reader) ([]map[string]string, error) {
+	entries := []map[string]string{}
+
+	decoder := json.NewDecoder(&closingReader{r: r})
+	if _, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("readJSONArray: could not decode entries: %s", err.Error())
+	}
+
+	for decoder.More() {
+		raw := map[string]json.RawMessage{}
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("readJSONArray: could not decode entry: %s", err.Error())
+		}
+		entries = append(entries, flattenJSON(raw))
+	}
+
+	return entries, nil
+}
+
+// closingReader appends the closing bracket of a JSON array if it is missing
+type closingReader struct {
+	r    io.Reader
+	last byte // Last non-whitespace byte read
+}
+
+// Read reads from the underlying reader and adds the closing bracket at its end
+func (c *closingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for _, b := range p[:n] {
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			c.last = b
+		}
+	}
+
+	if err == io.EOF && c.last != ']' {
+		c.r, c.last = strings.NewReader("]"), ']'
+		err = nil
+	}
+
+	return n, err
+}
+
+// flattenJSON turns the values of a JSON-encoded entry into strings. Structured
+// fields that are not strings are kept JSON-encoded.
+func flattenJSON(raw map[string]json.RawMessage) map[string]string {
+	entry := make(map[string]string, len(raw))
+	for key, value := range raw {
+		var str string
+		if err := json.Unmarshal(value, &str); err == nil {
+			entry[key] = str
+		} else {
+			entry[key] = string(value)
+		}
+	}
+	return entry
+}
@@ -0,0 +1,127 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSearchMixedFormats(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	// The same folder gets a JSON logfile and (after a config change) a TSV one
+	columns := []int64{COL_SERVICE, COL_INSTANCE, COL_MSG_TYPE_INT, COL_MSG}
+	for _, format := range []int{FORMAT_JSON, FORMAT_TSV} {
+		l, err := New(&Config{Service: "web", Instance: "1", Folder: tempdir, Filename: "myservice", Rotation: ROT_NONE, Out: OUT_FILE, Format: format, Columns: columns})
+		if err != nil {
+			t.Fatalf("Could not start logger: %s", err.Error())
+		}
+		l.Log("test", 0, "notification %d", format)
+		l.Log("test", 1, "error %d", format)
+		l.Quit()
+
+		if format == FORMAT_JSON {
+			if err := os.Rename(path.Join(tempdir, "myservice.log"), path.Join(tempdir, "myservice_2017-01-01.log")); err != nil {
+				t.Fatalf("Could not archive logfile: %s", err.Error())
+			}
+		}
+	}
+
+	matches, err := Search(&Config{Folder: tempdir, Filename: "myservice"}, map[string]string{"Service": "web", "Type_INT": "1"})
+	if err != nil {
+		t.Fatalf("Could not search logfiles: %s", err.Error())
+	}
+
+	if len(matches) != 2 {
+		t.Fatalf("Expected 2 errors, got %d", len(matches))
+	}
+
+	// The archived (JSON) logfile comes before the active (TSV) one
+	for i, expected := range []string{"error 1", "error 0"} {
+		if matches[i]["Message"] != expected || matches[i]["Instance"] != "1" {
+			t.Errorf("Unexpected entry: %v", matches[i])
+		}
+	}
+}
+
+func TestSearchFilenameTemplate(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	config := &Config{Folder: tempdir, Filename: "myservice", FilenameTemplate: "{date}-{stem}", Rotation: ROT_NONE, Out: OUT_FILE, Columns: []int64{COL_MSG}}
+	for i, archive := range []string{"2017-01-02-myservice.log", "2017-01-01-myservice.log", ""} {
+		l, err := New(config)
+		if err != nil {
+			t.Fatalf("Could not start logger: %s", err.Error())
+		}
+		l.Log("test", 0, "entry %d", i)
+		l.Quit()
+
+		if archive != "" {
+			if err := os.Rename(path.Join(tempdir, "myservice.log"), path.Join(tempdir, archive)); err != nil {
+				t.Fatalf("Could not archive logfile: %s", err.Error())
+			}
+		}
+	}
+
+	// Logfiles of other stems are left out
+	if err := ioutil.WriteFile(path.Join(tempdir, "2017-01-01-other.log"), []byte("Message\nother\n"), 0600); err != nil {
+		t.Fatalf("Could not write logfile: %s", err.Error())
+	}
+
+	matches, err := Search(config, map[string]string{})
+	if err != nil {
+		t.Fatalf("Could not search logfiles: %s", err.Error())
+	}
+
+	if len(matches) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(matches))
+	}
+
+	for i, expected := range []string{"entry 1", "entry 0", "entry 2"} {
+		if matches[i]["Message"] != expected {
+			t.Errorf("Unexpected entry #%d: %v", i, matches[i])
+		}
+	}
+}
+
+func TestReadLogfileDateColumns(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Folder: tempdir, Filename: "myservice", Rotation: ROT_NONE, Out: OUT_FILE, Columns: []int64{COL_DATE_YYMMDD, COL_TIMESTAMP, COL_MSG}})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	l.Log("test", 0, strings.Repeat("x", 100*1024))
+	l.Quit()
+
+	entries, err := ReadLogfile(path.Join(tempdir, "myservice.log"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Could not read logfile: %v", err)
+	}
+	if entries[0]["Date"] == "" || entries[0]["Timestamp"] == "" || entries[0]["Date"] == entries[0]["Timestamp"] {
+		t.Errorf("Date columns share a header: %v", entries[0])
+	}
+	if len(entries[0]["Message"]) != 100*1024 {
+		t.Errorf("Long message has not been read")
+	}
+}
+
+func TestReadLogfileOpenJSONArray(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	filename := path.Join(tempdir, "active.log")
+	if err := ioutil.WriteFile(filename, []byte("[\n{\"Message\":\"first\"},\n{\"Message\":\"second\"}\n"), 0600); err != nil {
+		t.Fatalf("Could not write logfile: %s", err.Error())
+	}
+
+	entries, err := ReadLogfile(filename)
+	if err != nil || len(entries) != 2 || entries[1]["Message"] != "second" {
+		t.Errorf("Could not read a JSON array without the closing bracket: %v (%v)", entries, err)
+	}
+}
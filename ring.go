@@ -0,0 +1,45 @@
+package journal
+
+import "sync"
+
+// LogRecord is a copy of a log entry (column codes to values, see COL_*)
+type LogRecord map[int64]string
+
+// ringBuffer retains the most recent log entries (see Config.RingBufferSize)
+type ringBuffer struct {
+	mu      sync.Mutex
+	records []LogRecord
+	next    int  // Position of the next record
+	full    bool // Have the oldest records been overwritten?
+}
+
+// newRingBuffer creates a ring buffer of size records
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{records: make([]LogRecord, size)}
+}
+
+// add copies an entry into the ring buffer (overwriting the oldest one)
+func (r *ringBuffer) add(entry *logEntry) {
+	record := entry.toMap()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records[r.next] = record
+	if r.next++; r.next == len(r.records) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// recent returns the retained records (oldest first)
+func (r *ringBuffer) recent() []LogRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]LogRecord{}, r.records[:r.next]...)
+	}
+
+	return append(append([]LogRecord{}, r.records[r.next:]...), r.records[:r.next]...)
+}
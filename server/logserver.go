@@ -2,6 +2,8 @@ package server
 
 import (
   "io"
+  "net"
+  "github.com/vaitekunas/journal"
   "github.com/vaitekunas/journal/logrpc"
   context "golang.org/x/net/context"
 )
@@ -18,15 +20,30 @@ type LogServer interface {
   // RemoveDestination removes a destination/backend
   RemoveDestination(name string) error
 
+  // DestinationStats returns the write metrics of the destinations/backends
+  DestinationStats() map[string]journal.DestStats
+
  // AddToken creates a new token for the service/instance if it does not yet exist
  AddToken(service, instance string) (string, error)
 
- // AggregateServiceStatistics aggregates statistics
- AggregateServiceStatistics() (totalVolume int64, services []*AggregateStatistics, hourly [24][2]int64)
+ // AddTokenValue stores a caller-supplied token for the service/instance if it does not yet exist
+ AddTokenValue(service, instance, token string) error
+
+ // Addr returns the address the gRPC server is bound to
+ Addr() net.Addr
+
+ // AggregateServiceStatistics aggregates statistics per service (sorted by volume share, largest first) and per bucket
+ AggregateServiceStatistics() (totalVolume int64, services []*AggregateStatistics, buckets []*StatisticsBucket)
 
  // Authorize is a gRPC interceptor that authorizes incoming RPCs
  Authorize(ctx context.Context) error
 
+ // Err returns the failure that triggered the kill switch (if any)
+ Err() error
+
+ // ExportTokens exports all the tokens in a portable format (encrypted if a passphrase is provided)
+ ExportTokens(passphrase string) ([]byte, error)
+
  // GatherStatistics saves log-related statistics
  GatherStatistics(service, instance, key, ip string, logEntry *logrpc.LogEntry)
 
@@ -36,9 +53,18 @@ type LogServer interface {
  // GetTokens returns LogServer's authentication tokens
  GetTokens() map[string]string
 
+ // ImportTokens creates the tokens of many service/instances at once (failures are reported per entry)
+ ImportTokens(pairs [][2]string) ([]TokenImport, error)
+
+ // Info returns the server's runtime information (version, uptime, etc.)
+ Info() ServerInfo
+
  // KillSwitch returns the internal killswitch
  KillSwitch() chan bool
 
+ // ConsoleRole returns the management console role (ROLE_*) a secret grants
+ ConsoleRole(secret string) int
+
  // Logfiles returns statistics about available log files
  Logfiles() (map[string]string, error)
 
@@ -48,10 +74,31 @@ type LogServer interface {
  // RemoteLog handles incoming remote logs
  RemoteLog(ctx context.Context, logEntry *logrpc.LogEntry) (*logrpc.Nothing, error)
 
+ // RemoteLogCompact handles incoming remote logs sent in the compact form (parallel arrays of columns and values)
+ RemoteLogCompact(ctx context.Context, compact *logrpc.CompactLogEntry) (*logrpc.Nothing, error)
+
  // RemoveToken removes an authentication token
  RemoveToken(service, instance string, lock bool) error
 
  // RemoveTokens removes all the authentication tokens of a service
  RemoveTokens(service string) error
 
+ // RestoreTokens imports the tokens of an export (failures are reported per entry)
+ RestoreTokens(exported []byte, passphrase string) ([]TokenImport, error)
+
+ // RotateLogs archives the current logfile and opens a fresh one (regardless of the rotation schedule)
+ RotateLogs() error
+
+ // RevokeMatching removes all the authentication tokens matching a glob (or "re:"-prefixed regular expression)
+ RevokeMatching(pattern string) (int, error)
+
+ // StatisticsEnabled returns false if statistics are neither gathered nor stored
+ StatisticsEnabled() bool
+
+ // Version returns the server's version and log entry schema version
+ Version(ctx context.Context, _ *logrpc.Nothing) (*logrpc.ServerVersion, error)
+
+ // VerifyToken lets clients verify their credentials without logging anything
+ VerifyToken(ctx context.Context, _ *logrpc.Nothing) (*logrpc.Nothing, error)
+
 }
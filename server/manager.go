@@ -1,16 +1,15 @@
 package server
 
 import (
-	"bytes"
 	"fmt"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/fatih/color"
 	"github.com/vaitekunas/journal/connect"
-	"github.com/vaitekunas/lentele"
+	"github.com/vaitekunas/journal/logrpc"
 	"github.com/vaitekunas/unixsock"
 )
 
@@ -20,12 +19,27 @@ type ManagementConsole interface {
 	// AttachToServer attaches a management console to the LogServer
 	AttachToServer(LogServer)
 
+	// CmdChunk returns a chunk of a chunked payload
+	CmdChunk(unixsock.Args) *unixsock.Response
+
 	// CmdStatistics displays various statistics
 	CmdStatistics(unixsock.Args) *unixsock.Response
 
+	// CmdStatisticsExport exports raw statistics as csv or json
+	CmdStatisticsExport(unixsock.Args) *unixsock.Response
+
+	// CmdStatus displays the server's version, uptime, etc.
+	CmdStatus(unixsock.Args) *unixsock.Response
+
+	// CmdVersion displays the server's version
+	CmdVersion(unixsock.Args) *unixsock.Response
+
 	// CmdLogsList list all available logfiles and their archives
 	CmdLogsList(unixsock.Args) *unixsock.Response
 
+	// CmdLogsRotate archives the current logfile and opens a fresh one
+	CmdLogsRotate(unixsock.Args) *unixsock.Response
+
 	// CmdRemoteAdd adds a remote backend
 	CmdRemoteAdd(unixsock.Args) *unixsock.Response
 
@@ -38,6 +52,15 @@ type ManagementConsole interface {
 	// CmdTokensAdd adds a new token for a service/instance
 	CmdTokensAdd(unixsock.Args) *unixsock.Response
 
+	// CmdTokensExport exports all the tokens (optionally encrypted)
+	CmdTokensExport(unixsock.Args) *unixsock.Response
+
+	// CmdTokensImport creates the tokens of many service/instances at once
+	CmdTokensImport(unixsock.Args) *unixsock.Response
+
+	// CmdTokensListAll lists all service/instances (incl. revoked ones with statistics)
+	CmdTokensListAll(unixsock.Args) *unixsock.Response
+
 	// CmdTokensListInstances lists all permitted instances of a service
 	CmdTokensListInstances(unixsock.Args) *unixsock.Response
 
@@ -50,6 +73,9 @@ type ManagementConsole interface {
 	// CmdTokensRemoveService removes the token of all instances of a service
 	CmdTokensRemoveService(unixsock.Args) *unixsock.Response
 
+	// CmdTokensRevokeMatching removes the tokens of all service/instances matching a pattern
+	CmdTokensRevokeMatching(unixsock.Args) *unixsock.Response
+
 	// Execute is the executor of management console commands
 	Execute(string, unixsock.Args) *unixsock.Response
 }
@@ -57,13 +83,18 @@ type ManagementConsole interface {
 // NewConsole creates a new management console for the log server
 func NewConsole() ManagementConsole {
 
-	return &managementConsole{}
+	return &managementConsole{
+		chunksMu: &sync.Mutex{},
+		chunks:   map[string]*pendingChunks{},
+	}
 }
 
 // managementConsole handles commands received over the unix socket
 type managementConsole struct {
 	banner    string
 	logserver LogServer
+	chunksMu  *sync.Mutex
+	chunks    map[string]*pendingChunks
 }
 
 // Execute is the executor of management console commands
@@ -78,20 +109,69 @@ func (m *managementConsole) Execute(cmd string, args unixsock.Args) *unixsock.Re
 
 	fmt.Println(console(bold(strings.ToLower(cmd))))
 
-	switch strings.ToLower(cmd) {
+	// Check the role of the caller
+	secret, _ := args["secret"].(string)
+	if role := m.logserver.ConsoleRole(secret); role < requiredRole(strings.ToLower(cmd), args) {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Sprintf("forbidden: command '%s' is not permitted", strings.ToLower(cmd)),
+		}
+	}
+
+	resp := m.execute(strings.ToLower(cmd), args)
+
+	// Warn about arguments the command does not know (not for raw exports and
+	// JSON-encoded results, which carry their own warnings)
+	format, _ := args["format"].(string)
+	if unknown := unknownArguments(strings.ToLower(cmd), args); len(unknown) > 0 && resp.Status == unixsock.STATUS_OK && !strings.HasSuffix(strings.ToLower(cmd), ".export") && strings.ToLower(format) != "json" {
+		resp.Payload = fmt.Sprintf("%s\n%s", resp.Payload, console(fmt.Sprintf("ignored unknown argument(s): %s", strings.Join(unknown, ", "))))
+	}
+
+	// Large payloads are fetched in chunks (if the client asks for it)
+	return m.splitResponse(args, resp)
+}
+
+// execute runs a management console command
+func (m *managementConsole) execute(cmd string, args unixsock.Args) *unixsock.Response {
+
+	switch cmd {
+
+	case "chunk":
+		return m.CmdChunk(args)
 
 	case "statistics":
 		return m.CmdStatistics(args)
 
+	case "statistics.export":
+		return m.CmdStatisticsExport(args)
+
+	case "status":
+		return m.CmdStatus(args)
+
+	case "version":
+		return m.CmdVersion(args)
+
 	case "tokens.add":
 		return m.CmdTokensAdd(args)
 
+	case "tokens.export":
+		return m.CmdTokensExport(args)
+
+	case "tokens.import":
+		return m.CmdTokensImport(args)
+
 	case "tokens.revoke.instance":
 		return m.CmdTokensRemoveInstance(args)
 
 	case "tokens.revoke.service":
 		return m.CmdTokensRemoveService(args)
 
+	case "tokens.revoke.matching":
+		return m.CmdTokensRevokeMatching(args)
+
+	case "tokens.list.all":
+		return m.CmdTokensListAll(args)
+
 	case "tokens.list.instances":
 		return m.CmdTokensListInstances(args)
 
@@ -101,6 +181,9 @@ func (m *managementConsole) Execute(cmd string, args unixsock.Args) *unixsock.Re
 	case "logs.list":
 		return m.CmdLogsList(args)
 
+	case "logs.rotate":
+		return m.CmdLogsRotate(args)
+
 	case "remote.add":
 		return m.CmdRemoteAdd(args)
 
@@ -125,24 +208,121 @@ type arg struct {
 	Kind reflect.Kind
 }
 
+// Arguments known to the management console commands ("format" selects
+// JSON-encoded results, see Result). The arguments "chunk_size" (see
+// splitResponse) and "secret" (see Config.AdminSecret) are known to all of them.
+var knownArguments = map[string][]string{
+	"chunk":                  {"id", "index"},
+	"statistics":             {"format"},
+	"statistics.export":      {"format"},
+	"status":                 {"format"},
+	"version":                {"format"},
+	"tokens.add":             {"service", "instance", "token", "format"},
+	"tokens.export":          {"passphrase"},
+	"tokens.import":          {"tokens", "passphrase", "format"},
+	"tokens.revoke.instance": {"service", "instance", "format"},
+	"tokens.revoke.service":  {"service", "format"},
+	"tokens.revoke.matching": {"pattern", "format"},
+	"tokens.list.all":        {"sort", "offset", "limit", "reveal", "format"},
+	"tokens.list.instances":  {"service", "offset", "limit", "reveal", "format"},
+	"tokens.list.services":   {"offset", "limit", "format"},
+	"logs.list":              {"show", "format"},
+	"logs.rotate":            {"format"},
+	"remote.add":             {"backend", "host", "port", "service", "instance", "token", "format"},
+	"remote.remove":          {"backend", "host", "port", "format"},
+	"remote.list":            {"format"},
+}
+
+// Read-only commands permitted to viewers (all the others require an admin)
+var viewerCommands = map[string]bool{
+	"chunk":                 true,
+	"statistics":            true,
+	"status":                true,
+	"version":               true,
+	"tokens.list.all":       true,
+	"tokens.list.instances": true,
+	"tokens.list.services":  true,
+	"logs.list":             true,
+	"remote.list":           true,
+}
+
+// requiredRole returns the role needed to run a command (revealing tokens
+// requires an admin)
+func requiredRole(cmd string, args unixsock.Args) int {
+	if reveal, _ := args["reveal"].(bool); viewerCommands[cmd] && !reveal {
+		return ROLE_VIEWER
+	}
+	return ROLE_ADMIN
+}
+
 // validArguments verifies that all the required arguments have been provided
-func validArguments(args unixsock.Args, required []arg) bool {
+// and are of the right kind. The error names the first invalid argument.
+func validArguments(args unixsock.Args, required []arg) error {
 	for _, f := range required {
 		x, ok := args[f.Name]
 		if !ok {
-			return false
+			return fmt.Errorf("missing argument '%s'", f.Name)
+		}
+
+		if x == nil || reflect.TypeOf(x).Kind() != f.Kind {
+			return fmt.Errorf("argument '%s' must be of kind %s (got %T)", f.Name, f.Kind, x)
+		}
+	}
+	return nil
+}
+
+// unknownArguments returns the (sorted) arguments a command does not know
+func unknownArguments(cmd string, args unixsock.Args) []string {
+	known := map[string]bool{}
+	for _, name := range knownArguments[cmd] {
+		known[name] = true
+	}
+
+	unknown := []string{}
+	for name := range args {
+		if !known[name] && name != "chunk_size" && name != "secret" {
+			unknown = append(unknown, name)
 		}
+	}
+	sort.Strings(unknown)
+
+	return unknown
+}
+
+// paginate returns the bounds of the page selected by the optional "offset"
+// and "limit" arguments (all rows by default)
+func paginate(args unixsock.Args, total int) (start, end int) {
+
+	start, end = 0, total
 
-		if reflect.TypeOf(x).Kind() != f.Kind {
-			return false
+	if offset, ok := args["offset"].(float64); ok && offset > 0 {
+		start = int(offset)
+		if start > total {
+			start = total
 		}
 	}
-	return true
+
+	if limit, ok := args["limit"].(float64); ok && limit > 0 && start+int(limit) < total {
+		end = start + int(limit)
+	}
+
+	return start, end
 }
 
-var respMissingArgs = &unixsock.Response{
-	Status: "failure",
-	Error:  fmt.Sprint("Missing/invalid parameters"),
+// pageInfo describes a page of rows, e.g. "showing 1-50 of 120"
+func pageInfo(start, end, total int) string {
+	if start == end {
+		return fmt.Sprintf("showing 0 of %d", total)
+	}
+	return fmt.Sprintf("showing %d-%d of %d", start+1, end, total)
+}
+
+// respInvalidArgs is the response to missing/invalid arguments
+func respInvalidArgs(err error) *unixsock.Response {
+	return &unixsock.Response{
+		Status: "failure",
+		Error:  fmt.Sprintf("Missing/invalid parameters: %s", err.Error()),
+	}
 }
 
 // AttachToServer attaches a management console to the log server
@@ -153,56 +333,36 @@ func (m *managementConsole) AttachToServer(srv LogServer) {
 // CmdStatistics displays various log-related statistics
 func (m *managementConsole) CmdStatistics(args unixsock.Args) *unixsock.Response {
 
+	if !m.logserver.StatisticsEnabled() {
+		return statisticsDisabled()
+	}
+
 	// Get aggregated statistics
-	totalLogVolume, aggro, hourly := m.logserver.AggregateServiceStatistics()
+	totalLogVolume, aggro, buckets := m.logserver.AggregateServiceStatistics()
+
+	result := newResult("statistics", "journald statistics")
 
 	// Service table
-	serviceTable := lentele.New("Service", "Instances", "Logs sent", "Volume share")
+	services := result.addTable("services", "Service", "Instances", "Logs", "Volume", "Share")
 	for _, service := range aggro {
-		plogStr, pbyteStr := prettyParsedSums(service.Logs, service.Volume)
-		serviceTable.AddRow("").Insert(service.Service, service.Instances, fmt.Sprintf("%s (%s)", plogStr, pbyteStr), fmt.Sprintf("%6.2f%%", service.Share*100))
+		services.addRow(service.Service, service.Instances, service.Logs, service.Volume, service.Share)
 	}
 
-	// Hourly table
-	hourlyTable := lentele.New("Hour", "Logs sent", "Volume", "Volume share")
-	hourlyVolumeShare := make([]float64, 24)
-	hours := make([]interface{}, 24)
-	for i, stats := range hourly {
-
-		var hour string
-		if i < 10 {
-			hour = fmt.Sprintf("0%d", i)
-		} else {
-			hour = fmt.Sprintf("%d", i)
-		}
-		hours[i] = hour
-
-		plogsStr, pbytesStr := prettyParsedSums(stats[0], stats[1])
-		share := float64(stats[1]) / float64(totalLogVolume)
-		hourlyVolumeShare[i] = share
-		if stats[0] > 0 {
-			row := hourlyTable.AddRow("")
-			row.Insert(hour, plogsStr, pbytesStr, fmt.Sprintf("%6.2f%%", share*100))
+	// Bucket table (see Config.StatsGranularity)
+	table := result.addTable("buckets", "Bucket", "Logs", "Volume", "Share")
+	for _, bucket := range buckets {
+		var share float64
+		if totalLogVolume > 0 {
+			share = float64(bucket.Volume) / float64(totalLogVolume)
 		}
+		table.addRow(bucket.Label, bucket.Logs, bucket.Volume, share)
 	}
 
-	// Print tables and barchart
-	buf := bytes.NewBuffer([]byte{})
-	serviceTable.Render(buf, false, true, true, lentele.LoadTemplate("classic"))
-	buf.WriteString("\n")
-	barchart(buf, hours, hourlyVolumeShare, "▧", color.New(color.FgHiGreen), 10, 1, true)
-	buf.WriteString("\n")
-	hourlyTable.Render(buf, false, true, true, lentele.LoadTemplate("classic"))
-
-	// Successful op
-	return &unixsock.Response{
-		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("journald statistics:\n%s", buf.String())),
-	}
-
+	return respond(args, result)
 }
 
-// CmdTokensAdd adds a new token for a service/instance
+// CmdTokensAdd adds a new token for a service/instance (random unless the
+// argument "token" is set)
 func (m *managementConsole) CmdTokensAdd(args unixsock.Args) *unixsock.Response {
 
 	// Validate arguments
@@ -214,14 +374,20 @@ func (m *managementConsole) CmdTokensAdd(args unixsock.Args) *unixsock.Response
 	// TODO: match service instance names to a [a-z][0-9]-_. regex
 
 	// Validate arguments
-	if !validArguments(args, required) {
-		return respMissingArgs
+	if err := validArguments(args, required); err != nil {
+		return respInvalidArgs(err)
 	}
 
 	// Identify service/instance
 	service := args["service"].(string)
 	instance := args["instance"].(string)
-	token, err := m.logserver.AddToken(service, instance)
+	token, supplied := args["token"].(string)
+	var err error
+	if supplied {
+		err = m.logserver.AddTokenValue(service, instance, token)
+	} else {
+		token, err = m.logserver.AddToken(service, instance)
+	}
 	if err != nil {
 		return &unixsock.Response{
 			Status: unixsock.STATUS_FAIL,
@@ -229,18 +395,111 @@ func (m *managementConsole) CmdTokensAdd(args unixsock.Args) *unixsock.Response
 		}
 	}
 
-	// Prepare table
-	table := lentele.New("Service", "Instance", "Token")
-	table.AddRow("").Insert(service, instance, token).Modify(bold, "Token")
-	buf := bytes.NewBuffer([]byte{})
-	table.Render(buf, false, true, false, lentele.LoadTemplate("classic"))
-
 	// Successful op
+	result := newResult("tokens.add", fmt.Sprintf("added token for '%s'", getCleanKey(service, instance)))
+	result.addTable("tokens", "Service", "Instance", "Token").addRow(service, instance, token)
+
+	return respond(args, result)
+
+}
+
+// CmdTokensExport exports all the tokens (encrypted if the argument "passphrase" is set)
+func (m *managementConsole) CmdTokensExport(args unixsock.Args) *unixsock.Response {
+
+	passphrase, _ := args["passphrase"].(string)
+	exported, err := m.logserver.ExportTokens(passphrase)
+	if err != nil {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Errorf("Could not export tokens: %s", err.Error()).Error(),
+		}
+	}
+
 	return &unixsock.Response{
 		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("added token for '%s':\n%s", bold(getCleanKey(service, instance)), buf.String())),
+		Payload: string(exported),
 	}
+}
 
+// CmdTokensImport creates the tokens of many service/instances at once. The
+// argument "tokens" is either a list of {service, instance} objects (see
+// ParseTokenList) or a token database exported by tokens.export, which is
+// restored along with the tokens' metadata (encrypted exports need the argument
+// "passphrase"). The server reads no files on behalf of the client.
+func (m *managementConsole) CmdTokensImport(args unixsock.Args) *unixsock.Response {
+
+	var imports []TokenImport
+	var pairs [][2]string
+	var exported []byte
+	var err error
+	switch tokens := args["tokens"].(type) {
+	case []interface{}:
+		for _, item := range tokens {
+			object, _ := item.(map[string]interface{})
+			service, _ := object["service"].(string)
+			instance, _ := object["instance"].(string)
+			pairs = append(pairs, [2]string{service, instance})
+		}
+
+	case string:
+		exported = []byte(strings.TrimSpace(tokens))
+
+	default:
+		return respInvalidArgs(fmt.Errorf("argument 'tokens' must be a list of {service, instance} objects or an exported token database"))
+	}
+
+	if exported != nil {
+		passphrase, _ := args["passphrase"].(string)
+		imports, err = m.logserver.RestoreTokens(exported, passphrase)
+	} else {
+		imports, err = m.logserver.ImportTokens(pairs)
+	}
+	if err != nil {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Errorf("could not import tokens: %s", err.Error()).Error(),
+		}
+	}
+
+	// Prepare table
+	created := 0
+	result := newResult("tokens.import", "")
+	table := result.addTable("tokens", "Service", "Instance", "Token", "Status")
+	for _, imported := range imports {
+		status := "created"
+		if imported.Error != "" {
+			status = imported.Error
+		} else {
+			created++
+		}
+		table.addRow(imported.Service, imported.Instance, imported.Token, status)
+	}
+	result.Title = fmt.Sprintf("imported %d of %d token(s)", created, len(imports))
+	result.Values["created"] = created
+
+	return respond(args, result)
+}
+
+// ParseTokenList parses a list of service/instances ("service instance" or
+// "service/instance" per line) to be imported with tokens.import. Empty lines
+// and #-comments are skipped, malformed lines are reported by their (1-based)
+// number only.
+func ParseTokenList(contents string) (pairs [][2]string, malformed []int) {
+	pairs = [][2]string{}
+	for i, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(strings.Replace(line, "/", " ", 1))
+		if len(fields) != 2 {
+			malformed = append(malformed, i+1)
+			continue
+		}
+		pairs = append(pairs, [2]string{fields[0], fields[1]})
+	}
+	return pairs, malformed
 }
 
 // CmdTokensRemoveInstance removes the token of a service/instance
@@ -253,8 +512,8 @@ func (m *managementConsole) CmdTokensRemoveInstance(args unixsock.Args) *unixsoc
 	}
 
 	// Validate arguments
-	if !validArguments(args, required) {
-		return respMissingArgs
+	if err := validArguments(args, required); err != nil {
+		return respInvalidArgs(err)
 	}
 
 	// Identify service/instance
@@ -268,10 +527,7 @@ func (m *managementConsole) CmdTokensRemoveInstance(args unixsock.Args) *unixsoc
 	}
 
 	// Successful op
-	return &unixsock.Response{
-		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("removed token for '%s'\n", bold(getCleanKey(service, instance)))),
-	}
+	return respond(args, newResult("tokens.revoke.instance", fmt.Sprintf("removed token for '%s'", getCleanKey(service, instance))))
 
 }
 
@@ -284,8 +540,8 @@ func (m *managementConsole) CmdTokensRemoveService(args unixsock.Args) *unixsock
 	}
 
 	// Validate arguments
-	if !validArguments(args, required) {
-		return respMissingArgs
+	if err := validArguments(args, required); err != nil {
+		return respInvalidArgs(err)
 	}
 
 	// Identify service/instance
@@ -298,14 +554,42 @@ func (m *managementConsole) CmdTokensRemoveService(args unixsock.Args) *unixsock
 	}
 
 	// Successful op
-	return &unixsock.Response{
-		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("removed all tokens for service '%s'\n", bold(service))),
+	return respond(args, newResult("tokens.revoke.service", fmt.Sprintf("removed all tokens for service '%s'", service)))
+
+}
+
+// CmdTokensRevokeMatching removes the tokens of all service/instances matching a pattern
+func (m *managementConsole) CmdTokensRevokeMatching(args unixsock.Args) *unixsock.Response {
+
+	// Validate arguments
+	required := []arg{
+		arg{"pattern", reflect.String},
+	}
+
+	if err := validArguments(args, required); err != nil {
+		return respInvalidArgs(err)
 	}
 
+	// Remove matching tokens
+	pattern := args["pattern"].(string)
+	count, err := m.logserver.RevokeMatching(pattern)
+	if err != nil {
+		return &unixsock.Response{
+			Status: "failure",
+			Error:  fmt.Errorf("Could not remove tokens matching '%s': %s", pattern, err.Error()).Error(),
+		}
+	}
+
+	// Successful op
+	result := newResult("tokens.revoke.matching", fmt.Sprintf("removed %d token(s) matching '%s'", count, pattern))
+	result.Values["removed"] = count
+
+	return respond(args, result)
+
 }
 
-// CmdTokensListInstances lists all permitted instances of a service
+// CmdTokensListInstances lists all permitted instances of a service. Tokens are
+// masked unless the argument "reveal" is set (admins only).
 func (m *managementConsole) CmdTokensListInstances(args unixsock.Args) *unixsock.Response {
 
 	// Validate arguments
@@ -313,8 +597,8 @@ func (m *managementConsole) CmdTokensListInstances(args unixsock.Args) *unixsock
 		arg{"service", reflect.String},
 	}
 
-	if !validArguments(args, required) {
-		return respMissingArgs
+	if err := validArguments(args, required); err != nil {
+		return respInvalidArgs(err)
 	}
 
 	// Get tokens and stats
@@ -324,31 +608,131 @@ func (m *managementConsole) CmdTokensListInstances(args unixsock.Args) *unixsock
 	// Identify service
 	service := strings.ToLower(args["service"].(string))
 
+	// Tokens are masked unless explicitly revealed
+	reveal, _ := args["reveal"].(bool)
+
+	// Collect the service's instances (sorted, so that pages are stable)
+	keys := []string{}
+	for key := range tokens {
+		if parts := strings.Split(key, "/"); len(parts) == 2 && parts[0] == service {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
 	// Prepare table
-	table := lentele.New("Instance", "Token", "Last known IP", "Logs sent")
+	start, end := paginate(args, len(keys))
+	result := newResult("tokens.list.instances", fmt.Sprintf("available instances for service '%s' (%s)", service, pageInfo(start, end, len(keys))))
+	result.Values["offset"] = start
+	result.Values["total"] = len(keys)
 
-	for key, token := range tokens {
-		parts := strings.Split(key, "/")
-		if len(parts) != 2 {
-			continue
+	table := result.addTable("instances", "Instance", "Token", "LastIP", "Logs", "Volume", "LastActive")
+	for _, key := range keys[start:end] {
+
+		// Instances that have never sent a log have no statistics
+		instanceStats, ok := stats[key]
+		if !ok {
+			instanceStats = &Statistic{}
 		}
-		if parts[0] == service {
-			ip := stats[key].LastIP
-			plogs := stats[key].LogsParsed
-			pbytes := stats[key].LogsParsedBytes
-			plogsStr, pbytesStr, _, _ := parsedSums(plogs, pbytes)
 
-			table.AddRow("").Insert(parts[1], token, ip, fmt.Sprintf("%s (%s)", plogsStr, pbytesStr))
+		_, _, plogs, pbytes := parsedSums(instanceStats.LogsParsed, instanceStats.LogsParsedBytes)
+
+		token := tokens[key]
+		if !reveal {
+			token = maskToken(token)
 		}
+
+		table.addRow(strings.Split(key, "/")[1], token, instanceStats.LastIP, plogs, pbytes, instanceStats.LastActive)
 	}
 
-	buf := bytes.NewBuffer([]byte{})
-	table.Render(buf, false, true, false, lentele.LoadTemplate("classic"))
+	return respond(args, result)
+}
 
-	return &unixsock.Response{
-		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("available instances for service %s:\n%s", bold(service), buf.String())),
+// tokenListOrders sort the rows of tokens.list.all (argument "sort", default "name")
+var tokenListOrders = map[string]func(a, b *tokenListRow) bool{
+	"name":   func(a, b *tokenListRow) bool { return a.key < b.key },
+	"active": func(a, b *tokenListRow) bool { return a.stats.LastActive.After(b.stats.LastActive) },
+	"logs":   func(a, b *tokenListRow) bool { return a.logs > b.logs },
+	"volume": func(a, b *tokenListRow) bool { return a.volume > b.volume },
+}
+
+// tokenListRow is a service/instance listed by tokens.list.all
+type tokenListRow struct {
+	key    string
+	token  string
+	stats  *Statistic
+	logs   int64
+	volume int64
+}
+
+// CmdTokensListAll lists all service/instances with their token status
+// ("active" or "revoked" if only statistics are left) and activity. Tokens
+// are masked unless the argument "reveal" is set (admins only).
+func (m *managementConsole) CmdTokensListAll(args unixsock.Args) *unixsock.Response {
+
+	order := "name"
+	if sortBy, ok := args["sort"].(string); ok {
+		order = strings.ToLower(sortBy)
+	}
+	less, ok := tokenListOrders[order]
+	if !ok {
+		return respInvalidArgs(fmt.Errorf("invalid sort order '%s' (name, active, logs or volume)", order))
+	}
+
+	// Get tokens and stats
+	tokens := m.logserver.GetTokens()
+	stats := m.logserver.GetStatistics()
+
+	// Tokens are masked unless explicitly revealed
+	reveal, _ := args["reveal"].(bool)
+
+	// Collect all service/instances (ties are sorted by name, so that pages are stable)
+	rows := []*tokenListRow{}
+	for key, token := range tokens {
+		rows = append(rows, &tokenListRow{key: key, token: token})
+	}
+	for key := range stats {
+		if _, ok := tokens[key]; !ok {
+			rows = append(rows, &tokenListRow{key: key})
+		}
+	}
+	for _, row := range rows {
+		// Instances that have never sent a log have no statistics
+		if row.stats = stats[row.key]; row.stats == nil {
+			row.stats = &Statistic{}
+		}
+		_, _, row.logs, row.volume = parsedSums(row.stats.LogsParsed, row.stats.LogsParsedBytes)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if less(rows[i], rows[j]) {
+			return true
+		}
+		return !less(rows[j], rows[i]) && rows[i].key < rows[j].key
+	})
+
+	// Prepare table
+	start, end := paginate(args, len(rows))
+	result := newResult("tokens.list.all", fmt.Sprintf("all service instances sorted by %s (%s)", order, pageInfo(start, end, len(rows))))
+	result.Values["offset"] = start
+	result.Values["total"] = len(rows)
+
+	table := result.addTable("tokens", "Service", "Instance", "Status", "Token", "LastIP", "Logs", "Volume", "LastActive")
+	for _, row := range rows[start:end] {
+		status, token := "revoked", ""
+		if row.token != "" {
+			status, token = "active", row.token
+			if !reveal {
+				token = maskToken(token)
+			}
+		}
+		parts := strings.SplitN(row.key, "/", 2)
+		if len(parts) < 2 {
+			parts = append(parts, "")
+		}
+		table.addRow(parts[0], parts[1], status, token, row.stats.LastIP, row.logs, row.volume, row.stats.LastActive)
 	}
+
+	return respond(args, result)
 }
 
 // CmdTokensListServices lists all permitted services
@@ -361,24 +745,88 @@ func (m *managementConsole) CmdTokensListServices(args unixsock.Args) *unixsock.
 	tokens := m.logserver.GetTokens()
 
 	// Service table
-	table := lentele.New("Service", "Instances (incl. inactive)", "Logs sent", "Volume share")
-	for _, service := range aggro {
+	start, end := paginate(args, len(aggro))
+	result := newResult("tokens.list.services", fmt.Sprintf("available services (%s)", pageInfo(start, end, len(aggro))))
+	result.Values["offset"] = start
+	result.Values["total"] = len(aggro)
+
+	table := result.addTable("services", "Service", "Active", "Instances", "Logs", "Volume", "Share")
+	for _, service := range aggro[start:end] {
 		active := 0
 		for key := range tokens {
 			if parts := strings.Split(key, "/"); parts[0] == service.Service {
 				active++
 			}
 		}
-		plogStr, pbyteStr := prettyParsedSums(service.Logs, service.Volume)
-		table.AddRow("").Insert(service.Service, fmt.Sprintf("%d (%d)", active, service.Instances), fmt.Sprintf("%s (%s)", plogStr, pbyteStr), fmt.Sprintf("%6.2f%%", service.Share*100))
+		table.addRow(service.Service, active, service.Instances, service.Logs, service.Volume, service.Share)
 	}
 
-	buf := bytes.NewBuffer([]byte{})
-	table.Render(buf, false, true, false, lentele.LoadTemplate("classic"))
+	return respond(args, result)
+}
+
+// CmdStatisticsExport exports raw statistics of all service/instances as csv
+// or json (default), depending on the "format" argument
+func (m *managementConsole) CmdStatisticsExport(args unixsock.Args) *unixsock.Response {
+
+	if !m.logserver.StatisticsEnabled() {
+		return statisticsDisabled()
+	}
+
+	format := "json"
+	if f, ok := args["format"].(string); ok && f != "" {
+		format = strings.ToLower(f)
+	}
+
+	exported, err := exportStatistics(m.logserver.GetStatistics(), format)
+	if err != nil {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Errorf("Could not export statistics: %s", err.Error()).Error(),
+		}
+	}
 
 	return &unixsock.Response{
 		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("available services:\n%s", buf.String())),
+		Payload: exported,
+	}
+}
+
+// CmdStatus displays the server's version, uptime, etc.
+func (m *managementConsole) CmdStatus(args unixsock.Args) *unixsock.Response {
+
+	info := m.logserver.Info()
+
+	result := newResult("status", "journald status")
+	result.Values["version"] = info.Version
+	result.Values["started"] = info.Started
+	result.Values["uptime"] = int64(info.Uptime / time.Second)
+	result.Values["addr"] = info.Addr
+	result.Values["tokens"] = info.Tokens
+	result.Values["destinations"] = info.Destinations
+	result.Values["logfolder"] = info.Logfolder
+	result.Values["dropped"] = info.Dropped
+	result.Values["truncated"] = info.Truncated
+
+	return respond(args, result)
+}
+
+// CmdVersion displays the server's version
+func (m *managementConsole) CmdVersion(args unixsock.Args) *unixsock.Response {
+
+	info := m.logserver.Info()
+
+	result := newResult("version", fmt.Sprintf("journald version '%s'", info.Version))
+	result.Values["version"] = info.Version
+	result.Values["schema"] = logrpc.SCHEMA_VERSION
+
+	return respond(args, result)
+}
+
+// statisticsDisabled is the response of the statistics commands if statistics are disabled
+func statisticsDisabled() *unixsock.Response {
+	return &unixsock.Response{
+		Status: unixsock.STATUS_FAIL,
+		Error:  "Statistics disabled (see Config.DisableStatistics)",
 	}
 }
 
@@ -413,21 +861,29 @@ func (m *managementConsole) CmdLogsList(args unixsock.Args) *unixsock.Response {
 		names = names[len(names)-tail:]
 	}
 
-	table := lentele.New("Logfile", "Size")
+	result := newResult("logs.list", "available logfiles")
+	table := result.addTable("logfiles", "Logfile", "Size")
 	for _, name := range names {
 		if name == "" {
 			continue
 		}
-		table.AddRow("").Insert(name, logs[name])
+		table.addRow(name, logs[name])
 	}
 
-	buf := bytes.NewBuffer([]byte{})
-	table.Render(buf, false, true, false, lentele.LoadTemplate("classic"))
+	return respond(args, result)
+}
 
-	return &unixsock.Response{
-		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("available logfiles:\n%s", buf.String())),
+// CmdLogsRotate archives the current logfile and opens a fresh one
+func (m *managementConsole) CmdLogsRotate(args unixsock.Args) *unixsock.Response {
+
+	if err := m.logserver.RotateLogs(); err != nil {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  err.Error(),
+		}
 	}
+
+	return respond(args, newResult("logs.rotate", "logfile has been rotated"))
 }
 
 // CmdRemoteAdd adds a remote backend
@@ -440,8 +896,8 @@ func (m *managementConsole) CmdRemoteAdd(args unixsock.Args) *unixsock.Response
 		arg{"port", reflect.Float64},
 	}
 
-	if !validArguments(args, required) {
-		return respMissingArgs
+	if err := validArguments(args, required); err != nil {
+		return respInvalidArgs(err)
 	}
 
 	// Connect to backend
@@ -460,15 +916,23 @@ func (m *managementConsole) CmdRemoteAdd(args unixsock.Args) *unixsock.Response
 			arg{"token", reflect.String},
 		}
 
-		if !validArguments(args, required) {
-			return respMissingArgs
+		if err := validArguments(args, required); err != nil {
+			return respInvalidArgs(err)
 		}
 
 		service := args["service"].(string)
 		instance := args["instance"].(string)
 		token := args["token"].(string)
 
-		remote, err := connect.ToJournald(host, port, service, instance, token, 10*time.Second)
+		// Preflight: the backend has to accept the credentials
+		if err := connect.Verify(host, port, service, instance, token); err != nil {
+			return &unixsock.Response{
+				Status: unixsock.STATUS_FAIL,
+				Error:  err.Error(),
+			}
+		}
+
+		remote, err := connect.ToJournald(host, port, service, instance, token, 10*time.Second, connect.WithDialTimeout(5*time.Second))
 		if err != nil {
 			return &unixsock.Response{
 				Status: unixsock.STATUS_FAIL,
@@ -483,10 +947,7 @@ func (m *managementConsole) CmdRemoteAdd(args unixsock.Args) *unixsock.Response
 			}
 		}
 
-		return &unixsock.Response{
-			Status:  unixsock.STATUS_OK,
-			Payload: console(fmt.Sprintf("added remote backend %s", bold(backendKey))),
-		}
+		return respond(args, newResult("remote.add", fmt.Sprintf("added remote backend '%s'", backendKey)))
 
 	case "kafka":
 		return &unixsock.Response{
@@ -513,8 +974,8 @@ func (m *managementConsole) CmdRemoteRemove(args unixsock.Args) *unixsock.Respon
 		arg{"port", reflect.Float64},
 	}
 
-	if !validArguments(args, required) {
-		return respMissingArgs
+	if err := validArguments(args, required); err != nil {
+		return respInvalidArgs(err)
 	}
 
 	// Remove backend from destination map
@@ -530,36 +991,25 @@ func (m *managementConsole) CmdRemoteRemove(args unixsock.Args) *unixsock.Respon
 		}
 	}
 
-	return &unixsock.Response{
-		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("removed remote backend %s", bold(backendKey))),
-	}
+	return respond(args, newResult("remote.remove", fmt.Sprintf("removed remote backend '%s'", backendKey)))
 
 }
 
 // CmdRemoteList lists all active remote backends
 func (m *managementConsole) CmdRemoteList(args unixsock.Args) *unixsock.Response {
 
-	destinations := m.logserver.ListDestinations()
-	table := lentele.New("Destination")
-	rowWidth := len("Destination")
-	for _, dst := range destinations {
-		if ldst := len(dst); ldst > rowWidth {
-			rowWidth = ldst
+	// Local outputs have no write metrics
+	stats := m.logserver.DestinationStats()
+	result := newResult("remote.list", "destinations currently used by journald")
+	table := result.addTable("destinations", "Destination", "Entries", "Bytes", "Failures", "LastSuccess", "LastError", "Open", "Skipped")
+	for _, dst := range m.logserver.ListDestinations() {
+		if s, ok := stats[dst]; ok {
+			table.addRow(dst, s.Entries, s.Bytes, s.Failures, s.LastSuccess, s.LastError, s.Open, s.Skipped)
+		} else {
+			table.addRow(dst, nil, nil, nil, nil, nil, nil, nil)
 		}
 	}
 
-	format := fmt.Sprintf("%%-%ds", rowWidth)
-	for _, dst := range destinations {
-		table.AddRow("").Insert(fmt.Sprintf(format, dst))
-	}
-
-	buf := bytes.NewBuffer([]byte{})
-	table.Render(buf, false, true, false, lentele.LoadTemplate("classic"))
-
-	return &unixsock.Response{
-		Status:  unixsock.STATUS_OK,
-		Payload: console(fmt.Sprintf("destinations currently used by journald:\n%s", buf.String())),
-	}
+	return respond(args, result)
 
 }
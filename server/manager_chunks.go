@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+// STATUS_CHUNKED is the status of responses whose payload has to be fetched in chunks
+const STATUS_CHUNKED = "chunked"
+
+// chunkExpiry is how long unfetched chunks are kept
+const chunkExpiry = 5 * time.Minute
+
+// ChunkedPayload describes a payload that has been split into chunks. Clients
+// fetch the chunks with the command "chunk" (arguments "id" and "index").
+type ChunkedPayload struct {
+	ID     string `json:"id"`
+	Chunks int    `json:"chunks"`
+	Size   int    `json:"size"`
+}
+
+// pendingChunks are the unfetched chunks of a payload
+type pendingChunks struct {
+	chunks  []string
+	expires time.Time
+}
+
+// splitResponse splits a successful response's payload into chunks of at most
+// chunkSize bytes (argument "chunk_size") if it does not fit into one. UTF-8
+// characters are not split, i.e. each chunk is valid text on its own (a chunk
+// holds at least one character, even if it is longer than chunkSize).
+func (m *managementConsole) splitResponse(args unixsock.Args, resp *unixsock.Response) *unixsock.Response {
+
+	chunkSize, ok := args["chunk_size"].(float64)
+	payload := fmt.Sprint(resp.Payload)
+	if !ok || int(chunkSize) <= 0 || resp.Status != unixsock.STATUS_OK || len(payload) <= int(chunkSize) {
+		return resp
+	}
+
+	id, err := newToken()
+	if err != nil {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Errorf("could not split payload: %s", err.Error()).Error(),
+		}
+	}
+
+	pending := &pendingChunks{expires: time.Now().Add(chunkExpiry)}
+	for start := 0; start < len(payload); {
+		end := start + int(chunkSize)
+		if end >= len(payload) {
+			end = len(payload)
+		} else {
+			for end > start && !utf8.RuneStart(payload[end]) {
+				end--
+			}
+			if end == start {
+				_, size := utf8.DecodeRuneInString(payload[start:])
+				end = start + size
+			}
+		}
+		pending.chunks = append(pending.chunks, payload[start:end])
+		start = end
+	}
+
+	header, err := json.Marshal(&ChunkedPayload{ID: id, Chunks: len(pending.chunks), Size: len(payload)})
+	if err != nil {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Errorf("could not split payload: %s", err.Error()).Error(),
+		}
+	}
+
+	m.chunksMu.Lock()
+	defer m.chunksMu.Unlock()
+
+	// Drop abandoned payloads
+	for key, p := range m.chunks {
+		if time.Now().After(p.expires) {
+			delete(m.chunks, key)
+		}
+	}
+	m.chunks[id] = pending
+
+	return &unixsock.Response{
+		Status:  STATUS_CHUNKED,
+		Payload: string(header),
+	}
+}
+
+// CmdChunk returns a chunk of a chunked payload. Chunks are fetched in order,
+// the payload is dropped once its last chunk has been fetched.
+func (m *managementConsole) CmdChunk(args unixsock.Args) *unixsock.Response {
+
+	// Validate arguments
+	required := []arg{
+		arg{"id", reflect.String},
+		arg{"index", reflect.Float64},
+	}
+
+	if err := validArguments(args, required); err != nil {
+		return respInvalidArgs(err)
+	}
+
+	id := args["id"].(string)
+	index := int(args["index"].(float64))
+
+	m.chunksMu.Lock()
+	defer m.chunksMu.Unlock()
+
+	pending, ok := m.chunks[id]
+	if !ok {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Sprintf("Unknown (or expired) chunked payload '%s'", id),
+		}
+	}
+
+	if index < 0 || index >= len(pending.chunks) {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Sprintf("Chunk %d out of range (%d chunks)", index, len(pending.chunks)),
+		}
+	}
+
+	chunk := pending.chunks[index]
+	if index == len(pending.chunks)-1 {
+		delete(m.chunks, id)
+	}
+
+	return &unixsock.Response{
+		Status:  unixsock.STATUS_OK,
+		Payload: chunk,
+	}
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/vaitekunas/lentele"
+	"github.com/vaitekunas/unixsock"
+)
+
+// Result is the structured result of a management console command. It is
+// returned JSON-encoded if the argument "format" is "json" and rendered as
+// text (see RenderResult) for older clients otherwise.
+type Result struct {
+	Command  string                 `json:"command"`
+	Title    string                 `json:"title"`
+	Values   map[string]interface{} `json:"values,omitempty"`
+	Tables   []*ResultTable         `json:"tables,omitempty"`
+	Warnings []string               `json:"warnings,omitempty"`
+}
+
+// ResultTable is a named table of raw (unformatted) values
+type ResultTable struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// newResult creates an empty result of a command
+func newResult(cmd, title string) *Result {
+	return &Result{
+		Command: cmd,
+		Title:   title,
+		Values:  map[string]interface{}{},
+	}
+}
+
+// addTable adds an empty table to the result
+func (r *Result) addTable(name string, columns ...string) *ResultTable {
+	table := &ResultTable{
+		Name:    name,
+		Columns: columns,
+		Rows:    [][]interface{}{},
+	}
+	r.Tables = append(r.Tables, table)
+	return table
+}
+
+// Table returns the table called name (nil if there is no such table)
+func (r *Result) Table(name string) *ResultTable {
+	for _, table := range r.Tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+// addRow adds a row of values to the table
+func (t *ResultTable) addRow(values ...interface{}) {
+	t.Rows = append(t.Rows, values)
+}
+
+// Value returns the value of a row's column (nil if there is no such column)
+func (t *ResultTable) Value(row []interface{}, column string) interface{} {
+	for i, name := range t.Columns {
+		if name == column && i < len(row) {
+			return row[i]
+		}
+	}
+	return nil
+}
+
+// respond turns a result into a response: JSON-encoded if the argument "format"
+// is "json" and rendered as text otherwise
+func respond(args unixsock.Args, result *Result) *unixsock.Response {
+
+	if format, _ := args["format"].(string); strings.ToLower(format) != "json" {
+		return &unixsock.Response{
+			Status:  unixsock.STATUS_OK,
+			Payload: RenderResult(result),
+		}
+	}
+
+	if unknown := unknownArguments(result.Command, args); len(unknown) > 0 {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("ignored unknown argument(s): %s", strings.Join(unknown, ", ")))
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return &unixsock.Response{
+			Status: unixsock.STATUS_FAIL,
+			Error:  fmt.Errorf("could not encode result: %s", err.Error()).Error(),
+		}
+	}
+
+	return &unixsock.Response{
+		Status:  unixsock.STATUS_OK,
+		Payload: string(encoded),
+	}
+}
+
+// DecodeResult decodes a JSON-encoded result
+func DecodeResult(payload string) (*Result, error) {
+	result := &Result{}
+	if err := json.Unmarshal([]byte(payload), result); err != nil {
+		return nil, fmt.Errorf("DecodeResult: could not decode result: %s", err.Error())
+	}
+	return result, nil
+}
+
+// resultRenderers render the tables of commands that need more than plain tables
+var resultRenderers = map[string]func(io.Writer, *Result){
+	"statistics":            renderStatistics,
+	"remote.list":           renderRemoteList,
+	"status":                renderStatus,
+	"tokens.add":            renderTokensAdd,
+	"tokens.list.all":       renderTokensListAll,
+	"tokens.list.instances": renderTokensListInstances,
+	"tokens.list.services":  renderTokensListServices,
+}
+
+// RenderResult renders a result (decoded or not) as console text
+func RenderResult(result *Result) string {
+
+	buf := bytes.NewBuffer([]byte{})
+	if render, ok := resultRenderers[result.Command]; ok {
+		render(buf, result)
+	} else {
+		for _, table := range result.Tables {
+			renderTable(buf, table, nil)
+		}
+	}
+
+	text := console(emphasize(result.Title))
+	if buf.Len() > 0 {
+		text = fmt.Sprintf("%s:\n%s", text, buf.String())
+	}
+
+	for _, warning := range result.Warnings {
+		text = fmt.Sprintf("%s\n%s", text, console(warning))
+	}
+
+	return text
+}
+
+// quoted matches the quoted parts of a result's title
+var quoted = regexp.MustCompile(`'[^']*'`)
+
+// emphasize renders the quoted parts of a title in bold
+func emphasize(title string) string {
+	return quoted.ReplaceAllStringFunc(title, func(s string) string {
+		return fmt.Sprint(bold(s))
+	})
+}
+
+// renderTable renders a table with its raw values (format may replace a row's values)
+func renderTable(dst io.Writer, table *ResultTable, format func([]interface{}) []interface{}, columns ...string) {
+	if table == nil {
+		return
+	}
+
+	if len(columns) == 0 {
+		columns = table.Columns
+	}
+
+	rendered := lentele.New(columns...)
+	for _, row := range table.Rows {
+		values := row
+		if format != nil {
+			if values = format(row); values == nil {
+				continue
+			}
+		}
+		rendered.AddRow("").Insert(values...)
+	}
+
+	rendered.Render(dst, false, true, false, lentele.LoadTemplate("classic"))
+}
+
+// renderStatistics renders the service and bucket statistics (incl. a barchart)
+func renderStatistics(dst io.Writer, result *Result) {
+
+	// Service table
+	services := result.Table("services")
+	renderTable(dst, services, func(row []interface{}) []interface{} {
+		plogStr, pbyteStr := prettyParsedSums(asInt64(services.Value(row, "Logs")), asInt64(services.Value(row, "Volume")))
+		return []interface{}{services.Value(row, "Service"), asInt64(services.Value(row, "Instances")), fmt.Sprintf("%s (%s)", plogStr, pbyteStr), fmt.Sprintf("%6.2f%%", asFloat64(services.Value(row, "Share"))*100)}
+	}, "Service", "Instances", "Logs sent", "Volume share")
+
+	buckets := result.Table("buckets")
+	if buckets == nil {
+		return
+	}
+
+	// Barchart (ticked by the buckets' positions to keep it narrow, e.g. the
+	// hours of the day)
+	ticks := make([]interface{}, len(buckets.Rows))
+	shares := make([]float64, len(buckets.Rows))
+	for i, row := range buckets.Rows {
+		ticks[i] = fmt.Sprintf("%02d", i)
+		shares[i] = asFloat64(buckets.Value(row, "Share"))
+	}
+	fmt.Fprint(dst, "\n")
+	barchart(dst, ticks, shares, "▧", color.New(color.FgHiGreen), 10, 1, true)
+	fmt.Fprint(dst, "\n")
+
+	// Bucket table (buckets without logs are skipped)
+	renderTable(dst, buckets, func(row []interface{}) []interface{} {
+		logs := asInt64(buckets.Value(row, "Logs"))
+		if logs == 0 {
+			return nil
+		}
+		plogsStr, pbytesStr := prettyParsedSums(logs, asInt64(buckets.Value(row, "Volume")))
+		return []interface{}{buckets.Value(row, "Bucket"), plogsStr, pbytesStr, fmt.Sprintf("%6.2f%%", asFloat64(buckets.Value(row, "Share"))*100)}
+	}, "Bucket", "Logs sent", "Volume", "Volume share")
+}
+
+// renderRemoteList renders the destinations' write metrics (local outputs have none)
+func renderRemoteList(dst io.Writer, result *Result) {
+	now := time.Now()
+	destinations := result.Table("destinations")
+	renderTable(dst, destinations, func(row []interface{}) []interface{} {
+		if destinations.Value(row, "Entries") == nil {
+			return []interface{}{destinations.Value(row, "Destination"), "-", "-", "-", "-", "-"}
+		}
+		circuit := "closed"
+		if open, _ := destinations.Value(row, "Open").(bool); open {
+			circuit = fmt.Sprintf("open (%d skipped)", asInt64(destinations.Value(row, "Skipped")))
+		}
+		plogsStr, pbytesStr := prettyParsedSums(asInt64(destinations.Value(row, "Entries")), asInt64(destinations.Value(row, "Bytes")))
+		return []interface{}{destinations.Value(row, "Destination"), fmt.Sprintf("%s (%s)", plogsStr, pbytesStr), asInt64(destinations.Value(row, "Failures")), relativeTime(asTime(destinations.Value(row, "LastSuccess")), now), destinations.Value(row, "LastError"), circuit}
+	}, "Destination", "Logs sent", "Failures", "Last success", "Last error", "Circuit")
+}
+
+// renderStatus renders the server's info as a property table
+func renderStatus(dst io.Writer, result *Result) {
+	table := lentele.New("Property", "Value")
+	table.AddRow("").Insert("Version", result.Values["version"])
+	table.AddRow("").Insert("Started", asTime(result.Values["started"]).Format("2006-01-02 15:04:05"))
+	table.AddRow("").Insert("Uptime", (time.Duration(asInt64(result.Values["uptime"])) * time.Second).String())
+	table.AddRow("").Insert("Address", result.Values["addr"])
+	table.AddRow("").Insert("Tokens", asInt64(result.Values["tokens"]))
+	table.AddRow("").Insert("Destinations", asInt64(result.Values["destinations"]))
+	table.AddRow("").Insert("Log folder", result.Values["logfolder"])
+	table.AddRow("").Insert("Dropped logs", asInt64(result.Values["dropped"]))
+	table.AddRow("").Insert("Truncated messages", asInt64(result.Values["truncated"]))
+	table.Render(dst, false, true, false, lentele.LoadTemplate("classic"))
+}
+
+// renderTokensAdd renders the new token in bold
+func renderTokensAdd(dst io.Writer, result *Result) {
+	table := lentele.New("Service", "Instance", "Token")
+	if tokens := result.Table("tokens"); tokens != nil {
+		for _, row := range tokens.Rows {
+			table.AddRow("").Insert(row...).Modify(bold, "Token")
+		}
+	}
+	table.Render(dst, false, true, false, lentele.LoadTemplate("classic"))
+}
+
+// renderTokensListAll renders the token status and activity of all service/instances
+func renderTokensListAll(dst io.Writer, result *Result) {
+	now := time.Now()
+	tokens := result.Table("tokens")
+	renderTable(dst, tokens, func(row []interface{}) []interface{} {
+		plogsStr, pbytesStr := prettyParsedSums(asInt64(tokens.Value(row, "Logs")), asInt64(tokens.Value(row, "Volume")))
+		return []interface{}{tokens.Value(row, "Service"), tokens.Value(row, "Instance"), tokens.Value(row, "Status"), tokens.Value(row, "Token"), tokens.Value(row, "LastIP"), fmt.Sprintf("%s (%s)", plogsStr, pbytesStr), relativeTime(asTime(tokens.Value(row, "LastActive")), now)}
+	}, "Service", "Instance", "Status", "Token", "Last known IP", "Logs sent", "Last active")
+}
+
+// renderTokensListInstances renders the instances' activity
+func renderTokensListInstances(dst io.Writer, result *Result) {
+	now := time.Now()
+	instances := result.Table("instances")
+	renderTable(dst, instances, func(row []interface{}) []interface{} {
+		plogsStr, pbytesStr := prettyParsedSums(asInt64(instances.Value(row, "Logs")), asInt64(instances.Value(row, "Volume")))
+		return []interface{}{instances.Value(row, "Instance"), instances.Value(row, "Token"), instances.Value(row, "LastIP"), fmt.Sprintf("%s (%s)", plogsStr, pbytesStr), relativeTime(asTime(instances.Value(row, "LastActive")), now)}
+	}, "Instance", "Token", "Last known IP", "Logs sent", "Last active")
+}
+
+// renderTokensListServices renders the services' activity
+func renderTokensListServices(dst io.Writer, result *Result) {
+	services := result.Table("services")
+	renderTable(dst, services, func(row []interface{}) []interface{} {
+		plogStr, pbyteStr := prettyParsedSums(asInt64(services.Value(row, "Logs")), asInt64(services.Value(row, "Volume")))
+		return []interface{}{services.Value(row, "Service"), fmt.Sprintf("%d (%d)", asInt64(services.Value(row, "Active")), asInt64(services.Value(row, "Instances"))), fmt.Sprintf("%s (%s)", plogStr, pbyteStr), fmt.Sprintf("%6.2f%%", asFloat64(services.Value(row, "Share"))*100)}
+	}, "Service", "Instances (incl. inactive)", "Logs sent", "Volume share")
+}
+
+// asInt64 converts a raw (or JSON-decoded) number to int64
+func asInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+// asFloat64 converts a raw (or JSON-decoded) number to float64
+func asFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// asTime converts a raw (or JSON-decoded) timestamp to time.Time
+func asTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case time.Time:
+		return t
+	case string:
+		parsed, _ := time.Parse(time.RFC3339Nano, t)
+		return parsed
+	}
+	return time.Time{}
+}
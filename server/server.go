@@ -8,135 +8,438 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	context "golang.org/x/net/context"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+)
+
+// Default time to wait for in-flight RPCs on Quit
+const defaultShutdownTimeout = 10 * time.Second
+
+// Default maximum number of servers a forwarded entry may pass
+const defaultMaxHops = 8
+
+// Default number of additional attempts to read the statistics file and the delay between them
+const (
+	defaultStatsLoadRetries    = 2
+	defaultStatsLoadRetryDelay = 500 * time.Millisecond
+)
+
+// Permissions of the files (tokens, statistics) and directories created by the server
+const (
+	fileMode os.FileMode = 0600
+	dirMode  os.FileMode = 0700
+)
+
+// Statistics file format (both formats are recognized when loading)
+const (
+	STATS_JSON = 0 // JSON (human-readable)
+	STATS_GOB  = 1 // gob (compact and faster to encode)
+)
+
+// Statistics eviction policy (see Config.MaxStatistics)
+const (
+	EVICT_LEAST_RECENTLY_ACTIVE = 0 // Evict the statistics that have been inactive the longest
+	EVICT_SMALLEST_VOLUME       = 1 // Evict the statistics with the smallest daily volume
+)
+
+// Default statistics buckets: hourly within a day (see Config.StatsGranularity)
+const (
+	defaultStatsGranularity = time.Hour
+	defaultStatsWindow      = 24 * time.Hour
+	maxStatsBuckets         = 7 * 24 * 60 // A week of minutes
+)
+
+// Management console roles (see Config.AdminSecret)
+const (
+	ROLE_FORBIDDEN = 0 // No access
+	ROLE_VIEWER    = 1 // Read-only commands (statistics, lists, etc.)
+	ROLE_ADMIN     = 2 // All commands
 )
 
 // Config contains all the configuration for the remote logger
 type Config struct {
 
 	// Remote logger config
-	Host         string
+	Host         string // Host/interface to bind to (empty binds all interfaces)
 	Port         int
 	UnixSockPath string
 	TokenPath    string
+	JSONTokens   bool // Store tokens in JSON format (legacy token databases are migrated)
 	StatsPath    string
+	CodesPath    string // JSON file with custom message codes (optional, see loadCodes)
+	MaxDiskBytes int64  // Maximum total size of the log folder (0 - unlimited)
+
+	// Statistics storage
+	DisableStatistics bool // Neither gather nor store statistics (StatsPath can be empty)
+	StatsFormat       int  // Format of the statistics file (STATS_JSON, STATS_GOB)
+	MaxStatistics     int  // Maximum number of retained service/instance statistics (0 - unlimited)
+	StatsEviction     int  // Policy used to evict statistics above MaxStatistics on each dump
+
+	// StatsLoadRetries is how often reading the statistics file is retried at
+	// startup (e.g. if it is locked or on a slow network mount). A corrupt
+	// statistics file does not prevent the start: it is backed up (<StatsPath>.corrupt)
+	// and the server starts with empty statistics.
+	StatsLoadRetries    int           // Additional attempts to read the statistics file (0 - 2)
+	StatsLoadRetryDelay time.Duration // Delay between the attempts (0 - 500ms)
+
+	// StatsGranularity and StatsWindow divide the statistics into buckets: the
+	// logs are counted in the bucket of their time within the window (e.g.
+	// per minute of an hour). The window must be a multiple of the granularity.
+	// Defaults: hourly buckets within a day.
+	StatsGranularity time.Duration
+	StatsWindow      time.Duration
+
+	// The server writes an entry to the local logger when it has started (with
+	// the version and a configuration summary) and when it is stopping, unless
+	// QuietLifecycle is set.
+	QuietLifecycle bool
+	Version        string // Version reported in the lifecycle entries
+
+	// ShutdownTimeout limits how long Quit waits for in-flight RPCs to
+	// finish before stopping the gRPC server forcefully (0 - 10 seconds)
+	ShutdownTimeout time.Duration
+
+	// UnaryInterceptors (e.g. tracing, metrics) are chained after the
+	// authorization interceptor and run in the given order, i.e. only for
+	// authorized RPCs.
+	UnaryInterceptors []grpc.UnaryServerInterceptor
+
+	// GRPCOptions are appended to journald's own gRPC server options. gRPC
+	// permits only a single unary interceptor option, so custom interceptors
+	// must be passed via UnaryInterceptors instead.
+	GRPCOptions []grpc.ServerOption
+
+	// EnableReflection registers the gRPC reflection service (e.g. for grpcurl).
+	// Reflection exposes the service schema to anyone, so use it for debugging only.
+	EnableReflection bool
+
+	// AdminSecret and ViewerSecret protect the management console: commands
+	// must pass one of them as the argument "secret". The viewer secret permits
+	// read-only commands only. Without an admin secret the console is open.
+	AdminSecret  string
+	ViewerSecret string
+
+	// SelfReportInterval is how often the server logs a summary of its
+	// throughput since the previous summary (0 - never)
+	SelfReportInterval time.Duration
+
+	// The IP recorded in the statistics is the address of the connection. Set
+	// TrustClientIP to use the IP claimed by the client instead (e.g. if all
+	// clients are behind a NAT). Connections from TrustedProxies (IPs) may
+	// pass the client's IP in the metadata "x-forwarded-for".
+	TrustClientIP  bool
+	TrustedProxies []string
+
+	// Entries forwarded to other servers (see AddDestination) carry the IDs of
+	// the servers they have passed (column journal.COL_ROUTE). Entries revisiting
+	// this server or having passed MaxHops servers are dropped, so that
+	// forwarding cycles terminate.
+	ServerID string // Unique ID of this server (default: random)
+	MaxHops  int    // Maximum number of servers an entry may pass (0 - 8)
 
 	// Local logger config
 	LoggerConfig *journal.Config
 }
 
-// New creates a new logserver instance
+// ValidateConfig performs all the configuration checks done by New without
+// binding any sockets or starting the server
+func ValidateConfig(config *Config) error {
+
+	if config == nil {
+		return fmt.Errorf("ValidateConfig: missing configuration")
+	}
+
+	// Network
+	if err := validHost(config.Host); err != nil {
+		return fmt.Errorf("ValidateConfig: invalid host: %s", err.Error())
+	}
+	if config.Port < 0 || config.Port > 65535 {
+		return fmt.Errorf("ValidateConfig: invalid port '%d'", config.Port)
+	}
+
+	// Paths
+	for name, path := range map[string]string{
+		"unix socket": config.UnixSockPath,
+		"token":       config.TokenPath,
+		"statistics":  config.StatsPath,
+	} {
+		if path == "" && name == "statistics" && config.DisableStatistics {
+			continue
+		}
+		if path == "" {
+			return fmt.Errorf("ValidateConfig: missing %s path", name)
+		}
+		if f, err := os.Stat(path); err == nil && f.IsDir() {
+			return fmt.Errorf("ValidateConfig: %s path '%s' is a directory", name, path)
+		}
+	}
+
+	if config.CodesPath != "" {
+		if _, err := loadCodes(config.CodesPath); err != nil {
+			return fmt.Errorf("ValidateConfig: invalid custom codes: %s", err.Error())
+		}
+	}
+
+	if config.MaxDiskBytes < 0 {
+		return fmt.Errorf("ValidateConfig: invalid maximum disk usage '%d'", config.MaxDiskBytes)
+	}
+	if config.StatsFormat < STATS_JSON || config.StatsFormat > STATS_GOB {
+		return fmt.Errorf("ValidateConfig: invalid statistics format '%d'", config.StatsFormat)
+	}
+	if config.MaxStatistics < 0 {
+		return fmt.Errorf("ValidateConfig: invalid maximum number of statistics '%d'", config.MaxStatistics)
+	}
+	if config.StatsEviction < EVICT_LEAST_RECENTLY_ACTIVE || config.StatsEviction > EVICT_SMALLEST_VOLUME {
+		return fmt.Errorf("ValidateConfig: invalid statistics eviction policy '%d'", config.StatsEviction)
+	}
+	if config.StatsLoadRetries < 0 {
+		return fmt.Errorf("ValidateConfig: invalid number of statistics load retries '%d'", config.StatsLoadRetries)
+	}
+	if config.StatsLoadRetryDelay < 0 {
+		return fmt.Errorf("ValidateConfig: invalid statistics load retry delay '%s'", config.StatsLoadRetryDelay)
+	}
+	if _, _, err := statsBuckets(config.StatsGranularity, config.StatsWindow); err != nil {
+		return fmt.Errorf("ValidateConfig: invalid statistics buckets: %s", err.Error())
+	}
+	if config.ViewerSecret != "" && config.AdminSecret == "" {
+		return fmt.Errorf("ValidateConfig: a viewer secret requires an admin secret")
+	}
+	if config.ViewerSecret != "" && config.ViewerSecret == config.AdminSecret {
+		return fmt.Errorf("ValidateConfig: the viewer secret must differ from the admin secret")
+	}
+	if config.ShutdownTimeout < 0 {
+		return fmt.Errorf("ValidateConfig: invalid shutdown timeout '%s'", config.ShutdownTimeout)
+	}
+	if config.SelfReportInterval < 0 {
+		return fmt.Errorf("ValidateConfig: invalid self-report interval '%s'", config.SelfReportInterval)
+	}
+	for _, proxy := range config.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			return fmt.Errorf("ValidateConfig: invalid trusted proxy '%s'", proxy)
+		}
+	}
+	if strings.Contains(config.ServerID, ",") {
+		return fmt.Errorf("ValidateConfig: invalid server ID '%s' (must not contain commas)", config.ServerID)
+	}
+	if config.MaxHops < 0 {
+		return fmt.Errorf("ValidateConfig: invalid maximum number of hops '%d'", config.MaxHops)
+	}
+
+	// Local logger
+	if config.LoggerConfig == nil {
+		return fmt.Errorf("ValidateConfig: missing logger configuration")
+	}
+	if err := journal.ValidateConfig(config.LoggerConfig); err != nil {
+		return fmt.Errorf("ValidateConfig: invalid logger configuration: %s", err.Error())
+	}
+
+	return nil
+}
+
+// New creates a new logserver instance. All startup failures (e.g. a port
+// that is already in use) are returned as errors. Should the gRPC server fail
+// later on, the failure is logged and the kill switch is triggered.
 func New(config *Config, manager ManagementConsole) (LogServer, error) {
 
+	// Validate configuration
+	if err := ValidateConfig(config); err != nil {
+		return nil, fmt.Errorf("New: invalid configuration: %s", err.Error())
+	}
+
 	// Instantiate remote logserver
-	rLogger := &logServer{Mutex: &sync.Mutex{}}
+	rLogger := &logServer{RWMutex: &sync.RWMutex{}, statsMu: &sync.RWMutex{}}
+	rLogger.unixSockPath = config.UnixSockPath
+	rLogger.statsPath = config.StatsPath
+	rLogger.statsFormat = config.StatsFormat
+	rLogger.maxStats = config.MaxStatistics
+	rLogger.statsEviction = config.StatsEviction
+	rLogger.statsLoadRetries = config.StatsLoadRetries
+	if rLogger.statsLoadRetries == 0 {
+		rLogger.statsLoadRetries = defaultStatsLoadRetries
+	}
+	rLogger.statsLoadDelay = config.StatsLoadRetryDelay
+	if rLogger.statsLoadDelay == 0 {
+		rLogger.statsLoadDelay = defaultStatsLoadRetryDelay
+	}
+	rLogger.statsGranularity, rLogger.statsWindow, _ = statsBuckets(config.StatsGranularity, config.StatsWindow)
+	rLogger.tokenPath = config.TokenPath
+	rLogger.logfolder = config.LoggerConfig.Folder
+	rLogger.stats = make(map[string]*Statistic)
+	rLogger.tokens = make(map[string]*tokenRecord)
+	rLogger.tokensJSON = config.JSONTokens
+	rLogger.quitChan = make(chan bool, 1)
+	rLogger.shutdownTimeout = config.ShutdownTimeout
+	if rLogger.shutdownTimeout == 0 {
+		rLogger.shutdownTimeout = defaultShutdownTimeout
+	}
+	rLogger.logLifecycle = !config.QuietLifecycle
+	rLogger.version = config.Version
+	if rLogger.version == "" {
+		rLogger.version = "N/A"
+	}
+	rLogger.started = time.Now()
+	rLogger.statsDisabled = config.DisableStatistics
+	rLogger.adminSecret = config.AdminSecret
+	rLogger.viewerSecret = config.ViewerSecret
+	rLogger.counters = newReportCounters()
+	rLogger.trustClientIP = config.TrustClientIP
+	for _, proxy := range config.TrustedProxies {
+		rLogger.trustedProxies = append(rLogger.trustedProxies, net.ParseIP(proxy))
+	}
+	rLogger.serverID = config.ServerID
+	if rLogger.serverID == "" {
+		id, errID := newToken()
+		if errID != nil {
+			return nil, fmt.Errorf("New: could not generate a server ID: %s", errID.Error())
+		}
+		rLogger.serverID = id[:16]
+	}
+	rLogger.maxHops = config.MaxHops
+	if rLogger.maxHops == 0 {
+		rLogger.maxHops = defaultMaxHops
+	}
 
-	// Internal context used to cancel supporting goroutines
-	internalCTX, cancel := context.WithCancel(context.Background())
+	// Load auth tokens from disk (corrupt tokens are reported once the logger
+	// runs, the admin can re-add them via the management console)
+	var corruptTokens error
+	if errToken := rLogger.loadTokensFromDisk(); errToken != nil {
+		if _, corrupt := errToken.(*corruptDBError); !corrupt {
+			return nil, fmt.Errorf("New: could not load tokens from disk: %s", errToken.Error())
+		}
+		corruptTokens = errToken
+	}
+
+	// Load statistics from disk (corrupt statistics are reported once the logger runs)
+	var corruptStats error
+	if !rLogger.statsDisabled {
+		if errStats := rLogger.loadStatisticsFromDisk(); errStats != nil {
+			if _, corrupt := errStats.(*corruptDBError); !corrupt {
+				return nil, fmt.Errorf("New: could not load statistics from disk: %s", errStats.Error())
+			}
+			corruptStats = errStats
+		}
+	}
+
+	// Load custom message codes
+	var codes map[int]journal.Code
+	if config.CodesPath != "" {
+		var errCodes error
+		if codes, errCodes = loadCodes(config.CodesPath); errCodes != nil {
+			return nil, fmt.Errorf("New: could not load custom codes: %s", errCodes.Error())
+		}
+	}
+
+	// Instantiate logger (the caller's logger config is left untouched)
+	loggerConfig := *config.LoggerConfig
+	if config.MaxDiskBytes > 0 {
+		loggerConfig.MaxDiskBytes = config.MaxDiskBytes
+	}
+	logger, err := journal.New(&loggerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("New: could not start logger: %s", err.Error())
+	}
+	rLogger.logger = logger
+	if codes != nil {
+		logger.UseCustomCodes(codes)
+	}
+	if corruptTokens != nil {
+		logger.Log("journald", 10, "New: %s. All clients are rejected until their tokens are added again via the management console!", corruptTokens.Error())
+	}
+	if corruptStats != nil {
+		logger.Log("journald", 1, "New: %s", corruptStats.Error())
+	}
 
 	// Start the unix domain socket server
 	manager.AttachToServer(rLogger)
 	sockSrv, err := unixsrv.New(config.UnixSockPath, manager.Execute)
 	if err != nil {
+		logger.Quit()
 		return nil, fmt.Errorf("New: could not listen on the unix domain socket: %s", err.Error())
 	}
+	rLogger.unixsrv = sockSrv
 
 	// Listen on tcp
-	listenTCP, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Port))
+	listenTCP, err := net.Listen("tcp", net.JoinHostPort(config.Host, strconv.Itoa(config.Port)))
 	if err != nil {
 		sockSrv.Stop()
+		logger.Quit()
 		return nil, fmt.Errorf("New: could not listen on tcp socket: %s", err.Error())
 	}
+	rLogger.listenTCP = listenTCP
 
-	// Create Auth interceptor
-	intercept := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	// Create Auth interceptor (always the first link of the chain)
+	authorize := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		if errAuth := rLogger.Authorize(ctx); errAuth != nil {
 			return nil, errAuth
 		}
 		return handler(ctx, req)
 	}
+	intercept := chainUnaryInterceptors(append([]grpc.UnaryServerInterceptor{authorize}, config.UnaryInterceptors...)...)
+	rLogger.server = grpc.NewServer(append([]grpc.ServerOption{grpc.UnaryInterceptor(intercept)}, config.GRPCOptions...)...)
 
-	// Put everything together
+	// Internal context used to cancel supporting goroutines
+	internalCTX, cancel := context.WithCancel(context.Background())
 	rLogger.cancelSupport = cancel
-	rLogger.unixSockPath = config.UnixSockPath
-	rLogger.unixsrv = sockSrv
-	rLogger.listenTCP = listenTCP
-	rLogger.statsPath = config.StatsPath
-	rLogger.tokenPath = config.TokenPath
-	rLogger.logfolder = config.LoggerConfig.Folder
-	rLogger.server = grpc.NewServer(grpc.UnaryInterceptor(intercept))
-	rLogger.stats = make(map[string]*Statistic)
-	rLogger.tokens = make(map[string]string)
-	rLogger.quitChan = make(chan bool, 1)
 
-	// Load auth tokens from disk
-	if errToken := rLogger.loadTokensFromDisk(); errToken != nil {
-		return nil, fmt.Errorf("New: could not load tokens from disk: %s", errToken.Error())
+	// Periodically dump statistics to file
+	if !rLogger.statsDisabled {
+		go rLogger.periodicallyDumpStats(internalCTX, 60*time.Second)
 	}
 
-	// Load statistics from disk
-	if errStats := rLogger.loadStatisticsFromDisk(); errStats != nil {
-		return nil, fmt.Errorf("New: could not load statistics from disk: %s", errStats.Error())
+	// Periodically log a throughput summary
+	if config.SelfReportInterval > 0 {
+		go rLogger.periodicallyReport(internalCTX, config.SelfReportInterval)
 	}
 
-	// Periodically dump statistics to file
-	go rLogger.periodicallyDumpStats(internalCTX, 60*time.Second)
-
-	// Serve gRPC requests
+	// Serve gRPC requests. Failures (other than those caused by Quit
+	// stopping the server) trigger the kill switch.
 	logrpc.RegisterRemoteLoggerServer(rLogger.server, rLogger)
-	failChan := make(chan error, 1)
-	go func() {
-		if errTCP := rLogger.server.Serve(listenTCP); errTCP != nil {
-			failChan <- errTCP
-		}
-	}()
-
-	// Quit if gRPC server fails (wait for 10 seconds to be sure)
+	if config.EnableReflection {
+		reflection.Register(rLogger.server)
+	}
 	go func() {
-		select {
-		case errTCP := <-failChan:
-			if errTCP != nil {
-				fmt.Printf("New: could not serve TCP requests: %s\n", errTCP.Error())
-				rLogger.Quit()
-				os.Exit(1)
+		if errTCP := rLogger.server.Serve(listenTCP); errTCP != nil && internalCTX.Err() == nil {
+			rLogger.logger.Log("journald", 1, "New: could not serve TCP requests: %s", errTCP.Error())
+			rLogger.Lock()
+			rLogger.err = fmt.Errorf("could not serve TCP requests: %s", errTCP.Error())
+			rLogger.Unlock()
+			select {
+			case rLogger.quitChan <- true:
+			default:
 			}
-		case <-time.After(10 * time.Second):
 		}
 	}()
 
-	// Wait for gRPC server to start up
-	go func() {
-		<-internalCTX.Done()
-		rLogger.server.Stop()
-	}()
-
-	// Instantiate logger
-	logger, err := journal.New(config.LoggerConfig)
-	if err != nil {
-		return nil, fmt.Errorf("New: could not start logger: %s", err.Error())
+	// Record the start in the logs
+	if rLogger.logLifecycle {
+		logger.Log("journald", 0, "New: server started (version: %s, tcp: %s, unix socket: %s, folder: %s, rotation: %d, output: %d)",
+			rLogger.version, listenTCP.Addr().String(), config.UnixSockPath, config.LoggerConfig.Folder, config.LoggerConfig.Rotation, config.LoggerConfig.Out)
 	}
-	rLogger.logger = logger
 
 	return rLogger, nil
 }
 
 // Statistic contains various log-related statistics
 type Statistic struct {
+	mu sync.Mutex // Protects the counters of a single service/instance
+
 	Service         string
 	Instance        string
-	LogsParsed      [24]int64
-	LogsParsedBytes [24]int64
+	LogsParsed      []int64 // Logs per bucket (see Config.StatsGranularity)
+	LogsParsedBytes []int64 // Volume per bucket
 	LastIP          string
 	LastActive      time.Time
 }
 
 // logServer implements log.Logger and log.RemoteLoggerServer interfaces
 type logServer struct {
-	*sync.Mutex // Mutex for tokens and statistics
+	*sync.RWMutex // Mutex for tokens and configuration
 
 	logger journal.Logger // Local logger
 	server *grpc.Server   // gRPC server
@@ -147,44 +450,146 @@ type logServer struct {
 	unixsrv      unixsrv.UnixSockSrv // UNIX domain socket server
 	listenTCP    net.Listener        // TCP listener (grpc)
 
-	cancelSupport func() // Internal context cancel function to stop all supporting goroutines
-
-	statsPath string                // A path to the file where all the statistics are kept
-	stats     map[string]*Statistic // Log statistics map[service/instance]*Statistic
-
-	tokenPath string            // A path to the file where all the tokens are kept
-	tokens    map[string]string // Authorization tokens map[service/instance]token
+	cancelSupport   func()          // Internal context cancel function to stop all supporting goroutines
+	shutdownTimeout time.Duration   // Maximum time to wait for in-flight RPCs on Quit
+	logLifecycle    bool            // Log server start and stop
+	version         string          // Version of the server
+	started         time.Time       // Start time of the server
+	adminSecret     string          // Management console secret permitting all commands
+	viewerSecret    string          // Management console secret permitting read-only commands
+	counters        *reportCounters // Throughput since the last self-report
+	trustClientIP   bool            // Record the IP claimed by the client
+	trustedProxies  []net.IP        // Proxies whose x-forwarded-for is honored
+	serverID        string          // ID of this server in the routes of forwarded entries
+	maxHops         int             // Maximum number of servers an entry may pass
+
+	statsDisabled    bool                  // Are statistics neither gathered nor stored?
+	statsPath        string                // A path to the file where all the statistics are kept
+	statsFormat      int                   // Format of the statistics file
+	maxStats         int                   // Maximum number of retained statistics (0 - unlimited)
+	statsEviction    int                   // Eviction policy of the statistics above maxStats
+	statsLoadRetries int                   // Additional attempts to read the statistics file at startup
+	statsLoadDelay   time.Duration         // Delay between the attempts to read the statistics file
+	statsGranularity time.Duration         // Duration of a statistics bucket (see buckets)
+	statsWindow      time.Duration         // Duration of all the statistics buckets
+	statsMu          *sync.RWMutex         // Mutex for the statistics map (counters are locked per statistic)
+	stats            map[string]*Statistic // Log statistics map[service/instance]*Statistic
+
+	tokenPath  string                  // A path to the file where all the tokens are kept
+	tokensJSON bool                    // Is the token database JSON-encoded?
+	tokens     map[string]*tokenRecord // Authorization tokens map[service/instance]token
 
 	quitChan chan bool // Internal kill switch
+	err      error     // Failure that triggered the kill switch
 }
 
 // RemoteLog handles incoming remote logs
 func (l *logServer) RemoteLog(ctx context.Context, logEntry *logrpc.LogEntry) (*logrpc.Nothing, error) {
+	return l.remoteLog(ctx, "RemoteLog", compactFromMap(logEntry.GetEntry()))
+}
+
+// RemoteLogCompact handles incoming remote logs sent in the compact form
+// (parallel arrays of columns and values)
+func (l *logServer) RemoteLogCompact(ctx context.Context, compact *logrpc.CompactLogEntry) (*logrpc.Nothing, error) {
+
+	if len(compact.GetColumns()) != len(compact.GetValues()) {
+		return nil, fmt.Errorf("RemoteLogCompact: got %d columns, but %d values", len(compact.GetColumns()), len(compact.GetValues()))
+	}
+
+	return l.remoteLog(ctx, "RemoteLogCompact", compact)
+}
+
+// remoteLog processes an incoming remote log in the compact form (entries
+// received as a map are converted once) and passes it on to the logger
+func (l *logServer) remoteLog(ctx context.Context, name string, entry *logrpc.CompactLogEntry) (*logrpc.Nothing, error) {
 
 	// Extract credentials
-	service, instance, key, _, ip, err := extractCaller(ctx)
+	service, instance, key, _, claimedIP, meta, err := extractCaller(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not extract caller credentials: %s", name, err.Error())
+	}
+
+	// Drop forwarded entries that are going around in circles (silently, since
+	// a failure would be logged and forwarded in turn)
+	route, ok := l.extendRoute(columnValue(entry, journal.COL_ROUTE))
+	if !ok {
+		l.counters.drop()
+		return &logrpc.Nothing{}, nil
+	}
+	setColumn(entry, journal.COL_ROUTE, route)
+
+	// Add the caller's metadata to the (forwarded) metadata of the entry
+	encoded := columnValue(entry, journal.COL_METADATA)
+	merged, err := mergeMetadata(encoded, meta)
 	if err != nil {
-		return nil, fmt.Errorf("RemoteLog: could not extract caller credentials")
+		l.counters.drop()
+		return nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	if merged != encoded {
+		setColumn(entry, journal.COL_METADATA, merged)
 	}
 
 	// Update statistics
-	go l.GatherStatistics(service, instance, key, ip, logEntry)
+	size := entrySize(entry)
+	if !l.statsDisabled {
+		l.gatherStatistics(service, instance, key, l.callerIP(ctx, claimedIP), entryTime(entry, time.Now()), size)
+	}
+
+	// The entry originates from the authenticated caller (prevents spoofing)
+	setColumn(entry, journal.COL_SERVICE, service)
+	setColumn(entry, journal.COL_INSTANCE, instance)
 
 	// Push entry into the log entry channel
-	if err := l.logger.RawEntry(logEntry.GetEntry()); err != nil {
-		return nil, fmt.Errorf("RemoteLog: could not process raw log: %s", err.Error())
+	if err := l.logger.RawColumns(entry.Columns, entry.Values); err != nil {
+		l.counters.drop()
+		return nil, fmt.Errorf("%s: could not process raw log: %s", name, err.Error())
 	}
+	l.counters.received(size)
 
 	return &logrpc.Nothing{}, nil
 }
 
+// extendRoute adds this server to the route of an entry (comma-separated server
+// IDs). Returns false if the entry has passed this server before or the route
+// has reached the maximum number of hops.
+func (l *logServer) extendRoute(route string) (string, bool) {
+
+	if route == "" || route == "N/A" {
+		return l.serverID, true
+	}
+
+	hops := strings.Split(route, ",")
+	if len(hops) >= l.maxHops {
+		return "", false
+	}
+	for _, hop := range hops {
+		if hop == l.serverID {
+			return "", false
+		}
+	}
+
+	return route + "," + l.serverID, true
+}
+
+// VerifyToken lets clients verify their credentials without logging anything
+// (authorization is done by the interceptor)
+func (l *logServer) VerifyToken(ctx context.Context, _ *logrpc.Nothing) (*logrpc.Nothing, error) {
+	return &logrpc.Nothing{}, nil
+}
+
+// Version returns the server's version and log entry schema version. Clients
+// use it to negotiate the compact form of the log entries.
+func (l *logServer) Version(ctx context.Context, _ *logrpc.Nothing) (*logrpc.ServerVersion, error) {
+	return &logrpc.ServerVersion{Version: l.version, Schema: logrpc.SCHEMA_VERSION, Compact: true}, nil
+}
+
 // Authorize is a gRPC interceptor that authorizes incoming RPCs
 func (l *logServer) Authorize(ctx context.Context) error {
-	l.Lock()
-	defer l.Unlock()
+	l.RLock()
+	defer l.RUnlock()
 
 	// Verify presence of metadata
-	_, _, key, token, _, err := extractCaller(ctx)
+	_, _, key, token, _, err := extractCredentials(ctx)
 	if err != nil {
 		return fmt.Errorf("Authorize: cannot extract caller credentials :%s", err.Error())
 	}
@@ -196,10 +601,15 @@ func (l *logServer) Authorize(ctx context.Context) error {
 	}
 
 	// Authorize
-	if realToken != token {
+	if realToken.Token != token {
 		return fmt.Errorf("Authorize: bad token")
 	}
 
+	// Reject clients sending entries of another schema
+	if err := checkSchema(ctx); err != nil {
+		return fmt.Errorf("Authorize: incompatible client: %s", err.Error())
+	}
+
 	return nil
 }
 
@@ -208,13 +618,13 @@ func (l *logServer) AddDestination(name string, writer io.Writer) error {
 	l.Lock()
 	defer l.Unlock()
 
-	return l.logger.AddDestination(name, writer)
+	return l.logger.AddDestination(name, &countingWriter{name: name, writer: writer, counters: l.counters})
 }
 
 // Lists all destinations/backends
 func (l *logServer) ListDestinations() []string {
-	l.Lock()
-	defer l.Unlock()
+	l.RLock()
+	defer l.RUnlock()
 
 	return l.logger.ListDestinations()
 }
@@ -227,22 +637,67 @@ func (l *logServer) RemoveDestination(name string) error {
 	return l.logger.RemoveDestination(name)
 }
 
+// DestinationStats returns the write metrics of the destinations/backends
+func (l *logServer) DestinationStats() map[string]journal.DestStats {
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.logger.DestinationStats()
+}
+
+// Addr returns the address the gRPC server is bound to (useful when binding to port 0)
+func (l *logServer) Addr() net.Addr {
+	return l.listenTCP.Addr()
+}
+
+// StatisticsEnabled returns false if statistics are neither gathered nor stored
+func (l *logServer) StatisticsEnabled() bool {
+	return !l.statsDisabled
+}
+
+// Err returns the failure that triggered the kill switch (nil if the server
+// is healthy or the kill switch has been triggered via the management console)
+func (l *logServer) Err() error {
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.err
+}
+
 // KillSwitch returns the internal killswitch
 func (l *logServer) KillSwitch() chan bool {
 	return l.quitChan
 }
 
-// Quit stops the server and all goroutines
+// Quit stops the server and all goroutines. In-flight RPCs are given
+// the shutdown timeout to finish, after which the local logger is flushed.
 func (l *logServer) Quit() {
 
+	// Record the shutdown in the logs
+	if l.logLifecycle {
+		l.logger.Log("journald", 0, "Quit: server stopping")
+	}
+
 	// Stop all supporting goroutines
 	l.cancelSupport()
 
 	// Close unix listener
 	l.unixsrv.Stop()
 
-	// Close TCP listener
-	if err := l.listenTCP.Close(); err != nil {
-		fmt.Printf("Quit: could not close tcp-socket listener: %s\n", err.Error())
+	// Stop accepting RPCs (closes the TCP listener) and drain in-flight ones
+	stopped := make(chan bool, 1)
+	go func() {
+		l.server.GracefulStop()
+		stopped <- true
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(l.shutdownTimeout):
+		l.logger.Log("journald", 1, "Quit: in-flight RPCs did not finish within %s, stopping", l.shutdownTimeout)
+		l.server.Stop()
 	}
+
+	// Flush the local logger and close its logfiles
+	l.logger.Quit()
 }
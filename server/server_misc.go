@@ -1,10 +1,68 @@
 package server
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"io/ioutil"
+	"time"
 )
 
+// ServerInfo describes a running log server
+type ServerInfo struct {
+	Version      string        // Version of the server (Config.Version)
+	Started      time.Time     // Start time
+	Uptime       time.Duration // Time since the start
+	Addr         string        // Address the gRPC server is bound to
+	Tokens       int           // Number of authentication tokens
+	Destinations int           // Number of destinations (local outputs included)
+	Logfolder    string        // Folder where logs are stored locally
+	Dropped      int64         // Entries dropped by the local logger (ledger full)
+	Truncated    int64         // Messages truncated to LoggerConfig.MaxMessageBytes
+}
+
+// Info returns the server's runtime information
+func (l *logServer) Info() ServerInfo {
+	l.RLock()
+	tokens := len(l.tokens)
+	l.RUnlock()
+
+	return ServerInfo{
+		Version:      l.version,
+		Started:      l.started,
+		Uptime:       time.Since(l.started),
+		Addr:         l.Addr().String(),
+		Tokens:       tokens,
+		Destinations: len(l.ListDestinations()),
+		Logfolder:    l.logfolder,
+		Dropped:      l.logger.Dropped(),
+		Truncated:    l.logger.Truncated(),
+	}
+}
+
+// ConsoleRole returns the management console role a secret grants (everyone is
+// an admin if there is no admin secret)
+func (l *logServer) ConsoleRole(secret string) int {
+	switch {
+	case l.adminSecret == "":
+		return ROLE_ADMIN
+	case subtle.ConstantTimeCompare([]byte(secret), []byte(l.adminSecret)) == 1:
+		return ROLE_ADMIN
+	case l.viewerSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(l.viewerSecret)) == 1:
+		return ROLE_VIEWER
+	default:
+		return ROLE_FORBIDDEN
+	}
+}
+
+// RotateLogs archives the current logfile and opens a fresh one (regardless of
+// the rotation schedule)
+func (l *logServer) RotateLogs() error {
+	if err := l.logger.Rotate(); err != nil {
+		return fmt.Errorf("RotateLogs: %s", err.Error())
+	}
+	return nil
+}
+
 // Logfiles returns statistics about available log files
 func (l *logServer) Logfiles() (map[string]string, error) {
 	files, err := ioutil.ReadDir(l.logfolder)
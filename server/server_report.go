@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	context "golang.org/x/net/context"
+)
+
+// selfReportCode is the message code of the periodic self-report (see Config.SelfReportInterval)
+const selfReportCode = 5
+
+// reportCounters count the server's throughput since the last self-report
+type reportCounters struct {
+	mu        sync.Mutex
+	logs      int64            // Logs received
+	bytes     int64            // Volume of the logs received
+	dropped   int64            // Logs that could not be processed
+	dstErrors map[string]int64 // Failed writes per destination
+
+	loggerDropped int64 // Entries dropped by the logger until the last self-report
+}
+
+// newReportCounters creates empty counters
+func newReportCounters() *reportCounters {
+	return &reportCounters{dstErrors: map[string]int64{}}
+}
+
+// received counts a log received and passed on to the logger
+func (c *reportCounters) received(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.logs++
+	c.bytes += int64(size)
+}
+
+// drop counts a log that could not be processed
+func (c *reportCounters) drop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dropped++
+}
+
+// failed counts a failed write to a destination
+func (c *reportCounters) failed(destination string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dstErrors[destination]++
+}
+
+// summary summarizes the counters and resets them. The logs dropped by the
+// logger (ledger full) are taken from its total number of dropped entries.
+func (c *reportCounters) summary(loggerDropped int64) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	failures := []string{}
+	for name, count := range c.dstErrors {
+		failures = append(failures, fmt.Sprintf("%s: %d", name, count))
+	}
+	sort.Strings(failures)
+	if len(failures) == 0 {
+		failures = append(failures, "none")
+	}
+
+	_, pbytesStr := prettyParsedSums(0, c.bytes)
+	dropped := c.dropped + loggerDropped - c.loggerDropped
+	summary := fmt.Sprintf("%d logs received (%s), %d dropped, destination errors: %s", c.logs, pbytesStr, dropped, strings.Join(failures, ", "))
+
+	c.logs, c.bytes, c.dropped = 0, 0, 0
+	c.loggerDropped = loggerDropped
+	c.dstErrors = map[string]int64{}
+
+	return summary
+}
+
+// countingWriter counts the failed writes to a destination
+type countingWriter struct {
+	name     string
+	writer   io.Writer
+	counters *reportCounters
+}
+
+// Write writes to the destination and counts failures
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if err != nil {
+		w.counters.failed(w.name)
+	}
+	return n, err
+}
+
+// periodicallyReport logs a summary of the throughput since the previous summary
+func (l *logServer) periodicallyReport(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.logger.Log("journald", selfReportCode, "periodicallyReport: %s in the last %s", l.counters.summary(l.logger.Dropped()), interval)
+		}
+	}
+}
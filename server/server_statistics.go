@@ -1,10 +1,14 @@
 package server
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/vaitekunas/journal/logrpc"
@@ -14,28 +18,43 @@ import (
 
 // GatherStatistics saves log-related statistics
 func (l *logServer) GatherStatistics(service, instance, key, ip string, logEntry *logrpc.LogEntry) {
-	l.Lock()
-	defer l.Unlock()
+	entry := compactFromMap(logEntry.GetEntry())
+	l.gatherStatistics(service, instance, key, ip, entryTime(entry, time.Now()), entrySize(entry))
+}
+
+// gatherStatistics counts an entry of size bytes logged at the time logged
+func (l *logServer) gatherStatistics(service, instance, key, ip string, logged time.Time, size int) {
 
 	now := time.Now()
 
-	if _, ok := l.stats[key]; !ok {
-		l.stats[key] = &Statistic{
-			Service:         service,
-			Instance:        instance,
-			LogsParsed:      [24]int64{},
-			LogsParsedBytes: [24]int64{},
+	// Most entries belong to a known service/instance and need only a read lock
+	l.statsMu.RLock()
+	stats, ok := l.stats[key]
+	l.statsMu.RUnlock()
+
+	if !ok {
+		l.statsMu.Lock()
+		if stats, ok = l.stats[key]; !ok {
+			stats = &Statistic{
+				Service:  service,
+				Instance: instance,
+			}
+			l.stats[key] = stats
 		}
+		l.statsMu.Unlock()
 	}
 
-	jsoned, err := json.Marshal(logEntry.GetEntry())
-	if err != nil {
-		jsoned = []byte{}
-	}
+	_, buckets := l.buckets()
+	bucket := l.bucket(logged)
 
-	stats := l.stats[key]
-	stats.LogsParsed[now.Hour()]++
-	stats.LogsParsedBytes[now.Hour()] += int64(len(jsoned))
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	// Entries are counted in the bucket they have been logged in (clients might
+	// have buffered them), not the one they have been received in
+	stats.fit(buckets)
+	stats.LogsParsed[bucket]++
+	stats.LogsParsedBytes[bucket] += int64(size)
 	stats.LastIP = ip
 	stats.LastActive = now
 }
@@ -49,43 +68,129 @@ type AggregateStatistics struct {
 	Share     float64
 }
 
+// StatisticsBucket contains the aggregated statistics of a bucket
+type StatisticsBucket struct {
+	Label  string // Start of the bucket within the window (see bucketLabel)
+	Logs   int64
+	Volume int64
+}
+
+// statsBuckets validates the granularity and window of the statistics buckets
+// and applies the defaults
+func statsBuckets(granularity, window time.Duration) (time.Duration, time.Duration, error) {
+
+	if granularity == 0 {
+		granularity = defaultStatsGranularity
+	}
+	if window == 0 {
+		window = defaultStatsWindow
+	}
+
+	switch {
+	case granularity < 0:
+		return 0, 0, fmt.Errorf("invalid granularity '%s'", granularity)
+	case window < 0:
+		return 0, 0, fmt.Errorf("invalid window '%s'", window)
+	case window%granularity != 0:
+		return 0, 0, fmt.Errorf("window '%s' is not a multiple of the granularity '%s'", window, granularity)
+	case window/granularity > maxStatsBuckets:
+		return 0, 0, fmt.Errorf("too many buckets (%d, at most %d)", window/granularity, maxStatsBuckets)
+	}
+
+	return granularity, window, nil
+}
+
+// buckets returns the granularity and the number of statistics buckets
+func (l *logServer) buckets() (time.Duration, int) {
+	granularity, window, _ := statsBuckets(l.statsGranularity, l.statsWindow)
+	return granularity, int(window / granularity)
+}
+
+// bucket returns the bucket of a (local) time, i.e. its position within the
+// window. Hourly buckets within a day are the hours of the day.
+func (l *logServer) bucket(t time.Time) int {
+	granularity, buckets := l.buckets()
+
+	_, offset := t.Zone()
+	local := t.UnixNano() + int64(offset)*int64(time.Second)
+
+	bucket := (local / int64(granularity)) % int64(buckets)
+	if bucket < 0 {
+		bucket += int64(buckets)
+	}
+
+	return int(bucket)
+}
+
+// bucketLabel describes a bucket by its start within the window, e.g. "14:00"
+// (with seconds for a granularity finer than minutes and the day for windows
+// longer than a day)
+func bucketLabel(bucket int, granularity, window time.Duration) string {
+	start := time.Duration(bucket) * granularity
+
+	label := fmt.Sprintf("%02d:%02d", int(start/time.Hour)%24, int(start/time.Minute)%60)
+	if granularity%time.Minute != 0 {
+		label = fmt.Sprintf("%s:%02d", label, int(start/time.Second)%60)
+	}
+	if window > 24*time.Hour {
+		label = fmt.Sprintf("day %d %s", int(start/(24*time.Hour))+1, label)
+	}
+
+	return label
+}
+
+// fit resets the buckets if there are not as many as expected (e.g. statistics
+// loaded from disk with another granularity, which cannot be converted)
+func (s *Statistic) fit(buckets int) {
+	if len(s.LogsParsed) != buckets || len(s.LogsParsedBytes) != buckets {
+		s.LogsParsed = make([]int64, buckets)
+		s.LogsParsedBytes = make([]int64, buckets)
+	}
+}
+
 // GetStatistics returns LogServer's statistics
 func (l *logServer) GetStatistics() map[string]*Statistic {
-	l.Lock()
-	defer l.Unlock()
+	l.statsMu.RLock()
+	defer l.statsMu.RUnlock()
 
-	copyStats := map[string]*Statistic{}
+	copyStats := make(map[string]*Statistic, len(l.stats))
 	for key, stats := range l.stats {
-
-		logsParsed := [24]int64{}
-		logsParsedBytes := [24]int64{}
-		copy(logsParsed[:24], stats.LogsParsed[:24])
-		copy(logsParsedBytes[:24], stats.LogsParsedBytes[:24])
-
-		copyStats[key] = &Statistic{
-			Service:         stats.Service,
-			Instance:        stats.Instance,
-			LogsParsed:      logsParsed,
-			LogsParsedBytes: logsParsedBytes,
-			LastIP:          stats.LastIP,
-			LastActive:      stats.LastActive,
-		}
+		copyStats[key] = stats.copy()
 	}
 
 	return copyStats
 }
 
-// AggregateServiceStatistics aggregates statistics
-func (l *logServer) AggregateServiceStatistics() (totalVolume int64, services []*AggregateStatistics, hourly [24][2]int64) {
-	l.Lock()
-	defer l.Unlock()
+// copy returns a copy of the statistic
+func (s *Statistic) copy() *Statistic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &Statistic{
+		Service:         s.Service,
+		Instance:        s.Instance,
+		LogsParsed:      append([]int64{}, s.LogsParsed...),
+		LogsParsedBytes: append([]int64{}, s.LogsParsedBytes...),
+		LastIP:          s.LastIP,
+		LastActive:      s.LastActive,
+	}
+}
+
+// AggregateServiceStatistics aggregates statistics per service (largest volume
+// share first) and per bucket (in the order of the window)
+func (l *logServer) AggregateServiceStatistics() (totalVolume int64, services []*AggregateStatistics, buckets []*StatisticsBucket) {
+
+	granularity, count := l.buckets()
+	buckets = make([]*StatisticsBucket, count)
+	for i := range buckets {
+		buckets[i] = &StatisticsBucket{Label: bucketLabel(i, granularity, time.Duration(count)*granularity)}
+	}
 
 	// Aggregate data
 	var totalLogVolume int64
 	serviceAggroMap := map[string]*AggregateStatistics{}
 	serviceNames := []string{}
-	hourly = [24][2]int64{}
-	for _, stats := range l.stats {
+	for _, stats := range l.GetStatistics() {
 
 		service := stats.Service
 		_, _, plogs, pbytes := parsedSums(stats.LogsParsed, stats.LogsParsedBytes)
@@ -97,9 +202,9 @@ func (l *logServer) AggregateServiceStatistics() (totalVolume int64, services []
 			serviceAggroMap[service] = serviceAggro
 		}
 
-		for i := 0; i <= 23; i++ {
-			hourly[i][0] += stats.LogsParsed[i]
-			hourly[i][1] += stats.LogsParsedBytes[i]
+		for i := 0; i < count && i < len(stats.LogsParsed) && i < len(stats.LogsParsedBytes); i++ {
+			buckets[i].Logs += stats.LogsParsed[i]
+			buckets[i].Volume += stats.LogsParsedBytes[i]
 		}
 
 		serviceAggro.Instances++
@@ -109,23 +214,99 @@ func (l *logServer) AggregateServiceStatistics() (totalVolume int64, services []
 		totalLogVolume += pbytes
 	}
 
-	// Calculate shares
+	// Calculate shares (services with equal shares are ordered by name, all
+	// shares are 0 until the first log has been received)
+	sort.Strings(serviceNames)
 	shares := make([]float64, len(serviceNames))
 	for i, name := range serviceNames {
 		stsum := serviceAggroMap[name]
-		stsum.Share = float64(stsum.Volume) / float64(totalLogVolume)
+		if totalLogVolume > 0 {
+			stsum.Share = float64(stsum.Volume) / float64(totalLogVolume)
+		}
 		shares[i] = stsum.Share
 	}
 
-	// Sort by share
-	shareSort := &floatSorter{floats: shares}
-	sort.Sort(shareSort)
+	// Sort by share (largest first)
 	aggro := make([]*AggregateStatistics, len(shares))
-	for i := range shareSort.GetIndexes() {
-		aggro[i] = serviceAggroMap[serviceNames[i]]
+	for i, idx := range newFloatSorter(shares, true).SortedOrder() {
+		aggro[i] = serviceAggroMap[serviceNames[idx]]
 	}
 
-	return totalLogVolume, aggro, hourly
+	return totalLogVolume, aggro, buckets
+}
+
+// exportStatistics encodes raw statistics as "csv" (one row per service/instance,
+// with a column per bucket) or "json"
+func exportStatistics(stats map[string]*Statistic, format string) (string, error) {
+
+	switch format {
+	case "json":
+		jsoned, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("exportStatistics: could not marshal statistics to json: %s", err.Error())
+		}
+		return string(jsoned), nil
+
+	case "csv":
+		keys := make([]string, 0, len(stats))
+		buckets := 0
+		for key, s := range stats {
+			keys = append(keys, key)
+			if len(s.LogsParsed) > buckets {
+				buckets = len(s.LogsParsed)
+			}
+		}
+		sort.Strings(keys)
+
+		// Headers
+		header := []string{"key", "service", "instance", "last_ip", "last_active"}
+		for i := 0; i < buckets; i++ {
+			header = append(header, fmt.Sprintf("logs_%02d", i))
+		}
+		for i := 0; i < buckets; i++ {
+			header = append(header, fmt.Sprintf("bytes_%02d", i))
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+		w := csv.NewWriter(buf)
+		w.Write(header)
+
+		// Rows
+		for _, key := range keys {
+			s := stats[key]
+			lastActive := ""
+			if !s.LastActive.IsZero() {
+				lastActive = s.LastActive.Format(time.RFC3339)
+			}
+
+			row := []string{key, s.Service, s.Instance, s.LastIP, lastActive}
+			for i := 0; i < buckets; i++ {
+				row = append(row, strconv.FormatInt(bucketValue(s.LogsParsed, i), 10))
+			}
+			for i := 0; i < buckets; i++ {
+				row = append(row, strconv.FormatInt(bucketValue(s.LogsParsedBytes, i), 10))
+			}
+			w.Write(row)
+		}
+
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return "", fmt.Errorf("exportStatistics: could not write csv: %s", err.Error())
+		}
+		return buf.String(), nil
+
+	default:
+		return "", fmt.Errorf("exportStatistics: unknown format '%s'", format)
+	}
+
+}
+
+// bucketValue returns the value of a bucket (0 if there is no such bucket)
+func bucketValue(values []int64, bucket int) int64 {
+	if bucket < len(values) {
+		return values[bucket]
+	}
+	return 0
 }
 
 // periodicallyDumpStats periodically dumps statistics to file
@@ -141,53 +322,215 @@ Loop:
 	}
 }
 
-// dumpStatsToFile dumps all the statistics into file
+// dumpStatsToFile evicts statistics above the limit and dumps the remaining
+// ones into file
 func (l *logServer) dumpStatsToFile() error {
-	l.Lock()
-	defer l.Unlock()
 
 	// Make sure file exists
 	if err := fileExists(l.statsPath); err != nil {
 		return fmt.Errorf("dumpStatsToFile: could not create statistics database: %s", err.Error())
 	}
 
-	// JSON statistics
-	jsoned, errJSON := json.Marshal(l.stats)
-	if errJSON != nil {
-		return fmt.Errorf("dumpStatsToFile: could not marshal statistics to json: %s", errJSON.Error())
+	// Keep the statistics within limits
+	if evicted := l.evictStatistics(); evicted > 0 {
+		l.logger.Log("journald", 0, "dumpStatsToFile: evicted %d statistics (limit: %d)", evicted, l.maxStats)
+	}
+
+	// Encode statistics
+	encoded, err := encodeStatistics(l.GetStatistics(), l.statsFormat)
+	if err != nil {
+		return fmt.Errorf("dumpStatsToFile: %s", err.Error())
 	}
 
-	// Write stats
-	if err := ioutil.WriteFile(l.statsPath, jsoned, 0600); err != nil {
+	// Replace the statistics file atomically (a crash never leaves a partial dump)
+	if err := writeFileAtomic(l.statsPath, encoded, fileMode); err != nil {
 		return fmt.Errorf("dumpStatsToFile: could not dump stats: %s", err.Error())
 	}
 
 	return nil
 }
 
-// loadStatisticsFromDisk loads server statistics from file
-func (l *logServer) loadStatisticsFromDisk() error {
-	l.Lock()
-	defer l.Unlock()
+// evictStatistics removes the statistics above the limit according to the
+// eviction policy and returns the number of removed statistics
+func (l *logServer) evictStatistics() int {
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
 
-	// Make sure file exists
-	if err := fileExists(l.statsPath); err != nil {
-		return fmt.Errorf("loadStatisticsFromDisk: could not create statistics database: %s", err.Error())
+	if l.maxStats <= 0 || len(l.stats) <= l.maxStats {
+		return 0
+	}
+
+	// Order the statistics from the first to the last one to evict (only the
+	// volume or the last activity is set, depending on the policy)
+	type rank struct {
+		volume     int64
+		lastActive time.Time
+	}
+	keys := make([]string, 0, len(l.stats))
+	ranks := make(map[string]rank, len(l.stats))
+	for key, stats := range l.stats {
+		stats.mu.Lock()
+		switch l.statsEviction {
+		case EVICT_SMALLEST_VOLUME:
+			var volume int64
+			for _, parsed := range stats.LogsParsedBytes {
+				volume += parsed
+			}
+			ranks[key] = rank{volume: volume}
+		default:
+			ranks[key] = rank{lastActive: stats.LastActive}
+		}
+		stats.mu.Unlock()
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := ranks[keys[i]], ranks[keys[j]]
+		switch {
+		case ri.volume != rj.volume:
+			return ri.volume < rj.volume
+		case !ri.lastActive.Equal(rj.lastActive):
+			return ri.lastActive.Before(rj.lastActive)
+		}
+		return keys[i] < keys[j]
+	})
+
+	evicted := len(keys) - l.maxStats
+	for _, key := range keys[:evicted] {
+		delete(l.stats, key)
+	}
+
+	return evicted
+}
+
+// Headers of the statistics file formats. Files written by older versions have
+// no header: they are either JSON objects or gob-encoded.
+var (
+	statsHeaderJSON = []byte("journald-statistics json\n")
+	statsHeaderGob  = []byte("journald-statistics gob\n")
+)
+
+// encodeStatistics encodes statistics in the statistics file format (with the
+// format's header)
+func encodeStatistics(stats map[string]*Statistic, format int) ([]byte, error) {
+
+	switch format {
+	case STATS_GOB:
+		buf := bytes.NewBuffer(append([]byte{}, statsHeaderGob...))
+		if err := gob.NewEncoder(buf).Encode(stats); err != nil {
+			return nil, fmt.Errorf("could not encode statistics to gob: %s", err.Error())
+		}
+		return buf.Bytes(), nil
+
+	default:
+		jsoned, err := json.Marshal(stats)
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal statistics to json: %s", err.Error())
+		}
+		return append(append([]byte{}, statsHeaderJSON...), jsoned...), nil
+	}
+
+}
+
+// decodeStatistics decodes statistics of either file format, with or without
+// the format's header
+func decodeStatistics(encoded []byte) (map[string]*Statistic, error) {
+
+	stats := map[string]*Statistic{}
+	trimmed := bytes.TrimSpace(encoded)
+	switch {
+	case bytes.HasPrefix(encoded, statsHeaderJSON):
+		if err := json.Unmarshal(encoded[len(statsHeaderJSON):], &stats); err != nil {
+			return nil, fmt.Errorf("could not unmarshal statistics: %s", err.Error())
+		}
+		return stats, nil
+
+	case bytes.HasPrefix(encoded, statsHeaderGob):
+		if err := gob.NewDecoder(bytes.NewReader(encoded[len(statsHeaderGob):])).Decode(&stats); err != nil {
+			return nil, fmt.Errorf("could not decode statistics: %s", err.Error())
+		}
+		return stats, nil
+
+	case len(trimmed) > 0 && trimmed[0] == '{':
+		if err := json.Unmarshal(encoded, &stats); err != nil {
+			return nil, fmt.Errorf("could not unmarshal statistics: %s", err.Error())
+		}
+		return stats, nil
 	}
 
-	// Read json-encoded statistics
-	jsoned, err := ioutil.ReadFile(l.statsPath)
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&stats); err != nil {
+		legacy := map[string]*legacyStatistic{}
+		if gob.NewDecoder(bytes.NewReader(encoded)).Decode(&legacy) != nil {
+			return nil, fmt.Errorf("could not decode statistics: %s", err.Error())
+		}
+
+		stats = make(map[string]*Statistic, len(legacy))
+		for key, s := range legacy {
+			stats[key] = &Statistic{
+				Service:         s.Service,
+				Instance:        s.Instance,
+				LogsParsed:      s.LogsParsed[:],
+				LogsParsedBytes: s.LogsParsedBytes[:],
+				LastIP:          s.LastIP,
+				LastActive:      s.LastActive,
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// legacyStatistic is a statistic with fixed hourly buckets (as gob-encoded by
+// older versions)
+type legacyStatistic struct {
+	Service         string
+	Instance        string
+	LogsParsed      [24]int64
+	LogsParsedBytes [24]int64
+	LastIP          string
+	LastActive      time.Time
+}
+
+// loadStatisticsFromDisk loads server statistics from file. Reading the file is
+// retried statsLoadRetries times. A corrupt file is moved aside and reported as
+// *corruptDBError.
+func (l *logServer) loadStatisticsFromDisk() error {
+	l.statsMu.Lock()
+	defer l.statsMu.Unlock()
+
+	// Read encoded statistics (making sure the file exists)
+	var encoded []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fileExists(l.statsPath); err != nil {
+			err = fmt.Errorf("could not create statistics database: %s", err.Error())
+		} else if encoded, err = ioutil.ReadFile(l.statsPath); err != nil {
+			err = fmt.Errorf("could not read file: %s", err.Error())
+		}
+		if err == nil || attempt >= l.statsLoadRetries {
+			break
+		}
+		time.Sleep(l.statsLoadDelay)
+	}
 	if err != nil {
-		return fmt.Errorf("loadStatisticsFromDisk: could not read file: %s", err.Error())
+		return fmt.Errorf("loadStatisticsFromDisk: %s", err.Error())
 	}
-	if len(jsoned) == 0 {
+	if len(encoded) == 0 {
 		return nil
 	}
 
-	// Unmarshal json-encoded statistics
-	if err := json.Unmarshal(jsoned, &l.stats); err != nil {
-		return fmt.Errorf("loadStatisticsFromDisk: could not unmarshal statistics: %s", err.Error())
+	// Decode statistics (JSON or gob). Corrupt statistics are moved aside, so
+	// that the next dump does not overwrite them.
+	stats, err := decodeStatistics(encoded)
+	if err != nil {
+		return setAsideCorrupt(l.statsPath, fmt.Errorf("loadStatisticsFromDisk: %s, starting with empty statistics", err.Error()))
+	}
+
+	// Statistics of another granularity are reset
+	_, buckets := l.buckets()
+	for _, s := range stats {
+		s.fit(buckets)
 	}
+	l.stats = stats
 
 	return nil
 }
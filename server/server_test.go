@@ -0,0 +1,2076 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/vaitekunas/journal"
+	"github.com/vaitekunas/journal/connect"
+	"github.com/vaitekunas/journal/logrpc"
+	"github.com/vaitekunas/unixsock"
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+	metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Test setup
+func setup(t testing.TB) (config *Config, teardown func()) {
+
+	dir, err := ioutil.TempDir("", "journald")
+	if err != nil {
+		t.Fatalf("Could not create tempdir: %s", err.Error())
+	}
+
+	config = &Config{
+		Host:         "127.0.0.1",
+		Port:         0,
+		UnixSockPath: filepath.Join(dir, "journald.sock"),
+		TokenPath:    filepath.Join(dir, "tokens.db"),
+		StatsPath:    filepath.Join(dir, "stats.db"),
+		LoggerConfig: &journal.Config{
+			Folder:   dir,
+			Filename: "aggregate",
+			Rotation: journal.ROT_DAILY,
+			Out:      journal.OUT_FILE,
+			Headers:  true,
+			JSON:     true,
+			Columns:  []int64{},
+		},
+	}
+
+	return config, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// nonLoopbackIP returns the first non-loopback IPv4 address of this host
+func nonLoopbackIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+	}
+
+	return ""
+}
+
+func TestNewBindsToHost(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	port := srv.Addr().(*net.TCPAddr).Port
+	if port == 0 {
+		t.Fatalf("Addr did not return the chosen port")
+	}
+
+	// Loopback must be reachable
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+	if err != nil {
+		t.Fatalf("Could not dial loopback: %s", err.Error())
+	}
+	conn.Close()
+
+	// Other interfaces must not be
+	ip := nonLoopbackIP()
+	if ip == "" {
+		t.Skip("No non-loopback interface available")
+	}
+	if conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ip, port), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("Server bound to loopback is reachable via %s", ip)
+	}
+}
+
+func TestNewPortInUse(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not occupy a port: %s", err.Error())
+	}
+	defer taken.Close()
+
+	config.Port = taken.Addr().(*net.TCPAddr).Port
+	if srv, err := New(config, NewConsole()); err == nil {
+		srv.Quit()
+		t.Fatalf("New did not return an error for a port in use")
+	}
+
+	// The unix socket has been released
+	config.Port = 0
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server after a failed start: %s", err.Error())
+	}
+	srv.Quit()
+}
+
+func TestNewInvalidHost(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.Host = "not a host"
+	if srv, err := New(config, NewConsole()); err == nil {
+		srv.Quit()
+		t.Errorf("New accepted an invalid host")
+	}
+}
+
+func TestServeFailureTriggersKillSwitch(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	if srv.Err() != nil {
+		t.Fatalf("Healthy server reported an error: %s", srv.Err().Error())
+	}
+
+	// Pull the listener from under the running server
+	srv.(*logServer).listenTCP.Close()
+
+	select {
+	case <-srv.KillSwitch():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve failure did not trigger the kill switch")
+	}
+
+	if srv.Err() == nil {
+		t.Errorf("Serve failure has not been reported")
+	}
+}
+
+// newEntry returns a remote log entry containing all the columns
+func newEntry(msg string) *logrpc.LogEntry {
+	entry := &logrpc.LogEntry{Entry: map[int64]string{}}
+	for col := int64(journal.COL_DATE_YYMMDD); col <= journal.COL_LINE; col++ {
+		entry.Entry[col] = "N/A"
+	}
+	entry.Entry[journal.COL_MSG] = msg
+
+	return entry
+}
+
+// dial connects to the log server using the provided credentials
+func dial(t *testing.T, srv LogServer, service, instance, token string) (logrpc.RemoteLoggerClient, func()) {
+	return dialCreds(t, srv, &logrpc.TokenCred{
+		IP:       "127.0.0.1",
+		Service:  service,
+		Instance: instance,
+		Token:    token,
+		Schema:   logrpc.SCHEMA_VERSION,
+	})
+}
+
+// dialCreds connects to the log server using the provided raw credentials
+func dialCreds(t *testing.T, srv LogServer, creds *logrpc.TokenCred) (logrpc.RemoteLoggerClient, func()) {
+	conn, err := grpc.Dial(srv.Addr().String(), grpc.WithInsecure(), grpc.WithPerRPCCredentials(creds))
+	if err != nil {
+		t.Fatalf("Could not dial log server: %s", err.Error())
+	}
+
+	return logrpc.NewRemoteLoggerClient(conn), func() { conn.Close() }
+}
+
+func TestUnaryInterceptorsRunAfterAuth(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	var mu sync.Mutex
+	count := 0
+	config.UnaryInterceptors = []grpc.UnaryServerInterceptor{
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			mu.Lock()
+			count++
+			mu.Unlock()
+			return handler(ctx, req)
+		},
+	}
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token, err := srv.AddToken("service", "instance")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	// Authorized RPC passes through the interceptor
+	client, closeConn := dial(t, srv, "service", "instance", token)
+	defer closeConn()
+	if _, err := client.RemoteLog(context.Background(), newEntry("authorized")); err != nil {
+		t.Fatalf("Authorized RPC failed: %s", err.Error())
+	}
+
+	// Unauthorized RPC is rejected before reaching the interceptor
+	badClient, closeBadConn := dial(t, srv, "service", "instance", "bad token")
+	defer closeBadConn()
+	if _, err := badClient.RemoteLog(context.Background(), newEntry("unauthorized")); err == nil {
+		t.Fatalf("Unauthorized RPC succeeded")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if count != 1 {
+		t.Errorf("Interceptor ran %d times, expected 1", count)
+	}
+}
+
+func TestSchemaVersionMismatch(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token, err := srv.AddToken("service", "instance")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	// Clients using another schema are rejected
+	client, closeConn := dialCreds(t, srv, &logrpc.TokenCred{IP: "127.0.0.1", Service: "service", Instance: "instance", Token: token, Schema: "0"})
+	defer closeConn()
+	if _, err := client.RemoteLog(context.Background(), newEntry("mismatched")); err == nil || !strings.Contains(err.Error(), "schema '0' is not supported") {
+		t.Errorf("Client with a mismatched schema has not been rejected: %v", err)
+	}
+
+	// Clients predating the schema negotiation are accepted
+	legacy, closeLegacy := dialCreds(t, srv, &logrpc.TokenCred{IP: "127.0.0.1", Service: "service", Instance: "instance", Token: token})
+	defer closeLegacy()
+	if _, err := legacy.RemoteLog(context.Background(), newEntry("legacy")); err != nil {
+		t.Errorf("Legacy client has been rejected: %s", err.Error())
+	}
+}
+
+// newTokenServer creates a bare log server that only manages tokens
+func newTokenServer(t *testing.T, tokenPath string, jsonTokens bool) *logServer {
+	l := &logServer{
+		RWMutex:    &sync.RWMutex{},
+		statsMu:    &sync.RWMutex{},
+		stats:      map[string]*Statistic{},
+		tokenPath:  tokenPath,
+		tokensJSON: jsonTokens,
+		tokens:     map[string]*tokenRecord{},
+	}
+
+	if err := l.loadTokensFromDisk(); err != nil {
+		t.Fatalf("Could not load tokens: %s", err.Error())
+	}
+
+	return l
+}
+
+func TestJSONTokensRoundTrip(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	l := newTokenServer(t, config.TokenPath, true)
+	token1, _ := l.AddToken("service", "instance1")
+	l.AddToken("service", "instance2")
+	token3, _ := l.AddToken("other", "instance")
+	if err := l.RemoveToken("service", "instance2", true); err != nil {
+		t.Fatalf("Could not remove token: %s", err.Error())
+	}
+
+	reloaded := newTokenServer(t, config.TokenPath, false)
+	if !reloaded.tokensJSON {
+		t.Errorf("JSON token database has not been detected")
+	}
+
+	tokens := reloaded.GetTokens()
+	if len(tokens) != 2 || tokens["service/instance1"] != token1 || tokens["other/instance"] != token3 {
+		t.Errorf("Unexpected tokens after reload: %v", tokens)
+	}
+	if reloaded.tokens["service/instance1"].Created.IsZero() {
+		t.Errorf("Token metadata has not been preserved")
+	}
+}
+
+func TestLegacyTokensMigration(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	legacy := "service/instance1\ttoken1\nmalformed line\nservice/instance2\ttoken2\n"
+	if err := ioutil.WriteFile(config.TokenPath, []byte(legacy), 0600); err != nil {
+		t.Fatalf("Could not write legacy tokens: %s", err.Error())
+	}
+
+	// Legacy stores are kept as they are unless JSON is requested
+	l := newTokenServer(t, config.TokenPath, false)
+	if l.tokensJSON || len(l.GetTokens()) != 2 {
+		t.Fatalf("Could not load legacy tokens: %v", l.GetTokens())
+	}
+
+	newTokenServer(t, config.TokenPath, true)
+	contents, _ := ioutil.ReadFile(config.TokenPath)
+	if len(contents) == 0 || contents[0] != '{' {
+		t.Fatalf("Token database has not been migrated: %s", contents)
+	}
+	if backup, _ := ioutil.ReadFile(config.TokenPath + ".legacy"); string(backup) != legacy {
+		t.Errorf("Legacy token database has not been backed up")
+	}
+
+	tokens := newTokenServer(t, config.TokenPath, false).GetTokens()
+	if len(tokens) != 2 || tokens["service/instance1"] != "token1" || tokens["service/instance2"] != "token2" {
+		t.Errorf("Unexpected tokens after migration: %v", tokens)
+	}
+}
+
+func TestCorruptTokens(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	garbage := []byte("{\x00\xff not tokens")
+	if err := ioutil.WriteFile(config.TokenPath, garbage, 0600); err != nil {
+		t.Fatalf("Could not write tokens: %s", err.Error())
+	}
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Corrupt tokens prevented the start: %s", err.Error())
+	}
+
+	if len(srv.GetTokens()) != 0 {
+		t.Errorf("Expected no tokens")
+	}
+	if backups := corruptBackups(t, config.TokenPath); len(backups) != 1 || !bytes.Equal(backups[0], garbage) {
+		t.Errorf("Corrupt tokens have not been backed up")
+	}
+
+	// Tokens can be re-provisioned
+	if _, err := srv.AddToken("service", "instance"); err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+	if tokens := newTokenServer(t, config.TokenPath, false).GetTokens(); len(tokens) != 1 {
+		t.Errorf("Re-provisioned token has not been stored: %v", tokens)
+	}
+	srv.Quit()
+
+	// A second corruption does not overwrite the first backup
+	if err := ioutil.WriteFile(config.TokenPath, []byte("{again"), 0600); err != nil {
+		t.Fatalf("Could not write tokens: %s", err.Error())
+	}
+	srv, err = New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Corrupt tokens prevented the start: %s", err.Error())
+	}
+	defer srv.Quit()
+	if backups := corruptBackups(t, config.TokenPath); len(backups) != 2 {
+		t.Errorf("Expected two backups, got %d", len(backups))
+	}
+}
+
+// TestUnreadableTokens checks that a token file that cannot be read prevents the start
+func TestUnreadableTokens(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	if err := os.Mkdir(config.TokenPath, 0700); err != nil {
+		t.Fatalf("Could not create directory: %s", err.Error())
+	}
+	if srv, err := New(config, NewConsole()); err == nil {
+		srv.Quit()
+		t.Errorf("Expected an unreadable token file to prevent the start")
+	}
+	if backups := corruptBackups(t, config.TokenPath); len(backups) != 0 {
+		t.Errorf("Unreadable token file has been moved aside")
+	}
+}
+
+// corruptBackups returns the contents of all backups of a corrupt database
+func corruptBackups(t *testing.T, path string) [][]byte {
+	matches, err := filepath.Glob(path + ".corrupt.*")
+	if err != nil {
+		t.Fatalf("Could not list backups: %s", err.Error())
+	}
+	backups := [][]byte{}
+	for _, match := range matches {
+		contents, err := ioutil.ReadFile(match)
+		if err != nil {
+			t.Fatalf("Could not read backup: %s", err.Error())
+		}
+		backups = append(backups, contents)
+	}
+	return backups
+}
+
+// Measures the throughput of the RemoteLog hot path with many concurrent clients
+func BenchmarkRemoteLog(b *testing.B) {
+	config, teardown := setup(b)
+	defer teardown()
+
+	logger, err := journal.New(config.LoggerConfig)
+	if err != nil {
+		b.Fatalf("Could not start logger: %s", err.Error())
+	}
+	defer logger.Quit()
+
+	l := &logServer{
+		RWMutex: &sync.RWMutex{},
+		statsMu: &sync.RWMutex{},
+		logger:  logger,
+		stats:   map[string]*Statistic{},
+		tokens:  map[string]*tokenRecord{},
+	}
+
+	entry := newEntry("benchmark")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+			"service", "bench",
+			"instance", fmt.Sprintf("%p", pb),
+			"token", "token",
+			"ip", "127.0.0.1",
+		))
+		for pb.Next() {
+			if _, err := l.RemoteLog(ctx, entry); err != nil {
+				b.Fatalf("RemoteLog failed: %s", err.Error())
+			}
+		}
+	})
+}
+
+// logfileContents returns the contents of the server's current logfile
+func logfileContents(config *Config) string {
+	name := fmt.Sprintf("%s_%s.log", config.LoggerConfig.Filename, time.Now().Format("2006-01-02"))
+	contents, _ := ioutil.ReadFile(filepath.Join(config.LoggerConfig.Folder, name))
+	return string(contents)
+}
+
+func TestLifecycleEntries(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.Version = "v1.2.3"
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	srv.Quit()
+
+	contents := logfileContents(config)
+	started := strings.Index(contents, "server started (version: v1.2.3")
+	stopping := strings.Index(contents, "server stopping")
+	if started < 0 || stopping < started {
+		t.Errorf("Lifecycle entries are missing: %s", contents)
+	}
+}
+
+func TestRemoteLogOverwritesOrigin(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+
+	token, err := srv.AddToken("service", "instance")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	// The entry claims to originate from another service
+	entry := newEntry("spoofed")
+	entry.Entry[journal.COL_SERVICE] = "other"
+	entry.Entry[journal.COL_INSTANCE] = "other"
+
+	client, closeConn := dial(t, srv, "service", "instance", token)
+	if _, err := client.RemoteLog(context.Background(), entry); err != nil {
+		t.Fatalf("RemoteLog failed: %s", err.Error())
+	}
+	closeConn()
+	srv.Quit()
+
+	contents := logfileContents(config)
+	if !strings.Contains(contents, `"Service":"service","Instance":"instance"`) || strings.Contains(contents, `"other"`) {
+		t.Errorf("Origin of the entry has not been corrected: %s", contents)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.Version = "v1.2.3"
+	before := time.Now()
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	if _, err := srv.AddToken("service", "instance"); err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	info := srv.Info()
+	if info.Version != "v1.2.3" || info.Started.Before(before) || info.Uptime <= 0 || info.Uptime > time.Since(before) {
+		t.Errorf("Unexpected version/uptime: %+v", info)
+	}
+	if info.Addr != srv.Addr().String() || info.Tokens != 1 || info.Destinations != 1 || info.Logfolder != config.LoggerConfig.Folder {
+		t.Errorf("Unexpected info: %+v", info)
+	}
+}
+
+func TestInfoTruncated(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.LoggerConfig.MaxMessageBytes = 32
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token, _ := srv.AddToken("service", "instance")
+	client, closeConn := dial(t, srv, "service", "instance", token)
+	defer closeConn()
+
+	before := srv.Info().Truncated
+	if _, err := client.RemoteLog(context.Background(), newEntry(strings.Repeat("x", 64))); err != nil {
+		t.Fatalf("Could not send log: %s", err.Error())
+	}
+	if info := srv.Info(); info.Truncated != before+1 {
+		t.Errorf("Truncated message has not been counted: %+v", info)
+	}
+
+	resp := manager.Execute("status", unixsock.Args{})
+	if resp.Status != unixsock.STATUS_OK || !strings.Contains(fmt.Sprint(resp.Payload), "Truncated messages") {
+		t.Errorf("Status does not report truncated messages: %v", resp)
+	}
+}
+
+func TestExecuteInvalidArguments(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	if resp := manager.Execute("tokens.add", unixsock.Args{"service": "web"}); resp.Status != unixsock.STATUS_FAIL || !strings.Contains(resp.Error, "'instance'") {
+		t.Errorf("Missing argument has not been named: %v", resp)
+	}
+
+	resp := manager.Execute("tokens.add", unixsock.Args{"service": "web", "instance": "1", "verbose": true})
+	if resp.Status != unixsock.STATUS_OK || !strings.Contains(fmt.Sprint(resp.Payload), "ignored unknown argument(s): verbose") {
+		t.Errorf("Unknown argument has not been reported: %v", resp)
+	}
+}
+
+func TestEnableReflection(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		config, teardown := setup(t)
+
+		config.EnableReflection = enabled
+		srv, err := New(config, NewConsole())
+		if err != nil {
+			t.Fatalf("Could not start log server: %s", err.Error())
+		}
+
+		_, registered := srv.(*logServer).server.GetServiceInfo()["grpc.reflection.v1alpha.ServerReflection"]
+		if registered != enabled {
+			t.Errorf("Unexpected registration of the reflection service (enabled: %t)", enabled)
+		}
+
+		srv.Quit()
+		teardown()
+	}
+}
+
+func TestCreatedFileModes(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	dir := filepath.Join(filepath.Dir(config.TokenPath), "db")
+	l := newTokenServer(t, filepath.Join(dir, "tokens.db"), true)
+	l.statsPath = filepath.Join(dir, "stats.db")
+	if _, err := l.AddToken("service", "instance"); err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+	if err := l.RemoveToken("service", "instance", true); err != nil {
+		t.Fatalf("Could not remove token: %s", err.Error())
+	}
+	if err := l.dumpStatsToFile(); err != nil {
+		t.Fatalf("Could not dump statistics: %s", err.Error())
+	}
+
+	for path, mode := range map[string]os.FileMode{l.tokenPath: 0600, l.statsPath: 0600, dir: 0700} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != mode {
+			t.Errorf("Unexpected permissions of '%s'", path)
+		}
+	}
+}
+
+func TestCustomCodes(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.CodesPath = filepath.Join(config.LoggerConfig.Folder, "codes.json")
+	for _, invalid := range []string{`{"42": `, `{"1": {"Type": "Reserved"}}`, `{"42": {"Error": true}}`} {
+		ioutil.WriteFile(config.CodesPath, []byte(invalid), 0600)
+		if srv, err := New(config, NewConsole()); err == nil {
+			srv.Quit()
+			t.Errorf("New accepted invalid codes: %s", invalid)
+		}
+	}
+
+	ioutil.WriteFile(config.CodesPath, []byte(`{"42": {"Type": "PaymentDeclined", "Error": true}}`), 0600)
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+
+	errLog := srv.(*logServer).logger.Log("test", 42, "declined")
+	srv.Quit()
+
+	if errLog == nil {
+		t.Errorf("Custom error code did not return an error")
+	}
+	if contents := logfileContents(config); !strings.Contains(contents, "PaymentDeclined") {
+		t.Errorf("Custom code has not been used: %s", contents)
+	}
+}
+
+func TestQuitDrainsInFlightRPCs(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	entered := make(chan bool, 1)
+	config.UnaryInterceptors = []grpc.UnaryServerInterceptor{
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			entered <- true
+			time.Sleep(200 * time.Millisecond)
+			return handler(ctx, req)
+		},
+	}
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+
+	token, err := srv.AddToken("service", "instance")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	client, closeConn := dial(t, srv, "service", "instance", token)
+	defer closeConn()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.RemoteLog(context.Background(), newEntry("in-flight"))
+		done <- err
+	}()
+
+	<-entered
+	srv.Quit()
+
+	if err := <-done; err != nil {
+		t.Fatalf("In-flight RPC failed: %s", err.Error())
+	}
+	if contents := logfileContents(config); !strings.Contains(contents, "in-flight") {
+		t.Errorf("In-flight log has not been flushed: %s", contents)
+	}
+}
+
+func TestQuitLogsShutdownTimeout(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	entered := make(chan bool, 1)
+	config.ShutdownTimeout = 50 * time.Millisecond
+	config.UnaryInterceptors = []grpc.UnaryServerInterceptor{
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			entered <- true
+			time.Sleep(300 * time.Millisecond)
+			return handler(ctx, req)
+		},
+	}
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+
+	token, _ := srv.AddToken("service", "instance")
+	client, closeConn := dial(t, srv, "service", "instance", token)
+	defer closeConn()
+
+	go client.RemoteLog(context.Background(), newEntry("stuck"))
+	<-entered
+	srv.Quit()
+
+	if contents := logfileContents(config); !strings.Contains(contents, "in-flight RPCs did not finish within 50ms") {
+		t.Errorf("Forced shutdown has not been logged: %s", contents)
+	}
+}
+
+func TestQuitFlushesLogger(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+
+	token, err := srv.AddToken("service", "instance")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	client, closeConn := dial(t, srv, "service", "instance", token)
+	defer closeConn()
+	for i := 0; i < 100; i++ {
+		if _, err := client.RemoteLog(context.Background(), newEntry(fmt.Sprintf("entry #%d", i))); err != nil {
+			t.Fatalf("Could not send log: %s", err.Error())
+		}
+	}
+
+	srv.Quit()
+
+	contents := logfileContents(config)
+	if count := strings.Count(contents, "entry #"); count != 100 || !strings.Contains(contents, "entry #99") {
+		t.Errorf("Expected 100 entries on disk, got %d", count)
+	}
+}
+
+// newStatistic returns a statistic with all the logs parsed within a single hour
+func newStatistic(service, instance string, logs, bytes int64) *Statistic {
+	stats := &Statistic{Service: service, Instance: instance}
+	stats.fit(24)
+	stats.LogsParsed[0] = logs
+	stats.LogsParsedBytes[0] = bytes
+	return stats
+}
+
+func TestAggregateServiceStatisticsOrder(t *testing.T) {
+	l := &logServer{
+		RWMutex: &sync.RWMutex{},
+		statsMu: &sync.RWMutex{},
+		stats: map[string]*Statistic{
+			"medium/instance1": newStatistic("medium", "instance1", 10, 200),
+			"large/instance1":  newStatistic("large", "instance1", 10, 300),
+			"large/instance2":  newStatistic("large", "instance2", 10, 400),
+			"small/instance1":  newStatistic("small", "instance1", 10, 100),
+		},
+	}
+
+	total, aggro, _ := l.AggregateServiceStatistics()
+	if total != 1000 || len(aggro) != 3 {
+		t.Fatalf("Unexpected aggregates: total %d, %d services", total, len(aggro))
+	}
+
+	expected := []struct {
+		service   string
+		instances int
+		volume    int64
+	}{
+		{"large", 2, 700},
+		{"medium", 1, 200},
+		{"small", 1, 100},
+	}
+	for i, exp := range expected {
+		if aggro[i].Service != exp.service || aggro[i].Instances != exp.instances || aggro[i].Volume != exp.volume {
+			t.Errorf("Unexpected aggregate #%d: %+v", i, aggro[i])
+		}
+	}
+}
+
+func TestMaxDiskBytesKeepsLoggerConfig(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.MaxDiskBytes = 1 << 20
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	if config.LoggerConfig.MaxDiskBytes != 0 {
+		t.Errorf("The caller's logger config has been modified")
+	}
+}
+
+func TestStatisticsJSONWithoutLogs(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	if _, err := srv.AddToken("web", "1"); err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	// No log has been received, i.e. the total volume is 0
+	for _, cmd := range []string{"statistics", "tokens.list.services"} {
+		if resp := manager.Execute(cmd, unixsock.Args{"format": "json"}); resp.Status != unixsock.STATUS_OK {
+			t.Errorf("Could not execute '%s': %s", cmd, resp.Error)
+		}
+	}
+}
+
+func TestImportTokens(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	l := newTokenServer(t, config.TokenPath, false)
+	if _, err := l.AddToken("web", "1"); err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	pairs, malformed := ParseTokenList("# batch\nweb 2\nweb/3\n\nweb 1\nbad/name/here\nweb 2\nworker\n")
+	if len(malformed) != 1 || malformed[0] != 8 {
+		t.Errorf("Expected malformed line 8, got %v", malformed)
+	}
+	imports, err := l.ImportTokens(pairs)
+	if err != nil {
+		t.Fatalf("Could not import tokens: %s", err.Error())
+	}
+
+	// Valid, valid, existing, invalid, duplicate
+	created := []bool{true, true, false, false, false}
+	if len(imports) != len(created) {
+		t.Fatalf("Expected %d imports, got %d", len(created), len(imports))
+	}
+	for i, imported := range imports {
+		if (imported.Token != "") != created[i] || (imported.Error == "") != created[i] {
+			t.Errorf("Unexpected import #%d: %+v", i, imported)
+		}
+	}
+
+	// Imported tokens are stored
+	tokens := newTokenServer(t, config.TokenPath, false).GetTokens()
+	if len(tokens) != 3 || tokens["web/2"] != imports[0].Token || tokens["web/3"] != imports[1].Token {
+		t.Errorf("Unexpected tokens after import: %v", tokens)
+	}
+}
+
+func TestExportTokensRoundTrip(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	l := newTokenServer(t, config.TokenPath, true)
+	for _, instance := range []string{"1", "2"} {
+		if _, err := l.AddToken("web", instance); err != nil {
+			t.Fatalf("Could not add token: %s", err.Error())
+		}
+	}
+
+	for _, passphrase := range []string{"", "secret"} {
+		exported, err := l.ExportTokens(passphrase)
+		if err != nil {
+			t.Fatalf("Could not export tokens: %s", err.Error())
+		}
+		if passphrase != "" && bytes.Contains(exported, []byte(l.tokens["web/1"].Token)) {
+			t.Errorf("Encrypted export contains a plaintext token")
+		}
+		if passphrase != "" {
+			if _, err := newTokenServer(t, filepath.Join(config.LoggerConfig.Folder, "wrong.db"), true).RestoreTokens(exported, "wrong"); err == nil {
+				t.Errorf("Export has been decrypted with a wrong passphrase")
+			}
+		}
+
+		// Restore into a fresh store
+		path := filepath.Join(config.LoggerConfig.Folder, fmt.Sprintf("fresh%s.db", passphrase))
+		fresh := newTokenServer(t, path, true)
+		imports, err := fresh.RestoreTokens(exported, passphrase)
+		if err != nil || len(imports) != 2 {
+			t.Fatalf("Could not restore tokens: %v", err)
+		}
+
+		reloaded := newTokenServer(t, path, true)
+		for key, record := range l.tokens {
+			if restored := reloaded.tokens[key]; restored == nil || restored.Token != record.Token || !restored.Created.Equal(record.Created) {
+				t.Errorf("Token of %s has not been restored with its metadata", key)
+			}
+		}
+
+		for _, imported := range imports {
+			if imported.Token != maskToken(l.tokens[getCleanKey(imported.Service, imported.Instance)].Token) {
+				t.Errorf("Restored token of %s/%s is not masked in the report", imported.Service, imported.Instance)
+			}
+		}
+
+		// Existing tokens are kept
+		if imports, _ := fresh.RestoreTokens(exported, passphrase); imports[0].Error == "" {
+			t.Errorf("Existing token has been overwritten")
+		}
+	}
+
+	// Invalid names and tokens are rejected
+	valid := strings.Repeat("a", 64)
+	exported := []byte(fmt.Sprintf(`{"version":1,"tokens":{"Web/1":{"token":%q},"web/a b":{"token":%q},"web/3":{"token":"short"},"web/4":{"token":%q}}}`, valid, valid, valid))
+	fresh := newTokenServer(t, filepath.Join(config.LoggerConfig.Folder, "invalid.db"), true)
+	imports, err := fresh.RestoreTokens(exported, "")
+	if err != nil || len(imports) != 4 {
+		t.Fatalf("Could not restore tokens: %v", err)
+	}
+	for _, imported := range imports {
+		if failed := imported.Error != ""; failed != (imported.Instance != "4") {
+			t.Errorf("Unexpected result for %s/%s: %q", imported.Service, imported.Instance, imported.Error)
+		}
+	}
+	if len(fresh.tokens) != 1 || fresh.tokens["web/4"] == nil {
+		t.Errorf("Invalid tokens have been restored: %v", fresh.tokens)
+	}
+}
+
+func TestRevokeMatching(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	for _, jsonTokens := range []bool{false, true} {
+		os.Remove(config.TokenPath)
+
+		l := newTokenServer(t, config.TokenPath, jsonTokens)
+		for _, key := range []string{"api/worker-1", "api/worker-2", "api/web-1", "batch/worker-1", "batch/cron"} {
+			parts := strings.Split(key, "/")
+			l.AddToken(parts[0], parts[1])
+		}
+
+		if count, err := l.RevokeMatching("*/worker-*"); err != nil || count != 3 {
+			t.Fatalf("Unexpected glob revocation: %d (%v)", count, err)
+		}
+		if count, err := l.RevokeMatching("re:^api/"); err != nil || count != 1 {
+			t.Fatalf("Unexpected regex revocation: %d (%v)", count, err)
+		}
+		if _, err := l.RevokeMatching("re:("); err == nil {
+			t.Errorf("Invalid regular expression has been accepted")
+		}
+
+		tokens := newTokenServer(t, config.TokenPath, false).GetTokens()
+		if _, ok := tokens["batch/cron"]; len(tokens) != 1 || !ok {
+			t.Errorf("Unexpected tokens after revocation (json: %t): %v", jsonTokens, tokens)
+		}
+	}
+}
+
+func TestExportStatistics(t *testing.T) {
+
+	stats := map[string]*Statistic{
+		"web/2": newStatistic("web", "2", 5, 500),
+		"web/1": newStatistic("web", "1", 1, 100),
+	}
+	stats["web/1"].LastIP = "10.0.0.1"
+	stats["web/1"].LogsParsed[23] = 2
+
+	exported, err := exportStatistics(stats, "csv")
+	if err != nil {
+		t.Fatalf("Could not export csv: %s", err.Error())
+	}
+
+	rows := strings.Split(strings.TrimSpace(exported), "\n")
+	if len(rows) != 3 || !strings.HasPrefix(rows[0], "key,service,instance,last_ip,last_active,logs_00,") {
+		t.Fatalf("Unexpected csv: %s", exported)
+	}
+	if fields := strings.Split(rows[1], ","); len(fields) != 53 || fields[0] != "web/1" || fields[3] != "10.0.0.1" || fields[5] != "1" || fields[28] != "2" || fields[29] != "100" {
+		t.Errorf("Unexpected csv row: %s", rows[1])
+	}
+
+	exported, err = exportStatistics(stats, "json")
+	if err != nil {
+		t.Fatalf("Could not export json: %s", err.Error())
+	}
+	decoded := map[string]*Statistic{}
+	if err := json.Unmarshal([]byte(exported), &decoded); err != nil || decoded["web/2"].LogsParsedBytes[0] != 500 {
+		t.Errorf("Unexpected json: %s", exported)
+	}
+
+	if _, err := exportStatistics(stats, "xml"); err == nil {
+		t.Errorf("Unknown format has been accepted")
+	}
+}
+
+func TestDisableStatistics(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.DisableStatistics = true
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+
+	token, err := srv.AddToken("service", "instance")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+	client, closeConn := dial(t, srv, "service", "instance", token)
+	if _, err := client.RemoteLog(context.Background(), newEntry("not counted")); err != nil {
+		t.Fatalf("RemoteLog failed: %s", err.Error())
+	}
+	closeConn()
+
+	if resp := manager.CmdStatistics(nil); resp.Status != unixsock.STATUS_FAIL || !strings.Contains(resp.Error, "Statistics disabled") {
+		t.Errorf("Unexpected response of the statistics command: %v", resp)
+	}
+	if len(srv.GetStatistics()) != 0 {
+		t.Errorf("Statistics have been gathered")
+	}
+	srv.Quit()
+
+	if _, err := os.Stat(config.StatsPath); !os.IsNotExist(err) {
+		t.Errorf("Statistics file has been created")
+	}
+}
+
+func TestStatisticsEviction(t *testing.T) {
+
+	now := time.Now()
+	for policy, expected := range map[int][]string{
+		EVICT_LEAST_RECENTLY_ACTIVE: {"web/2", "web/3"},
+		EVICT_SMALLEST_VOLUME:       {"web/1", "web/3"},
+	} {
+		l := &logServer{
+			statsMu:       &sync.RWMutex{},
+			maxStats:      2,
+			statsEviction: policy,
+			stats: map[string]*Statistic{
+				"web/1": newStatistic("web", "1", 1, 300),
+				"web/2": newStatistic("web", "2", 1, 100),
+				"web/3": newStatistic("web", "3", 1, 200),
+			},
+		}
+		l.stats["web/1"].LastActive = now.Add(-time.Hour)
+		l.stats["web/2"].LastActive = now.Add(-time.Minute)
+		l.stats["web/3"].LastActive = now
+
+		if evicted := l.evictStatistics(); evicted != 1 {
+			t.Errorf("Expected 1 evicted statistic, got %d (policy %d)", evicted, policy)
+		}
+		for _, key := range expected {
+			if _, ok := l.stats[key]; !ok {
+				t.Errorf("Statistic '%s' has been evicted (policy %d)", key, policy)
+			}
+		}
+	}
+}
+
+func TestStatisticsEvictionPrecision(t *testing.T) {
+
+	// Nanoseconds apart (indistinguishable as float64)
+	active := time.Date(2017, 3, 5, 12, 0, 0, 123456789, time.UTC)
+	l := &logServer{
+		statsMu:  &sync.RWMutex{},
+		maxStats: 1,
+		stats: map[string]*Statistic{
+			"web/a": newStatistic("web", "a", 1, 100),
+			"web/b": newStatistic("web", "b", 1, 100),
+		},
+	}
+	l.stats["web/a"].LastActive = active.Add(time.Nanosecond)
+	l.stats["web/b"].LastActive = active
+
+	l.evictStatistics()
+	if _, ok := l.stats["web/a"]; !ok {
+		t.Errorf("The most recently active statistic has been evicted")
+	}
+}
+
+func TestStatisticsFormats(t *testing.T) {
+
+	stats := map[string]*Statistic{"web/1": newStatistic("web", "1", 5, 500)}
+	stats["web/1"].LastIP = "10.0.0.1"
+
+	for _, format := range []int{STATS_JSON, STATS_GOB} {
+		encoded, err := encodeStatistics(stats, format)
+		if err != nil {
+			t.Fatalf("Could not encode statistics (format %d): %s", format, err.Error())
+		}
+
+		decoded, err := decodeStatistics(encoded)
+		if err != nil {
+			t.Fatalf("Could not decode statistics (format %d): %s", format, err.Error())
+		}
+		if decoded["web/1"] == nil || decoded["web/1"].LogsParsedBytes[0] != 500 || decoded["web/1"].LastIP != "10.0.0.1" {
+			t.Errorf("Statistics changed in a round trip (format %d)", format)
+		}
+	}
+
+	// Files without a header (written by older versions)
+	jsoned, _ := json.Marshal(stats)
+	var gobbed bytes.Buffer
+	gob.NewEncoder(&gobbed).Encode(stats)
+	for i, encoded := range [][]byte{jsoned, gobbed.Bytes()} {
+		if decoded, err := decodeStatistics(encoded); err != nil || decoded["web/1"] == nil || decoded["web/1"].LastIP != "10.0.0.1" {
+			t.Errorf("Could not decode statistics without a header (#%d): %v", i, err)
+		}
+	}
+}
+
+func TestDumpShrinkingStatistics(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	l := &logServer{statsMu: &sync.RWMutex{}, statsPath: config.StatsPath, stats: map[string]*Statistic{}}
+	for i := 0; i < 10; i++ {
+		instance := strconv.Itoa(i)
+		l.stats["service/"+instance] = newStatistic("service", instance, 1, 100)
+	}
+	if err := l.dumpStatsToFile(); err != nil {
+		t.Fatalf("Could not dump statistics: %s", err.Error())
+	}
+
+	l.stats = map[string]*Statistic{"service/0": newStatistic("service", "0", 1, 100)}
+	if err := l.dumpStatsToFile(); err != nil {
+		t.Fatalf("Could not dump statistics: %s", err.Error())
+	}
+
+	loaded := &logServer{statsMu: &sync.RWMutex{}, statsPath: config.StatsPath, stats: map[string]*Statistic{}}
+	if err := loaded.loadStatisticsFromDisk(); err != nil {
+		t.Fatalf("Could not reload statistics: %s", err.Error())
+	}
+	if len(loaded.stats) != 1 {
+		t.Errorf("Expected 1 statistic, got %d", len(loaded.stats))
+	}
+
+	// No temporary files are left behind
+	if files, _ := ioutil.ReadDir(filepath.Dir(config.StatsPath)); len(files) != 1 {
+		t.Errorf("Expected only the statistics file, got %d files", len(files))
+	}
+}
+
+func TestCorruptStatistics(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	corrupt := []byte("{not statistics")
+	if err := ioutil.WriteFile(config.StatsPath, corrupt, 0600); err != nil {
+		t.Fatalf("Could not write statistics: %s", err.Error())
+	}
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Corrupt statistics prevented the start: %s", err.Error())
+	}
+	if len(srv.GetStatistics()) != 0 {
+		t.Errorf("Expected empty statistics")
+	}
+	srv.Quit()
+
+	if backups := corruptBackups(t, config.StatsPath); len(backups) != 1 || !bytes.Equal(backups[0], corrupt) {
+		t.Errorf("Corrupt statistics have not been backed up")
+	}
+	if contents := logfileContents(config); !strings.Contains(contents, "starting with empty statistics") {
+		t.Errorf("Corrupt statistics have not been logged: %s", contents)
+	}
+}
+
+func BenchmarkDumpStats(b *testing.B) {
+	dir, err := ioutil.TempDir("", "journald")
+	if err != nil {
+		b.Fatalf("Could not create tempdir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	stats := make(map[string]*Statistic, 10000)
+	for i := 0; i < 10000; i++ {
+		instance := strconv.Itoa(i)
+		stats["service/"+instance] = newStatistic("service", instance, int64(i), int64(i*100))
+	}
+
+	for name, format := range map[string]int{"json": STATS_JSON, "gob": STATS_GOB} {
+		b.Run(name, func(b *testing.B) {
+			l := &logServer{statsMu: &sync.RWMutex{}, stats: stats, statsFormat: format, statsPath: filepath.Join(dir, name)}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := l.dumpStatsToFile(); err != nil {
+					b.Fatalf("Could not dump statistics: %s", err.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	if conn, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback is not available")
+	} else {
+		conn.Close()
+	}
+
+	config.Host = "::1"
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server on IPv6 loopback: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token, err := srv.AddToken("service", "instance")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	port := srv.Addr().(*net.TCPAddr).Port
+	for _, host := range []string{"::1", "[::1]"} {
+		remote, err := connect.ToJournald(host, port, "service", "instance", token, time.Second, connect.WithDialTimeout(time.Second))
+		if err != nil {
+			t.Fatalf("Could not connect to %s: %s", host, err.Error())
+		}
+
+		jsoned, _ := json.Marshal(newEntry("ipv6").Entry)
+		if _, err := remote.Write(jsoned); err != nil {
+			t.Errorf("Could not send log via %s: %s", host, err.Error())
+		}
+		remote.Close()
+	}
+
+	if _, err := connect.ToJournald("", port, "service", "instance", token, time.Second); err == nil {
+		t.Errorf("Empty host has been accepted")
+	}
+}
+
+func TestStatisticsStructured(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token, err := srv.AddToken("web", "1")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+	client, closeConn := dial(t, srv, "web", "1", token)
+	for i := 0; i < 3; i++ {
+		if _, err := client.RemoteLog(context.Background(), newEntry("counted")); err != nil {
+			t.Fatalf("RemoteLog failed: %s", err.Error())
+		}
+	}
+	closeConn()
+
+	resp := manager.Execute("statistics", unixsock.Args{"format": "json"})
+	if resp.Status != unixsock.STATUS_OK {
+		t.Fatalf("Statistics failed: %s", resp.Error)
+	}
+
+	result, err := DecodeResult(fmt.Sprint(resp.Payload))
+	if err != nil {
+		t.Fatalf("Statistics are not structured: %s", err.Error())
+	}
+
+	services := result.Table("services")
+	if result.Command != "statistics" || services == nil || len(services.Rows) != 1 {
+		t.Fatalf("Unexpected result: %v", result)
+	}
+	if row := services.Rows[0]; services.Value(row, "Service") != "web" || asInt64(services.Value(row, "Logs")) != 3 || asFloat64(services.Value(row, "Share")) != 1 {
+		t.Errorf("Unexpected service statistics: %v", row)
+	}
+
+	if buckets := result.Table("buckets"); buckets == nil || len(buckets.Rows) != 24 {
+		t.Errorf("Expected 24 hourly rows, got %v", buckets)
+	}
+
+	// Old clients get rendered text
+	if resp := manager.Execute("statistics", nil); !strings.Contains(fmt.Sprint(resp.Payload), "journald statistics") {
+		t.Errorf("Statistics have not been rendered: %v", resp.Payload)
+	}
+}
+
+func TestChunkedResponse(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	l := newTokenServer(t, config.TokenPath, true)
+	pairs := make([][2]string, 30000)
+	for i := range pairs {
+		pairs[i] = [2]string{"web", fmt.Sprintf("%d", i)}
+	}
+	if _, err := l.ImportTokens(pairs); err != nil {
+		t.Fatalf("Could not import tokens: %s", err.Error())
+	}
+
+	manager := NewConsole()
+	manager.AttachToServer(l)
+
+	resp := manager.Execute("tokens.export", unixsock.Args{"chunk_size": float64(256 * 1024)})
+	if resp.Status != STATUS_CHUNKED {
+		t.Fatalf("Payload has not been chunked: %s", resp.Status)
+	}
+
+	chunked := ChunkedPayload{}
+	if err := json.Unmarshal([]byte(fmt.Sprint(resp.Payload)), &chunked); err != nil {
+		t.Fatalf("Could not decode chunked payload: %s", err.Error())
+	}
+	if chunked.Size < 2*1024*1024 {
+		t.Fatalf("Expected a multi-megabyte payload, got %d bytes", chunked.Size)
+	}
+
+	payload := bytes.NewBuffer([]byte{})
+	for i := 0; i < chunked.Chunks; i++ {
+		chunk := manager.Execute("chunk", unixsock.Args{"id": chunked.ID, "index": float64(i)})
+		if chunk.Status != unixsock.STATUS_OK {
+			t.Fatalf("Could not fetch chunk %d: %s", i, chunk.Error)
+		}
+		payload.WriteString(fmt.Sprint(chunk.Payload))
+	}
+
+	if payload.Len() != chunked.Size {
+		t.Fatalf("Expected %d bytes, got %d", chunked.Size, payload.Len())
+	}
+
+	exported := tokenExport{}
+	if err := json.Unmarshal(payload.Bytes(), &exported); err != nil || len(exported.Tokens) != len(pairs) {
+		t.Errorf("Payload has not been fully received: %v", err)
+	}
+
+	// Fetched payloads are dropped
+	if chunk := manager.Execute("chunk", unixsock.Args{"id": chunked.ID, "index": float64(0)}); chunk.Status != unixsock.STATUS_FAIL {
+		t.Errorf("Fetched payload has not been dropped")
+	}
+}
+
+func TestChunksKeepCharacters(t *testing.T) {
+
+	manager := NewConsole().(*managementConsole)
+	text := strings.Repeat("aé€😀", 100)
+
+	for _, size := range []int{1, 2, 3, 5, 7} {
+		resp := manager.splitResponse(unixsock.Args{"chunk_size": float64(size)}, &unixsock.Response{Status: unixsock.STATUS_OK, Payload: text})
+
+		chunked := ChunkedPayload{}
+		if err := json.Unmarshal([]byte(fmt.Sprint(resp.Payload)), &chunked); err != nil {
+			t.Fatalf("Could not decode chunked payload: %s", err.Error())
+		}
+
+		payload := ""
+		for i := 0; i < chunked.Chunks; i++ {
+			chunk := fmt.Sprint(manager.CmdChunk(unixsock.Args{"id": chunked.ID, "index": float64(i)}).Payload)
+			if !utf8.ValidString(chunk) {
+				t.Fatalf("Chunk %d of size %d splits a character: %q", i, size, chunk)
+			}
+			payload += chunk
+		}
+		if payload != text {
+			t.Errorf("Payload has been altered by chunks of size %d", size)
+		}
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token, err := srv.AddToken("web", "1")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	port := srv.Addr().(*net.TCPAddr).Port
+	if err := connect.Verify("127.0.0.1", port, "web", "1", token); err != nil {
+		t.Errorf("Good token has been rejected: %s", err.Error())
+	}
+	if err := connect.Verify("127.0.0.1", port, "web", "1", "bad"); err == nil {
+		t.Errorf("Bad token has been accepted")
+	}
+
+	// Nothing has been logged or counted
+	if contents := logfileContents(config); strings.Contains(contents, "web") {
+		t.Errorf("Verification has been logged: %s", contents)
+	}
+	if stats := srv.GetStatistics()["web/1"]; stats != nil && !stats.LastActive.IsZero() {
+		t.Errorf("Verification has been counted")
+	}
+}
+
+func TestAddTokenValue(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token := "migrated-token_0123456789abcdefghijKLMNOP"
+	if err := srv.AddTokenValue("web", "1", token); err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+	port := srv.Addr().(*net.TCPAddr).Port
+	if err := connect.Verify("127.0.0.1", port, "web", "1", token); err != nil {
+		t.Errorf("Supplied token has been rejected: %s", err.Error())
+	}
+	if err := srv.AddTokenValue("web", "1", token); err == nil {
+		t.Errorf("Existing token has been replaced")
+	}
+
+	for _, malformed := range []string{"", "short", strings.Repeat("a", 257), "contains spaces and is long enough to pass", "tab\tseparated-0123456789abcdefghijklmnop"} {
+		if err := srv.AddTokenValue("web", "2", malformed); err == nil {
+			t.Errorf("Malformed token '%s' has been accepted", malformed)
+		}
+	}
+	if _, ok := srv.GetTokens()["web/2"]; ok {
+		t.Errorf("Malformed token has been stored")
+	}
+
+	// Stored like generated tokens
+	if tokens := newTokenServer(t, config.TokenPath, false).GetTokens(); tokens["web/1"] != token {
+		t.Errorf("Supplied token has not been stored: %v", tokens)
+	}
+}
+
+func TestCustomMetadata(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.LoggerConfig.Columns = []int64{journal.COL_MSG, journal.COL_METADATA}
+	tenants := make(chan string, 1)
+	config.UnaryInterceptors = []grpc.UnaryServerInterceptor{
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if _, ok := req.(*logrpc.CompactLogEntry); ok { // the client negotiates the compact form
+				tenants <- MetadataFromContext(ctx)["tenant"]
+			}
+			return handler(ctx, req)
+		},
+	}
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	token, err := srv.AddToken("web", "1")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	port := srv.Addr().(*net.TCPAddr).Port
+	if _, err := connect.ToJournald("127.0.0.1", port, "web", "1", token, time.Second, connect.WithMetadata("Bad Key", "value")); err == nil {
+		t.Errorf("Invalid metadata key has been accepted")
+	}
+	remote, err := connect.ToJournald("127.0.0.1", port, "web", "1", token, time.Second, connect.WithDialTimeout(time.Second), connect.WithMetadata("Tenant", "acme"))
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err.Error())
+	}
+	defer remote.Close()
+
+	entry := map[int64]string{}
+	for col := int64(journal.COL_DATE_YYMMDD); col <= journal.COL_LINE; col++ {
+		entry[col] = "N/A"
+	}
+	entry[journal.COL_MSG] = "tenant's log"
+	p, _ := json.Marshal(entry)
+	if _, err := remote.Write(p); err != nil {
+		t.Fatalf("Could not write: %s", err.Error())
+	}
+
+	select {
+	case tenant := <-tenants:
+		if tenant != "acme" {
+			t.Errorf("Expected tenant 'acme' in the interceptor, got '%s'", tenant)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Interceptor has not seen the log")
+	}
+
+	// Invalid metadata is rejected server-side
+	invalid := []*logrpc.TokenCred{
+		{Metadata: map[string]string{"tenant!": "value"}},
+		{Metadata: map[string]string{"tenant": "caf\u00e9"}},
+		{Metadata: map[string]string{"tenant": strings.Repeat("x", maxMetadataBytes)}},
+		{},
+	}
+	for i, creds := range invalid {
+		creds.IP, creds.Service, creds.Instance, creds.Token, creds.Schema = "127.0.0.1", "web", "1", token, logrpc.SCHEMA_VERSION
+		client, closeConn := dialCreds(t, srv, creds)
+		log := newEntry("invalid metadata")
+		if creds.Metadata == nil {
+			log.Entry[journal.COL_METADATA] = "{not json"
+		}
+		if _, err := client.RemoteLog(context.Background(), log); err == nil {
+			t.Errorf("Invalid metadata #%d has been accepted", i)
+		}
+		closeConn()
+	}
+
+	srv.Quit()
+	contents := logfileContents(config)
+	if !strings.Contains(contents, `{\"tenant\":\"acme\"}`) {
+		t.Errorf("Metadata has not been stored: %s", contents)
+	}
+	if strings.Contains(contents, "invalid metadata") {
+		t.Errorf("Log with invalid metadata has been stored: %s", contents)
+	}
+}
+
+func TestStatisticsBucketedByEntryTime(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	l := newTokenServer(t, config.TokenPath, true)
+
+	// A buffered entry logged three hours ago
+	logged := time.Now().Add(-3 * time.Hour)
+	old := newEntry("buffered")
+	old.Entry[journal.COL_TIMESTAMP] = strconv.FormatInt(logged.Unix(), 10)
+	l.GatherStatistics("web", "1", "web/1", "127.0.0.1", old)
+
+	// Entries without a usable timestamp fall back to the receive time
+	l.GatherStatistics("web", "1", "web/1", "127.0.0.1", newEntry("undated"))
+
+	stats := l.GetStatistics()["web/1"]
+	if stats.LogsParsed[logged.Hour()] != 1 {
+		t.Errorf("Buffered entry has not been counted in hour %d: %v", logged.Hour(), stats.LogsParsed)
+	}
+	if stats.LogsParsed[time.Now().Hour()] != 1 {
+		t.Errorf("Undated entry has not been counted in the current hour: %v", stats.LogsParsed)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.Version = "v1.2.3"
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	// Console
+	resp := manager.Execute("version", unixsock.Args{"format": "json"})
+	result, err := DecodeResult(fmt.Sprint(resp.Payload))
+	if err != nil || result.Values["version"] != "v1.2.3" {
+		t.Errorf("Unexpected version: %v (%v)", resp, err)
+	}
+
+	// RPC
+	token, err := srv.AddToken("web", "1")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+	client, closeConn := dial(t, srv, "web", "1", token)
+	defer closeConn()
+
+	version, err := client.Version(context.Background(), &logrpc.Nothing{})
+	if err != nil || version.Version != "v1.2.3" || version.Schema != logrpc.SCHEMA_VERSION {
+		t.Errorf("Unexpected version: %v (%v)", version, err)
+	}
+}
+
+func TestConsoleRoles(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.AdminSecret = "admin"
+	config.ViewerSecret = "viewer"
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	for _, test := range []struct {
+		cmd       string
+		args      unixsock.Args
+		secret    string
+		permitted bool
+	}{
+		{"status", unixsock.Args{}, "viewer", true},
+		{"tokens.list.services", unixsock.Args{}, "viewer", true},
+		{"tokens.add", unixsock.Args{"service": "web", "instance": "1"}, "viewer", false},
+		{"tokens.revoke.service", unixsock.Args{"service": "web"}, "viewer", false},
+		{"status", unixsock.Args{}, "", false},
+		{"status", unixsock.Args{}, "wrong", false},
+		{"status", unixsock.Args{}, "admin", true},
+		{"tokens.add", unixsock.Args{"service": "web", "instance": "1"}, "admin", true},
+		{"tokens.revoke.service", unixsock.Args{"service": "web"}, "admin", true},
+	} {
+		if test.secret != "" {
+			test.args["secret"] = test.secret
+		}
+
+		resp := manager.Execute(test.cmd, test.args)
+		if forbidden := strings.HasPrefix(resp.Error, "forbidden"); forbidden == test.permitted {
+			t.Errorf("%s with secret '%s': expected permitted=%t, got %v", test.cmd, test.secret, test.permitted, resp)
+		}
+		if test.permitted && strings.Contains(fmt.Sprint(resp.Payload), "unknown argument") {
+			t.Errorf("The secret has been reported as an unknown argument")
+		}
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("destination unavailable")
+}
+
+func TestSelfReport(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.SelfReportInterval = 50 * time.Millisecond
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+
+	srv.AddDestination("failing", failingWriter{})
+	token, _ := srv.AddToken("service", "instance")
+	client, hangup := dial(t, srv, "service", "instance", token)
+	defer hangup()
+
+	if _, err := client.RemoteLog(context.Background(), newEntry("hello")); err != nil {
+		t.Fatalf("Could not log: %s", err.Error())
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	srv.Quit()
+
+	contents := logfileContents(config)
+	if !strings.Contains(contents, "1 logs received") {
+		t.Errorf("No summary reports the received log: %s", contents)
+	}
+	if !strings.Contains(contents, "destination errors: failing: ") {
+		t.Errorf("No summary reports the failing destination: %s", contents)
+	}
+	if !strings.Contains(contents, `"Summary"`) {
+		t.Errorf("Summaries are not logged with the summary code: %s", contents)
+	}
+}
+
+func TestReportCountersDropped(t *testing.T) {
+	counters := newReportCounters()
+
+	counters.drop()
+	if summary := counters.summary(3); !strings.Contains(summary, "4 dropped") {
+		t.Errorf("Logs dropped by the logger are not reported: %s", summary)
+	}
+	if summary := counters.summary(5); !strings.Contains(summary, "2 dropped") {
+		t.Errorf("Logs dropped by the logger are not reported as a delta: %s", summary)
+	}
+}
+
+func TestTokensMasked(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	config.AdminSecret = "admin"
+	config.ViewerSecret = "viewer"
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token, _ := srv.AddToken("web", "1")
+	masked := token[:4] + "..." + token[len(token)-4:]
+
+	listed := func(args unixsock.Args) string {
+		args["service"] = "web"
+		args["format"] = "json"
+		resp := manager.Execute("tokens.list.instances", args)
+		if resp.Status != unixsock.STATUS_OK {
+			t.Fatalf("Could not list instances: %s", resp.Error)
+		}
+		result, err := DecodeResult(fmt.Sprint(resp.Payload))
+		if err != nil {
+			t.Fatalf("Could not decode result: %s", err.Error())
+		}
+		instances := result.Table("instances")
+		return fmt.Sprint(instances.Value(instances.Rows[0], "Token"))
+	}
+
+	if listed := listed(unixsock.Args{"secret": "viewer"}); listed != masked {
+		t.Errorf("Expected masked token '%s', got '%s'", masked, listed)
+	}
+	if listed := listed(unixsock.Args{"secret": "admin", "reveal": true}); listed != token {
+		t.Errorf("Expected revealed token '%s', got '%s'", token, listed)
+	}
+
+	// Viewers cannot reveal tokens
+	resp := manager.Execute("tokens.list.instances", unixsock.Args{"service": "web", "secret": "viewer", "reveal": true})
+	if !strings.HasPrefix(resp.Error, "forbidden") {
+		t.Errorf("A viewer has revealed tokens: %v", resp)
+	}
+
+	// New tokens are shown in full once
+	resp = manager.Execute("tokens.add", unixsock.Args{"service": "web", "instance": "2", "secret": "admin", "format": "json"})
+	if tokens := srv.GetTokens(); !strings.Contains(fmt.Sprint(resp.Payload), tokens["web/2"]) {
+		t.Errorf("New token has not been shown in full: %v", resp.Payload)
+	}
+}
+
+func TestTokensListAll(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	keys := []string{"api/1", "db/1", "web/1", "web/2"}
+	tokens := map[string]string{}
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		if tokens[key], err = srv.AddToken(parts[0], parts[1]); err != nil {
+			t.Fatalf("Could not add token: %s", err.Error())
+		}
+	}
+	client, closeConn := dial(t, srv, "web", "2", tokens["web/2"])
+	for i := 0; i < 3; i++ {
+		if _, err := client.RemoteLog(context.Background(), newEntry("counted")); err != nil {
+			t.Fatalf("RemoteLog failed: %s", err.Error())
+		}
+	}
+	closeConn()
+
+	list := func(args unixsock.Args) []string {
+		args["format"] = "json"
+		resp := manager.Execute("tokens.list.all", args)
+		if resp.Status != unixsock.STATUS_OK {
+			t.Fatalf("Could not list tokens: %s", resp.Error)
+		}
+		result, err := DecodeResult(fmt.Sprint(resp.Payload))
+		if err != nil {
+			t.Fatalf("Could not decode result: %s", err.Error())
+		}
+		table := result.Table("tokens")
+		listed := []string{}
+		for _, row := range table.Rows {
+			listed = append(listed, fmt.Sprintf("%s/%s", table.Value(row, "Service"), table.Value(row, "Instance")))
+			if status := table.Value(row, "Status"); status != "active" {
+				t.Errorf("Unexpected token status '%v'", status)
+			}
+		}
+		return listed
+	}
+
+	if listed := list(unixsock.Args{}); strings.Join(listed, ",") != strings.Join(keys, ",") {
+		t.Errorf("Expected all service instances %v, got %v", keys, listed)
+	}
+	if listed := list(unixsock.Args{"sort": "logs"}); len(listed) != 4 || listed[0] != "web/2" {
+		t.Errorf("Expected the most active instance first, got %v", listed)
+	}
+	if listed := list(unixsock.Args{"offset": float64(1), "limit": float64(2)}); strings.Join(listed, ",") != "db/1,web/1" {
+		t.Errorf("Unexpected page %v", listed)
+	}
+	if resp := manager.Execute("tokens.list.all", unixsock.Args{"sort": "token"}); resp.Status != unixsock.STATUS_FAIL {
+		t.Errorf("Invalid sort order has been accepted")
+	}
+}
+
+func TestMinuteStatistics(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	// The window must consist of whole buckets
+	config.StatsGranularity = time.Minute
+	config.StatsWindow = 90 * time.Second
+	if err := ValidateConfig(config); err == nil {
+		t.Errorf("A window of 1.5 buckets passed validation")
+	}
+
+	config.StatsWindow = time.Hour
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	logged := time.Now().Add(-10 * time.Minute)
+	entry := newEntry("ten minutes ago")
+	entry.Entry[journal.COL_TIMESTAMP] = strconv.FormatInt(logged.Unix(), 10)
+	srv.GatherStatistics("web", "1", "web/1", "127.0.0.1", entry)
+
+	stats := srv.GetStatistics()["web/1"]
+	if len(stats.LogsParsed) != 60 || stats.LogsParsed[logged.Minute()] != 1 {
+		t.Fatalf("Entry has not been counted in minute %d: %v", logged.Minute(), stats.LogsParsed)
+	}
+
+	resp := manager.Execute("statistics", unixsock.Args{"format": "json"})
+	result, err := DecodeResult(fmt.Sprint(resp.Payload))
+	if err != nil {
+		t.Fatalf("Could not decode statistics: %s", err.Error())
+	}
+	buckets := result.Table("buckets")
+	if buckets == nil || len(buckets.Rows) != 60 {
+		t.Fatalf("Expected 60 buckets, got %v", buckets)
+	}
+	row := buckets.Rows[logged.Minute()]
+	if label := buckets.Value(row, "Bucket"); label != fmt.Sprintf("00:%02d", logged.Minute()) || asInt64(buckets.Value(row, "Logs")) != 1 {
+		t.Errorf("Unexpected bucket of minute %d: %v", logged.Minute(), row)
+	}
+}
+
+func TestDecodeLegacyStatistics(t *testing.T) {
+	legacy := map[string]*legacyStatistic{"web/1": &legacyStatistic{Service: "web", Instance: "1"}}
+	legacy["web/1"].LogsParsed[5] = 3
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(legacy); err != nil {
+		t.Fatalf("Could not encode legacy statistics: %s", err.Error())
+	}
+
+	stats, err := decodeStatistics(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Could not decode legacy statistics: %s", err.Error())
+	}
+	if s := stats["web/1"]; s == nil || len(s.LogsParsed) != 24 || s.LogsParsed[5] != 3 {
+		t.Errorf("Legacy statistics have not been converted: %v", stats)
+	}
+}
+
+func TestCallerIP(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	token, err := srv.AddToken("web", "1")
+	if err != nil {
+		t.Fatalf("Could not add token: %s", err.Error())
+	}
+
+	// The client claims another IP
+	client, closeConn := dialCreds(t, srv, &logrpc.TokenCred{
+		IP:       "203.0.113.9",
+		Service:  "web",
+		Instance: "1",
+		Token:    token,
+		Schema:   logrpc.SCHEMA_VERSION,
+	})
+	defer closeConn()
+	if _, err := client.RemoteLog(context.Background(), newEntry("forged")); err != nil {
+		t.Fatalf("RemoteLog failed: %s", err.Error())
+	}
+
+	if stats := srv.GetStatistics()["web/1"]; stats == nil || stats.LastIP != "127.0.0.1" {
+		t.Errorf("The connection's address has not been recorded: %v", stats)
+	}
+
+	// Trusted proxies may forward the client's IP
+	l := &logServer{trustedProxies: []net.IP{net.ParseIP("10.0.0.1")}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4332}})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", "198.51.100.1, 198.51.100.2, 10.0.0.1"))
+	if ip := l.callerIP(ctx, "203.0.113.9"); ip != "198.51.100.2" {
+		t.Errorf("Expected the forwarded IP 198.51.100.2, got %s", ip)
+	}
+
+	l.trustClientIP = true
+	if ip := l.callerIP(ctx, "203.0.113.9"); ip != "203.0.113.9" {
+		t.Errorf("Expected the claimed IP 203.0.113.9, got %s", ip)
+	}
+}
+
+func TestLogsRotate(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	manager := NewConsole()
+	srv, err := New(config, manager)
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+	defer srv.Quit()
+
+	if resp := manager.Execute("logs.rotate", unixsock.Args{}); resp.Status != unixsock.STATUS_OK {
+		t.Fatalf("Could not rotate logs: %s", resp.Error)
+	}
+
+	logs, err := srv.Logfiles()
+	if err != nil {
+		t.Fatalf("Could not list logfiles: %s", err.Error())
+	}
+	date := time.Now().Format("2006-01-02")
+	if _, ok := logs[fmt.Sprintf("aggregate_%s.1.log", date)]; !ok {
+		t.Errorf("Rotated logfile is missing: %v", logs)
+	}
+	if _, ok := logs[fmt.Sprintf("aggregate_%s.log", date)]; !ok {
+		t.Errorf("Fresh logfile is missing: %v", logs)
+	}
+}
+
+func TestForwardingCycleTerminates(t *testing.T) {
+	configA, teardownA := setup(t)
+	defer teardownA()
+	configB, teardownB := setup(t)
+	defer teardownB()
+
+	configA.ServerID = "a"
+	configB.ServerID = "b"
+	srvA, err := New(configA, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server A: %s", err.Error())
+	}
+	srvB, err := New(configB, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server B: %s", err.Error())
+	}
+
+	// A forwards to B forwards to A
+	for _, pair := range [][2]LogServer{{srvA, srvB}, {srvB, srvA}} {
+		from, to := pair[0], pair[1]
+		token, _ := to.AddToken("journald", "forwarder")
+		remote, errConnect := connect.ToJournald("127.0.0.1", to.Addr().(*net.TCPAddr).Port, "journald", "forwarder", token, time.Second, connect.WithDialTimeout(time.Second))
+		if errConnect != nil {
+			t.Fatalf("Could not connect the servers: %s", errConnect.Error())
+		}
+		defer remote.Close()
+		from.AddDestination("cycle", remote)
+	}
+
+	token, _ := srvA.AddToken("service", "instance")
+	client, hangup := dial(t, srvA, "service", "instance", token)
+	defer hangup()
+	if _, err := client.RemoteLog(context.Background(), newEntry("going around")); err != nil {
+		t.Fatalf("Could not log: %s", err.Error())
+	}
+
+	// The entry returning to A is dropped
+	counters := srvA.(*logServer).counters
+	deadline := time.Now().Add(time.Second)
+	for {
+		counters.mu.Lock()
+		dropped := counters.dropped
+		counters.mu.Unlock()
+		if dropped == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Entry has not been dropped on its return (%d drops)", dropped)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	srvA.Quit()
+	srvB.Quit()
+
+	if count := strings.Count(logfileContents(configA), "going around"); count != 1 {
+		t.Errorf("Server A has logged the entry %d times", count)
+	}
+	if count := strings.Count(logfileContents(configB), "going around"); count != 1 {
+		t.Errorf("Server B has logged the entry %d times", count)
+	}
+}
+
+func TestRemoteLogCompact(t *testing.T) {
+	config, teardown := setup(t)
+	defer teardown()
+
+	srv, err := New(config, NewConsole())
+	if err != nil {
+		t.Fatalf("Could not start log server: %s", err.Error())
+	}
+
+	token, _ := srv.AddToken("service", "instance")
+	client, hangup := dial(t, srv, "service", "instance", token)
+	defer hangup()
+
+	if version, err := client.Version(context.Background(), &logrpc.Nothing{}); err != nil || !version.GetCompact() {
+		t.Fatalf("Server does not offer the compact form: %v", err)
+	}
+
+	compact := &logrpc.CompactLogEntry{}
+	for col, value := range newEntry("compact entry").Entry {
+		compact.Columns = append(compact.Columns, col)
+		compact.Values = append(compact.Values, value)
+	}
+	if _, err := client.RemoteLogCompact(context.Background(), compact); err != nil {
+		t.Fatalf("Could not log in the compact form: %s", err.Error())
+	}
+
+	// Repeated columns cannot spoof the caller
+	spoofed := &logrpc.CompactLogEntry{
+		Columns: append(append([]int64{}, compact.Columns...), journal.COL_SERVICE, journal.COL_SERVICE),
+		Values:  append(append([]string{}, compact.Values...), "spoofed", "spoofed"),
+	}
+	if _, err := client.RemoteLogCompact(context.Background(), spoofed); err != nil {
+		t.Fatalf("Could not log in the compact form: %s", err.Error())
+	}
+
+	compact.Values = compact.Values[1:]
+	if _, err := client.RemoteLogCompact(context.Background(), compact); err == nil {
+		t.Errorf("Mismatched columns and values have been accepted")
+	}
+	srv.Quit()
+
+	contents := logfileContents(config)
+	if !strings.Contains(contents, "compact entry") {
+		t.Errorf("Compact entry has not been logged: %s", contents)
+	}
+	if strings.Contains(contents, "spoofed") {
+		t.Errorf("Service has been spoofed: %s", contents)
+	}
+}
@@ -2,57 +2,370 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	rand "crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
 )
 
+// tokenStore is the JSON-encoded token database
+type tokenStore struct {
+	Version int                     `json:"version"`
+	Tokens  map[string]*tokenRecord `json:"tokens"`
+}
+
+// tokenRecord contains a single authentication token and its metadata
+type tokenRecord struct {
+	Token   string    `json:"token"`
+	Created time.Time `json:"created"`
+}
+
+// tokenExport is the portable token database used to move tokens between servers.
+// Encrypted exports contain the JSON-encoded tokens encrypted with AES-GCM using
+// a key derived from a passphrase (scrypt) instead of the plain tokens.
+type tokenExport struct {
+	Version   int                     `json:"version"`
+	Exported  time.Time               `json:"exported"`
+	Tokens    map[string]*tokenRecord `json:"tokens,omitempty"`
+	Salt      []byte                  `json:"salt,omitempty"`      // scrypt salt
+	Encrypted []byte                  `json:"encrypted,omitempty"` // nonce followed by the encrypted tokens
+}
+
+// TokenImport is the outcome of importing a single service/instance (see ImportTokens)
+type TokenImport struct {
+	Service  string
+	Instance string
+	Token    string // Generated token (masked if restored, empty if the import failed)
+	Error    string // Reason of the failure (empty if the token has been created)
+}
+
+// Valid service and instance names of imported tokens
+var tokenNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Valid caller-supplied tokens (see AddTokenValue): 32-256 characters of
+// the URL-safe and standard base64 alphabets (incl. hex)
+var tokenValuePattern = regexp.MustCompile(`^[a-zA-Z0-9._~+/=-]{32,256}$`)
+
 // AddToken creates a new token for the service/instance if it does not yet exist
 func (l *logServer) AddToken(service, instance string) (string, error) {
 	l.Lock()
 	defer l.Unlock()
 
-	// Clean the key
-	key := getCleanKey(service, instance)
-
 	// Verify key existence
+	key := getCleanKey(service, instance)
 	if _, ok := l.tokens[key]; ok {
 		return "", fmt.Errorf("AddToken: token for %s already exists", key)
 	}
 
 	// Create a random token
-	tokenBytes := make([]byte, 32)
-	if _, err := rand.Read(tokenBytes); err != nil {
-		return "", fmt.Errorf("AddToken: could not generate a random token: %s", err.Error())
+	token, err := newToken()
+	if err != nil {
+		return "", fmt.Errorf("AddToken: %s", err.Error())
+	}
+
+	if err := l.storeToken(service, instance, token); err != nil {
+		return "", fmt.Errorf("AddToken: %s", err.Error())
+	}
+
+	return token, nil
+}
+
+// AddTokenValue stores a caller-supplied token (e.g. migrated from another
+// system) for the service/instance if it does not yet exist
+func (l *logServer) AddTokenValue(service, instance, token string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	// Verify key existence
+	key := getCleanKey(service, instance)
+	if _, ok := l.tokens[key]; ok {
+		return fmt.Errorf("AddTokenValue: token for %s already exists", key)
+	}
+
+	// Validate the token
+	if !tokenValuePattern.MatchString(token) {
+		return fmt.Errorf("AddTokenValue: invalid token (must be 32-256 characters of a-z, A-Z, 0-9 and ._~+/=-)")
 	}
-	token := fmt.Sprintf("%x", sha256.Sum256(tokenBytes))
+
+	if err := l.storeToken(service, instance, token); err != nil {
+		return fmt.Errorf("AddTokenValue: %s", err.Error())
+	}
+
+	return nil
+}
+
+// storeToken writes a new token to file and assigns it to the service/instance
+func (l *logServer) storeToken(service, instance, token string) error {
+	key := getCleanKey(service, instance)
 
 	// Write the token database to file
-	if err := l.writeTokenToFile(key, token); err != nil {
-		return "", fmt.Errorf("AddToken: could not write token to file: %s", err.Error())
+	record := &tokenRecord{Token: token, Created: time.Now()}
+	if err := l.writeTokenToFile(key, record); err != nil {
+		return fmt.Errorf("could not write token to file: %s", err.Error())
 	}
 
 	// Assign token to the key
-	l.tokens[key] = token
-	l.stats[key] = &Statistic{
+	l.tokens[key] = record
+	l.initStatistic(key, service, instance)
+
+	return nil
+}
+
+// ImportTokens creates the tokens of many service/instances with a single write
+// of the token database. Invalid names and already existing service/instances
+// are reported per entry and do not prevent the others from being imported.
+func (l *logServer) ImportTokens(pairs [][2]string) ([]TokenImport, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	// Generate the tokens of all valid service/instances
+	tokens := l.copyTokenRecords()
+	imports := make([]TokenImport, len(pairs))
+	created := 0
+	for i, pair := range pairs {
+		service, instance := strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+		key := getCleanKey(service, instance)
+		imports[i] = TokenImport{Service: service, Instance: instance}
+
+		if !tokenNamePattern.MatchString(service) || !tokenNamePattern.MatchString(instance) {
+			imports[i].Error = "invalid service/instance name"
+			continue
+		}
+		if _, ok := tokens[key]; ok {
+			imports[i].Error = fmt.Sprintf("token for %s already exists", key)
+			continue
+		}
+
+		token, err := newToken()
+		if err != nil {
+			return nil, fmt.Errorf("ImportTokens: %s", err.Error())
+		}
+		tokens[key] = &tokenRecord{Token: token, Created: time.Now()}
+		imports[i].Token = token
+		created++
+	}
+
+	if created == 0 {
+		return imports, nil
+	}
+
+	// Rewrite the token database in one pass
+	if err := l.writeTokenFile(tokens); err != nil {
+		return nil, fmt.Errorf("ImportTokens: could not rewrite token database: %s", err.Error())
+	}
+
+	l.tokens = tokens
+	for _, imported := range imports {
+		if imported.Token != "" {
+			l.initStatistic(getCleanKey(imported.Service, imported.Instance), imported.Service, imported.Instance)
+		}
+	}
+
+	return imports, nil
+}
+
+// ExportTokens exports all the tokens (with their metadata) in a portable format.
+// The tokens are encrypted if a passphrase is provided.
+func (l *logServer) ExportTokens(passphrase string) ([]byte, error) {
+	l.RLock()
+	tokens := l.copyTokenRecords()
+	l.RUnlock()
+
+	export := &tokenExport{Version: 1, Exported: time.Now(), Tokens: tokens}
+
+	// Encrypt the tokens
+	if passphrase != "" {
+		plain, err := json.Marshal(tokens)
+		if err != nil {
+			return nil, fmt.Errorf("ExportTokens: could not marshal tokens: %s", err.Error())
+		}
+
+		export.Salt = make([]byte, 16)
+		if _, err := rand.Read(export.Salt); err != nil {
+			return nil, fmt.Errorf("ExportTokens: could not generate salt: %s", err.Error())
+		}
+		aead, err := tokenExportCipher(passphrase, export.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("ExportTokens: %s", err.Error())
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("ExportTokens: could not generate nonce: %s", err.Error())
+		}
+
+		export.Encrypted = aead.Seal(nonce, nonce, plain, nil)
+		export.Tokens = nil
+	}
+
+	jsoned, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("ExportTokens: could not marshal export: %s", err.Error())
+	}
+
+	return jsoned, nil
+}
+
+// RestoreTokens imports the tokens of an export (see ExportTokens) with their
+// metadata using a single write of the token database. Invalid names and tokens
+// (see AddTokenValue) as well as already existing service/instances are reported
+// per entry. The report contains the restored tokens masked.
+func (l *logServer) RestoreTokens(exported []byte, passphrase string) ([]TokenImport, error) {
+
+	export := &tokenExport{}
+	if err := json.Unmarshal(exported, export); err != nil {
+		return nil, fmt.Errorf("RestoreTokens: could not unmarshal export: %s", err.Error())
+	}
+
+	// Decrypt the tokens
+	if len(export.Encrypted) > 0 {
+		if passphrase == "" {
+			return nil, fmt.Errorf("RestoreTokens: the export is encrypted, but no passphrase has been provided")
+		}
+		aead, err := tokenExportCipher(passphrase, export.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("RestoreTokens: %s", err.Error())
+		}
+		if len(export.Encrypted) < aead.NonceSize() {
+			return nil, fmt.Errorf("RestoreTokens: truncated export")
+		}
+		nonce, sealed := export.Encrypted[:aead.NonceSize()], export.Encrypted[aead.NonceSize():]
+		plain, err := aead.Open(nil, nonce, sealed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("RestoreTokens: could not decrypt tokens (wrong passphrase?)")
+		}
+		if err := json.Unmarshal(plain, &export.Tokens); err != nil {
+			return nil, fmt.Errorf("RestoreTokens: could not unmarshal tokens: %s", err.Error())
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	// Merge the exported tokens (sorted for a stable report)
+	keys := make([]string, 0, len(export.Tokens))
+	for key := range export.Tokens {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tokens := l.copyTokenRecords()
+	imports := make([]TokenImport, 0, len(keys))
+	restored := 0
+	for _, key := range keys {
+		parts := strings.Split(key, "/")
+		imported := TokenImport{Service: parts[0]}
+		if len(parts) == 2 {
+			imported.Instance = parts[1]
+		}
+		cleanKey := getCleanKey(imported.Service, imported.Instance)
+
+		switch record := export.Tokens[key]; {
+		case record == nil || len(parts) != 2:
+			imported.Error = "malformed token record"
+		case !tokenNamePattern.MatchString(imported.Service) || !tokenNamePattern.MatchString(imported.Instance) || key != cleanKey:
+			imported.Error = "invalid service/instance name"
+		case !tokenValuePattern.MatchString(record.Token):
+			imported.Error = "invalid token"
+		case tokens[cleanKey] != nil:
+			imported.Error = fmt.Sprintf("token for %s already exists", cleanKey)
+		default:
+			tokens[cleanKey] = record
+			imported.Token = maskToken(record.Token)
+			restored++
+		}
+		imports = append(imports, imported)
+	}
+
+	if restored == 0 {
+		return imports, nil
+	}
+
+	// Rewrite the token database in one pass
+	if err := l.writeTokenFile(tokens); err != nil {
+		return nil, fmt.Errorf("RestoreTokens: could not rewrite token database: %s", err.Error())
+	}
+
+	l.tokens = tokens
+	for _, imported := range imports {
+		if imported.Token != "" {
+			l.initStatistic(getCleanKey(imported.Service, imported.Instance), imported.Service, imported.Instance)
+		}
+	}
+
+	return imports, nil
+}
+
+// tokenExportCipher derives the AES-GCM cipher of encrypted token exports from a passphrase
+func tokenExportCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive key: %s", err.Error())
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %s", err.Error())
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// newToken generates a new random token
+func newToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("could not generate a random token: %s", err.Error())
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(tokenBytes)), nil
+}
+
+// maskToken hides all but the first and last 4 characters of a token
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:4] + "..." + token[len(token)-4:]
+}
+
+// initStatistic creates empty statistics for a new service/instance
+func (l *logServer) initStatistic(key, service, instance string) {
+	if l.statsDisabled {
+		return
+	}
+
+	stats := &Statistic{
 		Service:  service,
 		Instance: instance,
 	}
+	_, buckets := l.buckets()
+	stats.fit(buckets)
 
-	return token, nil
+	l.statsMu.Lock()
+	l.stats[key] = stats
+	l.statsMu.Unlock()
 }
 
 // GetTokens returns LogServer's tokens
 func (l *logServer) GetTokens() map[string]string {
-	l.Lock()
-	l.Unlock()
+	l.RLock()
+	defer l.RUnlock()
 
 	copyTokens := map[string]string{}
-	for key, token := range l.tokens {
-		copyTokens[key] = token
+	for key, record := range l.tokens {
+		copyTokens[key] = record.Token
 	}
 
 	return copyTokens
@@ -82,6 +395,56 @@ func (l *logServer) RemoveTokens(service string) error {
 	return nil
 }
 
+// RevokeMatching removes all the authentication tokens whose service/instance
+// key matches the pattern and returns the number of removed tokens. Patterns
+// prefixed with "re:" are regular expressions, all others are globs matched
+// against the whole key (e.g. "*/worker-*" or "myservice/*").
+func (l *logServer) RevokeMatching(pattern string) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	// Compile the pattern
+	var match func(key string) bool
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return 0, fmt.Errorf("RevokeMatching: invalid regular expression: %s", err.Error())
+		}
+		match = re.MatchString
+	} else {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return 0, fmt.Errorf("RevokeMatching: invalid pattern: %s", err.Error())
+		}
+		match = func(key string) bool {
+			matched, _ := path.Match(pattern, key)
+			return matched
+		}
+	}
+
+	// Split tokens into the remaining and the revoked ones
+	remaining := l.copyTokenRecords()
+	revoked := []string{}
+	for key := range remaining {
+		if match(key) {
+			revoked = append(revoked, key)
+			delete(remaining, key)
+		}
+	}
+
+	if len(revoked) == 0 {
+		return 0, nil
+	}
+
+	// Rewrite the token database in one pass
+	if err := l.writeTokenFile(remaining); err != nil {
+		return 0, fmt.Errorf("RevokeMatching: could not rewrite token database: %s", err.Error())
+	}
+
+	l.tokens = remaining
+
+	return len(revoked), nil
+}
+
 // RemoveToken removes an authentication token
 func (l *logServer) RemoveToken(service, instance string, lock bool) error {
 	if lock {
@@ -109,7 +472,17 @@ func (l *logServer) RemoveToken(service, instance string, lock bool) error {
 }
 
 // writeTokenToFile writes a tokens to file
-func (l *logServer) writeTokenToFile(key, token string) error {
+func (l *logServer) writeTokenToFile(key string, record *tokenRecord) error {
+
+	// JSON stores are always rewritten as a whole
+	if l.tokensJSON {
+		tokens := l.copyTokenRecords()
+		tokens[key] = record
+		if err := writeTokenStore(l.tokenPath, tokens); err != nil {
+			return fmt.Errorf("writeTokenToFile: %s", err.Error())
+		}
+		return nil
+	}
 
 	// Make sure file is writeable
 	if err := fileExists(l.tokenPath); err != nil {
@@ -117,9 +490,9 @@ func (l *logServer) writeTokenToFile(key, token string) error {
 	}
 
 	// Write to file
-	f, err := os.OpenFile(l.tokenPath, os.O_WRONLY|os.O_APPEND, 0600)
+	f, err := os.OpenFile(l.tokenPath, os.O_WRONLY|os.O_APPEND, fileMode)
 	if err == nil {
-		if _, err = f.WriteString(fmt.Sprintf("%s\t%s\n", key, token)); err != nil {
+		if _, err = f.WriteString(fmt.Sprintf("%s\t%s\n", key, record.Token)); err != nil {
 			return fmt.Errorf("writeTokenToFile: could not write token to file: %s", err.Error())
 		}
 	} else {
@@ -137,13 +510,23 @@ func (l *logServer) removeTokenFromFile(key string, lock bool) error {
 		defer l.Unlock()
 	}
 
+	// JSON stores are always rewritten as a whole
+	if l.tokensJSON {
+		tokens := l.copyTokenRecords()
+		delete(tokens, key)
+		if err := writeTokenStore(l.tokenPath, tokens); err != nil {
+			return fmt.Errorf("removeTokenFromFile: %s", err.Error())
+		}
+		return nil
+	}
+
 	// Make sure file exists
 	if err := fileExists(l.tokenPath); err != nil {
 		return fmt.Errorf("removeTokenFromFile: could not create tokens database: %s", err.Error())
 	}
 
 	// Open file for reading
-	f, err := os.OpenFile(l.tokenPath, os.O_RDWR, 600)
+	f, err := os.OpenFile(l.tokenPath, os.O_RDWR, fileMode)
 	if err != nil {
 		return fmt.Errorf("removeTokenFromFile: could not open token database for reading: %s", err.Error())
 	}
@@ -175,14 +558,18 @@ func (l *logServer) removeTokenFromFile(key string, lock bool) error {
 	tokens = append(tokens, "\n")
 
 	// Revwrite tokens.db
-	if err := ioutil.WriteFile(l.tokenPath, []byte(strings.Join(tokens, "\n")), 0600); err != nil {
+	if err := writeFileAtomic(l.tokenPath, []byte(strings.Join(tokens, "\n")), fileMode); err != nil {
 		return fmt.Errorf("removeTokenFromFile: could not rewrite token database: %s", err.Error())
 	}
 
 	return nil
 }
 
-// loadTokensFromDisk loads all the tokens from disk to memory
+// loadTokensFromDisk loads all the tokens from disk to memory. The format of
+// the token database (JSON or legacy tab-separated) is detected automatically.
+// Legacy databases are migrated to JSON if the server uses JSON tokens. Malformed
+// lines are skipped, a database that cannot be decoded is moved aside and reported
+// as *corruptDBError (the server starts without tokens). Read errors are fatal.
 func (l *logServer) loadTokensFromDisk() error {
 	l.Lock()
 	defer l.Unlock()
@@ -192,14 +579,30 @@ func (l *logServer) loadTokensFromDisk() error {
 		return fmt.Errorf("loadTokensFromDisk: could not create tokens.db: %s", err.Error())
 	}
 
-	// Open file for reading
-	f, err := os.OpenFile(l.tokenPath, os.O_RDONLY, 0600)
+	// Read the whole database
+	contents, err := ioutil.ReadFile(l.tokenPath)
 	if err != nil {
-		return fmt.Errorf("loadTokensFromDisk: could not open token file for reading: %s", err.Error())
+		return fmt.Errorf("loadTokensFromDisk: could not read token file: %s", err.Error())
 	}
 
-	// Read line by line and add to the in-memory db
-	fileScanner := bufio.NewScanner(f)
+	// JSON store
+	if trimmed := bytes.TrimSpace(contents); len(trimmed) > 0 && trimmed[0] == '{' {
+		store := &tokenStore{}
+		if err := json.Unmarshal(trimmed, store); err != nil {
+			l.tokensJSON = true
+			return setAsideCorrupt(l.tokenPath, fmt.Errorf("loadTokensFromDisk: could not unmarshal tokens: %s, starting without tokens", err.Error()))
+		}
+		for key, record := range store.Tokens {
+			if record != nil && len(strings.Split(key, "/")) == 2 {
+				l.tokens[key] = record
+			}
+		}
+		l.tokensJSON = true
+		return nil
+	}
+
+	// Legacy store: read line by line and add to the in-memory db
+	fileScanner := bufio.NewScanner(bytes.NewReader(contents))
 	for fileScanner.Scan() {
 		line := fileScanner.Text()
 		parts := strings.Split(line, "\t")
@@ -210,8 +613,67 @@ func (l *logServer) loadTokensFromDisk() error {
 		if len(keyParts) != 2 {
 			continue
 		}
-		l.tokens[parts[0]] = parts[1]
+		l.tokens[parts[0]] = &tokenRecord{Token: parts[1]}
 	}
 
-	return f.Close()
+	// One-time migration to JSON (the legacy database is kept as a backup)
+	if l.tokensJSON && len(bytes.TrimSpace(contents)) > 0 {
+		if err := writeFileAtomic(fmt.Sprintf("%s.legacy", l.tokenPath), contents, fileMode); err != nil {
+			return fmt.Errorf("loadTokensFromDisk: could not back up legacy tokens: %s", err.Error())
+		}
+		if err := writeTokenStore(l.tokenPath, l.tokens); err != nil {
+			return fmt.Errorf("loadTokensFromDisk: could not migrate legacy tokens: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// copyTokenRecords returns a shallow copy of the in-memory token database
+func (l *logServer) copyTokenRecords() map[string]*tokenRecord {
+	tokens := make(map[string]*tokenRecord, len(l.tokens))
+	for key, record := range l.tokens {
+		tokens[key] = record
+	}
+	return tokens
+}
+
+// writeTokenFile atomically replaces the token database with tokens
+func (l *logServer) writeTokenFile(tokens map[string]*tokenRecord) error {
+
+	if l.tokensJSON {
+		return writeTokenStore(l.tokenPath, tokens)
+	}
+
+	keys := make([]string, 0, len(tokens))
+	for key := range tokens {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := bytes.NewBuffer([]byte{})
+	for _, key := range keys {
+		buf.WriteString(fmt.Sprintf("%s\t%s\n", key, tokens[key].Token))
+	}
+
+	if err := writeFileAtomic(l.tokenPath, buf.Bytes(), fileMode); err != nil {
+		return fmt.Errorf("writeTokenFile: could not write tokens: %s", err.Error())
+	}
+
+	return nil
+}
+
+// writeTokenStore atomically writes tokens as a JSON token database
+func writeTokenStore(filename string, tokens map[string]*tokenRecord) error {
+
+	jsoned, err := json.MarshalIndent(&tokenStore{Version: 1, Tokens: tokens}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("writeTokenStore: could not marshal tokens: %s", err.Error())
+	}
+
+	if err := writeFileAtomic(filename, jsoned, fileMode); err != nil {
+		return fmt.Errorf("writeTokenStore: could not write tokens: %s", err.Error())
+	}
+
+	return nil
 }
@@ -2,24 +2,68 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	"github.com/fatih/color"
+	"github.com/vaitekunas/journal"
+	"github.com/vaitekunas/journal/logrpc"
 	"golang.org/x/crypto/ssh/terminal"
 	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
 	metadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 )
 
+// Valid keys of custom metadata (see connect.WithMetadata)
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// maxMetadataBytes limits the total size of the custom metadata of a caller (keys and values)
+const maxMetadataBytes = 4096
+
+// Extracts service, instance, token and the validated custom metadata from the grpc context
+func extractCaller(ctx context.Context) (service, instance, key, token, ip string, meta map[string]string, err error) {
+
+	service, instance, key, token, ip, err = extractCredentials(ctx)
+	if err != nil {
+		return "", "", "", "", "", nil, err
+	}
+
+	// Verify the custom metadata
+	meta = MetadataFromContext(ctx)
+	size := 0
+	for mkey, value := range meta {
+		if !metadataKeyPattern.MatchString(mkey) {
+			return "", "", "", "", "", nil, fmt.Errorf("extractCaller: invalid metadata key '%s'", mkey)
+		}
+		for _, r := range value {
+			if r < ' ' || r > '~' {
+				return "", "", "", "", "", nil, fmt.Errorf("extractCaller: invalid metadata value of '%s' (must be printable ASCII)", mkey)
+			}
+		}
+		size += len(mkey) + len(value)
+	}
+	if size > maxMetadataBytes {
+		return "", "", "", "", "", nil, fmt.Errorf("extractCaller: metadata exceeds %d bytes", maxMetadataBytes)
+	}
+
+	return service, instance, key, token, ip, meta, nil
+}
+
 // Extracts service, instance and token from the grpc context
-func extractCaller(ctx context.Context) (service, instance, key, token, ip string, err error) {
+func extractCredentials(ctx context.Context) (service, instance, key, token, ip string, err error) {
 
 	// Verify presence of metadata
 	md, ok := metadata.FromContext(ctx)
@@ -44,6 +88,192 @@ func extractCaller(ctx context.Context) (service, instance, key, token, ip strin
 	return service, instance, key, token, ip, nil
 }
 
+// MetadataFromContext returns the custom metadata a client has attached to its
+// logs (see connect.WithMetadata), e.g. for routing them in an interceptor
+// (see Config.UnaryInterceptors). The keys are returned without logrpc.METADATA_PREFIX.
+func MetadataFromContext(ctx context.Context) map[string]string {
+
+	meta := map[string]string{}
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return meta
+	}
+
+	for key, values := range md {
+		if strings.HasPrefix(key, logrpc.METADATA_PREFIX) && len(values) > 0 {
+			meta[strings.TrimPrefix(key, logrpc.METADATA_PREFIX)] = values[0]
+		}
+	}
+
+	return meta
+}
+
+// mergeMetadata adds the custom metadata of the caller to the (JSON-encoded)
+// metadata of an entry, e.g. set by a server the entry has been forwarded from.
+// The caller's values take precedence. Metadata that is not a JSON object of
+// strings is rejected.
+func mergeMetadata(encoded string, meta map[string]string) (string, error) {
+
+	merged := map[string]string{}
+	if encoded != "" && encoded != "N/A" {
+		if err := json.Unmarshal([]byte(encoded), &merged); err != nil {
+			return "", fmt.Errorf("mergeMetadata: invalid metadata: %s", err.Error())
+		}
+	}
+	if len(meta) == 0 {
+		return encoded, nil
+	}
+	for key, value := range meta {
+		merged[key] = value
+	}
+
+	jsoned, err := json.Marshal(merged)
+	if err != nil {
+		return "", fmt.Errorf("mergeMetadata: could not marshal metadata: %s", err.Error())
+	}
+	return string(jsoned), nil
+}
+
+// checkSchema verifies that the caller uses the server's log entry schema. Clients
+// predating the schema negotiation send no schema and are assumed to use the first one.
+func checkSchema(ctx context.Context) error {
+
+	schema := "1"
+	if md, ok := metadata.FromContext(ctx); ok && len(md["schema"]) == 1 && md["schema"][0] != "" {
+		schema = md["schema"][0]
+	}
+
+	if schema != logrpc.SCHEMA_VERSION {
+		return fmt.Errorf("log entry schema '%s' is not supported (server uses '%s')", schema, logrpc.SCHEMA_VERSION)
+	}
+
+	return nil
+}
+
+// callerIP returns the IP of the caller: the address of the connection unless the
+// claimed IP is trusted. Behind a trusted proxy the rightmost untrusted hop of
+// the metadata "x-forwarded-for" is used.
+func (l *logServer) callerIP(ctx context.Context, claimed string) string {
+
+	if l.trustClientIP {
+		return claimed
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "N/A"
+	}
+	ip := p.Addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	if !l.trustedProxy(ip) {
+		return ip
+	}
+
+	md, ok := metadata.FromContext(ctx)
+	if !ok {
+		return ip
+	}
+	var hops []string
+	for _, header := range md["x-forwarded-for"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !l.trustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// trustedProxy checks whether ip belongs to a trusted proxy
+func (l *logServer) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, proxy := range l.trustedProxies {
+		if proxy.Equal(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// validHost verifies that the host is either empty (all interfaces), an IP address
+// or a resolvable hostname
+func validHost(host string) error {
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+
+	if strings.TrimSpace(host) != host || strings.ContainsAny(host, ":/ ") {
+		return fmt.Errorf("malformed host '%s'", host)
+	}
+
+	if _, err := net.LookupHost(host); err != nil {
+		return fmt.Errorf("could not resolve host '%s': %s", host, err.Error())
+	}
+
+	return nil
+}
+
+// chainUnaryInterceptors combines several interceptors into one. The interceptors
+// are executed in the given order, each wrapping all of the following ones.
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+
+		return chained(ctx, req)
+	}
+}
+
+// corruptDBError is returned if a database (statistics, tokens) could not be
+// decoded. The server continues with an empty database, the file has been
+// backed up.
+type corruptDBError struct {
+	backup string
+	err    error
+}
+
+// Error describes the corruption and the backup
+func (e *corruptDBError) Error() string {
+	return fmt.Sprintf("%s (backed up to '%s')", e.err.Error(), e.backup)
+}
+
+// setAsideCorrupt moves a corrupt database aside (<filename>.corrupt.<time>),
+// so that it is not overwritten by the empty one. Earlier backups are kept. If
+// the database cannot be moved, the error is returned as is (i.e. it is fatal).
+func setAsideCorrupt(filename string, err error) error {
+
+	backup := fmt.Sprintf("%s.corrupt.%s", filename, time.Now().Format("20060102-150405"))
+	for i := 1; ; i++ {
+		if _, errStat := os.Lstat(backup); os.IsNotExist(errStat) {
+			break
+		} else if errStat != nil {
+			return fmt.Errorf("%s; could not back up the file: %s", err.Error(), errStat.Error())
+		}
+		backup = fmt.Sprintf("%s.corrupt.%s.%d", filename, time.Now().Format("20060102-150405"), i)
+	}
+
+	if errBackup := os.Rename(filename, backup); errBackup != nil {
+		return fmt.Errorf("%s; could not back up the file: %s", err.Error(), errBackup.Error())
+	}
+	return &corruptDBError{backup: backup, err: err}
+}
+
 // Verifies that a file exist
 func fileExists(filename string) error {
 
@@ -52,7 +282,7 @@ func fileExists(filename string) error {
 
 	// Make sure dir and file exist
 	if dir, err := os.Stat(dirPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(dirPath, 0700); err != nil {
+		if err := os.MkdirAll(dirPath, dirMode); err != nil {
 			return fmt.Errorf("fileExists: directory to store tokens.db could not be created: %s", err.Error())
 		}
 	} else if !dir.IsDir() {
@@ -61,7 +291,7 @@ func fileExists(filename string) error {
 
 	// Make sure the file exists
 	if d, err := os.Stat(filename); os.IsNotExist(err) {
-		f, errF := os.Create(filename)
+		f, errF := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, fileMode)
 		if errF != nil {
 			return fmt.Errorf("fileExists: could not create token db: %s", err.Error())
 		}
@@ -73,6 +303,143 @@ func fileExists(filename string) error {
 	return nil
 }
 
+// writeFileAtomic writes data to a temporary file and renames it to filename,
+// so that readers never see a partially written file
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), fmt.Sprintf(".%s", filepath.Base(filename)))
+	if err != nil {
+		return fmt.Errorf("writeFileAtomic: could not create temporary file: %s", err.Error())
+	}
+	tempname := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tempname)
+		return fmt.Errorf("writeFileAtomic: could not write temporary file: %s", err.Error())
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tempname)
+		return fmt.Errorf("writeFileAtomic: could not sync temporary file: %s", err.Error())
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tempname)
+		return fmt.Errorf("writeFileAtomic: could not close temporary file: %s", err.Error())
+	}
+
+	if err := os.Chmod(tempname, perm); err != nil {
+		os.Remove(tempname)
+		return fmt.Errorf("writeFileAtomic: could not set permissions: %s", err.Error())
+	}
+
+	if err := os.Rename(tempname, filename); err != nil {
+		os.Remove(tempname)
+		return fmt.Errorf("writeFileAtomic: could not replace file: %s", err.Error())
+	}
+
+	return nil
+}
+
+// loadCodes reads custom message codes from a JSON file, e.g.
+// {"42": {"Type": "PaymentDeclined", "Error": true}}. Only codes 2-998 can be
+// customized (see journal.Logger.UseCustomCodes).
+func loadCodes(path string) (map[int]journal.Code, error) {
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadCodes: could not read codes file: %s", err.Error())
+	}
+
+	codes := map[int]journal.Code{}
+	if err := json.Unmarshal(contents, &codes); err != nil {
+		return nil, fmt.Errorf("loadCodes: could not parse codes file '%s': %s", path, err.Error())
+	}
+
+	for code, lCode := range codes {
+		if code < 2 || code > 998 {
+			return nil, fmt.Errorf("loadCodes: code '%d' is out of range (2-998)", code)
+		}
+		if lCode.Type == "" {
+			return nil, fmt.Errorf("loadCodes: code '%d' has no type", code)
+		}
+	}
+
+	return codes, nil
+}
+
+// entryTime returns the time a remote log entry has been logged at (the unix
+// timestamp or one of the date columns), or fallback if it carries none
+func entryTime(entry *logrpc.CompactLogEntry, fallback time.Time) time.Time {
+
+	if seconds, err := strconv.ParseInt(columnValue(entry, journal.COL_TIMESTAMP), 10, 64); err == nil && seconds > 0 {
+		return time.Unix(seconds, 0)
+	}
+
+	for col, layout := range map[int64]string{
+		journal.COL_DATE_YYMMDD_HHMMSS_NANO: "2006-01-02 15:04:05.000000000",
+		journal.COL_DATE_YYMMDD_HHMMSS:      "2006-01-02 15:04:05",
+	} {
+		if t, err := time.ParseInLocation(layout, columnValue(entry, col), time.Local); err == nil {
+			return t
+		}
+	}
+
+	return fallback
+}
+
+// compactFromMap converts a remote log entry received as a map to the compact form
+func compactFromMap(entry map[int64]string) *logrpc.CompactLogEntry {
+
+	compact := &logrpc.CompactLogEntry{
+		Columns: make([]int64, 0, len(entry)),
+		Values:  make([]string, 0, len(entry)),
+	}
+	for col, value := range entry {
+		compact.Columns = append(compact.Columns, col)
+		compact.Values = append(compact.Values, value)
+	}
+
+	return compact
+}
+
+// columnValue returns the value of a column of a compact log entry (the last
+// one if the column is repeated, empty if it is missing)
+func columnValue(entry *logrpc.CompactLogEntry, col int64) string {
+	for i := len(entry.Columns) - 1; i >= 0; i-- {
+		if entry.Columns[i] == col {
+			return entry.Values[i]
+		}
+	}
+	return ""
+}
+
+// setColumn sets (every occurrence of) a column of a compact log entry
+func setColumn(entry *logrpc.CompactLogEntry, col int64, value string) {
+	found := false
+	for i := range entry.Columns {
+		if entry.Columns[i] == col {
+			entry.Values[i] = value
+			found = true
+		}
+	}
+	if !found {
+		entry.Columns = append(entry.Columns, col)
+		entry.Values = append(entry.Values, value)
+	}
+}
+
+// entrySize returns the size of a compact log entry, i.e. of its values, in bytes
+func entrySize(entry *logrpc.CompactLogEntry) int {
+	size := 0
+	for _, value := range entry.Values {
+		size += len(value)
+	}
+	return size
+}
+
 // getCleanKey cleans inputs and builds from them a service/instance key
 func getCleanKey(service, instance string) string {
 	return strings.ToLower(fmt.Sprintf("%s/%s", strings.TrimSpace(service), strings.TrimSpace(instance)))
@@ -93,14 +460,36 @@ func console(s interface{}) string {
 	return fmt.Sprintf(" %s [%s] %v", color.New(color.FgHiBlue).Sprint("▶"), time.Now().Format("2006-01-02 15:04:05"), s)
 }
 
+// relativeTime describes how long ago t was, e.g. "3m ago" (zero time is "never")
+func relativeTime(t, now time.Time) string {
+
+	if t.IsZero() {
+		return "never"
+	}
+
+	switch ago := now.Sub(t); {
+	case ago < time.Minute:
+		return "just now"
+	case ago < time.Hour:
+		return fmt.Sprintf("%dm ago", int(ago/time.Minute))
+	case ago < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(ago/time.Hour))
+	default:
+		return fmt.Sprintf("%dd ago", int(ago/(24*time.Hour)))
+	}
+
+}
+
 // parsedSums sums and formats parsed log statistics
-func parsedSums(parsedLogs, parsedBytes [24]int64) (string, string, int64, int64) {
+func parsedSums(parsedLogs, parsedBytes []int64) (string, string, int64, int64) {
 	var plogs int64
 	var pbytes int64
 
-	for i := 0; i < 24; i++ {
-		plogs += parsedLogs[i]
-		pbytes += parsedBytes[i]
+	for _, logs := range parsedLogs {
+		plogs += logs
+	}
+	for _, bytes := range parsedBytes {
+		pbytes += bytes
 	}
 
 	plogsStr, pbytesStr := prettyParsedSums(plogs, pbytes)
@@ -156,53 +545,54 @@ func prettyParsedSums(plogs, pbytes int64) (plogsStr, pbytesStr string) {
 		strings.TrimSpace(fmt.Sprintf("%6.2f %s", pbytesNorm, pbytesSuffix))
 }
 
-// floatSorter implements the sort.Interface
+// floatSorter sorts floats while keeping track of their original indexes
+// (implements the sort.Interface)
 type floatSorter struct {
-	order  []int
-	floats []float64
+	order      []int
+	floats     []float64
+	descending bool
 }
 
-// Len implements sort.Interface.Len
-func (f *floatSorter) Len() int {
-	if f.order == nil {
-		f.createOrders()
+// newFloatSorter creates a floatSorter for a copy of floats
+func newFloatSorter(floats []float64, descending bool) *floatSorter {
+	f := &floatSorter{
+		order:      make([]int, len(floats)),
+		floats:     make([]float64, len(floats)),
+		descending: descending,
 	}
 
+	copy(f.floats, floats)
+	for i := range f.order {
+		f.order[i] = i
+	}
+
+	return f
+}
+
+// Len implements sort.Interface.Len
+func (f *floatSorter) Len() int {
 	return len(f.floats)
 }
 
 // Less implements sort.Interface.Less
 func (f *floatSorter) Less(i, j int) bool {
+	if f.descending {
+		return f.floats[i] > f.floats[j]
+	}
 	return f.floats[i] < f.floats[j]
 }
 
 // Swap implements sort.Interface.Swap
 func (f *floatSorter) Swap(i, j int) {
-
-	tempIdx := f.order[i]
-	tempV := f.floats[i]
-
-	f.floats[i] = f.floats[j]
-	f.floats[j] = tempV
-
-	f.order[i] = f.order[j]
-	f.order[j] = tempIdx
-
+	f.floats[i], f.floats[j] = f.floats[j], f.floats[i]
+	f.order[i], f.order[j] = f.order[j], f.order[i]
 }
 
-// createOrders initiates the order slice
-func (f *floatSorter) createOrders() {
-	f.order = make([]int, len(f.floats))
-	for i := 0; i < len(f.floats); i++ {
-		f.order[i] = i
-	}
-}
-
-// GetSortedIndexes returns the indexes of sorted floats
-func (f *floatSorter) GetIndexes() []int {
-	if f.order == nil {
-		f.createOrders()
-	}
+// SortedOrder sorts the floats and returns their original indexes, i.e.
+// SortedOrder()[0] is the index of the smallest (largest if descending) float.
+// Equal floats keep their original order.
+func (f *floatSorter) SortedOrder() []int {
+	sort.Stable(f)
 	return f.order
 }
 
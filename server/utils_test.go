@@ -0,0 +1,113 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vaitekunas/unixsock"
+)
+
+func TestFloatSorter(t *testing.T) {
+
+	floats := []float64{0.3, 0.1, 0.4, 0.15, 0.05}
+	sorter := newFloatSorter(floats, false)
+
+	if order := sorter.SortedOrder(); !reflect.DeepEqual(order, []int{4, 1, 3, 0, 2}) {
+		t.Errorf("Unexpected sorted order: %v", order)
+	}
+	if !reflect.DeepEqual(sorter.floats, []float64{0.05, 0.1, 0.15, 0.3, 0.4}) {
+		t.Errorf("Floats have not been sorted: %v", sorter.floats)
+	}
+	if !reflect.DeepEqual(floats, []float64{0.3, 0.1, 0.4, 0.15, 0.05}) {
+		t.Errorf("Input floats have been modified: %v", floats)
+	}
+
+	// Equal floats keep their original order
+	if order := newFloatSorter([]float64{0.5, 0.5, 0.5}, false).SortedOrder(); !reflect.DeepEqual(order, []int{0, 1, 2}) {
+		t.Errorf("Unexpected sorted order of equal floats: %v", order)
+	}
+
+	if order := newFloatSorter(floats, true).SortedOrder(); !reflect.DeepEqual(order, []int{2, 0, 3, 1, 4}) {
+		t.Errorf("Unexpected descending order: %v", order)
+	}
+
+	if order := newFloatSorter(nil, false).SortedOrder(); len(order) != 0 {
+		t.Errorf("Unexpected sorted order of no floats: %v", order)
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"never":    {},
+		"just now": now.Add(-30 * time.Second),
+		"3m ago":   now.Add(-3*time.Minute - 10*time.Second),
+		"2h ago":   now.Add(-2*time.Hour - 59*time.Minute),
+		"5d ago":   now.AddDate(0, 0, -5),
+	}
+
+	for expected, then := range cases {
+		if relative := relativeTime(then, now); relative != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, relative)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+
+	cases := []struct {
+		args         unixsock.Args
+		total        int
+		start, end   int
+		expectedInfo string
+	}{
+		{unixsock.Args{}, 120, 0, 120, "showing 1-120 of 120"},
+		{unixsock.Args{"offset": 50.0, "limit": 50.0}, 120, 50, 100, "showing 51-100 of 120"},
+		{unixsock.Args{"offset": 100.0, "limit": 50.0}, 120, 100, 120, "showing 101-120 of 120"},
+		{unixsock.Args{"offset": 150.0, "limit": 50.0}, 120, 120, 120, "showing 0 of 120"},
+		{unixsock.Args{"limit": 10.0}, 0, 0, 0, "showing 0 of 0"},
+	}
+
+	for i, c := range cases {
+		start, end := paginate(c.args, c.total)
+		if start != c.start || end != c.end {
+			t.Errorf("Unexpected page bounds #%d: [%d, %d)", i, start, end)
+		}
+		if info := pageInfo(start, end, c.total); info != c.expectedInfo {
+			t.Errorf("Unexpected page info #%d: %s", i, info)
+		}
+	}
+}
+
+func TestValidArguments(t *testing.T) {
+
+	required := []arg{
+		arg{"service", reflect.String},
+		arg{"port", reflect.Float64},
+	}
+
+	cases := []struct {
+		args     unixsock.Args
+		expected string
+	}{
+		{unixsock.Args{"service": "web", "port": 4332.0}, ""},
+		{unixsock.Args{"port": 4332.0}, "missing argument 'service'"},
+		{unixsock.Args{"service": "web", "port": "4332"}, "argument 'port' must be of kind float64 (got string)"},
+		{unixsock.Args{"service": nil, "port": 4332.0}, "argument 'service' must be of kind string (got <nil>)"},
+	}
+
+	for i, c := range cases {
+		err := validArguments(c.args, required)
+		if (err == nil && c.expected != "") || (err != nil && err.Error() != c.expected) {
+			t.Errorf("Unexpected validation #%d: %v", i, err)
+		}
+	}
+
+	// Extra arguments are reported separately
+	unknown := unknownArguments("tokens.add", unixsock.Args{"service": "web", "instance": "1", "verbose": true, "force": true})
+	if !reflect.DeepEqual(unknown, []string{"force", "verbose"}) {
+		t.Errorf("Unexpected unknown arguments: %v", unknown)
+	}
+}
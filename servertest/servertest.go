@@ -0,0 +1,66 @@
+// Package servertest runs ephemeral journald servers for integration tests
+package servertest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vaitekunas/journal"
+	"github.com/vaitekunas/journal/server"
+)
+
+// Credentials of the token created by Start
+const (
+	Service  = "servertest"
+	Instance = "servertest"
+)
+
+// Start boots an in-process log server on a random local port with its files
+// (tokens, statistics, logs) in a temporary folder. It returns the server's
+// address (host:port) and a token of Service/Instance. Cleanup stops the server
+// and removes the temporary folder. Start fails the test if the server cannot
+// be started.
+func Start(t testing.TB) (addr string, token string, cleanup func()) {
+
+	dir, err := ioutil.TempDir("", "servertest")
+	if err != nil {
+		t.Fatalf("Start: could not create a temporary folder: %s", err.Error())
+	}
+
+	config := &server.Config{
+		Host:         "127.0.0.1",
+		Port:         0,
+		UnixSockPath: filepath.Join(dir, "journald.sock"),
+		TokenPath:    filepath.Join(dir, "tokens.db"),
+		StatsPath:    filepath.Join(dir, "stats.db"),
+		LoggerConfig: &journal.Config{
+			Folder:   dir,
+			Filename: "aggregate",
+			Rotation: journal.ROT_NONE,
+			Out:      journal.OUT_FILE,
+			Headers:  true,
+			JSON:     true,
+			Columns:  []int64{},
+		},
+	}
+
+	srv, err := server.New(config, server.NewConsole())
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Start: could not start log server: %s", err.Error())
+	}
+
+	token, err = srv.AddToken(Service, Instance)
+	if err != nil {
+		srv.Quit()
+		os.RemoveAll(dir)
+		t.Fatalf("Start: could not create a token: %s", err.Error())
+	}
+
+	return srv.Addr().String(), token, func() {
+		srv.Quit()
+		os.RemoveAll(dir)
+	}
+}
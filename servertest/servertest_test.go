@@ -0,0 +1,44 @@
+package servertest
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vaitekunas/journal"
+	"github.com/vaitekunas/journal/connect"
+)
+
+func TestStart(t *testing.T) {
+	addr, token, cleanup := Start(t)
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("Invalid address '%s': %s", addr, err.Error())
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	remote, err := connect.ToJournald(host, port, Service, Instance, token, time.Second, connect.WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Could not connect: %s", err.Error())
+	}
+	defer remote.Close()
+
+	entry := map[int64]string{}
+	for col := int64(journal.COL_DATE_YYMMDD); col <= journal.COL_LINE; col++ {
+		entry[col] = "N/A"
+	}
+	p, _ := json.Marshal(entry)
+	if _, err := remote.Write(p); err != nil {
+		t.Errorf("Could not write to the server: %s", err.Error())
+	}
+
+	cleanup()
+
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("The server is still listening after cleanup")
+	}
+}
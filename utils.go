@@ -10,12 +10,18 @@ import (
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 )
 
@@ -29,133 +35,460 @@ func (l *logger) getMsgCode(code int) (string, bool) {
 	return resp.Type, resp.Error
 }
 
-// rotateFile creates a new and archives the old logfile
+// rotateFile opens the local writers and starts the logfile rotation
 func (l *logger) rotateFile(ctx context.Context) {
 
-	// Prepare stdout
+	// Prepare stdout (and stderr)
+	l.openConsole()
+
 	if l.config.Out == OUT_STDOUT {
-		l.stdout = os.Stdout
 		return
 	}
 
-	if l.config.Out == OUT_FILE_AND_STDOUT {
-		l.stdout = os.Stdout
+	// Use the pre-opened logfile (rotation is the caller's responsibility)
+	if l.config.File != nil {
+		isNew := false
+		if info, err := l.config.File.Stat(); err == nil && info.Size() == 0 {
+			isNew = true
+		}
+		if err := l.setLogfile(l.config.File, isNew); err != nil {
+			l.Log("system", 1, "rotateFile %s", err.Error())
+		}
+		return
 	}
 
-	// Start the rotation coroutine
-	ready := make(chan bool, 1)
-	go func() {
-		prev := ""
-		current := rotationDate(l.config.Rotation, 0)
-		next := rotationDate(l.config.Rotation, 1)
-
-		// Compress old files (if not yet done so)
-		if l.config.Compress {
-			compressOld(l.config.Folder, fmt.Sprintf("%s_%s", l.config.Filename, current))
+	// Compress old files (if not yet done so)
+	current := l.logfileDate()
+	if l.config.Compress {
+		except := []string{strings.TrimSuffix(path.Base(l.logfilePath(current)), ".log")}
+		if l.config.ErrorFile != "" {
+			except = append(except, strings.TrimSuffix(path.Base(l.errfilePath(current)), ".log"))
 		}
+		compressOld(l.config.Folder, except...)
+	}
 
-		var once sync.Once
-	Loop:
-		for {
+	// Open the current logfile
+	if err := l.openLogfile(current); err != nil {
+		l.Log("system", 1, "rotateFile %s", err.Error())
+	}
+	if l.config.MaxDiskBytes > 0 {
+		l.enforceDiskQuota(current)
+	}
 
-			if current = time.Now().Format("2006-01-02"); prev == "" || (current != prev && current == next) {
+	l.startRotation(ctx, current)
+}
 
-				// Update relevant dates
-				next = rotationDate(l.config.Rotation, 1)
-				d1, _ := time.Parse("2006-01-02", next)
-				d2, _ := time.Parse("2006-01-02", current)
-				delta := d1.Unix() - d2.Unix() - 60
+// openConsole sets stdout (and stderr) according to the output mode
+func (l *logger) openConsole() {
 
-				// Open the new logfile
-				newLogfile := fmt.Sprintf("%s/%s_%s.log", l.config.Folder, l.config.Filename, current)
-				isNew := false
-				if _, err := os.Stat(newLogfile); os.IsNotExist(err) {
-					isNew = true
-				}
+	l.stdout = nil
+	l.stderr = nil
+	l.consoleFailures = 0
 
-				f, err := os.OpenFile(newLogfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
-				if err != nil {
-					l.Log("system", 1, "rotateFile could not open a new logfile: %s", err.Error())
-					continue
-				}
+	if l.config.Out == OUT_STDOUT || l.config.Out == OUT_FILE_AND_STDOUT {
+		l.stdout = os.Stdout
+		if l.config.StdoutWriter != nil {
+			l.stdout = l.config.StdoutWriter
+		}
 
-				// Replace local writers
-				l.mu.Lock()
-				l.logfile.Close()
-				l.logfile = f
-				if isNew && !l.config.JSON {
-					l.logfile.WriteString(fmt.Sprintf("%s\n", l.headers()))
-				}
-				l.mu.Unlock()
+		if l.config.ErrorsToStderr {
+			l.stderr = os.Stderr
+			if l.config.StderrWriter != nil {
+				l.stderr = l.config.StderrWriter
+			}
+		}
+	}
 
-				// Compress and delete old file
-				if l.config.Compress && prev != "" {
-					if err := compress(l.config.Folder, fmt.Sprintf("%s_%s", l.config.Filename, prev)); err != nil {
-						l.Log("rotateFile", 1, "Could not compress old logfile: %s", err.Error())
-					}
-				}
+}
 
-				// Update previous date
-				prev = current
+// startRotation starts the rotation coroutine for the logfile opened on date prev.
+// Nothing is started for ROT_NONE, since its logfile never rotates.
+func (l *logger) startRotation(ctx context.Context, prev string) {
 
-				// Proceed with main routine
-				once.Do(func() { ready <- true })
+	if l.config.Rotation == ROT_NONE {
+		return
+	}
 
-				// Wait for up until one minute before the next date
-				select {
-				case <-time.After(time.Duration(delta) * time.Second):
-				case <-ctx.Done():
-					break Loop
-				}
+	rotationCTX, cancel := context.WithCancel(ctx)
+	done := make(chan bool)
+	l.stopRotation = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+
+		next := rotationDate(l.config.Rotation, 1, l.clock())
+		for {
 
+			// Sleep until the next rotation date (or shortly if the logfile could not be opened)
+			wait := time.Minute
+			if nextDate, err := time.ParseInLocation("2006-01-02", next, time.Local); err == nil {
+				wait = nextDate.Sub(l.clock())
 			}
 
-			// Wait for a second
+			timer := time.NewTimer(wait)
 			select {
-			case <-time.After(1 * time.Second):
-			case <-ctx.Done():
-				break Loop
+			case <-timer.C:
+			case <-rotationCTX.Done():
+				timer.Stop()
+				return
+			}
+
+			// The timer may fire early if the clock has been adjusted
+			current := l.clock().Format("2006-01-02")
+			if current == prev || current < next {
+				continue
+			}
+
+			// Never append to the logfiles of an earlier rotation into the same
+			// period (e.g. after the clock has been set back)
+			archived, err := l.archiveExisting(current)
+			if err != nil {
+				l.Log("system", 1, "rotateFile %s", err.Error())
+			}
+
+			// Open the new logfile
+			if err := l.openLogfile(current); err != nil {
+				l.Log("system", 1, "rotateFile %s", err.Error())
+				next = ""
+				continue
 			}
 
+			// Compress and delete old files, then prune old archives if the
+			// logfiles take up too much space (in the background, so that
+			// large logfiles do not delay the next rotation)
+			var old []string
+			if l.config.Compress {
+				old = append(old, archived...)
+				old = append(old, strings.TrimSuffix(path.Base(l.logfilePath(prev)), ".log"))
+				if l.config.ErrorFile != "" {
+					old = append(old, strings.TrimSuffix(path.Base(l.errfilePath(prev)), ".log"))
+				}
+			}
+			l.compressAsync(current, old...)
+
+			// Update relevant dates
+			prev = current
+			next = rotationDate(l.config.Rotation, 1, l.clock())
 		}
 	}()
 
-	<-ready
+}
+
+// archiveExisting moves the existing logfiles of a rotation date out of the way
+// of new ones (see archiveLogfile). Returns the archives' names (without extension).
+func (l *logger) archiveExisting(date string) ([]string, error) {
+
+	filenames := []string{l.logfilePath(date)}
+	if l.config.ErrorFile != "" {
+		filenames = append(filenames, l.errfilePath(date))
+	}
+
+	archives := []string{}
+	for _, filename := range filenames {
+		exists, err := anyExists(filename)
+		if err != nil {
+			return archives, fmt.Errorf("could not check logfile: %s", err.Error())
+		}
+		if !exists {
+			continue
+		}
+
+		archive, err := archiveLogfile(filename, true)
+		if err != nil {
+			return archives, err
+		}
+		archives = append(archives, strings.TrimSuffix(path.Base(archive), ".log"))
+	}
+
+	return archives, nil
+}
+
+// logfileDate returns the date of a logfile opened now (empty for ROT_NONE)
+func (l *logger) logfileDate() string {
+	if l.config.Rotation == ROT_NONE {
+		return ""
+	}
+	return l.clock().Format("2006-01-02")
+}
+
+// logfilePath returns the path of the logfile for a rotation date (the
+// logfile of ROT_NONE has no date)
+func (l *logger) logfilePath(date string) string {
+	return fmt.Sprintf("%s/%s.log", l.config.Folder, expandFilename(l.config, l.hostname, l.config.Filename, date))
+}
+
+// errfilePath returns the path of the error logfile for a rotation date
+func (l *logger) errfilePath(date string) string {
+	return fmt.Sprintf("%s/%s.log", l.config.Folder, expandFilename(l.config, l.hostname, l.config.ErrorFile, date))
+}
+
+// Default logfile name (see Config.FilenameTemplate)
+const defaultFilenameTemplate = "{stem}_{date}"
+
+// Filesystem-safe logfile name
+var safeFilenamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// expandFilename expands the logfile name template for a stem and rotation date
+// (the host is resolved once by the logger)
+func expandFilename(config *Config, host, stem, date string) string {
+
+	template := config.FilenameTemplate
+	if template == "" {
+		template = defaultFilenameTemplate
+	}
+
+	name := fillTemplate(template, map[string]interface{}{
+		"stem":     stem,
+		"date":     date,
+		"service":  config.Service,
+		"instance": config.Instance,
+		"host":     host,
+	})
+
+	if date == "" {
+		name = strings.Trim(name, "_-.")
+	}
+
+	return name
+}
+
+// validFilenameTemplate verifies that the logfile name template only contains
+// known placeholders and produces filesystem-safe names. Rotating logfiles need
+// the {date}, whereas the error logfile needs the {stem} to be told apart.
+func validFilenameTemplate(config *Config) error {
+
+	if config.FilenameTemplate == "" {
+		return nil
+	}
+
+	if config.Rotation != ROT_NONE && !strings.Contains(config.FilenameTemplate, "{date}") {
+		return fmt.Errorf("rotated logfiles need a {date}")
+	}
+	if config.ErrorFile != "" && !strings.Contains(config.FilenameTemplate, "{stem}") {
+		return fmt.Errorf("the error logfile needs a {stem}")
+	}
+
+	host := hostname()
+	for _, stem := range []string{config.Filename, config.ErrorFile} {
+		if stem == "" {
+			continue
+		}
+		name := expandFilename(config, host, stem, rotationDate(config.Rotation, 0, time.Now()))
+		if unknown := placeholderPattern.FindString(name); unknown != "" {
+			return fmt.Errorf("unknown placeholder '%s'", unknown)
+		}
+		if !safeFilenamePattern.MatchString(name) || strings.Trim(name, ".") == "" {
+			return fmt.Errorf("'%s' is not a safe filename", name)
+		}
+	}
+
+	return nil
+}
+
+// openLogfile opens the logfile (and the error logfile, if any) for a rotation
+// date and replaces the active one
+func (l *logger) openLogfile(date string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.openLogfileLocked(date)
+}
+
+// openLogfileLocked is openLogfile for callers holding l.mu. The active logfiles
+// are only replaced once the new ones have been opened.
+func (l *logger) openLogfileLocked(date string) error {
+
+	f, isNew, err := openForAppend(l.logfilePath(date))
+	if err != nil {
+		return fmt.Errorf("could not open a new logfile: %s", err.Error())
+	}
+
+	if l.config.ErrorFile == "" {
+		return l.setLogfileLocked(f, isNew)
+	}
+
+	ef, isNewErr, err := openForAppend(l.errfilePath(date))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not open a new error logfile: %s", err.Error())
+	}
+
+	if err := l.setLogfileLocked(f, isNew); err != nil {
+		ef.Close()
+		return err
+	}
+
+	l.errfile = ef
+	if l.errFirstEntry, err = l.prepareLogfile(ef, isNewErr); err != nil {
+		return fmt.Errorf("could not prepare the error logfile: %s", err.Error())
+	}
+
+	return nil
+}
+
+// openForAppend opens (or creates) a logfile for appending. Returns true if
+// the logfile did not exist yet.
+func openForAppend(filename string) (*os.File, bool, error) {
+
+	isNew := false
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		isNew = true
+	}
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return f, isNew, nil
+}
+
+// setLogfile replaces the active logfile (and closes the error logfile)
+func (l *logger) setLogfile(f *os.File, isNew bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.setLogfileLocked(f, isNew)
+}
+
+// setLogfileLocked is setLogfile for callers holding l.mu
+func (l *logger) setLogfileLocked(f *os.File, isNew bool) error {
+	var err error
+
+	l.closeLogfile()
+	l.logfile = f
+	if l.firstEntry, err = l.prepareLogfile(f, isNew); err != nil {
+		return fmt.Errorf("could not reopen the JSON array: %s", err.Error())
+	}
+
+	return nil
+}
+
+// prepareLogfile writes the column headers to a new logfile (FORMAT_TSV) or
+// reopens its JSON array (FORMAT_JSON_ARRAY). Returns true if the JSON array
+// has no entries yet.
+func (l *logger) prepareLogfile(f *os.File, isNew bool) (bool, error) {
+	switch {
+	case l.config.Format == FORMAT_JSON_ARRAY:
+		return openJSONArray(f)
+	case isNew && l.config.Format == FORMAT_TSV:
+		f.WriteString(fmt.Sprintf("%s\n", l.headers()))
+	}
+
+	return false, nil
+}
+
+// closeLogfile finalizes and closes the active logfile and error logfile
+func (l *logger) closeLogfile() {
+	if l.logfile != nil {
+		finalizeLogfile(l.logfile, l.config.Format, l.firstEntry)
+		l.logfile = nil
+	}
+
+	if l.errfile != nil {
+		finalizeLogfile(l.errfile, l.config.Format, l.errFirstEntry)
+		l.errfile = nil
+	}
+}
+
+// finalizeLogfile closes the JSON array of a logfile (FORMAT_JSON_ARRAY) and closes it
+func finalizeLogfile(f *os.File, format int, firstEntry bool) {
+	if format == FORMAT_JSON_ARRAY {
+		if firstEntry {
+			f.WriteString("]\n")
+		} else {
+			f.WriteString("\n]\n")
+		}
+	}
+
+	f.Close()
+}
+
+// openJSONArray prepares a logfile for appending entries to a JSON array.
+// A new file gets an opening bracket, whereas a previously closed array
+// is reopened by truncating its closing bracket. Returns true if the
+// array has no entries yet.
+func openJSONArray(f *os.File) (bool, error) {
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("openJSONArray: could not stat logfile: %s", err.Error())
+	}
+
+	if info.Size() == 0 {
+		if _, err := f.WriteString("[\n"); err != nil {
+			return false, fmt.Errorf("openJSONArray: could not open array: %s", err.Error())
+		}
+		return true, nil
+	}
+
+	// Inspect the tail of the file
+	rf, err := os.Open(f.Name())
+	if err != nil {
+		return false, fmt.Errorf("openJSONArray: could not open logfile for reading: %s", err.Error())
+	}
+	defer rf.Close()
+
+	offset := info.Size() - 64
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err := rf.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return false, fmt.Errorf("openJSONArray: could not read logfile: %s", err.Error())
+	}
+
+	trimmed := strings.TrimRight(string(tail), " \t\r\n")
+	if strings.HasSuffix(trimmed, "]") {
+		trimmed = strings.TrimSuffix(trimmed, "]")
+		if err := f.Truncate(offset + int64(len(trimmed))); err != nil {
+			return false, fmt.Errorf("openJSONArray: could not reopen array: %s", err.Error())
+		}
+		trimmed = strings.TrimRight(trimmed, " \t\r\n")
+	}
+
+	return strings.HasSuffix(trimmed, "["), nil
 }
 
 // rotationDate returns a log's rotation date with a specific offset
-// , e.g.: 0 - current, 1 - next, -1 - previous.
-func rotationDate(rotation int, offset int) string {
-	suffix := time.Now().Format("2006-01-02")
+// , e.g.: 0 - current, 1 - next, -1 - previous. ROT_NONE has no rotation dates.
+func rotationDate(rotation int, offset int, now time.Time) string {
+	suffix := now.Format("2006-01-02")
 
 	switch rotation {
+	case ROT_NONE:
+		return ""
 	case ROT_DAILY:
-		shift := time.Now().AddDate(0, 0, offset)
+		shift := now.AddDate(0, 0, offset)
 		suffix = fmt.Sprintf("%s", shift.Format("2006-01-02"))
 	case ROT_WEEKLY:
-		shift := time.Now().AddDate(0, 0, offset*7)
+		shift := now.AddDate(0, 0, offset*7)
 		if day := int(shift.Weekday()); day == 0 {
 			suffix = fmt.Sprintf("%s", shift.AddDate(0, 0, -6).Format("2006-01-02"))
 		} else {
 			suffix = fmt.Sprintf("%s", shift.AddDate(0, 0, -(day-1)).Format("2006-01-02"))
 		}
 	case ROT_MONTHLY:
-		shift := time.Now().AddDate(0, 1, 0)
+		shift := now.AddDate(0, 1, 0)
 		suffix = fmt.Sprintf("%s-01", shift.Format("2006-01"))
 	case ROT_ANNUALLY:
-		shift := time.Now().AddDate(1, 0, 0)
+		shift := now.AddDate(1, 0, 0)
 		suffix = fmt.Sprintf("%s-01-01", shift.Format("2006"))
 	}
 
 	return suffix
 }
 
-// compress compresses a logfile and deletes the old one
+// compress compresses a logfile and deletes the old one. Existing archives are
+// never overwritten: a sequence number is added to the archive's name instead
+// (e.g. file.1.log.gz), should the logfile of the same date be archived again.
 func compress(folder, file string) error {
 
 	// Relevant files
 	filepath := fmt.Sprintf("%s/%s.log", folder, file)
-	gzipfilepath := fmt.Sprintf("%s/%s.log.gz", folder, file)
 
 	// Open logfile
 	// (fails if file does not exist)
@@ -164,8 +497,13 @@ func compress(folder, file string) error {
 		return fmt.Errorf("compress: could not open logfile: %s", err.Error())
 	}
 
-	// Open gzipfile
-	fzip, err := os.OpenFile(gzipfilepath, os.O_CREATE|os.O_WRONLY, 0600)
+	// Open a new gzipfile
+	gzipfilepath := fmt.Sprintf("%s/%s.log.gz", folder, file)
+	fzip, err := os.OpenFile(gzipfilepath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	for seq := 1; os.IsExist(err); seq++ {
+		gzipfilepath = fmt.Sprintf("%s/%s.%d.log.gz", folder, file, seq)
+		fzip, err = os.OpenFile(gzipfilepath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	}
 	if err != nil {
 		return fmt.Errorf("compress: could not open archive file: %s", err.Error())
 	}
@@ -225,18 +563,205 @@ func compress(folder, file string) error {
 	return nil
 }
 
-// compressOld compresses all logfiles except one (current)
-func compressOld(folder, except string) {
+// archiveLogfile moves a closed logfile out of the way of its successor, i.e.
+// renames it to the first free sequence number (filename.1.log, filename.2.log,
+// etc.). Logfiles not in the way (e.g. of a previous date) keep their name.
+func archiveLogfile(filename string, inTheWay bool) (string, error) {
+
+	if !inTheWay {
+		return filename, nil
+	}
+
+	stem := strings.TrimSuffix(filename, ".log")
+	for seq := 1; ; seq++ {
+		archive := fmt.Sprintf("%s.%d.log", stem, seq)
+		taken, err := anyExists(archive, archive+".gz")
+		if err != nil {
+			return "", fmt.Errorf("archiveLogfile: could not check archive: %s", err.Error())
+		}
+		if taken {
+			continue
+		}
+		if err := os.Rename(filename, archive); err != nil {
+			return "", fmt.Errorf("archiveLogfile: could not rename logfile: %s", err.Error())
+		}
+		return archive, nil
+	}
+}
+
+// anyExists returns true if any of the files exists. Errors other than a
+// missing file (e.g. permission denied) are returned.
+func anyExists(filenames ...string) (bool, error) {
+	for _, filename := range filenames {
+		_, err := os.Stat(filename)
+		switch {
+		case err == nil:
+			return true, nil
+		case !os.IsNotExist(err):
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// compressAsync compresses old logfiles (names without extension) of the log
+// folder in the background and prunes old archives afterwards (see
+// Config.MaxDiskBytes) except those of the current rotation date. At most
+// maxCompressions run concurrently, Quit and Reconfigure wait for the pending ones.
+func (l *logger) compressAsync(current string, files ...string) {
+
+	if len(files) == 0 && l.config.MaxDiskBytes <= 0 {
+		return
+	}
+
+	l.compressions.Add(1)
+	go func() {
+		defer l.compressions.Done()
+
+		l.compressSlots <- true
+		defer func() { <-l.compressSlots }()
+
+		for _, file := range files {
+			if err := compress(l.config.Folder, file); err != nil {
+				l.Log("rotateFile", 1, "Could not compress old logfile: %s", err.Error())
+			}
+		}
+
+		if l.config.MaxDiskBytes > 0 {
+			l.enforceDiskQuota(current)
+		}
+	}()
+
+}
+
+// compressOld compresses all logfiles except the current ones
+func compressOld(folder string, except ...string) {
+
+	current := make(map[string]bool, len(except))
+	for _, file := range except {
+		current[fmt.Sprintf("%s.log", file)] = true
+	}
 
 	files, _ := ioutil.ReadDir(folder)
 	for _, f := range files {
-		if !f.IsDir() && path.Ext(f.Name()) == ".log" && f.Name() != fmt.Sprintf("%s.log", except) {
+		if !f.IsDir() && path.Ext(f.Name()) == ".log" && !current[f.Name()] {
 			compress(folder, strings.TrimSuffix(f.Name(), ".log"))
 		}
 	}
 
 }
 
+// enforceDiskQuota prunes the oldest archives if the logfiles (error logfiles
+// included) exceed the disk quota. The logfiles of the current rotation date are kept.
+func (l *logger) enforceDiskQuota(current string) {
+
+	patterns := []string{expandFilename(l.config, l.hostname, l.config.Filename, "*")}
+	active := []string{path.Base(l.logfilePath(current))}
+	if l.config.ErrorFile != "" {
+		patterns = append(patterns, expandFilename(l.config, l.hostname, l.config.ErrorFile, "*"))
+		active = append(active, path.Base(l.errfilePath(current)))
+	}
+
+	pruned, err := pruneArchives(l.config.Folder, patterns, active, l.config.MaxDiskBytes)
+	if err != nil {
+		l.Log("system", 1, "enforceDiskQuota: could not prune old logfiles: %s", err.Error())
+	}
+
+	if len(pruned) > 0 {
+		l.Log("system", 6, "enforceDiskQuota: logfiles exceeded %d bytes, pruned %d archive(s): %s", l.config.MaxDiskBytes, len(pruned), strings.Join(pruned, ", "))
+	}
+
+}
+
+// pruneArchives deletes the oldest logfile archives until the total size of all the
+// logfiles is at most maxBytes. Logfiles are matched by glob patterns of their names
+// without extension (e.g. "filename_*", where * is the date). The active logfiles
+// are never deleted.
+func pruneArchives(folder string, patterns, active []string, maxBytes int64) ([]string, error) {
+
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, fmt.Errorf("pruneArchives: could not list logfiles: %s", err.Error())
+	}
+
+	isActive := make(map[string]bool, len(active))
+	for _, name := range active {
+		isActive[name] = true
+	}
+
+	// Sum up all the logfiles and collect archives (along with their dates)
+	var total int64
+	archives := []os.FileInfo{}
+	dates := map[string]string{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || (!strings.HasSuffix(name, ".log") && !strings.HasSuffix(name, ".log.gz")) {
+			continue
+		}
+
+		if isActive[name] {
+			total += f.Size()
+			continue
+		}
+		for _, pattern := range patterns {
+			if matchLogfile(pattern, name) {
+				total += f.Size()
+				archives = append(archives, f)
+				dates[name] = archiveDate(pattern, name)
+				break
+			}
+		}
+	}
+
+	// Dates sort chronologically, i.e. oldest archives come first
+	sort.Slice(archives, func(i, j int) bool {
+		di, dj := dates[archives[i].Name()], dates[archives[j].Name()]
+		if di != dj {
+			return di < dj
+		}
+		return archives[i].Name() < archives[j].Name()
+	})
+
+	// Delete archives until under the limit
+	pruned := []string{}
+	for _, f := range archives {
+		if total <= maxBytes {
+			break
+		}
+
+		if err := os.Remove(path.Join(folder, f.Name())); err != nil {
+			return pruned, fmt.Errorf("pruneArchives: could not delete '%s': %s", f.Name(), err.Error())
+		}
+
+		total -= f.Size()
+		pruned = append(pruned, f.Name())
+	}
+
+	return pruned, nil
+}
+
+// archiveDate returns the part of an archive's name that sorts chronologically,
+// i.e. the name without the literal parts of its glob pattern
+func archiveDate(pattern, name string) string {
+	parts := strings.SplitN(pattern, "*", 2)
+	date := strings.TrimPrefix(name, parts[0])
+	if len(parts) == 2 && parts[1] != "" {
+		date = strings.Replace(date, parts[1], "", 1)
+	}
+	return date
+}
+
+// matchLogfile checks whether a logfile or its archive (file.log.gz, file.N.log.gz)
+// matches a glob pattern of the logfile's name
+func matchLogfile(pattern, name string) bool {
+	for _, suffix := range []string{".log", ".log.gz", ".*.log.gz"} {
+		if matched, _ := filepath.Match(pattern+suffix, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
 // headers returns log's column headers as a tab-separated string
 func (l *logger) headers() string {
 	header := make([]string, len(l.config.Columns))
@@ -247,14 +772,22 @@ func (l *logger) headers() string {
 	return strings.Join(header, "\t")
 }
 
-// pushToLedger pushes a log entry into the ledger
-func (l *logger) pushToLedger(depth int, caller string, code int, msg string, format ...interface{}) error {
+// Template placeholder pattern ({name})
+var placeholderPattern = regexp.MustCompile(`\{([^{}\s]+)\}`)
 
-	// An active Logger will wait for the transit to finish
-	inTransit := l.active
-	if inTransit {
-		l.wg.Add(1)
-	}
+// fillTemplate substitutes {name} placeholders with the corresponding fields.
+// Placeholders without a field are left as they are.
+func fillTemplate(template string, fields map[string]interface{}) string {
+	return placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		if value, ok := fields[placeholder[1:len(placeholder)-1]]; ok {
+			return fmt.Sprint(value)
+		}
+		return placeholder
+	})
+}
+
+// pushToLedger formats a message and pushes it into the ledger
+func (l *logger) pushToLedger(ctx context.Context, depth int, caller string, code int, msg string, format ...interface{}) error {
 
 	// Format message
 	fmsg := msg
@@ -262,18 +795,44 @@ func (l *logger) pushToLedger(depth int, caller string, code int, msg string, fo
 		fmsg = fmt.Sprintf(msg, format...)
 	}
 
-	// Get some additional information
-	_, file, line, _ := runtime.Caller(depth)
-	name, isErr := l.getMsgCode(code)
+	return l.push(ctx, depth+1, caller, code, fmsg, "N/A")
+}
 
-	// Prepare log entry
-	entry := l.newRawEntry(caller, name, fmsg, file, line, code, isErr)
+// limitMessage truncates the message of an entry to Config.MaxMessageBytes
+func (l *logger) limitMessage(entry *logEntry) {
+	if max := l.config.MaxMessageBytes; max > 0 && len(entry[COL_MSG]) > max {
+		entry[COL_MSG] = truncateMessage(entry[COL_MSG], max)
+		atomic.AddInt64(&l.truncated, 1)
+	}
+}
+
+// truncateMessage shortens msg to at most max bytes (incl. the truncation
+// marker) without splitting a UTF-8 character
+func truncateMessage(msg string, max int) string {
+	cut := max - len(truncationMarker)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(msg[cut]) {
+		cut--
+	}
+	return msg[:cut] + truncationMarker
+}
+
+// push pushes a log entry with the (JSON-encoded) structured fields into the
+// ledger. Trace columns are taken from the context's span (if any).
+func (l *logger) push(ctx context.Context, depth int, caller string, code int, fmsg, fields string) error {
+
+	// An active Logger will wait for the transit to finish
+	inTransit := l.admit()
+
+	entry, isErr := l.buildEntry(ctx, depth+1, caller, code, fmsg, fields)
 
 	// Write entry into the ledger
 	if inTransit {
-		go func() {
-			l.ledger <- entry
-		}()
+		l.enqueue(ctx, entry)
+	} else {
+		releaseEntry(entry)
 	}
 
 	// Return error
@@ -284,21 +843,152 @@ func (l *logger) pushToLedger(depth int, caller string, code int, msg string, fo
 	return nil
 }
 
-// newRawEntry builds a new raw log entry
-func (l *logger) newRawEntry(caller, name, fmsg, file string, line, code int, isErr bool) logEntry {
+// pushAt writes a message logged at the given file and line into the ledger
+func (l *logger) pushAt(caller string, code int, file string, line int, msg, fields string) error {
+
+	inTransit := l.admit()
+
+	name, isErr := l.getMsgCode(code)
+	entry := l.newRawEntry(caller, name, msg, file, line, code, isErr)
+	l.limitMessage(entry)
+	entry[COL_FIELDS] = fields
+
+	if inTransit {
+		l.enqueue(context.Background(), entry)
+	} else {
+		releaseEntry(entry)
+	}
+
+	if isErr {
+		return fmt.Errorf("%s", msg)
+	}
+
+	return nil
+}
+
+// marshalFields encodes the fields of Logf in JSON. Fields that cannot be
+// encoded are replaced by the error (key FieldsError), the message is kept.
+func marshalFields(fields map[string]interface{}) string {
+	jsoned, err := json.Marshal(fields)
+	if err != nil {
+		jsoned, _ = json.Marshal(map[string]string{"FieldsError": fmt.Sprintf("could not marshal fields to JSON: %s", err.Error())})
+	}
+
+	return string(jsoned)
+}
+
+// encodeFields encodes fields in JSON. Values that cannot be encoded are
+// replaced by their string representation instead of losing all the fields.
+func encodeFields(fields map[string]interface{}) string {
+	jsoned, err := json.Marshal(fields)
+	if err == nil {
+		return string(jsoned)
+	}
+
+	printable := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if _, err := json.Marshal(value); err != nil {
+			value = fmt.Sprint(value)
+		}
+		printable[key] = value
+	}
+	jsoned, _ = json.Marshal(printable)
+
+	return string(jsoned)
+}
+
+// buildEntry prepares a log entry of the caller found at the given depth and
+// reports whether its code is an error code
+func (l *logger) buildEntry(ctx context.Context, depth int, caller string, code int, fmsg, fields string) (*logEntry, bool) {
+
+	// Get some additional information
+	pc, file, line, _ := runtime.Caller(depth)
+	name, isErr := l.getMsgCode(code)
+	if caller == "" {
+		if ctxCaller, ok := CallerFromContext(ctx); ok {
+			caller = ctxCaller
+		} else if l.config.AutoCaller {
+			caller = funcName(pc)
+		}
+	}
+
+	// Prepare log entry
+	entry := l.newRawEntry(caller, name, fmsg, file, line, code, isErr)
+	l.limitMessage(entry)
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		entry[COL_TRACE_ID] = span.TraceID().String()
+		entry[COL_SPAN_ID] = span.SpanID().String()
+	}
+	entry[COL_FIELDS] = fields
+
+	return entry, isErr
+}
+
+// funcName returns the name of the function (package.Func) containing pc
+func funcName(pc uintptr) string {
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "N/A"
+	}
+
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return name
+}
+
+// admit registers an entry about to be written into the ledger, i.e. Quit waits
+// for it. Entries are only admitted while the logger is active. The activity
+// switch and the wait group are changed under the same lock, so that Quit
+// cannot start waiting in between.
+func (l *logger) admit() bool {
+	l.state.RLock()
+	defer l.state.RUnlock()
+
+	if l.active {
+		l.wg.Add(1)
+	}
+
+	return l.active
+}
+
+// enqueue writes an entry into the ledger without blocking the caller.
+// A goroutine is only spawned if the ledger is full. It waits for room in the
+// ledger until the context is done, in which case the entry is dropped.
+func (l *logger) enqueue(ctx context.Context, entry *logEntry) {
+	select {
+	case l.ledger <- entry:
+	default:
+		go func() {
+			select {
+			case l.ledger <- entry:
+			case <-ctx.Done():
+				releaseEntry(entry)
+				atomic.AddInt64(&l.dropped, 1)
+				l.wg.Done()
+			}
+		}()
+	}
+}
+
+// newRawEntry builds a new raw log entry (taken from the entry pool)
+func (l *logger) newRawEntry(caller, name, fmsg, file string, line, code int, isErr bool) *logEntry {
 
 	// Prepare log entry
-	entry := logEntry{}
-	for i := int64(COL_DATE_YYMMDD); i <= int64(COL_LINE); i++ {
+	now := time.Now()
+	entry := getEntry()
+	for i := int64(COL_DATE_YYMMDD); i <= int64(COL_METADATA); i++ {
 		switch i {
 		case COL_DATE_YYMMDD:
-			entry[i] = time.Now().Format("2006-01-02")
+			entry[i] = now.Format("2006-01-02")
 		case COL_DATE_YYMMDD_HHMMSS:
-			entry[i] = time.Now().Format("2006-01-02 15:04:05")
+			entry[i] = now.Format("2006-01-02 15:04:05")
 		case COL_DATE_YYMMDD_HHMMSS_NANO:
-			entry[i] = time.Now().Format("2006-01-02 15:04:05.000000000")
+			entry[i] = now.Format("2006-01-02 15:04:05.000000000")
 		case COL_TIMESTAMP:
-			entry[i] = strconv.FormatInt(time.Now().Unix(), 10)
+			entry[i] = strconv.FormatInt(now.Unix(), 10)
 		case COL_SERVICE:
 			entry[i] = l.config.Service
 		case COL_INSTANCE:
@@ -321,6 +1011,8 @@ func (l *logger) newRawEntry(caller, name, fmsg, file string, line, code int, is
 			entry[i] = file
 		case COL_LINE:
 			entry[i] = strconv.Itoa(line)
+		case COL_TRACE_ID, COL_SPAN_ID, COL_FIELDS, COL_SIZE, COL_ROUTE, COL_METADATA:
+			entry[i] = "N/A"
 		}
 	}
 
@@ -334,6 +1026,7 @@ func (l *logger) write(ctx context.Context) {
 
 	ready := make(chan bool, 1)
 	go func() {
+		defer close(l.writerDone)
 
 		var once sync.Once
 	Loop:
@@ -345,29 +1038,55 @@ func (l *logger) write(ctx context.Context) {
 
 				l.mu.Lock()
 
+				// Serialize the entry for remote endpoints (and measure it)
+				var jsoned []byte
+				if l.sizeColumn || len(l.remoteWriters) > 0 {
+					var err error
+					if jsoned, err = json.Marshal(entry.toMap()); err != nil {
+						l.Log("system", 1, "write: could not marshal log entry: %s", err.Error())
+					} else if l.sizeColumn {
+						entry[COL_SIZE] = strconv.Itoa(len(jsoned))
+					}
+				}
+
 				// Write to local endpoints
 				l.writeLocal(entry)
+				if l.ring != nil {
+					l.ring.add(entry)
+				}
 
-				// Write to remote endpoints
-				if len(l.remoteWriters) > 0 {
-					jsoned, err := json.Marshal(entry)
-					if err != nil {
-						l.Log("system", 1, "write: could not marshal log entry: %s", err.Error())
-					}
+				// Remote endpoints are written to without holding the lock
+				// (slow backends must not block destination management)
+				remotes := l.remoteSnapshot
+				l.mu.Unlock()
 
-					for backend, remote := range l.remoteWriters {
-						if _, err := remote.Write(jsoned); err != nil {
-							fmsg := fmt.Sprintf("write: could not send log to a remote backend '%s': %s", backend, err.Error())
-							_, file, line, _ := runtime.Caller(2)
-							name, isErr := l.getMsgCode(1)
-							rawEntry := l.newRawEntry("system", name, fmsg, file, line, 1, isErr)
-							l.writeLocal(rawEntry)
+				// Write to remote endpoints (in the order of their names, failing
+				// ones are skipped while their circuit is open)
+				for _, remote := range remotes {
+					if !remote.stats.allow(time.Now()) {
+						continue
+					}
+					n, err := remote.writer.Write(jsoned)
+					opened := remote.stats.record(n, err)
+					if err != nil {
+						fmsg := fmt.Sprintf("write: could not send log to a remote backend '%s': %s", remote.name, err.Error())
+						if opened {
+							fmsg = fmt.Sprintf("%s (skipping it for %s after %d consecutive failures)", fmsg, l.config.BreakerCooldown, l.config.BreakerThreshold)
 						}
+						_, file, line, _ := runtime.Caller(2)
+						name, isErr := l.getMsgCode(1)
+						rawEntry := l.newRawEntry("system", name, fmsg, file, line, 1, isErr)
+						l.mu.Lock()
+						l.writeLocal(rawEntry)
+						l.mu.Unlock()
+						releaseEntry(rawEntry)
 					}
 				}
 
+				// Entries are not referenced after being written
+				releaseEntry(entry)
+
 				l.wg.Done()
-				l.mu.Unlock()
 
 			case <-ctx.Done():
 				break Loop
@@ -379,23 +1098,109 @@ func (l *logger) write(ctx context.Context) {
 	<-ready
 }
 
-// writeLocal writes a log to local endpoints
-func (l *logger) writeLocal(entry logEntry) {
+// writeLocal writes a log to local endpoints. The console gets the same format
+// as the logfile (FORMAT_JSON_ARRAY is written as one JSON object per line).
+func (l *logger) writeLocal(entry *logEntry) {
+
+	// Encode JSON (and CEF) entries only once
+	var jsoned string
+	var errJSON error
+	switch l.config.Format {
+	case FORMAT_TSV:
+	case FORMAT_CEF:
+		jsoned = entry.toCEF(l.config.Columns)
+	case FORMAT_GELF:
+		jsoned, errJSON = entry.toGELF(l.config.Columns, l.hostname)
+	default:
+		jsoned, errJSON = entry.toJSON(l.config.Columns)
+	}
 
-	// Write to stdout
+	// Write to stdout (errors to stderr if requested)
 	if l.stdout != nil {
-		l.stdout.WriteString(fmt.Sprintf("%s\n", entry.toStr(l.config.Columns)))
+		console := l.stdout
+		if l.stderr != nil && entry[COL_MSG_TYPE_SHORT] == "ERR" {
+			console = l.stderr
+		}
+		line := jsoned
+		if l.config.Format == FORMAT_TSV {
+			line = entry.toStr(l.config.Columns)
+		}
+		if _, err := fmt.Fprintf(console, "%s\n", line); err != nil {
+			l.consoleFailed(err)
+		} else {
+			l.consoleFailures = 0
+		}
 	}
 
 	// Write to local file
 	if l.logfile != nil {
-		if l.config.JSON {
-			l.logfile.WriteString(fmt.Sprintf("%s\n", entry.toJSON(l.config.Columns)))
+		l.appendEntry(l.logfile, l.firstEntry, entry, jsoned)
+		l.firstEntry = false
+	}
+
+	// Mirror errors to the error logfile
+	if l.errfile != nil && entry[COL_MSG_TYPE_SHORT] == "ERR" {
+		l.appendEntry(l.errfile, l.errFirstEntry, entry, jsoned)
+		l.errFirstEntry = false
+	}
+
+	// Errors must not be lost in the OS buffers (e.g. on a crash)
+	if l.config.SyncOnError && entry[COL_MSG_TYPE_SHORT] == "ERR" {
+		for _, f := range []*os.File{l.logfile, l.errfile} {
+			if f != nil {
+				f.Sync()
+			}
+		}
+	}
+
+	// The entry has been written with a fallback representation
+	if errJSON != nil {
+		l.writeSystemEntry(fmt.Sprintf("writeLocal: entry of '%s' written partially: %s", entry[COL_CALLER], errJSON.Error()))
+	}
+
+}
+
+// appendEntry writes an entry to a logfile (jsoned is the entry's JSON or CEF
+// representation, unused with FORMAT_TSV)
+func (l *logger) appendEntry(f *os.File, firstEntry bool, entry *logEntry, jsoned string) {
+	switch l.config.Format {
+	case FORMAT_JSON, FORMAT_GELF, FORMAT_CEF:
+		f.WriteString(fmt.Sprintf("%s\n", jsoned))
+	case FORMAT_JSON_ARRAY:
+		if firstEntry {
+			f.WriteString(jsoned)
 		} else {
-			l.logfile.WriteString(fmt.Sprintf("%s\n", entry.toStr(l.config.Columns)))
+			f.WriteString(fmt.Sprintf(",\n%s", jsoned))
 		}
+	default:
+		f.WriteString(fmt.Sprintf("%s\n", entry.toStr(l.config.Columns)))
 	}
+}
 
+// writeSystemEntry writes an error entry of the logger itself directly to the
+// local endpoints (used within the write loop, i.e. bypassing the ledger)
+func (l *logger) writeSystemEntry(fmsg string) {
+	_, file, line, _ := runtime.Caller(2)
+	name, isErr := l.getMsgCode(1)
+	rawEntry := l.newRawEntry("system", name, fmsg, file, line, 1, isErr)
+	l.writeLocal(rawEntry)
+	releaseEntry(rawEntry)
+}
+
+// consoleFailed registers a failed write to stdout/stderr and stops writing to
+// the console if it seems to be persistently broken (e.g. a closed pipe)
+func (l *logger) consoleFailed(err error) {
+
+	l.consoleFailures++
+	if l.consoleFailures < maxConsoleFailures {
+		return
+	}
+
+	l.stdout = nil
+	l.stderr = nil
+
+	// Record the failure directly (already within the write loop)
+	l.writeSystemEntry(fmt.Sprintf("writeLocal: stopped writing to stdout after %d consecutive failures: %s", l.consoleFailures, err.Error()))
 }
 
 // canWrite checks if the directory is writeable
@@ -413,6 +1218,14 @@ func canWrite(folder string) bool {
 	return true
 }
 
+// hostname returns the name of the host (or its IP if the name is unknown)
+func hostname() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return getIP()
+}
+
 // Returns the IP
 // https://stackoverflow.com/questions/23558425/how-do-i-get-the-local-ip-address-in-go
 func getIP() string {
@@ -0,0 +1,169 @@
+package journal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPruneArchives(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	files := []string{
+		"myservice_2017-01-01.log.gz",
+		"myservice_2017-01-02.log.gz",
+		"myservice_2017-01-03.log.gz",
+		"myservice_2017-01-04.log",
+	}
+	for _, name := range files {
+		if err := ioutil.WriteFile(path.Join(tempdir, name), bytes.Repeat([]byte("x"), 100), 0600); err != nil {
+			t.Fatalf("Could not create fake logfile: %s", err.Error())
+		}
+	}
+
+	// Unrelated files are neither counted nor deleted
+	if err := ioutil.WriteFile(path.Join(tempdir, "other.txt"), bytes.Repeat([]byte("x"), 1000), 0600); err != nil {
+		t.Fatalf("Could not create unrelated file: %s", err.Error())
+	}
+
+	pruned, err := pruneArchives(tempdir, []string{"myservice_*"}, []string{"myservice_2017-01-04.log"}, 250)
+	if err != nil {
+		t.Fatalf("Could not prune archives: %s", err.Error())
+	}
+
+	if len(pruned) != 2 || pruned[0] != files[0] || pruned[1] != files[1] {
+		t.Errorf("Pruned the wrong archives: %v", pruned)
+	}
+
+	for i, name := range files {
+		_, err := os.Stat(path.Join(tempdir, name))
+		if exists := err == nil; exists != (i >= 2) {
+			t.Errorf("Unexpected state of '%s' (exists: %t)", name, exists)
+		}
+	}
+
+	// The active logfile is kept even if it alone exceeds the limit
+	if _, err := pruneArchives(tempdir, []string{"myservice_*"}, []string{"myservice_2017-01-04.log"}, 10); err != nil {
+		t.Fatalf("Could not prune archives: %s", err.Error())
+	}
+	if _, err := os.Stat(path.Join(tempdir, files[3])); err != nil {
+		t.Errorf("Active logfile has been deleted")
+	}
+	if _, err := os.Stat(path.Join(tempdir, "other.txt")); err != nil {
+		t.Errorf("Unrelated file has been deleted")
+	}
+}
+
+func TestPruneArchivesWithErrorLogfiles(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	files := []string{
+		"myservice_2017-01-01.log.gz",
+		"errors_2017-01-02.log.gz",
+		"myservice_2017-01-03.log.gz",
+		"errors_2017-01-04.log",
+		"myservice_2017-01-04.log",
+	}
+	for _, name := range files {
+		if err := ioutil.WriteFile(path.Join(tempdir, name), bytes.Repeat([]byte("x"), 100), 0600); err != nil {
+			t.Fatalf("Could not create fake logfile: %s", err.Error())
+		}
+	}
+
+	// Archives are pruned by date regardless of the logfile they belong to
+	pruned, err := pruneArchives(tempdir, []string{"myservice_*", "errors_*"}, []string{"myservice_2017-01-04.log", "errors_2017-01-04.log"}, 300)
+	if err != nil {
+		t.Fatalf("Could not prune archives: %s", err.Error())
+	}
+	if len(pruned) != 2 || pruned[0] != files[0] || pruned[1] != files[1] {
+		t.Errorf("Pruned the wrong archives: %v", pruned)
+	}
+}
+
+func TestCompressKeepsArchives(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	// Archive the logfile of the same date twice
+	for _, contents := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(path.Join(tempdir, "myservice_2017-01-01.log"), []byte(contents), 0600); err != nil {
+			t.Fatalf("Could not create fake logfile: %s", err.Error())
+		}
+		if err := compress(tempdir, "myservice_2017-01-01"); err != nil {
+			t.Fatalf("Could not compress logfile: %s", err.Error())
+		}
+	}
+
+	for name, expected := range map[string]string{"myservice_2017-01-01.log.gz": "first", "myservice_2017-01-01.1.log.gz": "second"} {
+		f, err := os.Open(path.Join(tempdir, name))
+		if err != nil {
+			t.Fatalf("Missing archive '%s': %s", name, err.Error())
+		}
+		zip, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Could not read archive '%s': %s", name, err.Error())
+		}
+		contents, _ := ioutil.ReadAll(zip)
+		f.Close()
+
+		if string(contents) != expected {
+			t.Errorf("Unexpected contents of '%s': %s", name, contents)
+		}
+	}
+}
+
+func TestFilenameTemplate(t *testing.T) {
+	host := "myhost"
+	config := &Config{Service: "web", Instance: "1", Filename: "aggregate"}
+
+	for template, expected := range map[string][2]string{
+		"":                            {"aggregate_2017-01-01", "aggregate"},
+		"{service}-{instance}_{date}": {"web-1_2017-01-01", "web-1"},
+		"{date}.{stem}.{host}":        {"2017-01-01.aggregate." + host, "aggregate." + host},
+	} {
+		config.FilenameTemplate = template
+		if name := expandFilename(config, host, "aggregate", "2017-01-01"); name != expected[0] {
+			t.Errorf("Unexpected filename of template '%s': %s", template, name)
+		}
+		if name := expandFilename(config, host, "aggregate", ""); name != expected[1] {
+			t.Errorf("Unexpected undated filename of template '%s': %s", template, name)
+		}
+	}
+
+	for template, valid := range map[string]bool{
+		"{stem}_{date}":    true,
+		"{stem}":           false, // Rotated logfiles would overwrite each other
+		"{stem}_{unknown}": false,
+		"../{date}":        false,
+		"{date} {stem}":    false,
+	} {
+		config.FilenameTemplate = template
+		config.Rotation = ROT_DAILY
+		if err := validFilenameTemplate(config); (err == nil) != valid {
+			t.Errorf("Unexpected validation of template '%s': %v", template, err)
+		}
+	}
+}
+
+func TestFilenameTemplateLogfile(t *testing.T) {
+	tempdir, teardown := setup(t)
+	defer teardown()
+
+	l, err := New(&Config{Service: "web", Folder: tempdir, Filename: "aggregate", FilenameTemplate: "{service}_{stem}_{date}", Rotation: ROT_DAILY, Out: OUT_FILE})
+	if err != nil {
+		t.Fatalf("Could not start logger: %s", err.Error())
+	}
+	defer l.Quit()
+
+	expected := path.Join(tempdir, fmt.Sprintf("web_aggregate_%s.log", time.Now().Format("2006-01-02")))
+	if current, _ := l.CurrentLogfile(); current != expected {
+		t.Errorf("Unexpected logfile: %s", current)
+	}
+}